@@ -0,0 +1,594 @@
+package clone
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bundle_attempts is how many times a bundle is requested, resuming where the last
+// attempt stopped if the source supports Range requests, before giving up on it.
+
+const bundle_attempts = 5
+
+// bundle_temp_prefix is the name given to bundles while they are being downloaded.
+// Unlike partial_suffix these are not removed by removeTempFiles.
+
+const bundle_temp_prefix = ".wof-clone-bundle-"
+
+// bundle_placeholder is replaced with the name of the meta file in Bundle, see bundleURL.
+
+const bundle_placeholder = "{meta}"
+
+// bundleURL returns the bundle to extract before cloning the meta file at meta, see
+// Bundle. The name of a meta file is its filename without the .csv (.csv.gz, .csv.bz2)
+// extension so "wof-locality-latest.csv" becomes "wof-locality-latest" and a Bundle of
+// "https://example.com/bundles/" becomes "https://example.com/bundles/wof-locality-latest-bundle.tar.bz2".
+
+func (c *WOFClone) bundleURL(meta string) string {
+
+	name := filepath.Base(meta)
+
+	for _, suffix := range meta_file_suffixes {
+
+		if strings.HasSuffix(name, suffix) {
+			name = strings.TrimSuffix(name, suffix)
+			break
+		}
+	}
+
+	if strings.Contains(c.Bundle, bundle_placeholder) {
+		return strings.Replace(c.Bundle, bundle_placeholder, name, -1)
+	}
+
+	if strings.HasSuffix(c.Bundle, "/") {
+		return c.Bundle + name + "-bundle.tar.bz2"
+	}
+
+	return c.Bundle
+}
+
+// CloneBundle downloads the bundle at remote (a tarball, optionally compressed with
+// bzip2 or gzip, or a path on disk) and extracts the files in its data directory to
+// Dest, without a meta file. Every file is counted in Scheduled and then in Success or
+// Error like any other run, see Bundle.
+
+func (c *WOFClone) CloneBundle(remote string) error {
+
+	if c.isRunning() {
+		return ErrRunning
+	}
+
+	run, err := c.startRun("", nil)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.cloneBundle(remote, false)
+
+	if err != nil {
+		run.read_err = err
+		c.Wait()
+		return err
+	}
+
+	return c.Wait()
+}
+
+// cloneBundle downloads and extracts the bundle at remote during a run. If sync is true
+// the files will be cloned (or skipped) from the meta file afterwards so they are only
+// counted in BundleFiles and BundleErrors, otherwise they are also counted like files
+// cloned from a meta file. It returns an error if the bundle itself can't be read, not
+// if individual files in it can't be extracted.
+
+func (c *WOFClone) cloneBundle(remote string, sync bool) error {
+
+	t1 := time.Now()
+
+	c.Logger.Info("fetch bundle %s", remote)
+
+	local, downloaded, err := c.downloadBundle(remote)
+
+	if err != nil {
+		c.Logger.Error("Failed to download bundle %s, because %v", remote, err)
+		return err
+	}
+
+	if downloaded {
+		defer os.Remove(local)
+	}
+
+	c.Logger.Debug("time to fetch bundle %s : %v", remote, time.Since(t1))
+
+	err = c.extractBundle(remote, local, sync)
+
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return err
+	}
+
+	c.Logger.Info("extracted %d files (%d errors) from bundle %s in %v", atomic.LoadInt64(&c.BundleFiles), atomic.LoadInt64(&c.BundleErrors), remote, time.Since(t1))
+	return nil
+}
+
+// downloadBundle returns the path to a copy of the bundle at remote on disk and true if
+// it was downloaded, and so should be removed once it has been extracted. remote may be
+// a path or a file:// URL, in which case it is read where it is.
+
+func (c *WOFClone) downloadBundle(remote string) (string, bool, error) {
+
+	u, err := url.Parse(remote)
+
+	if err != nil || u.Scheme == "" {
+		return remote, false, nil
+	}
+
+	if u.Scheme == "file" {
+		return u.Path, false, nil
+	}
+
+	root := c.tempRoot()
+
+	if root == "" {
+		root = c.Dest
+	}
+
+	err = os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	tmp := filepath.Join(root, bundle_temp_prefix+url.PathEscape(path.Base(u.Path)))
+
+	os.Remove(tmp)
+
+	etag := ""
+
+	for attempt := 1; ; attempt++ {
+
+		err = c.fetchBundle(remote, tmp, &etag)
+
+		if err == nil {
+			return tmp, true, nil
+		}
+
+		var write_err *WriteError
+
+		if attempt >= bundle_attempts || errors.As(err, &write_err) || !c.isRetryable(err, attempt) || c.ctx.Err() != nil {
+			os.Remove(tmp)
+			return "", false, err
+		}
+
+		c.Logger.Warning("Failed to download bundle %s (attempt %d of %d), trying again, because %v", remote, attempt, bundle_attempts, err)
+	}
+}
+
+// fetchBundle streams remote to tmp. If tmp already has some of remote in it, from an
+// attempt that failed, then only the rest of it is requested. etag is the ETag of the
+// last response, to make sure the rest comes from the same version of the bundle.
+
+func (c *WOFClone) fetchBundle(remote string, tmp string, etag *string) error {
+
+	offset := int64(0)
+
+	info, err := os.Stat(tmp)
+
+	if err == nil {
+		offset = info.Size()
+	}
+
+	var header http.Header
+
+	if offset > 0 {
+
+		header = make(http.Header)
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+		if *etag != "" {
+			header.Set("If-Range", *etag)
+		}
+	}
+
+	rsp, err := c.fetchWithHeader("GET", remote, header)
+
+	if err == nil && rsp.StatusCode == 206 && !resumesAt(rsp, offset) {
+
+		// See resumesAt
+
+		c.Logger.Warning("unable to resume download of bundle %s, asked for bytes %d onwards but got Content-Range '%s'", remote, offset, rsp.Header.Get("Content-Range"))
+		rsp.Body.Close()
+
+		rsp, err = c.fetchWithHeader("GET", remote, nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+	if rsp.StatusCode == 206 {
+		c.Logger.Info("resuming download of bundle %s at byte %d", remote, offset)
+		flags = os.O_WRONLY | os.O_APPEND
+	} else {
+		offset = 0
+	}
+
+	*etag = rsp.Header.Get("Etag")
+
+	fh, err := os.OpenFile(tmp, flags, local_file_mode)
+
+	if err != nil {
+		return &WriteError{Path: tmp, Err: err}
+	}
+
+	src := &sourceReader{Reader: rsp.Body}
+
+	_, err = io.Copy(fh, src)
+
+	close_err := fh.Close()
+
+	if err != nil && src.err == nil {
+		return &WriteError{Path: tmp, Err: err}
+	}
+
+	if err != nil {
+		return &FetchError{Method: "GET", URL: remote, Attempt: 1, Err: err}
+	}
+
+	if close_err != nil {
+		return &WriteError{Path: tmp, Err: close_err}
+	}
+
+	if rsp.ContentLength >= 0 && src.n != rsp.ContentLength {
+		return &TruncatedError{URL: remote, Expected: offset + rsp.ContentLength, Actual: offset + src.n}
+	}
+
+	c.addMetric(MetricBytesDownloaded, float64(src.n))
+	atomic.AddInt64(&c.FetchedBytes, src.n)
+	return nil
+}
+
+// extractBundle writes the regular files under the data directory of the bundle at
+// local to Dest, in the same layout as they would be cloned from a meta file. Anything
+// else in the bundle (its meta files, directories, links) is ignored. remote is only
+// used to describe errors.
+
+func (c *WOFClone) extractBundle(remote string, local string, sync bool) error {
+
+	fh, err := os.Open(local)
+
+	if err != nil {
+		return &BundleError{URL: remote, Err: err}
+	}
+
+	defer fh.Close()
+
+	body, err := decompressBundle(fh)
+
+	if err != nil {
+		return &BundleError{URL: remote, Err: err}
+	}
+
+	reader := tar.NewReader(body)
+
+	for {
+
+		if c.isAborted() {
+			return nil
+		}
+
+		hdr, err := reader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return &BundleError{URL: remote, Err: err}
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		rel_path, err := c.bundleRelPath(hdr.Name)
+
+		if err == nil && rel_path != "" && !c.isInDest(c.LocalPath(rel_path)) {
+			err = ErrUnsafeBundleEntry
+		}
+
+		if err != nil {
+			c.finishBundleEntry(hdr.Name, &BundleError{URL: remote, Entry: hdr.Name, Err: err}, sync)
+			continue
+		}
+
+		if rel_path == "" {
+			continue
+		}
+
+		err = c.extractBundleEntry(rel_path, reader, hdr.ModTime)
+
+		var read_err *BundleError
+
+		if errors.As(err, &read_err) {
+
+			// The bundle itself is broken, so there's no point carrying on
+
+			read_err.URL = remote
+			c.finishBundleEntry(rel_path, err, sync)
+			return err
+		}
+
+		c.finishBundleEntry(rel_path, err, sync)
+	}
+}
+
+// bundleRelPath returns the path, relative to Source, of the entry name in a bundle or
+// "" if it isn't a data file. Bundles keep their files in a data directory, usually
+// inside a directory named after the bundle. The data directory is included in the
+// path if DataPrefix is "add". It returns ErrUnsafeBundleEntry if name is absolute or
+// has any ".." elements.
+
+func (c *WOFClone) bundleRelPath(name string) (string, error) {
+
+	name = strings.Replace(name, "\\", "/", -1)
+
+	if path.IsAbs(name) {
+		return "", ErrUnsafeBundleEntry
+	}
+
+	parts := strings.Split(name, "/")
+
+	for _, part := range parts {
+
+		if part == ".." {
+			return "", ErrUnsafeBundleEntry
+		}
+	}
+
+	for i, part := range parts {
+
+		if part+"/" != data_prefix {
+			continue
+		}
+
+		rel_path := path.Clean(path.Join(parts[i+1:]...))
+
+		if rel_path == "." {
+			return "", nil
+		}
+
+		if c.DataPrefix == DataPrefixAdd {
+			rel_path = data_prefix + rel_path
+		}
+
+		return rel_path, nil
+	}
+
+	return "", nil
+}
+
+// isInDest returns true if local is inside Dest.
+
+func (c *WOFClone) isInDest(local string) bool {
+
+	dest_rel, err := filepath.Rel(c.Dest, local)
+
+	if err != nil {
+		return false
+	}
+
+	return dest_rel != ".." && !strings.HasPrefix(dest_rel, ".."+string(filepath.Separator))
+}
+
+// extractBundleEntry writes body to the local copy of rel_path the same way download
+// does: through a temporary file, compressed if CompressLocal is true and filtered by
+// ContentFilter. Its modification time is set to lastmod. Errors reading body (that is
+// the bundle) are returned as a *BundleError.
+
+func (c *WOFClone) extractBundleEntry(rel_path string, body io.Reader, lastmod time.Time) error {
+
+	local := c.LocalPath(rel_path)
+
+	err := c.prepareLocal(local)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := c.tempPath(local)
+
+	atomic.AddInt64(&c.Filehandles, 1)
+	defer atomic.AddInt64(&c.Filehandles, -1)
+
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, local_file_mode)
+
+	if err != nil {
+		c.SetMaxFilehandles()
+		return &WriteError{Path: local, Err: err}
+	}
+
+	var wr io.Writer = fh
+	var gz *gzip.Writer
+
+	if c.CompressLocal {
+		gz = gzip.NewWriter(fh)
+		wr = gz
+	}
+
+	// As in download the source hash is of the file in the bundle and the local hash
+	// is of whatever ContentFilter makes of it
+
+	src := &sourceReader{Reader: body}
+	hasher := c.newHash()
+	source_hasher := hasher
+
+	var rd io.Reader = src
+	var tee io.Reader
+
+	if c.ContentFilter != nil {
+
+		source_hasher = c.newHash()
+		tee = io.TeeReader(src, source_hasher)
+
+		rd, err = c.ContentFilter(rel_path, tee)
+
+		if err != nil {
+			fh.Close()
+			os.Remove(tmp)
+			return &FilterError{Path: rel_path, Err: err}
+		}
+	}
+
+	scan := c.scanLastModified(rel_path)
+
+	if scan != nil {
+		wr = io.MultiWriter(wr, scan)
+	}
+
+	size, read_err, write_err := copyBody(wr, hasher, rd)
+
+	if tee != nil && read_err == nil && write_err == nil {
+		_, read_err = io.Copy(ioutil.Discard, tee)
+	}
+
+	if gz != nil && write_err == nil {
+		write_err = gz.Close()
+	}
+
+	close_err := fh.Close()
+
+	if write_err == nil {
+		write_err = close_err
+	}
+
+	if src.err != nil {
+		os.Remove(tmp)
+		return &BundleError{Entry: rel_path, Err: src.err}
+	}
+
+	if read_err != nil {
+		os.Remove(tmp)
+		return &FilterError{Path: rel_path, Err: read_err}
+	}
+
+	if write_err != nil {
+		c.SetMaxFilehandles()
+		os.Remove(tmp)
+		return &WriteError{Path: local, Err: write_err}
+	}
+
+	if c.validatesJSON(rel_path) {
+
+		err = c.validateLocal(tmp)
+
+		if err != nil {
+			os.Remove(tmp)
+			return &InvalidFileError{Path: rel_path}
+		}
+	}
+
+	err = c.moveFile(tmp, local)
+
+	if err != nil {
+		os.Remove(tmp)
+		return &WriteError{Path: local, Err: err}
+	}
+
+	if !lastmod.IsZero() {
+		os.Chtimes(local, time.Now(), lastmod)
+	}
+
+	c.removeAlternate(local)
+
+	local_hash := hex.EncodeToString(hasher.Sum(nil))
+
+	if c.ContentFilter != nil {
+		c.writeSourceRecord(local, hex.EncodeToString(source_hasher.Sum(nil)), "")
+	} else {
+		removeSourceRecord(local)
+	}
+
+	c.wroteFile(rel_path, writtenFile{hash: local_hash, size: size, lastmod: scan.lastModified()})
+
+	if c.manifest != nil {
+		c.manifest.Add(rel_path, c.localRelPath(rel_path), local_hash, size, lastmod)
+	}
+
+	return nil
+}
+
+// finishBundleEntry records the outcome of extracting rel_path (or, if it was rejected,
+// the name of the entry) from a bundle. Files that will be cloned from a meta file
+// afterwards (sync is true) are left for that to count and, if they failed, fetch again.
+
+func (c *WOFClone) finishBundleEntry(rel_path string, err error, sync bool) {
+
+	if err == nil {
+		atomic.AddInt64(&c.BundleFiles, 1)
+	} else {
+		atomic.AddInt64(&c.BundleErrors, 1)
+		c.Logger.Error("%v", err)
+	}
+
+	if sync {
+		return
+	}
+
+	atomic.AddInt64(&c.Scheduled, 1)
+
+	if err == nil {
+		atomic.AddInt64(&c.Success, 1)
+		c.addMetric(MetricFilesSucceeded, 1)
+		c.decide(rel_path, DecisionExtracted)
+	} else {
+		atomic.AddInt64(&c.PermanentErrors, 1)
+		c.recordError(rel_path, err)
+		c.decide(rel_path, DecisionFailed)
+	}
+
+	atomic.AddInt64(&c.Completed, 1)
+}
+
+// decompressBundle wraps fh in a bzip2 or gzip reader if its contents look like they
+// have been compressed, and returns it as-is (a plain tarball) otherwise.
+
+func decompressBundle(fh io.Reader) (io.Reader, error) {
+
+	buf := bufio.NewReader(fh)
+
+	magic, err := buf.Peek(3)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, bzip2_magic):
+		return bzip2.NewReader(buf), nil
+	case bytes.HasPrefix(magic, gzip_magic):
+		return gzip.NewReader(buf)
+	default:
+		return buf, nil
+	}
+}
@@ -0,0 +1,76 @@
+package clone
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ChangeState is the answer to whether a local file is different from its source.
+
+type ChangeState int
+
+const (
+	Unknown ChangeState = iota
+	Changed
+	Unchanged
+)
+
+// The ways of dealing with files whose state is Unknown, see UnknownChanges.
+
+const (
+	UnknownFetch = "fetch"
+	UnknownSkip  = "skip"
+	UnknownFail  = "fail"
+)
+
+func (s ChangeState) String() string {
+
+	switch s {
+	case Changed:
+		return "changed"
+	case Unchanged:
+		return "unchanged"
+	default:
+		return "unknown"
+	}
+}
+
+func changeState(changed bool) ChangeState {
+
+	if changed {
+		return Changed
+	}
+
+	return Unchanged
+}
+
+func (c *WOFClone) checkUnknownChanges() error {
+
+	switch c.UnknownChanges {
+	case "", UnknownFetch, UnknownSkip, UnknownFail:
+		return nil
+	default:
+		return fmt.Errorf("Invalid UnknownChanges value '%s'", c.UnknownChanges)
+	}
+}
+
+// unknownChange counts rel_path as a file whose state is Unknown (because of err, which
+// may be nil) and decides what to do with it according to c.UnknownChanges. It returns
+// Changed if the file should be fetched, Unchanged if it should be skipped or an
+// *UnknownChangeError if it should fail.
+
+func (c *WOFClone) unknownChange(rel_path string, err error) (ChangeState, error) {
+
+	atomic.AddInt64(&c.UnknownChange, 1)
+
+	switch c.UnknownChanges {
+	case UnknownSkip:
+		c.Logger.Warning("Unable to determine whether %s has changed (%v), skipping it", rel_path, err)
+		return Unchanged, nil
+	case UnknownFail:
+		return Unknown, &UnknownChangeError{Path: rel_path, Err: err}
+	default:
+		c.Logger.Debug("Unable to determine whether %s has changed (%v), fetching it", rel_path, err)
+		return Changed, nil
+	}
+}
@@ -1,13 +1,11 @@
 package clone
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	_ "fmt"
-	"github.com/whosonfirst/go-whosonfirst-csv"
-	"github.com/whosonfirst/go-whosonfirst-log"
-	"github.com/whosonfirst/go-whosonfirst-pool"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -16,34 +14,717 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const version = "0.2.0"
+
+// Version returns the version of this package, as reported in the default User-Agent header.
+
+func Version() string {
+	return version
+}
+
 type WOFClone struct {
-	Source         string
-	Dest           string
-	Success        int64
-	Error          int64
-	Skipped        int64
-	Scheduled      int64
-	Completed      int64
-	MaxFilehandles int64
-	Filehandles    int64
-	MaxRetries     float64 // max percentage of errors over scheduled
-	Failed         []string
-	Logger         *log.WOFLogger
-	client         *http.Client
-	retries        *pool.LIFOPool
-	writesync      *sync.WaitGroup
-	timer          time.Time
-	done           chan bool
-	throttle       chan bool
-}
-
-func NewWOFClone(source string, dest string, procs int, logger *log.WOFLogger) (*WOFClone, error) {
+	Source          string
+	Mirrors         []string // fallback sources, see AddMirror
+	Dest            string
+	Success         int64
+	Error           int64
+	Skipped         int64
+	SkippedTooLarge int64 // files skipped because they are larger than MaxFileSize
+	Truncated       int64 // responses with fewer bytes than their Content-Length header promised
+	Ignored         int64 // rows not considered at all because of MaxFiles or SampleRate
+	Scheduled       int64
+	Completed       int64
+	MaxFilehandles  int64
+	Filehandles     int64
+	CheckWorkers    int     // the number of files to check for changes concurrently, default 200
+	FetchWorkers    int     // the number of files to fetch concurrently, default 100
+	MetaFileWorkers int     // the number of meta files CloneMetaFiles clones concurrently, default 1
+	MaxRetries      float64 // max percentage of scheduled files waiting to be retried, for each run, see below
+	UseLastModified bool    // skip existing files not modified since the meta file's LastModifiedColumn, see isModifiedSince
+
+	// Since, if set, leaves out rows whose LastModifiedColumn says they were last
+	// modified before then, so that only what has changed since (say) the last sync is
+	// cloned. They aren't looked at at all, locally or at the source, and are counted in
+	// TooOld. Rows that don't say when they were last modified are cloned as usual unless
+	// SinceExcludeUndated is true, in which case they are left out (and counted) too.
+	// See since.go
+
+	Since               time.Time
+	SinceExcludeUndated bool
+	TooOld              int64
+
+	// Exclude and ExcludeFile list rel_paths (exactly as they appear in meta files) and
+	// Who's On First IDs that are never cloned, for example records that are known to
+	// be broken at the source. ExcludeFile has one per line. Excluding an ID excludes
+	// the record and its alternate geometry files. Rows that are excluded aren't looked
+	// at, locally or at the source, and are counted in Excluded and listed in the
+	// report. See exclude.go
+
+	Exclude     []string
+	ExcludeFile string
+	Excluded    int64
+
+	// ForcePaths limits force_updates to some of the files in a meta file: rows whose
+	// path starts with, or matches (as a path.Match pattern), one of them are fetched
+	// whether or not they have changed, as if force_updates were true, and the rest
+	// are checked for changes as usual. For example "859/" fetches everything under
+	// 859 again. Files that are fetched because of force_updates or ForcePaths are
+	// counted in Forced as well as Success. See force.go
+
+	ForcePaths []string
+	Forced     int64
+
+	// The names of the meta file columns containing each file's relative path (default
+	// "path"), MD5 hash (default "file_hash"), size in bytes (default "size", falling back
+	// to "filesize") and last modified time as a Unix timestamp (default "lastmodified").
+	// AltPathsColumn is the (optional) name of a column listing alternate geometry files,
+	// see AltPaths. Rows whose path is empty are logged and counted in MissingPath.
+
+	PathColumn         string
+	HashColumn         string
+	SizeColumn         string
+	LastModifiedColumn string
+	AltPathsColumn     string
+	MissingPath        int64
+
+	// ValidateIds causes the "id" column of each meta file row to be compared with its
+	// path, see UriForId. Rows where the two disagree are logged and counted in the
+	// report and, if RejectIdMismatches is true, recorded as errors and not cloned.
+
+	ValidateIds        bool
+	RejectIdMismatches bool
+
+	// MaxPendingRetries is the most files that may be waiting to be retried at once;
+	// exceeding it aborts the clone with ErrExcessiveErrors. Zero means no limit.
+	MaxPendingRetries int
+
+	// MaxRetries only counts failures that are worth retrying (see RetryPredicate), such as
+	// network errors, 5XX responses and truncated downloads. Permanent failures, like a
+	// 404 for a record deleted since the meta file was made, are never retried so they
+	// don't count towards it, they are counted in PermanentErrors instead (as well as in
+	// Error). If more than MaxRetries percent of the files scheduled are waiting to be
+	// retried at the end of the main pass the retries are abandoned and the run fails
+	// with ErrExcessiveErrors.
+
+	PermanentErrors int64
+
+	// RetryPredicate decides which errors are worth retrying, in place of
+	// DefaultRetryPredicate, for deployments that disagree with it (retrying 403s from
+	// signed URLs that have expired, say, or never retrying 500s). attempt is the number
+	// of tries that have failed so far. It is consulted before trying the next mirror or
+	// downloading a bundle again, before adding a failed file to the end-of-run retries
+	// and, when a retry fails, to decide whether to count it in PermanentErrors. It is
+	// called from many goroutines at once, so it must be safe for concurrent use and
+	// should not have side effects. See retries.go
+
+	RetryPredicate func(err error, attempt int) bool
+
+	// StatusActions overrides DefaultStatusAction for specific status codes, for sources
+	// behind proxies that answer in odd ways (a 203 from a transforming proxy, say, or a
+	// 403 that really means "try again later"). A 206 that wasn't asked for is only ever
+	// accepted if it has the whole file. Errors for statuses that aren't accepted are
+	// *FetchErrors with the status and the action taken. See status.go
+
+	StatusActions map[int]StatusAction
+
+	// Once MaxRetriesMinScheduled files have been scheduled the MaxRetries percentage is
+	// checked every time a file fails, rather than only at the end of the main pass, and
+	// the clone is aborted with ErrExcessiveErrors as soon as it is exceeded. This stops
+	// a source that has gone away from filling memory with failures. Zero means only
+	// check at the end (default 1000).
+
+	MaxRetriesMinScheduled int64
+
+	// MaxFailureRecords is the most failed files listed (with their errors) in Failed,
+	// the report and the summary. Failures beyond that are only counted, see
+	// WOFCloneReport.FailedOmitted, and aren't marked as failed in the updated meta
+	// file either. Zero means no limit (default 10000).
+
+	MaxFailureRecords int
+
+	// MaxFiles stops scheduling new files once this many have been fetched (or, if
+	// MaxFilesIncludesSkipped is true, considered) in a single call to CloneMetaFile.
+	// SampleRate is the probability (0.0 - 1.0) that any given row will be considered
+	// at all and is seeded with SampleSeed so that runs are reproducible. In both
+	// cases zero means "no limit" and rows that are passed over are counted as Ignored.
+
+	MaxFiles                int64
+	MaxFilesIncludesSkipped bool
+	SampleRate              float64
+	SampleSeed              int64
+
+	// MaxErrors, if greater than zero, causes CloneMetaFile to stop scheduling new files,
+	// cancel any requests in flight and skip retries as soon as that many errors have
+	// occurred. Set it to 1 to fail fast.
+
+	MaxErrors int64
+
+	// ManifestPath, if set, is where CloneMetaFile will write a CSV file listing the path,
+	// file_hash, size and lastmodified time of every file it fetched or skipped. See manifest.go
+
+	ManifestPath string
+
+	// Metrics, if not nil, is notified about files scheduled, fetched, skipped and so on.
+	// MetricLabels are added to every metric, to tell WOFClones that share Metrics apart.
+	// See metrics.go
+
+	Metrics      Metrics
+	MetricLabels map[string]string
+
+	// MaxRedirects is the number of redirects to follow for a single request. Zero means
+	// the default (10) and a negative number means redirects are never followed. Redirects
+	// to a different host than the one originally requested are refused if RefuseCrossHostRedirects
+	// is true; otherwise the Authorization header and any custom Headers are stripped from
+	// them unless ForwardAuthOnRedirect is true. See redirect.go
+
+	MaxRedirects             int
+	RefuseCrossHostRedirects bool
+	ForwardAuthOnRedirect    bool
+
+	// ResumeDownloads causes downloads that fail part way through to be kept (as "<path>.partial")
+	// and resumed using a Range request when the path is retried, provided the source advertises
+	// support for ranges and the file's ETag hasn't changed. This is not supported in combination
+	// with CompressLocal. See download.go
+
+	ResumeDownloads bool
+
+	// MaxFileSize, if greater than zero, is the size in bytes above which files are skipped.
+	// The meta file's "size" or "filesize" column is used when present, otherwise downloads
+	// are abandoned as soon as their Content-Length header says they are too large. Files
+	// whose size isn't known are fetched unless SkipUnknownSize is true.
+
+	MaxFileSize     int64
+	SkipUnknownSize bool
+
+	// RowOrder, if set, is the order rows are scheduled in, by their size column (see
+	// SizeColumn): OrderLargestFirst, so that the largest files aren't left until the end
+	// for one worker to fetch while the rest sit idle, or OrderSmallestFirst, to get
+	// through as many files as possible early on. Rows without a size come last. The
+	// meta file is read once to sort its rows before any are scheduled. By default rows
+	// are scheduled as they are read. See order.go
+
+	RowOrder string
+
+	// CompressLocal causes files to be written to disk gzip-compressed, as "<path>.gz".
+	// Change detection and verification hash the uncompressed contents. See compress.go
+
+	CompressLocal bool
+
+	// MaxConnsPerHost, if greater than zero, is the most requests that will be made to
+	// any one host at the same time regardless of how many workers there are. This is
+	// useful when c.Source and its mirrors are on different hosts with different quotas.
+
+	MaxConnsPerHost int
+
+	// LocalHash and RemoteHash make change detection pluggable, for sources that don't
+	// report MD5 hashes as ETags. LocalHash hashes the (uncompressed) contents of a local
+	// file and RemoteHash returns the hash of a remote file in the same scheme. When they
+	// are nil local files are MD5-hashed and compared with the ETag from a HEAD request.
+	// See SetGitHubSource for an example.
+
+	LocalHash  func(body []byte) string
+	RemoteHash func(remote string) (string, error)
+
+	// HashAlgorithm is the algorithm ("md5", "sha1" or "sha256", default "md5") used to hash
+	// local files and downloads. HashSource is where the hash each file is expected to have
+	// comes from: "column" (HashColumn in the meta file), "sidecar" (a file fetched from
+	// HashSidecarURL, in which "{url}" and "{path}" are replaced by the file's URL and relative
+	// path) or "etag". Downloads are verified against column and sidecar hashes but ETags are
+	// only ever used to decide whether to fetch a file. When HashSource is empty file_hash
+	// columns are compared with ETags, as they always have been. See hash.go
+
+	HashAlgorithm  string
+	HashSource     string
+	HashSidecarURL string
+
+	// DataPrefix controls what happens to the "data/" prefix that some meta files include
+	// in their paths: "strip" removes it, "add" adds it and "auto" checks whether the first
+	// path in each meta file exists and, if it doesn't but the path with the prefix added
+	// (or removed) does, does that for every path. By default paths are used as is.
+
+	DataPrefix string
+
+	// DestPath and DestTemplate change where files are stored under Dest, which is their
+	// relative path by default. DestPath is passed each file's relative path and meta file
+	// row (which may be nil) and returns where it should go, relative to Dest. DestTemplate
+	// is a simpler alternative, for example "{basename}" for a flat layout or
+	// "{placetype}/{id}.geojson", see destpath.go for details. DestPath wins if both are set.
+
+	DestPath     func(rel_path string, row map[string]string) string
+	DestTemplate string
+
+	// RemotePrefix and RemotePath change where files are fetched from, for sources (like
+	// dated snapshots) that keep them somewhere other than their relative path, without
+	// changing where they are stored under Dest. RemotePrefix is added to the start of
+	// every relative path, for example "archive/2023-06-01/". RemotePath is passed each
+	// file's relative path and returns the one to fetch instead, and wins if both are set.
+	// They apply to every request for a file under Source or one of its mirrors and the
+	// URLs that files were actually fetched from are recorded in the report. See
+	// remotepath.go
+
+	RemotePrefix string
+	RemotePath   func(rel_path string) string
+
+	// MaxRateLimitWaits is the number of times a request that was refused because of
+	// rate limiting (see ratelimit.go) will be retried, once the limit has been reset,
+	// before giving up. Default 3.
+
+	MaxRateLimitWaits int
+
+	// Requests that fail because the source closed a kept alive connection while it was
+	// idle, which isn't anything to worry about, are sent again straight away on a new
+	// connection rather than being retried at the end of the run. They are counted in
+	// ReusedConnRetries. See connreuse.go
+
+	ReusedConnRetries int64
+
+	// Existing files are only skipped (see skip_existing and UseLastModified) if they are
+	// not empty and at least MinExistingSize bytes on disk and, if ValidateJSON is true,
+	// parse as JSON. ValidateJSON also causes new downloads that don't parse as JSON to
+	// fail with an InvalidFileError rather than being written to disk. Only ".geojson"
+	// and ".json" files are validated, other files (READMEs, say) are cloned as they are.
+
+	MinExistingSize int64
+	ValidateJSON    bool
+
+	// AllowedExtensions, if not empty, are the only extensions (".geojson", say, or
+	// ".geojson.gz") that files listed in a meta file may have. Rows for other files,
+	// like rows whose path is a directory ("data/123/") rather than a file, fail with a
+	// RejectedPathError without anything being fetched. See pathkind.go
+
+	AllowedExtensions []string
+
+	// A successful response with an empty body for a GeoJSON file is assumed to be a
+	// mistake on the source's part (a real record is never empty) so it fails, with an
+	// EmptyBodyError that is retried like any other error, rather than being written to
+	// disk. They are counted in EmptyBody. AllowEmptyBodies turns that off, for sources
+	// with files that really are empty.
+
+	AllowEmptyBodies bool
+	EmptyBody        int64
+
+	// PrescanDest walks Dest once, at the start of each run, to find out which files are
+	// already there rather than checking for each one as it comes up. That is a lot
+	// quicker when Dest is on a network filesystem, where every check is a round trip,
+	// but not worth the time (or memory) on a local disk. Files written during the run
+	// are kept track of, but anything added to Dest by something else during the run
+	// isn't noticed. See destindex.go
+
+	PrescanDest bool
+
+	// TempDir is where files are downloaded to before being moved in to place. By default
+	// that happens alongside each file in Dest, which means the final rename is atomic.
+	// Setting TempDir can help when Dest is a network or FUSE mount that handles lots of
+	// small renames poorly, but if TempDir is on a different filesystem each file has to
+	// be copied to Dest (and then renamed) instead. Files are kept in a directory in
+	// TempDir named after Dest, so clones into different destinations can share one.
+	// Leftover temporary files are removed from Dest and that directory at the start of
+	// every run, unless SkipTempCleanup is true, and counted in TempFilesRemoved.
+
+	TempDir          string
+	SkipTempCleanup  bool
+	TempFilesRemoved int64
+
+	// Deadline and Timeout limit how long a run (a call to CloneMetaFile, or Schedule and
+	// Wait) may take, as an absolute time or relative to the start of the run. If both are
+	// set whichever comes first applies. Once the deadline passes no new files are
+	// scheduled, requests in flight are cancelled, retries are skipped and an error
+	// matching ErrDeadlineExceeded, with the partial stats in its Summary, is returned.
+
+	Deadline time.Time
+	Timeout  time.Duration
+
+	// AdaptiveThrottle causes the number of requests in flight to be reduced, and a delay
+	// to be added before each request, when more than ThrottleErrorRate (default 0.2) of
+	// the last ThrottleWindow (default 100) requests failed with a 429 or 5XX status or a
+	// network error. Concurrency is never reduced below ThrottleMinConcurrency (default 1)
+	// and the delay never grows beyond ThrottleMaxDelay (default 5s). Both recover
+	// gradually as requests start succeeding again. See throttle.go
+
+	AdaptiveThrottle       bool
+	ThrottleWindow         int
+	ThrottleErrorRate      float64
+	ThrottleMinConcurrency int
+	ThrottleMaxDelay       time.Duration
+
+	// Download durations are tallied in a histogram, and the slowest and largest
+	// TopFilesCount (default 10) files are remembered, for the report. LogTimings causes
+	// them to be logged at the end of each run as well. DisableTimings turns all of that off.
+
+	DisableTimings bool
+	LogTimings     bool
+	TopFilesCount  int
+
+	// While a run is going Status is called every StatusInterval (default one second,
+	// a negative value means never) to say how it is getting on. Its progress lines are
+	// written to StatusWriter, one per line, if it is set and logged at Info otherwise.
+	// Whatever they are set to a summary of each run (see WOFCloneSummary's String) is
+	// logged at Info once it has finished.
+
+	StatusInterval time.Duration
+	StatusWriter   io.Writer
+
+	// RunLabel, if set, is prefixed (as "[label] ") to every log and status line of
+	// every run, to tell apart WOFClones that share a Logger. It is also added to every
+	// metric as a "run" label and to each run's WOFCloneSummary. MetaFileOptions' Label
+	// overrides it for a single meta file and if LabelLogs is true runs without either
+	// are labeled with the name of their meta file. See logger.go
+
+	RunLabel  string
+	LabelLogs bool
+
+	// FetchedBytes is the number of bytes fetched, and Retried the number of failed
+	// files that were tried again at the end of the run, see processRetries.
+
+	FetchedBytes int64
+	Retried      int64
+
+	// Verbose adds how long each file took to check, fetch and process (and, if
+	// TraceRequests is true, each request's phases) to the debug messages. Debug
+	// messages are only put together when the Logger will emit them, see logger.go
+
+	Verbose bool
+
+	// PostVerify re-reads every file written during a run, once the run is otherwise done,
+	// and checks it against the hash of what was written to catch anything that got
+	// corrupted on the way to disk. This roughly doubles local I/O. Mismatches count as
+	// errors and, if PostVerifyRefetch is true, are fetched once more. See postverify.go
+
+	PostVerify           bool
+	PostVerifyRefetch    bool
+	PostVerified         int64
+	PostVerifyMismatches int64
+
+	// WriteHook, if not nil, is called for every file written (or extracted from a Bundle)
+	// with its hash (see HashAlgorithm) and size, which are worked out as it is written
+	// rather than by reading it back. It is called from many goroutines at once. See
+	// download.go
+
+	WriteHook func(rel_path string, hash string, size int64)
+
+	// ContentFilter, if set, is applied to the body of every file between fetching it and
+	// writing it to disk, for example to remove properties that aren't needed. Since the
+	// local files won't match the source any more their ETags and hashes are recorded in
+	// a hidden file alongside them to decide whether they've changed, see filter.go, and
+	// lastmodified columns are always used when the meta file has them. Errors returned
+	// by the filter are counted as errors and only retried if RetryFilterErrors is true.
+
+	ContentFilter     func(rel_path string, body io.Reader) (io.Reader, error)
+	RetryFilterErrors bool
+
+	// ProtectNewerLocal leaves existing files alone, even if they have changed, when they
+	// have been modified more recently than the source's copy (according to its
+	// Last-Modified header). This is for files that have been edited locally and is
+	// overridden by force_updates. The files are counted in LocalNewer and listed in
+	// the report. See newer.go
+
+	ProtectNewerLocal bool
+	LocalNewer        int64
+
+	// LastModifiedTolerance is how far in the future a Last-Modified header (see
+	// ProtectNewerLocal) can be, to allow for clocks being out, before it is ignored as
+	// if there wasn't one. Ones that are the Unix epoch are always ignored, since some
+	// mirrors send that for every file. Default 5 minutes. Ignored headers are counted in
+	// BogusLastModified, and by host in the report. See lastmod.go
+
+	LastModifiedTolerance time.Duration
+	BogusLastModified     int64
+
+	// UnknownChanges is what to do with existing files when it isn't possible to tell
+	// whether they have changed, for example because a HEAD request failed or the source
+	// sent an ETag that isn't a hash: "fetch" them again (the default), "skip" them or
+	// "fail" them, in which case they are retried like any other error. They are counted
+	// in UnknownChange. See changes.go
+
+	UnknownChanges string
+	UnknownChange  int64
+
+	// Existing files that can't be read, to hash them, are tried a couple more times (in
+	// case the problem goes away, as it can on network filesystems) before
+	// UnreadableLocal decides what happens to them: "fetch" them again, replacing the
+	// local copy (the default), or "fail" them so that they can be looked at, in which
+	// case they aren't retried. They are counted in Unreadable and listed in the report.
+	// See unreadable.go
+
+	UnreadableLocal string
+	Unreadable      int64
+
+	// Files that can't be read because of their permissions (for example, a file
+	// belonging to someone else with mode 0600) always fail, whatever UnreadableLocal
+	// says, since fetching them again would just fail the same way on every run. They
+	// aren't retried and are counted in PermissionDenied as well as Unreadable. If
+	// FixPermissions is true their mode is first changed to the one cloned files are
+	// written with (0644) and they are read again.
+
+	FixPermissions   bool
+	PermissionDenied int64
+
+	// DetectFalseChanges compares files that the source says have changed with the
+	// local copy once they have been fetched and, if they are the same, leaves the local
+	// copy alone and skips them rather than rewriting them. This is for sources behind
+	// CDNs that recompress or otherwise transform files, so that their ETags never match.
+	// They are counted in FalseChanges and Skipped, and by host in the report, and a
+	// warning is logged for each host at the end of the run. Setting Headers to send
+	// "Accept-Encoding: identity" will often stop it happening. See falsechange.go
+
+	DetectFalseChanges bool
+	FalseChanges       int64
+
+	// RecordProvenance records the ETag and Last-Modified header of the response that
+	// each file was written from, in its extended attributes (user.wof.etag and
+	// user.wof.lastmodified) or, where the filesystem doesn't support them, in a hidden
+	// file next to it. On later runs a file whose recorded ETag is the source's current
+	// one is skipped without being read, as long as it hasn't been changed since it was
+	// written. See provenance.go
+
+	RecordProvenance bool
+
+	// WriteIfDifferent compares every file that is fetched, including ones fetched
+	// because of force_updates, with the local copy and leaves the local copy alone if
+	// they are the same, rather than writing it again. This is for destinations (like
+	// some network shares) where rewriting a file resets its permissions or other
+	// metadata. Files that are left alone are counted in SkippedIdentical and Skipped,
+	// unless they are counted in FalseChanges instead (see DetectFalseChanges). See
+	// falsechange.go
+
+	WriteIfDifferent bool
+	SkippedIdentical int64
+
+	// Malformed rows in a meta file (a stray quote or the wrong number of fields) are
+	// logged, counted in BadRows and skipped, unless there are more than MaxBadRows of
+	// them or they make up more than MaxBadRowsRate (0.0 - 1.0) of the rows, in which
+	// case the run fails with a *MetaFileError matching ErrTooManyBadRows. Zero means no
+	// limit. StrictMetaFiles stops reading at the first malformed row instead.
+
+	StrictMetaFiles bool
+	MaxBadRows      int64
+	MaxBadRowsRate  float64
+	BadRows         int64
+
+	// A meta file that is empty, has a header but no rows or has rows that all have an
+	// empty path is almost always a broken export, so CloneMetaFile fails with an
+	// *EmptyMetaError (wrapped in a *MetaFileError, and matching ErrEmptyMeta) rather than
+	// succeeding without doing anything, unless AllowEmpty is true. One without a path
+	// column at all always fails, the same way.
+
+	AllowEmpty bool
+
+	// Rows with something in their HashColumn that doesn't look like a hash (made with
+	// HashAlgorithm if HashSource is "column" and MD5 otherwise), like "0" or a truncated
+	// hash, are logged and counted in InvalidHash. Their local copies are compared with
+	// the source instead, as if there was no hash. See checkRowHash
+
+	InvalidHash int64
+
+	// Before CloneMetaFile fetches anything it checks that the first file in the meta
+	// file is served (without being redirected to another host), looks like JSON rather
+	// than an HTML page and, if the row has a hash, matches it. This catches a Source
+	// that points at the wrong place, see preflight.go. SkipPreflight turns the check
+	// off for sources that don't work that way.
+
+	SkipPreflight bool
+
+	// CloneMetaFile refuses to run, with a *SelfCloneError, if Source is a file URL for
+	// Dest (or a directory inside or above it), which would clone every file on to
+	// itself. Symlinks are resolved first. An HTTP source on this machine that serves
+	// Dest can only be caught by writing a probe file in Dest (which is removed again) and
+	// seeing whether Source serves it back, which is only done if ProbeSelfClone is true.
+	// AllowSelfClone turns the check off. See selfclone.go
+
+	AllowSelfClone bool
+	ProbeSelfClone bool
+
+	// ActiveWindow, if set, is the time of day ("HH:MM-HH:MM", in UTC unless
+	// ActiveWindowLocation says otherwise) that requests may be sent to the source, for
+	// sources that only allow bulk traffic at certain times. The window may span
+	// midnight. Outside it every request waits for it to open, so the run pauses (with
+	// everything it has done so far kept) and resumes by itself, however many days that
+	// takes. Status and Progress say when it will resume. Cancelling the run or its
+	// Deadline still stops it straight away. See window.go
+
+	ActiveWindow         string
+	ActiveWindowLocation *time.Location
+
+	// Bundle, if set, is a tarball of the files in a meta file (optionally compressed
+	// with bzip2 or gzip, the way WOF bundles are published) that CloneMetaFile downloads
+	// and extracts to Dest instead of fetching each file on its own, which is a great
+	// deal faster for a first clone. It may be a URL or a path on disk, "{meta}" in it is
+	// replaced with the name of the meta file and if it ends in "/" then
+	// "{meta}-bundle.tar.bz2" is added to it. If BundleThenSync is true the meta file is
+	// cloned as usual afterwards to catch anything the bundle is missing or has out of
+	// date. Files extracted from the bundle, or that failed to be, are counted in
+	// BundleFiles and BundleErrors. See bundle.go
+
+	Bundle         string
+	BundleThenSync bool
+	BundleFiles    int64
+	BundleErrors   int64
+
+	// RecordDecisions keeps track of what happened to every path, and why (whether it
+	// was fetched because it was new, had changed or because of force_updates, skipped
+	// because it exists or hasn't changed according to its ETag or file hash, or failed)
+	// in the report and the summary. Decisions are always logged at debug level. See
+	// decisions.go
+
+	RecordDecisions bool
+
+	// GroupBy, if set, breaks the outcomes of a run down by group in the report and the
+	// summary (and in the final log lines, if LogGroups is true) so that, for example,
+	// errors that all come from one country or placetype stand out. It is the name of a
+	// meta file column, such as "placetype" or "iso", falling back to the first component
+	// of a file's path when a row doesn't have it, or "path" to always use that. See groups.go
+
+	GroupBy   string
+	LogGroups bool
+
+	// ReferenceDir, if set, is a previous clone (for example last month's snapshot) to
+	// take files from rather than fetching them, when they are the same as the source's
+	// according to the meta file's hash, the expected hash (see HashSource) or a HEAD
+	// request. Files are hardlinked, unless ReferenceLink is "reflink" (a copy-on-write
+	// clone) or "copy", falling back to the next method when one doesn't work. They are
+	// counted in Success and in Linked. force_updates fetches files regardless. Note
+	// that hardlinked files share their contents so editing one, rather than replacing
+	// it, changes both. See reference.go
+
+	ReferenceDir  string
+	ReferenceLink string
+	Linked        int64
+
+	// ClobberConflicts removes whatever is in the way of a file being written, rather
+	// than failing it with a *PathConflictError: a file where one of its directories
+	// should be or a directory (and everything in it) where the file should be. These
+	// are usually left behind by an earlier run with a different layout. See conflicts.go
+
+	ClobberConflicts bool
+
+	// QuarantineFailures moves the local copy of a file out of the way when the source
+	// has changed but the new version failed verification (see HashSource), so that
+	// anything reading Dest sees that it is missing rather than silently reading out of
+	// date data. It is moved to QuarantineDir, keeping its path, if that is set and
+	// otherwise renamed to "<path>.quarantined-<time>". Quarantined files are counted in
+	// Quarantined and listed in the report, and removed again if a retry fetches a
+	// verified copy. See quarantine.go
+
+	QuarantineFailures bool
+	QuarantineDir      string
+	Quarantined        int64
+
+	// IncrementalManifest, if set, is a manifest written by a previous run (see
+	// ManifestPath, it can be the same file). Rows whose hash matches the one it lists
+	// for their path are skipped without looking at the source, or even the local copy,
+	// and counted in Skipped and SkippedManifest, so only new and changed rows are checked
+	// as usual. Like ManifestPath it is suffixed with the name of each meta file when
+	// there is more than one, and it is only read again once it has been replaced. If it
+	// is missing, older than IncrementalMaxAge (zero means any age), doesn't match what
+	// is in Dest or has hashes that can't be compared with the meta file's then every row
+	// is checked as usual. Local copies changed or removed since it was written aren't
+	// noticed, and alternate geometry files are always checked since the meta file has
+	// no hash for them. See incremental.go
+
+	IncrementalManifest string
+	IncrementalMaxAge   time.Duration
+	SkippedManifest     int64
+
+	// HeadKeepAlive reuses connections for the HEAD requests that check whether files
+	// have changed, keeping up to CheckWorkers of them open for the length of a run,
+	// rather than opening a new one for each request like everything else. It is on by
+	// default and makes a big difference to runs where little has changed. See headclient.go
+
+	HeadKeepAlive bool
+
+	// TraceRequests times the DNS, connect, TLS, wait and body phases of every request,
+	// summarizing them in the report and, if Verbose is true, logging them (at debug
+	// level) as well. It also counts the connections opened and reused, and the protocol
+	// (HTTP/1.1 or HTTP/2) each request used, which are logged at the end of each run.
+	// See trace.go and http2.go
+
+	TraceRequests bool
+
+	// UpdatedMetaPath, if set, is where a copy of the meta file is written at the end of
+	// each run with its hash, size and lastmodified columns updated to match the files on
+	// disk. Rows for files that could not be cloned are left out unless UpdatedMetaStatus
+	// is true, in which case a clone_status column is added instead. See updatedmeta.go
+
+	UpdatedMetaPath   string
+	UpdatedMetaStatus bool
+
+	// SummaryPath, if set, is where a JSON summary of each run is written when it ends,
+	// however it ends. See WOFCloneSummary
+
+	SummaryPath string
+
+	// AllowFailures restores the lenient behaviour where CloneMetaFile (and Wait) only
+	// return an error if the run was aborted or there were too many failures to retry.
+	// By default an error is returned if any file is still failing at the end of the run.
+
+	AllowFailures bool
+
+	Failed        []string            // the files that were still failing at the end of the last run
+	Logger        Logger              // see logger.go
+	UserAgent     string              // defaults to "go-whosonfirst-clone/<version>"
+	Headers       map[string]string   // additional headers sent with every request
+	RequestHook   func(*http.Request) // called on every request just before it is sent
+	report        *report
+	client        *http.Client
+	head_client   *http.Client  // see HeadKeepAlive
+	groups        *groupTracker // see GroupBy
+	transport     *http.Transport
+	auth_user     string
+	auth_password string
+	auth_token    string
+	retries       *retryQueue
+	timer         time.Time
+	ctx           context.Context
+	cancel        context.CancelFunc
+	aborted       int32
+	excessive     int32 // set if the run was aborted by checkRetryRate
+	manifest      *manifest
+	written       *writtenLog // see PostVerify
+	hashes        *sync.Map   // see wroteFile
+	meta_label    string
+	run_label     string          // see RunLabel
+	meta_options  MetaFileOptions // see CloneMetaFilesWithOptions
+	run           *cloneRun
+	run_mu        *sync.Mutex
+	hosts         *hostLimiter
+	manifests     *manifestCache    // see IncrementalManifest
+	progress      *progress         // see Status
+	live          *liveRuns         // see Progress
+	dest_index    *destIndex        // see PrescanDest
+	previous      *previousManifest // see IncrementalManifest
+	rate_reset    *int64            // unix time, see ratelimit.go
+	paused_until  *int64            // unix time in nanoseconds, see window.go
+	active_window *activeWindow     // see checkActiveWindow
+	totals        *WOFCloneStats
+	sessions      map[*WOFClone]bool // the sessions still running, see newSession
+	parent        *WOFClone          // the WOFClone a session was started from
+	keep_summary  bool               // see newSession
+	last_summary  *WOFCloneSummary   // the summary of the last run, if keep_summary is true
+	s3            *s3Signer
+	throttle      *throttle
+	timings       *timings
+	traces        *traceStats
+	partials      *sync.Map
+	expected      *sync.Map // rel_path -> hash, see rememberHash
+	dest_paths    *sync.Map // rel_path -> path relative to Dest, see mapPath
+	h2_hosts      *sync.Map // host -> true, for hosts that speak HTTP/2, see http2.go
+	procs         int       // see NewWOFClone
+}
+
+// NewWOFClone returns a WOFClone that copies the files listed in meta files from source
+// to dest, using procs CPUs for things (like VerifyMetaFile) that are limited by them
+// rather than the network. It doesn't change GOMAXPROCS, or anything else that would
+// affect the rest of the process, so any number of WOFClones can be used side by side.
+// A nil logger means nothing is logged.
+
+func NewWOFClone(source string, dest string, procs int, logger Logger) (*WOFClone, error) {
 
 	// https://golang.org/src/net/http/filetransport.go
 
@@ -53,7 +734,16 @@ func NewWOFClone(source string, dest string, procs int, logger *log.WOFLogger) (
 		return nil, err
 	}
 
-	var cl *http.Client
+	// We always build our own transport (rather than using http.DefaultTransport)
+	// so that things like TLS settings can be scoped to this instance without
+	// affecting anything else in the process
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Setting TLSClientConfig (see SetTLSConfig) stops HTTP/2 being used unless it is
+	// asked for explicitly. See http2.go
+
+	t.ForceAttemptHTTP2 = true
 
 	if u.Scheme == "file" {
 
@@ -75,319 +765,1113 @@ func NewWOFClone(source string, dest string, procs int, logger *log.WOFLogger) (
 			(20160112/thisisaaronland)
 		*/
 
-		t := &http.Transport{}
 		t.RegisterProtocol("file", http.NewFileTransport(http.Dir(root)))
-
-		cl = &http.Client{Transport: t}
-	} else {
-		cl = &http.Client{}
 	}
 
-	runtime.GOMAXPROCS(procs)
+	cl := &http.Client{Transport: t}
 
-	count := 1000 // anything more and the operating system's "too many open filehandles"
-	// triggers get hit (20161229/thisisaaronland)
+	retries := newRetryQueue(default_max_pending_retries)
 
-	throttle := make(chan bool, count)
-
-	for i := 0; i < count; i++ {
-		throttle <- true
+	c := WOFClone{
+		Success:                0,
+		Error:                  0,
+		Skipped:                0,
+		Filehandles:            0,
+		MaxFilehandles:         512,
+		CheckWorkers:           200,
+		FetchWorkers:           100,
+		Source:                 source,
+		procs:                  procs,
+		Dest:                   dest,
+		Logger:                 ensureLogger(logger),
+		UserAgent:              "go-whosonfirst-clone/" + version,
+		PathColumn:             "path",
+		HashColumn:             "file_hash",
+		LastModifiedColumn:     "lastmodified",
+		MaxRetries:             25.0, // maybe allow this to be user-defined ?
+		MaxPendingRetries:      default_max_pending_retries,
+		MaxRetriesMinScheduled: default_max_retries_min_scheduled,
+		MaxFailureRecords:      default_max_failure_records,
+		report:                 newReport(),
+		partials:               new(sync.Map),
+		expected:               new(sync.Map),
+		dest_paths:             new(sync.Map),
+		h2_hosts:               new(sync.Map),
+		run_mu:                 new(sync.Mutex),
+		hosts:                  newHostLimiter(),
+		manifests:              newManifestCache(),
+		timings:                newTimings(default_top_files),
+		rate_reset:             new(int64),
+		paused_until:           new(int64),
+		totals:                 new(WOFCloneStats),
+		sessions:               make(map[*WOFClone]bool),
+		live:                   new(liveRuns),
+		traces:                 newTraceStats(),
+		MaxRateLimitWaits:      3,
+		HeadKeepAlive:          true,
+		client:                 cl,
+		transport:              t,
+		retries:                retries,
+		timer:                  time.Now(),
+		ctx:                    context.Background(),
+		cancel:                 func() {},
 	}
 
-	retries := pool.NewLIFOPool()
+	cl.CheckRedirect = c.checkRedirect
 
-	/*
+	return &c, nil
+}
 
-		This gets triggered in the 'Process' function to ensure that
-		we don't exit out of 'CloneMetaFile' before all the goroutines
-		to write new files to disk actually finish ... you know, writing
-		to disk (20160606/thisisaaronland)
-	*/
+// CloneMetaFile clones every file listed in the meta file at file. Each call is
+// self-contained, with its own counters and retries, so a single WOFClone can be used
+// to clone any number of meta files one after the other or at the same time. Once it
+// returns c's counters (Success, Error and so on) and Failed describe that call, the
+// totals for every call are available from Stats and Report describes every call.
+// If file is a directory or a glob pattern it is the same as CloneMetaFiles. If the
+// meta file can't be read to the end the rows before the failure are still cloned and
+// a *PartialReadError, saying how far it got, is returned.
 
-	writesync := new(sync.WaitGroup)
+func (c *WOFClone) CloneMetaFile(file string, skip_existing bool, force_updates bool) error {
 
-	ch := make(chan bool)
+	if isMetaFileSet(file) {
+		return c.CloneMetaFiles([]string{file}, skip_existing, force_updates)
+	}
 
-	c := WOFClone{
-		Success:        0,
-		Error:          0,
-		Skipped:        0,
-		Filehandles:    0,
-		MaxFilehandles: 512,
-		Source:         source,
-		Dest:           dest,
-		Logger:         logger,
-		MaxRetries:     25.0, // maybe allow this to be user-defined ?
-		client:         cl,
-		writesync:      writesync,
-		retries:        retries,
-		timer:          time.Now(),
-		done:           ch,
-		throttle:       throttle,
-	}
-
-	go func(c *WOFClone) {
-
-		for {
-			select {
-
-			case <-c.done:
-				break
-			case <-time.After(1 * time.Second):
-				c.Status()
-			}
-		}
-	}(&c)
+	_, err := c.CloneMetaFileWithSummary(file, skip_existing, force_updates)
+	return err
+}
 
-	return &c, nil
+// CloneMetaFileWithSummary is CloneMetaFile but also returns a summary of the call, which
+// is nil if the meta file couldn't be read at all.
+
+func (c *WOFClone) CloneMetaFileWithSummary(file string, skip_existing bool, force_updates bool) (*WOFCloneSummary, error) {
+
+	opts := MetaFileOptions{
+		File:         file,
+		SkipExisting: skip_existing,
+		ForceUpdates: force_updates,
+	}
+
+	return c.cloneMetaFileSession(opts, false)
 }
 
-func (c *WOFClone) CloneMetaFile(file string, skip_existing bool, force_updates bool) error {
+func (c *WOFClone) cloneMetaFile(file string, skip_existing bool, force_updates bool) error {
 
 	abs_path, _ := filepath.Abs(file)
 
-	reader, read_err := csv.NewDictReaderFromPath(abs_path)
+	reader, read_err := openMetaFile(abs_path)
+
+	// There isn't even a header
+
+	if read_err == io.EOF {
+
+		if c.AllowEmpty {
+			c.Logger.Warning("%s is empty, there is nothing to clone", abs_path)
+			return nil
+		}
+
+		read_err = &MetaFileError{Path: abs_path, Err: &EmptyMetaError{Path: abs_path, Column: c.PathColumn}}
+	}
 
 	if read_err != nil {
 		c.Logger.Error("Failed to read %s, because %v", abs_path, read_err)
 		return read_err
 	}
 
-	wg := new(sync.WaitGroup)
+	defer reader.Close()
 
-	c.timer = time.Now()
+	if !hasColumn(reader.Fieldnames, c.PathColumn) {
+		err := &MetaFileError{Path: abs_path, Err: &EmptyMetaError{Path: abs_path, Column: c.PathColumn, MissingColumn: true}}
+		c.Logger.Error("%v", err)
+		return err
+	}
 
-	for {
+	if c.isRunning() {
+		return ErrRunning
+	}
 
-		row, err := reader.Read()
+	// Nothing is sent to the source (see checkSelfClone and preflight) outside
+	// ActiveWindow, see window.go
 
-		if err == io.EOF {
-			break
+	err := c.checkActiveWindow()
+
+	if err == nil {
+		err = c.waitForActiveWindow()
+	}
+
+	if err != nil {
+		c.Logger.Error("Failed to clone %s, because %v", abs_path, err)
+		return err
+	}
+
+	if !c.AllowSelfClone {
+
+		err := c.checkSelfClone()
+
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return err
 		}
+	}
+
+	// There's nothing to check if the files are all coming from a bundle
+
+	prefix := c.newDataPrefix()
+
+	if !c.SkipPreflight && (c.Bundle == "" || c.BundleThenSync) {
+
+		err := c.preflight(abs_path, prefix)
 
 		if err != nil {
+			c.Logger.Error("%v", err)
 			return err
 		}
+	}
 
-		rel_path, ok := row["path"]
+	run, err := c.startRun(abs_path, prefix)
 
-		if !ok {
+	if err != nil {
+		return err
+	}
+
+	// So that Status can say how far through the meta file the run is, see progress.go
+
+	go c.progress.countRows(abs_path)
+
+	if c.Bundle != "" {
+
+		c.setPhase(PhaseBundle)
+
+		err := c.cloneBundle(c.bundleURL(abs_path), c.BundleThenSync)
+
+		if err != nil && !c.BundleThenSync {
+			run.read_err = err
+			c.Wait()
+			return err
+		}
+
+		if err != nil {
+			c.Logger.Warning("Failed to clone bundle, cloning every file in %s instead", abs_path)
+		}
+
+		if !c.BundleThenSync {
+			return c.Wait()
+		}
+
+		c.setPhase(PhaseReading)
+	}
+
+	opts := ScheduleOptions{
+		SkipExisting: skip_existing,
+		ForceUpdates: force_updates,
+	}
+
+	// See rows.go and order.go
+
+	ordered := c.orderRows(abs_path, reader)
+
+	if ordered != reader {
+		defer ordered.Close()
+	}
+
+	rows, with_path, csv_err := c.scheduleRows(abs_path, ordered, opts)
+
+	atomic.StoreInt64(&run.rows, rows)
+
+	bad_rows := atomic.LoadInt64(&c.BadRows)
+
+	if bad_rows > 0 {
+
+		c.Logger.Warning("skipped %d malformed rows in %s", bad_rows, abs_path)
+
+		rate := float64(bad_rows) / float64(rows)
+
+		if csv_err == nil && c.MaxBadRowsRate > 0.0 && rate > c.MaxBadRowsRate {
+			csv_err = &MetaFileError{Path: abs_path, Err: ErrTooManyBadRows}
+		}
+	}
+
+	if csv_err == nil && with_path == 0 && !c.AllowEmpty && !c.isAborted() {
+		csv_err = &MetaFileError{Path: abs_path, Err: &EmptyMetaError{Path: abs_path, Column: c.PathColumn, Rows: rows}}
+	}
+
+	if csv_err != nil {
+		run.read_err = csv_err
+		c.Wait()
+		c.Logger.Error("Failed to read %s, because %v", abs_path, csv_err)
+		return csv_err
+	}
+
+	return c.Wait()
+}
+
+// Report returns a snapshot of the details collected so far about what has
+// been cloned, and from where.
+
+func (c *WOFClone) Report() *WOFCloneReport {
+
+	rpt := c.report.Snapshot()
+	rpt.PendingRetries = c.retries.Paths()
+
+	if !c.DisableTimings {
+		rpt.Durations, rpt.Slowest, rpt.Largest = c.timings.Snapshot()
+	}
+
+	if c.TraceRequests {
+		rpt.RequestPhases = c.traces.Snapshot()
+		rpt.Connections = c.traces.Connections()
+	}
+
+	return rpt
+}
+
+type fetchRequest struct {
+	rel_path       string
+	ensure_changes bool
+	forced         bool
+}
+
+// checkRow works out which of the files listed in row (the record itself, at rel_path,
+// and any alternate geometry files) need to be fetched and submits them to fetch_pool. count
+// is the number of rows that have been submitted so far and is used to enforce
+// c.MaxFiles.
+
+func (c *WOFClone) checkRow(rel_path string, row map[string]string, fetch_pool *workerPool, skip_existing bool, force_updates bool, count *int64) {
+
+	if c.isAborted() {
+		return
+	}
+
+	if c.MaxFiles > 0 && c.MaxFilesIncludesSkipped {
+
+		if atomic.AddInt64(count, 1) > c.MaxFiles {
+			atomic.AddInt64(&c.Ignored, 1)
+			c.decide(rel_path, DecisionIgnored)
+			return
+		}
+	}
+
+	// See pathkind.go
+
+	err := c.checkRowPath(rel_path)
+
+	if err != nil {
+		c.Logger.Error("%v", err)
+		c.rejectPath(rel_path, err)
+		return
+	}
+
+	alt_paths := make([]string, 0)
+
+	for _, alt_path := range c.AltPaths(rel_path, row) {
+
+		err := c.checkRowPath(alt_path)
+
+		if err != nil {
+			c.Logger.Error("%v", err)
+			c.rejectPath(alt_path, err)
 			continue
 		}
 
-		ensure_changes := true
-		has_changes := true
-		carry_on := false
+		alt_paths = append(alt_paths, alt_path)
+	}
 
-		remote := c.Source + rel_path
-		local := path.Join(c.Dest, rel_path)
+	// Alternate geometry files are in the same group as their record
 
-		_, err = os.Stat(local)
+	if c.groups != nil {
 
-		if !os.IsNotExist(err) {
+		group := c.groupKey(rel_path, row)
 
-			if force_updates {
+		c.setGroup(rel_path, group)
 
-				c.Logger.Debug("%s already but we are forcing updates", local)
-			} else if skip_existing {
+		for _, alt_path := range alt_paths {
+			c.setGroup(alt_path, group)
+		}
+	}
 
-				c.Logger.Debug("%s already exists and we are skipping things that exist", local)
-				carry_on = true
+	if c.ValidateIds && !c.checkId(rel_path, row) && c.RejectIdMismatches {
+		c.rejectPath(rel_path, &IdMismatchError{Path: rel_path, Id: row["id"]})
 
-			} else {
+		for _, alt_path := range alt_paths {
+			c.forgetGroup(alt_path)
+		}
 
-				file_hash, ok := row["file_hash"]
+		return
+	}
 
-				t1 := time.Now()
+	// Alternate geometry files are stored alongside the record they belong to so
+	// they are mapped using the same row. See destpath.go
 
-				if ok {
-					c.Logger.Debug("comparing hardcoded hash (%s) for %s", file_hash, local)
-					has_changes, _ = c.HasHashChanged(file_hash, remote)
-				} else {
-					has_changes, _ = c.HasChanged(local, remote)
-				}
+	c.mapPath(rel_path, row)
 
-				if !has_changes {
-					c.Logger.Info("no changes to %s", local)
-					carry_on = true
-				}
+	for _, alt_path := range alt_paths {
+		c.mapPath(alt_path, row)
+	}
+
+	c.checkRowHash(rel_path, row)
+
+	to_fetch := make([]fetchRequest, 0)
+
+	// See incremental.go
+
+	if !force_updates && c.isUnchangedSinceManifest(rel_path, row) {
+
+		c.skipUnchangedSinceManifest(rel_path)
+
+	} else {
+
+		fetch, ensure_changes, forced := c.checkPath(rel_path, row, skip_existing, force_updates)
 
-				t2 := time.Since(t1)
+		if fetch {
+			to_fetch = append(to_fetch, fetchRequest{rel_path, ensure_changes, forced})
+		}
+	}
+
+	for _, alt_path := range alt_paths {
+
+		fetch, ensure_changes, forced := c.checkPath(alt_path, nil, skip_existing, force_updates)
+
+		if fetch {
+			to_fetch = append(to_fetch, fetchRequest{alt_path, ensure_changes, forced})
+		}
+	}
+
+	if len(to_fetch) == 0 {
+		return
+	}
+
+	if c.MaxFiles > 0 && !c.MaxFilesIncludesSkipped {
+
+		if atomic.AddInt64(count, 1) > c.MaxFiles {
+
+			atomic.AddInt64(&c.Ignored, 1)
+			c.decide(rel_path, DecisionIgnored)
 
-				c.Logger.Debug("time to determine whether %s has changed (%t), %v", local, has_changes, t2)
+			for _, req := range to_fetch {
+				c.forgetGroup(req.rel_path)
 			}
 
-			if carry_on {
+			return
+		}
+	}
+
+	for _, req := range to_fetch {
+
+		req := req
+
+		fetch_pool.Submit(func() {
+			c.clonePath(req.rel_path, req.ensure_changes, req.forced)
+		})
+	}
+}
+
+// checkPath decides whether rel_path needs to be fetched, returning true if it does
+// along with whether or not ClonePath still needs to check for changes and whether
+// an existing file is being replaced because of force_updates. Files that don't need
+// to be fetched are counted as skipped. row is the meta file row that
+// rel_path was read from and may be nil (for example, for alternate geometry files)
+// in which case changes are determined by comparing the local file against the source.
+
+func (c *WOFClone) checkPath(rel_path string, row map[string]string, skip_existing bool, force_updates bool) (bool, bool, bool) {
+
+	remote := c.Source + rel_path
+	local := c.LocalPath(rel_path)
+
+	info, err := c.statLocal(local)
 
+	if err != nil {
+
+		info = nil
+
+		// The local copy may or may not be there, see UnreadableLocal
+
+		if !os.IsNotExist(err) {
+
+			_, err = c.unreadableLocal(rel_path, &LocalReadError{Path: local, Err: err})
+
+			if err != nil {
 				atomic.AddInt64(&c.Scheduled, 1)
-				atomic.AddInt64(&c.Completed, 1)
-				atomic.AddInt64(&c.Skipped, 1)
-				continue
+				c.addMetric(MetricFilesScheduled, 1)
+				c.finishPath(rel_path, DecisionFailed, err)
+				return false, false, false
 			}
+		}
+	}
+
+	opts := DecideOptions{
+		SkipExisting:       skip_existing,
+		ForceUpdates:       force_updates,
+		UseLastModified:    c.UseLastModified || c.ContentFilter != nil,
+		LastModifiedColumn: c.LastModifiedColumn,
+		MaxFileSize:        c.MaxFileSize,
+		SizeColumn:         c.SizeColumn,
+		MinExistingSize:    c.MinExistingSize,
+		LocalIncomplete:    info != nil && !force_updates && !c.isUsable(rel_path, local, info),
+	}
+
+	changed := func() (bool, Decision, error) {
+
+		file_hash, ok := c.rowHash(row)
+
+		t1 := time.Now()
+
+		// By default file_hash is an MD5 hash so it's no use if the source has its own
+		// way of hashing files and S3 sources may not have an MD5 hash to compare it with.
+		// See hash.go for the other options
+
+		var state ChangeState
+		var err error
+
+		decision := DecisionSkippedFileHash
+
+		if c.hasExplicitHash() {
+			state, err = c.hasExpectedHashChanged(rel_path, row, local, remote)
+		} else if ok && c.LocalHash == nil && c.s3 == nil && c.HashSource == "" && c.hashAlgorithm() == HashMD5 {
+			if c.debugging() {
+				c.Logger.Debug("comparing hardcoded hash (%s) for %s", file_hash, local)
+			}
+			state, err = c.CheckHashChanged(file_hash, remote)
+		} else {
+			state, err = c.CheckChanged(local, remote)
+			decision = DecisionSkippedETag
+		}
+
+		if state == Unknown && isLocalReadError(err) {
+			state, err = c.unreadableLocal(rel_path, err)
+		} else if state == Unknown && errors.Is(err, ErrNotModified) {
+			state, err = Unchanged, nil
+			decision = DecisionSkippedNotModified
+		} else if state == Unknown {
+			state, err = c.unknownChange(rel_path, err)
+			decision = DecisionSkippedUnknown
+		}
+
+		if err != nil {
+			return false, DecisionFailed, err
+		}
+
+		has_changes := state != Unchanged
+
+		if c.Verbose && c.debugging() {
+			c.Logger.Debug("time to determine whether %s has changed (%t), %v", local, has_changes, time.Since(t1))
+		}
 
-			ensure_changes = false
+		if !has_changes {
+			c.Logger.Info("no changes to %s", local)
+			return false, decision, nil
 		}
 
-		<-c.throttle
+		if c.ProtectNewerLocal && c.isLocalNewer(local, info, remote) {
+			c.protectLocal(rel_path, local)
+			return false, DecisionSkippedLocalNewer, nil
+		}
+
+		return true, "", nil
+	}
+
+	decision, reason, err := Decide(row, info, opts, changed)
+
+	if c.debugging() {
+		c.Logger.Debug("%s: %s, because %s", local, decision, reason)
+	}
+
+	if err != nil {
+
+		// See UnknownChanges
 
-		wg.Add(1)
 		atomic.AddInt64(&c.Scheduled, 1)
+		c.addMetric(MetricFilesScheduled, 1)
+		c.finishPath(rel_path, DecisionFailed, err)
+		return false, false, false
+	}
 
-		go func(c *WOFClone, rel_path string, ensure_changes bool) {
+	if decision == DecisionSkippedTooLarge {
+		atomic.AddInt64(&c.Scheduled, 1)
+		atomic.AddInt64(&c.Completed, 1)
+		c.skipTooLarge(rel_path)
+		c.decide(rel_path, DecisionSkippedTooLarge)
+		return false, false, false
+	}
 
-			c.EnsureFilehandles()
+	if decision.Skipped() {
+		atomic.AddInt64(&c.Scheduled, 1)
+		atomic.AddInt64(&c.Completed, 1)
+		c.addMetric(MetricFilesScheduled, 1)
+		c.skipUnchanged(rel_path, local)
+		c.decide(rel_path, decision)
+		return false, false, false
+	}
 
-			defer func() {
-				c.throttle <- true
-				wg.Done()
-			}()
+	if opts.LocalIncomplete {
+		c.Logger.Info("%s exists but looks incomplete, fetching it again", local)
+	}
 
-			t1 := time.Now()
-			cl_err := c.ClonePath(rel_path, ensure_changes)
-			t2 := time.Since(t1)
+	if c.ReferenceDir != "" && !force_updates && c.linkReference(rel_path, row, local) {
+		atomic.AddInt64(&c.Scheduled, 1)
+		c.addMetric(MetricFilesScheduled, 1)
+		c.finishPath(rel_path, DecisionLinked, nil)
+		return false, false, false
+	}
 
-			c.Logger.Debug("time to process %s : %v", rel_path, t2)
+	c.rememberHash(rel_path, row)
+	return true, info == nil, decision == DecisionForced
+}
 
-			if cl_err != nil {
-				atomic.AddInt64(&c.Error, 1)
-				c.retries.Push(&pool.PoolString{String: rel_path})
-			} else {
-				atomic.AddInt64(&c.Success, 1)
-			}
+// clonePath is what the fetch workers in CloneMetaFile run for each path that
+// needs to be fetched. forced is true if it is only being fetched because of
+// force_updates.
 
-			atomic.AddInt64(&c.Completed, 1)
+func (c *WOFClone) clonePath(rel_path string, ensure_changes bool, forced bool) {
 
-		}(c, rel_path, ensure_changes)
+	// Scheduled is incremented here, rather than when a path is queued, so
+	// that paths dropped because a run was aborted aren't counted
+
+	if c.isAborted() {
+		return
 	}
 
-	wg.Wait()
+	atomic.AddInt64(&c.Scheduled, 1)
+	c.addMetric(MetricFilesScheduled, 1)
+
+	c.EnsureFilehandles()
+
+	t1 := time.Now()
+	decision, cl_err := c.clonePathOrSkip(rel_path, ensure_changes, forced, "")
+
+	if c.Verbose && c.debugging() {
+		c.Logger.Debug("time to process %s : %v", rel_path, time.Since(t1))
+	}
+
+	if forced && decision == DecisionFetchedChanged {
+		decision = DecisionForced
+	}
+
+	c.finishPath(rel_path, decision, cl_err)
+}
+
+// finishPath records the outcome of cloning rel_path, which failed if cl_err is not nil
+// and was otherwise decision (see clonePathOrSkip). If it failed decision is what had
+// been decided about it by then, which is passed on to the retry. Every path that is
+// scheduled ends up counted in exactly one of Success, Error or Skipped.
+
+func (c *WOFClone) finishPath(rel_path string, decision Decision, cl_err error) {
 
-	c.writesync.Wait()
+	if decision.Skipped() {
 
-	ok := c.ProcessRetries()
+		c.skipUnchanged(rel_path, c.LocalPath(rel_path))
+
+	} else if errors.Is(cl_err, ErrTooLarge) {
+
+		c.skipTooLarge(rel_path)
+		decision = DecisionSkippedTooLarge
+
+	} else if cl_err != nil {
+
+		c.recordError(rel_path, cl_err)
+
+		c.quarantine(rel_path, decision, cl_err)
+
+		if c.isRetryable(cl_err, 1) {
+			c.queueRetry(rel_path, decision)
+		} else {
+			atomic.AddInt64(&c.PermanentErrors, 1)
+			c.Logger.Warning("%s failed with a permanent error (%s) and will not be retried", rel_path, ErrorCategory(cl_err))
+		}
+
+		decision = DecisionFailed
+
+	} else {
+		atomic.AddInt64(&c.Success, 1)
+		c.addMetric(MetricFilesSucceeded, 1)
+
+		if decision == DecisionForced {
+			atomic.AddInt64(&c.Forced, 1)
+		}
+	}
+
+	atomic.AddInt64(&c.Completed, 1)
+	c.decide(rel_path, decision)
+}
+
+// skipUnchanged records that rel_path, stored at local, was skipped because it hasn't
+// changed.
+
+func (c *WOFClone) skipUnchanged(rel_path string, local string) {
+
+	atomic.AddInt64(&c.Skipped, 1)
+	c.addMetric(MetricFilesSkipped, 1)
+	c.addSkippedToManifest(rel_path, local)
+}
+
+// skipTooLarge records that rel_path was skipped because it is larger than c.MaxFileSize.
+
+func (c *WOFClone) skipTooLarge(rel_path string) {
+
+	c.Logger.Info("skipping %s because it is larger than %d bytes", rel_path, c.MaxFileSize)
+
+	atomic.AddInt64(&c.Skipped, 1)
+	atomic.AddInt64(&c.SkippedTooLarge, 1)
+	c.addMetric(MetricFilesSkipped, 1)
+
+	c.report.AddTooLarge(rel_path)
+}
+
+// isTooLarge returns true if row has a size column (see rowSize) whose value is larger
+// than max.
+
+func isTooLarge(row map[string]string, column string, max int64) bool {
+
+	size, ok := rowSize(row, column)
+	return ok && size > max
+}
+
+// rowSize returns the value of row's size column (column, or "size" or "filesize" if it
+// is empty) and whether it has one.
+
+func rowSize(row map[string]string, column string) (int64, bool) {
+
+	columns := []string{"size", "filesize"}
+
+	if column != "" {
+		columns = []string{column}
+	}
+
+	for _, k := range columns {
+
+		str_size, ok := row[k]
+
+		if !ok {
+			continue
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(str_size), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		return size, true
+	}
+
+	return 0, false
+}
+
+// hasColumn returns true if column is one of fieldnames.
+
+func hasColumn(fieldnames []string, column string) bool {
+
+	for _, f := range fieldnames {
+
+		if f == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AltPaths returns the (relative) paths of any alternate geometry files listed in
+// the c.AltPathsColumn column of row. Values are separated by commas and any value
+// that is just a filename is assumed to live alongside rel_path.
+
+func (c *WOFClone) AltPaths(rel_path string, row map[string]string) []string {
+
+	alt_paths := make([]string, 0)
+
+	if c.AltPathsColumn == "" {
+		return alt_paths
+	}
+
+	str_alt, ok := row[c.AltPathsColumn]
 
 	if !ok {
-		c.Logger.Warning("failed to process retries")
-		return errors.New("One of file failed to be cloned")
+		return alt_paths
 	}
 
-	c.writesync.Wait()
+	root := path.Dir(rel_path)
 
-	c.done <- true
-	return nil
+	for _, alt := range strings.Split(str_alt, ",") {
+
+		alt = strings.TrimSpace(alt)
+
+		if alt == "" {
+			continue
+		}
+
+		if !strings.Contains(alt, "/") && root != "." {
+			alt = path.Join(root, alt)
+		}
+
+		alt_paths = append(alt_paths, alt)
+	}
+
+	return alt_paths
+}
+
+// isModifiedSince returns true unless row has a valid lastmodified (epoch) value,
+// in the column named column, that is older than or equal to the modification time of info. This is
+// what WOFClone.UseLastModified uses to skip existing files without any network
+// requests; rows with a missing or unparseable lastmodified value fall back to
+// the usual hash comparisons. Note that this assumes local mtimes can be trusted
+// which is why it is not enabled by default.
+
+func isModifiedSince(row map[string]string, column string, info os.FileInfo) bool {
+
+	lastmod, ok := rowLastModified(row, column)
+
+	if !ok {
+		return true
+	}
+
+	return info.ModTime().Unix() < lastmod
+}
+
+// recordError increments the error count for a run and, if c.MaxErrors has been
+// reached, aborts it.
+
+func (c *WOFClone) recordError(rel_path string, err error) {
+
+	count := atomic.AddInt64(&c.Error, 1)
+	c.addMetric(MetricFilesFailed, 1)
+
+	c.report.AddFailure(rel_path, err)
+	c.recentError(rel_path, err)
+
+	if c.MaxErrors > 0 && count >= c.MaxErrors {
+
+		if atomic.CompareAndSwapInt32(&c.aborted, 0, 1) {
+			c.Logger.Error("Reached the maximum number of errors (%d), aborting", c.MaxErrors)
+			c.cancel()
+		}
+	}
+}
+
+// queueRetry adds rel_path to the list of files to retry, along with decision and
+// its expected hash (if the meta file had one) so that the retry doesn't have to
+// check whether it has changed all over again. It aborts the clone if that list has
+// grown larger than c.MaxPendingRetries.
+
+func (c *WOFClone) queueRetry(rel_path string, decision Decision) {
+
+	entry := retryEntry{
+		decision: decision,
+		hash:     c.rememberedHash(rel_path),
+	}
+
+	if c.retries.Push(rel_path, entry) {
+		c.checkRetryRate()
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.aborted, 0, 1) {
+		c.Logger.Error("More than %d files are waiting to be retried, aborting", c.MaxPendingRetries)
+		c.cancel()
+	}
+}
+
+// checkRetryRate aborts the clone if more than c.MaxRetries percent of the files
+// scheduled so far are waiting to be retried, see MaxRetriesMinScheduled.
+
+func (c *WOFClone) checkRetryRate() {
+
+	if c.MaxRetriesMinScheduled <= 0 {
+		return
+	}
+
+	scheduled := atomic.LoadInt64(&c.Scheduled)
+
+	if scheduled < c.MaxRetriesMinScheduled {
+		return
+	}
+
+	pct := (float64(c.retries.Length()) / float64(scheduled)) * 100.0
+
+	if pct <= c.MaxRetries {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.aborted, 0, 1) {
+		atomic.StoreInt32(&c.excessive, 1)
+		c.Logger.Error("E_EXCESSIVE_ERRORS, %f percent of the %d files scheduled so far have failed in a way worth retrying, aborting", pct, scheduled)
+		c.cancel()
+	}
 }
 
+// hasExcessiveErrors returns true if the current run was aborted because too many
+// files failed, see MaxPendingRetries and MaxRetriesMinScheduled.
+
+func (c *WOFClone) hasExcessiveErrors() bool {
+	return c.retries.Overflowed() || atomic.LoadInt32(&c.excessive) == 1
+}
+
+func (c *WOFClone) cloneError(meta string, reason error) error {
+
+	first_path, first_err := c.report.FirstFailure()
+
+	_, omitted := c.report.FailedCount()
+
+	err := CloneError{
+		Failed:        c.Failed,
+		FailedOmitted: omitted,
+		Meta:          meta,
+		Reason:        reason,
+		Errors:        atomic.LoadInt64(&c.Error),
+		FirstPath:     first_path,
+		FirstErr:      first_err,
+	}
+
+	return &err
+}
+
+// isAborted returns true if the current run has been aborted, because of c.MaxErrors,
+// or its context is done, for example because its deadline has passed.
+
+func (c *WOFClone) isAborted() bool {
+	return atomic.LoadInt32(&c.aborted) == 1 || c.ctx.Err() != nil
+}
+
+// ProcessRetries retries every file that failed (with a retryable error) since the
+// last time it was called. It returns false if the retries weren't attempted, because
+// more than c.MaxRetries percent of scheduled files failed, or if any file failed again.
+// Files that failed again are listed in the report (see Report) and in c.Failed once
+// the run has ended.
+
 func (c *WOFClone) ProcessRetries() bool {
 
+	attempted, failed := c.processRetries()
+	return attempted && failed == 0
+}
+
+// processRetries does the work for ProcessRetries, returning whether the retries
+// were attempted at all and, if they were, how many files failed again.
+
+func (c *WOFClone) processRetries() (bool, int64) {
+
 	to_retry := c.retries.Length()
 
-	if to_retry > 0 {
+	if to_retry == 0 {
+		return true, 0
+	}
+
+	scheduled := atomic.LoadInt64(&c.Scheduled)
+	scheduled_f := float64(scheduled)
+
+	retry_f := float64(to_retry)
 
-		scheduled := atomic.LoadInt64(&c.Scheduled)
-		scheduled_f := float64(scheduled)
+	pct := (retry_f / scheduled_f) * 100.0
 
-		retry_f := float64(to_retry)
+	if pct > c.MaxRetries {
+		c.Logger.Warning("E_EXCESSIVE_ERRORS, %f percent of scheduled processes failed (not counting permanent errors) thus undermining our faith that they will work now...", pct)
+		return false, 0
+	}
 
-		pct := (retry_f / scheduled_f) * 100.0
+	c.Logger.Info("There are %d failed requests that will now be retried", to_retry)
+	c.setPhase(PhaseRetrying)
 
-		if pct > c.MaxRetries {
-			c.Logger.Warning("E_EXCESSIVE_ERRORS, %f percent of scheduled processes failed thus undermining our faith that they will work now...", pct)
-			return false
+	failed := int64(0)
+
+	retry_pool := newTrackedWorkerPool(c.ctx, c.FetchWorkers, &c.totals.Queued, &c.totals.InFlight)
+
+	for {
+
+		rel_path, entry, ok := c.retries.Pop()
+
+		if !ok {
+			break
 		}
 
-		c.Logger.Info("There are %d failed requests that will now be retried", to_retry)
+		// rel_path was counted in Scheduled and Completed when it first failed so
+		// retrying it only moves it from Error to another bucket, see finishPath
+
+		c.addMetric(MetricRetries, 1)
+		atomic.AddInt64(&c.Retried, 1)
+
+		retry_pool.Submit(func() {
 
-		wg := new(sync.WaitGroup)
+			// If rel_path failed after it was known to need fetching there is no
+			// need to check again, and its expected hash makes sure that what is
+			// fetched now is what was meant to be fetched then
+
+			ensure_changes := !entry.fetching()
+
+			t1 := time.Now()
+
+			decision, cl_err := c.clonePathOrSkip(rel_path, ensure_changes, entry.decision == DecisionForced, entry.hash)
+
+			if entry.decision == DecisionForced && decision == DecisionFetchedChanged {
+				decision = DecisionForced
+			}
+
+			if c.Verbose && c.debugging() {
+				c.Logger.Debug("time to retry clone %s : %v", rel_path, time.Since(t1))
+			}
+
+			// c.Error was incremented when rel_path first failed so it is only
+			// decremented here if the retry worked, and never incremented again
+
+			if decision.Skipped() {
+				atomic.AddInt64(&c.Error, -1)
+				c.report.Resolve(rel_path)
+				c.skipUnchanged(rel_path, c.LocalPath(rel_path))
+			} else if errors.Is(cl_err, ErrTooLarge) {
+				atomic.AddInt64(&c.Error, -1)
+				c.report.Resolve(rel_path)
+				c.skipTooLarge(rel_path)
+				decision = DecisionSkippedTooLarge
+			} else if cl_err != nil {
+				c.Logger.Error("%s failed again, because %v", rel_path, cl_err)
+				atomic.AddInt64(&failed, 1)
+
+				c.quarantine(rel_path, decision, cl_err)
+				decision = DecisionFailed
+
+				if !c.isRetryable(cl_err, 2) {
+					atomic.AddInt64(&c.PermanentErrors, 1)
+				}
+
+				c.report.UpdateFailure(rel_path, cl_err)
+				c.recentError(rel_path, cl_err)
+				c.addMetric(MetricFilesFailed, 1)
+			} else {
+				atomic.AddInt64(&c.Error, -1)
+				atomic.AddInt64(&c.Success, 1)
+				c.report.Resolve(rel_path)
+				c.addMetric(MetricFilesSucceeded, 1)
 
-		for c.retries.Length() > 0 {
+				// A file that was quarantined was changed, not new, see quarantine.go
 
-			r, ok := c.retries.Pop()
+				if c.releaseQuarantine(rel_path) && decision == DecisionFetchedNew {
+					decision = DecisionFetchedChanged
+				}
 
-			if !ok {
-				c.Logger.Error("failed to pop retries because... computers?")
-				break
+				if decision == DecisionForced {
+					atomic.AddInt64(&c.Forced, 1)
+				}
 			}
 
-			if r == nil {
-				c.Logger.Error("why is retry (pool) item nil?")
-				break
-			}
+			c.decide(rel_path, decision)
+		})
+	}
 
-			rel_path := r.StringValue()
+	retry_pool.Close()
 
-			<-c.throttle
+	// Anything that was never tried, because the run was cancelled, counts as failed too
 
-			atomic.AddInt64(&c.Scheduled, 1)
-			wg.Add(1)
+	failed += c.retries.Length()
 
-			go func(c *WOFClone, rel_path string) {
+	return true, failed
+}
 
-				defer func() {
-					wg.Done()
-					c.throttle <- true
-				}()
+// ClonePath fetches rel_path, unless ensure_changes is true and it hasn't changed in
+// which case it is counted as skipped.
 
-				ensure_changes := true
+func (c *WOFClone) ClonePath(rel_path string, ensure_changes bool) error {
 
-				t1 := time.Now()
+	err := c.checkRowPath(rel_path)
 
-				cl_err := c.ClonePath(rel_path, ensure_changes)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		c.decide(rel_path, DecisionFailed)
+		return err
+	}
 
-				t2 := time.Since(t1)
+	decision, err := c.clonePathOrSkip(rel_path, ensure_changes, !ensure_changes, "")
 
-				c.Logger.Debug("time to retry clone %s : %v\n", rel_path, t2)
+	if err != nil {
+		decision = DecisionFailed
+	} else if decision.Skipped() {
+		c.skipUnchanged(rel_path, c.LocalPath(rel_path))
+	}
 
-				if cl_err != nil {
-					atomic.AddInt64(&c.Error, 1)
-				} else {
-					atomic.AddInt64(&c.Error, -1)
-				}
+	c.decide(rel_path, decision)
+	return err
+}
 
-				atomic.AddInt64(&c.Completed, 1)
+// clonePathOrSkip is ClonePath but leaves counting the outcome to the caller, returning
+// what happened to rel_path: whether it was skipped because it hasn't changed or
+// fetched. If it failed the error is returned along with the decision that had been
+// made by then: DecisionFailed if it couldn't be told whether rel_path had changed,
+// otherwise why it was being fetched. If expected isn't "" it is the hash that
+// rel_path must have once it has been fetched. forced is true if it is only being
+// fetched because of force_updates.
 
-			}(c, rel_path)
-		}
+func (c *WOFClone) clonePathOrSkip(rel_path string, ensure_changes bool, forced bool, expected string) (Decision, error) {
 
-		wg.Wait()
-	}
+	remote := c.Source + rel_path
+	local := c.LocalPath(rel_path)
 
-	return true
-}
+	_, err := c.statLocal(local)
 
-func (c *WOFClone) ClonePath(rel_path string, ensure_changes bool) error {
+	exists := !os.IsNotExist(err)
 
-	remote := c.Source + rel_path
-	local := path.Join(c.Dest, rel_path)
+	if exists && ensure_changes {
 
-	_, err := os.Stat(local)
+		decision := DecisionSkippedETag
 
-	if !os.IsNotExist(err) && ensure_changes {
+		state, err := c.CheckChanged(local, remote)
 
-		change, _ := c.HasChanged(local, remote)
+		if state == Unknown && errors.Is(err, ErrNotModified) {
+			state, err = Unchanged, nil
+			decision = DecisionSkippedNotModified
+		} else if state == Unknown {
+			state, err = c.unknownChange(rel_path, err)
+			decision = DecisionSkippedUnknown
+		}
 
-		if !change {
+		if err != nil {
+			return DecisionFailed, err
+		}
 
+		if state == Unchanged {
 			c.Logger.Debug("%s has not changed so skipping", local)
-			atomic.AddInt64(&c.Skipped, 1)
-			return nil
+			return decision, nil
 		}
 
 	}
 
-	process_err := c.Process(remote, local)
+	decision := DecisionFetchedNew
 
-	if process_err != nil {
-		return process_err
+	if exists {
+		decision = DecisionFetchedChanged
 	}
 
-	return nil
+	process_err := c.process(remote, local, expected)
+
+	var identical *identicalError
+
+	if errors.As(process_err, &identical) {
+		return c.skipIdentical(rel_path, identical.Host, forced), nil
+	}
+
+	if exists && errors.Is(process_err, ErrNotModified) {
+		c.Logger.Debug("%s has not been modified so skipping", local)
+		return DecisionSkippedNotModified, nil
+	}
+
+	return decision, process_err
 }
 
-// don't return true if there's a problem - move that logic up above
+// HasChanged returns true if local is different from remote or if that can't be
+// determined. See CheckChanged, which can tell those apart.
 
 func (c *WOFClone) HasChanged(local string, remote string) (bool, error) {
 
-	change := true
+	state, err := c.CheckChanged(local, remote)
+	return state != Unchanged, err
+}
+
+// CheckChanged returns whether local is different from remote, or Unknown (and the
+// reason, if there was an error) if that can't be determined.
+
+func (c *WOFClone) CheckChanged(local string, remote string) (ChangeState, error) {
+
+	if c.ContentFilter != nil {
+		return c.filteredHasChanged(local, remote)
+	}
+
+	if c.s3 != nil {
+		return c.s3HasChanged(local, remote)
+	}
 
 	// OPEN FH
 
@@ -403,49 +1887,91 @@ func (c *WOFClone) HasChanged(local string, remote string) (bool, error) {
 	// in the interest of just removing go-whosonfirst-utils as a dependency we're
 	// going to do it the old-skool way by hand, for now (20170718/thisisaaronland)
 
-	body, err := ioutil.ReadFile(local)
-
-	if err != nil {
-		return false, err
-	}
-
-	enc := md5.Sum(body)
-	local_hash := hex.EncodeToString(enc[:])
+	// See provenance.go
 
-	// see notes above
+	if c.RecordProvenance && c.RemoteHash == nil {
 
-	/*
-		hash, err := hash.NewMD5Hash()
+		p, ok := c.readProvenance(local)
 
-		if err != nil {
-		   return false, err
+		if ok {
+			return c.provenanceHasChanged(local, remote, p)
 		}
+	}
 
-		local_hash, err := hash.HashFile(local)
+	if c.LocalHash == nil && c.RemoteHash == nil && c.hashAlgorithm() != HashMD5 {
+		return c.etagHasChanged(local, remote)
+	}
 
-		if err != nil {
-		   return false, err
-		}
-	*/
+	local_hash, err := c.changeHash(local)
 
 	if err != nil {
 		c.Logger.Error("Failed to hash %s, becase %v", local, err)
 
 		c.SetMaxFilehandles()
-		return change, err
+		return Unknown, err
 	}
 
-	return c.HasHashChanged(local_hash, remote)
+	return c.CheckHashChanged(local_hash, remote)
 }
 
+// compareETag is CheckChanged once the source's ETag (etag) is known, for when there
+// isn't a RemoteHash.
+
+func (c *WOFClone) compareETag(local string, remote string, etag string) (ChangeState, error) {
+
+	if c.LocalHash == nil && c.hashAlgorithm() != HashMD5 {
+		return c.etagChanged(local, remote, etag)
+	}
+
+	local_hash, err := c.changeHash(local)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	return changeState(local_hash != etag), nil
+}
+
+// HasHashChanged returns true if remote doesn't have the hash local_hash, or if that
+// can't be determined. See CheckHashChanged.
+
 func (c *WOFClone) HasHashChanged(local_hash string, remote string) (bool, error) {
 
-	change := true
+	state, err := c.CheckHashChanged(local_hash, remote)
+	return state != Unchanged, err
+}
+
+// CheckHashChanged returns whether remote has a different hash than local_hash, or
+// Unknown if remote's hash can't be determined.
+
+func (c *WOFClone) CheckHashChanged(local_hash string, remote string) (ChangeState, error) {
+
+	remote_hash, err := c.remoteHash(remote)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	if local_hash == remote_hash {
+		return Unchanged, nil
+	}
+
+	return Changed, nil
+}
+
+// remoteHash returns the hash of remote, using c.RemoteHash if it is set and the
+// ETag from a HEAD request otherwise.
+
+func (c *WOFClone) remoteHash(remote string) (string, error) {
+
+	if c.RemoteHash != nil {
+		return c.RemoteHash(remote)
+	}
 
 	rsp, err := c.Fetch("HEAD", remote)
 
 	if err != nil {
-		return change, err
+		return "", err
 	}
 
 	defer func() {
@@ -453,85 +1979,134 @@ func (c *WOFClone) HasHashChanged(local_hash string, remote string) (bool, error
 	}()
 
 	etag := rsp.Header.Get("Etag")
-	remote_hash := strings.Replace(etag, "\"", "", -1)
+	return strings.Replace(etag, "\"", "", -1), nil
+}
 
-	if local_hash == remote_hash {
-		change = false
-	}
+func (c *WOFClone) Process(remote string, local string) error {
 
-	return change, nil
+	return c.process(remote, local, "")
 }
 
-func (c *WOFClone) Process(remote string, local string) error {
+// process is Process for a file that must have the hash expected, if it isn't "".
 
-	c.Logger.Debug("fetch %s and store in %s", remote, local)
+func (c *WOFClone) process(remote string, local string, expected string) error {
 
-	local_root := path.Dir(local)
+	if c.debugging() {
+		c.Logger.Debug("fetch %s and store in %s", remote, local)
+	}
+
+	// See conflicts.go
 
-	_, err := os.Stat(local_root)
+	err := c.prepareLocal(local)
 
-	if os.IsNotExist(err) {
-		c.Logger.Debug("create %s", local_root)
-		os.MkdirAll(local_root, 0755)
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return err
 	}
 
 	t1 := time.Now()
 
-	rsp, fetch_err := c.Fetch("GET", remote)
+	// See download.go for details
+
+	written, err := c.download(remote, local, expected)
 
 	t2 := time.Since(t1)
 
-	c.Logger.Debug("time to fetch %s: %v", remote, t2)
+	if c.Verbose && c.debugging() {
+		c.Logger.Debug("time to fetch %s: %v", remote, t2)
+	}
 
-	if fetch_err != nil {
-		return fetch_err
+	if err != nil {
+		return err
 	}
 
-	defer func() {
-		rsp.Body.Close()
-	}()
+	if c.debugging() {
+		c.Logger.Debug("Wrote %s to disk", local)
+	}
 
-	contents, read_err := ioutil.ReadAll(rsp.Body)
+	c.addMetric(MetricBytesDownloaded, float64(written.size))
+	atomic.AddInt64(&c.FetchedBytes, written.size)
 
-	if read_err != nil {
-		c.Logger.Error("failed to read body for %s, because %v", remote, read_err)
-		return read_err
+	if !c.DisableTimings {
+		c.timings.Add(FileTiming{Path: strings.TrimPrefix(remote, c.Source), Duration: t2, Size: written.size})
+	}
+
+	rel_path := strings.TrimPrefix(remote, c.Source)
+
+	c.wroteFile(rel_path, written)
+
+	if c.manifest != nil {
+		c.manifest.Add(rel_path, c.localRelPath(rel_path), written.hash, written.size, time.Now())
 	}
 
-	c.writesync.Add(1) // See notes above in 'NewWOFClone'
+	return nil
+}
 
-	go func(writesync *sync.WaitGroup, local string, contents []byte) error {
+func (c *WOFClone) Fetch(method string, remote string) (*http.Response, error) {
 
-		defer writesync.Done()
+	rsp, _, err := c.fetchWithMirrors(method, remote)
+	return rsp, err
+}
 
-		// OPEN FH
+// fetchWithMirrors tries remote and then, if it failed in a way that another
+// source might be able to help with (network errors, 5XX and 404 responses),
+// the same relative path against each of c.Mirrors in turn. It returns the
+// source that actually served the request.
 
-		atomic.AddInt64(&c.Filehandles, 1)
+func (c *WOFClone) fetchWithMirrors(method string, remote string) (*http.Response, string, error) {
 
-		write_err := ioutil.WriteFile(local, contents, 0644)
+	if !strings.HasPrefix(remote, c.Source) {
+		rsp, err := c.fetch(method, remote)
+		return rsp, c.Source, err
+	}
 
-		atomic.AddInt64(&c.Filehandles, -1)
+	rel_path := strings.TrimPrefix(remote, c.Source)
 
-		if write_err != nil {
+	rsp, err := c.fetch(method, c.remoteURL(c.Source, rel_path))
 
-			c.Logger.Error("Failed to write %s, because %v", local, write_err)
-			c.SetMaxFilehandles()
+	if err == nil {
+		return rsp, c.Source, nil
+	}
+
+	if len(c.Mirrors) == 0 {
+		return nil, "", err
+	}
 
-			atomic.AddInt64(&c.Success, -1)
-			atomic.AddInt64(&c.Error, 1)
+	for i, mirror := range c.Mirrors {
 
-			return write_err
+		if !errors.Is(err, ErrNotFound) && !c.isRetryable(err, i+1) {
+			break
 		}
 
-		c.Logger.Debug("Wrote %s to disk", local)
-		return nil
+		c.Logger.Warning("Failed to %s %s from %s, trying mirror %s", method, rel_path, c.Source, mirror)
 
-	}(c.writesync, local, contents)
+		rsp, err = c.fetch(method, c.remoteURL(mirror, rel_path))
 
-	return nil
+		if err == nil {
+			return rsp, mirror, nil
+		}
+
+		var fetch_err *FetchError
+
+		if errors.As(err, &fetch_err) {
+			fetch_err.Attempt = i + 2
+		}
+	}
+
+	return nil, "", err
 }
 
-func (c *WOFClone) Fetch(method string, remote string) (*http.Response, error) {
+// fetch returns a *FetchError if the request fails or doesn't return a 200 response.
+
+func (c *WOFClone) fetch(method string, remote string) (*http.Response, error) {
+
+	return c.fetchWithHeader(method, remote, nil)
+}
+
+// fetchWithHeader is like fetch but adds header to the request. If header contains
+// a Range header then a 206 (Partial Content) response is also acceptable.
+
+func (c *WOFClone) fetchWithHeader(method string, remote string, header http.Header) (*http.Response, error) {
 
 	/*
 	  See notes in NewWOFClone for details on what's going on here. Given that
@@ -548,16 +2123,29 @@ func (c *WOFClone) Fetch(method string, remote string) (*http.Response, error) {
 		c.Logger.Debug("remote is now %s", remote)
 	}
 
-	c.Logger.Debug("%s %s", method, remote)
+	if c.debugging() {
+		c.Logger.Debug("%s %s", method, remote)
+	}
 
 	req, _ := http.NewRequest(method, remote, nil)
-	req.Close = true
+	req = req.WithContext(c.ctx)
+
+	_, req.Close = c.clientFor(req)
+
+	// Note that we never log the request headers since they may well contain
+	// credentials - don't change that without thinking about it first
+
+	c.PrepareRequest(req)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	// OPEN FH
 
 	atomic.AddInt64(&c.Filehandles, 1)
 
-	rsp, err := c.client.Do(req)
+	rsp, release, err := c.do(req)
 
 	atomic.AddInt64(&c.Filehandles, -1)
 
@@ -569,7 +2157,14 @@ func (c *WOFClone) Fetch(method string, remote string) (*http.Response, error) {
 			c.SetMaxFilehandles()
 		}
 
-		return nil, err
+		fetch_err := &FetchError{
+			Method:  method,
+			URL:     remote,
+			Attempt: 1,
+			Err:     err,
+		}
+
+		return nil, fetch_err
 	}
 
 	// Notice how we are not closing rsp.Body - that's because we are passing
@@ -577,22 +2172,206 @@ func (c *WOFClone) Fetch(method string, remote string) (*http.Response, error) {
 
 	// See also: https://github.com/whosonfirst/go-whosonfirst-clone/issues/6
 
-	expected := 200
+	rsp.Body = &releaseOnClose{rsp.Body, release}
 
-	if rsp.StatusCode != expected {
+	if rsp.StatusCode == 206 && header.Get("Range") != "" {
+		return rsp, nil
+	}
 
-		rsp.Body.Close()
+	action := c.statusAction(rsp.StatusCode)
 
-		c.Logger.Error("Failed to %s %s, because we expected %d from source and got '%s' instead", method, remote, expected, rsp.Status)
+	// A 206 we didn't ask for is only any use if it has the whole file - anything
+	// less would be written out as a truncated copy (see status.go)
 
-		if u.Scheme == "file" {
-			c.SetMaxFilehandles()
-		}
+	if rsp.StatusCode == 206 && (action == StatusAccept || action == StatusAcceptWarn) && !isWholeContentRange(rsp) {
+		action = StatusRetryable
+	}
+
+	switch action {
+	case StatusAccept:
+		return rsp, nil
+	case StatusAcceptWarn:
+		c.Logger.Warning("Accepting '%s' for %s %s, although we expected 200 from source", rsp.Status, method, remote)
+		return rsp, nil
+	}
+
+	rsp.Body.Close()
+
+	if action == StatusNotModified {
+		c.Logger.Debug("Source says %s has not been modified ('%s')", remote, rsp.Status)
+	} else {
+		c.Logger.Error("Failed to %s %s, because we expected 200 from source and got '%s' instead", method, remote, rsp.Status)
+	}
+
+	if u.Scheme == "file" {
+		c.SetMaxFilehandles()
+	}
+
+	fetch_err := &FetchError{
+		Method:     method,
+		URL:        remote,
+		StatusCode: rsp.StatusCode,
+		Status:     rsp.Status,
+		Attempt:    1,
+		Action:     action,
+	}
+
+	return nil, fetch_err
+}
+
+// AddMirror adds a fallback source to try when a file can not be retrieved from
+// c.Source. Mirrors are tried in the order they were added and, like c.Source,
+// should be an http or https URL ending in a "/".
+
+func (c *WOFClone) AddMirror(source string) error {
+
+	u, err := url.Parse(source)
+
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Unsupported mirror scheme '%s'", u.Scheme)
+	}
+
+	c.Mirrors = append(c.Mirrors, source)
+	return nil
+}
+
+// SetTLSConfig installs cfg on the transport used for all requests made by this
+// instance. It should be called before any cloning starts.
+
+func (c *WOFClone) SetTLSConfig(cfg *tls.Config) {
+
+	c.transport.TLSClientConfig = cfg
+}
+
+// SetCABundle adds the PEM-encoded certificates in path to the system certificate
+// pool and uses the result to verify remote servers.
+
+func (c *WOFClone) SetCABundle(path string) error {
+
+	pem, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	roots, err := x509.SystemCertPool()
+
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("Failed to parse any certificates from %s", path)
+	}
+
+	cfg := c.tlsConfig()
+	cfg.RootCAs = roots
+
+	return nil
+}
+
+// SetInsecureSkipVerify disables (or re-enables) verification of remote
+// certificates. You should not do this unless you really, really know what
+// you are doing.
+
+func (c *WOFClone) SetInsecureSkipVerify(skip bool) {
+
+	if skip {
+		c.Logger.Warning("TLS certificate verification is DISABLED for requests to %s", c.Source)
+	}
+
+	cfg := c.tlsConfig()
+	cfg.InsecureSkipVerify = skip
+}
+
+// SetProxy routes all requests made by this instance through the proxy at uri,
+// which may be an http, https or socks5 URL. Passing an empty string restores
+// the default behaviour of honouring the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. Other clients in the same process are not affected.
+
+func (c *WOFClone) SetProxy(uri string) error {
+
+	if uri == "" {
+		c.transport.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		// pass
+	default:
+		return fmt.Errorf("Unsupported proxy scheme '%s'", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("Invalid proxy URL, missing host")
+	}
+
+	c.transport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+func (c *WOFClone) tlsConfig() *tls.Config {
+
+	if c.transport.TLSClientConfig == nil {
+		c.transport.TLSClientConfig = &tls.Config{}
+	}
+
+	return c.transport.TLSClientConfig
+}
+
+func (c *WOFClone) SetBasicAuth(username string, password string) {
+
+	c.auth_user = username
+	c.auth_password = password
+}
+
+func (c *WOFClone) SetBearerToken(token string) {
+
+	c.auth_token = token
+}
+
+// PrepareRequest applies any custom headers, credentials and request hook to req.
+// It is called by Fetch for every request (including retries) so you shouldn't
+// need to call it yourself unless you are building requests by hand.
+
+func (c *WOFClone) PrepareRequest(req *http.Request) {
+
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if c.auth_user != "" || c.auth_password != "" {
+		req.SetBasicAuth(c.auth_user, c.auth_password)
+	}
 
-		return nil, errors.New(rsp.Status)
+	if c.auth_token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.auth_token)
 	}
 
-	return rsp, nil
+	if c.RequestHook != nil {
+		c.RequestHook(req)
+	}
+
+	// Signing has to happen last since it depends on the final URL
+
+	if c.s3 != nil {
+		c.s3.sign(req, time.Now())
+	}
 }
 
 func (c *WOFClone) SetMaxFilehandles() {
@@ -637,21 +2416,100 @@ func (c *WOFClone) EnsureFilehandles() {
 	}
 }
 
+// Status logs the current counters. It is called every second while a run is in
+// progress, and once more when it ends, but is safe to call at any time from any
+// goroutine. If c isn't in the middle of a run of its own but is cloning meta files,
+// each in a session (see newSession), it logs the status of each of those instead.
+
 func (c *WOFClone) Status() {
 
+	c.run_mu.Lock()
+
 	t2 := time.Since(c.timer)
+	running := c.run != nil
+
+	sessions := make([]*WOFClone, 0, len(c.sessions))
+
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+
+	c.run_mu.Unlock()
+
+	if !running && len(sessions) > 0 {
+
+		for _, s := range sessions {
+			s.Status()
+		}
+
+		return
+	}
 
 	scheduled := atomic.LoadInt64(&c.Scheduled)
 	completed := atomic.LoadInt64(&c.Completed)
 	success := atomic.LoadInt64(&c.Success)
 	error := atomic.LoadInt64(&c.Error)
+	permanent := atomic.LoadInt64(&c.PermanentErrors)
 	skipped := atomic.LoadInt64(&c.Skipped)
 
 	current_fh := atomic.LoadInt64(&c.Filehandles)
 	max_fh := atomic.LoadInt64(&c.MaxFilehandles)
 
-	c.Logger.Info("scheduled: %d completed: %d success: %d error: %d skipped: %d to retry: %d goroutines: %d filehandles: %d/%d time: %v",
-		scheduled, completed, success, error, skipped, c.retries.Length(), runtime.NumGoroutine(), current_fh, max_fh, t2)
+	ignored := atomic.LoadInt64(&c.Ignored)
+	too_old := atomic.LoadInt64(&c.TooOld)
+	excluded := atomic.LoadInt64(&c.Excluded)
+	truncated := atomic.LoadInt64(&c.Truncated)
+	too_large := atomic.LoadInt64(&c.SkippedTooLarge)
+	missing_path := atomic.LoadInt64(&c.MissingPath)
+	local_newer := atomic.LoadInt64(&c.LocalNewer)
+	skipped_manifest := atomic.LoadInt64(&c.SkippedManifest)
+	unknown := atomic.LoadInt64(&c.UnknownChange)
+	linked := atomic.LoadInt64(&c.Linked)
+	in_flight := atomic.LoadInt64(&c.totals.InFlight)
+	queued := atomic.LoadInt64(&c.totals.Queued)
+
+	format := "scheduled: %d completed: %d success: %d (linked: %d) error: %d (permanent: %d) skipped: %d (too large: %d local newer: %d manifest: %d) unknown changes: %d ignored: %d too old: %d excluded: %d missing path: %d truncated: %d to retry: %d in flight: %d queued: %d goroutines: %d filehandles: %d/%d time: %v"
+	args := []interface{}{scheduled, completed, success, linked, error, permanent, skipped, too_large, local_newer, skipped_manifest, unknown, ignored, too_old, excluded, missing_path, truncated, c.retries.Length(), in_flight, queued, runtime.NumGoroutine(), current_fh, max_fh, t2}
+
+	// Everything goes in one message, rather than one per thing, so that the status
+	// takes a single trip through the Logger however much there is to report
+
+	if th := c.throttle; th != nil {
+		limit, delay := th.state()
+		format += " throttle: %d concurrent requests, %v delay"
+		args = append(args, limit, delay)
+	}
+
+	// See window.go
+
+	if until := c.pausedUntil(); !until.IsZero() {
+		format = "paused until %s (outside the active window), " + format
+		args = append([]interface{}{until.Format(time.RFC3339)}, args...)
+	}
+
+	// See progress.go
+
+	if p := c.progress; p != nil {
+		format += " %s"
+		args = append(args, p.status(c.rowsDone(), completed-skipped))
+	}
+
+	// The Logger adds the run's label itself, see logger.go
+
+	if c.StatusWriter != nil && c.run_label != "" {
+		format = "[%s] " + format
+		args = append([]interface{}{c.run_label}, args...)
+	}
+
+	if c.StatusWriter != nil {
+		fmt.Fprintf(c.StatusWriter, format+"\n", args...)
+	} else {
+		c.Logger.Info(format, args...)
+	}
+
+	if !c.debugging() {
+		return
+	}
 
 	// https://deferpanic.com/blog/understanding-golang-memory-usage/
 	// https://golang.org/pkg/runtime/#MemStats
@@ -2,13 +2,56 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/whosonfirst/go-whosonfirst-clone"
 	"github.com/whosonfirst/go-whosonfirst-log"
 	"io"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+
+	pairs := make([]string, 0)
+
+	for k := range h {
+		pairs = append(pairs, k)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlags) Set(value string) error {
+
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid header '%s', expected 'Name: value'", value)
+	}
+
+	k := strings.TrimSpace(parts[0])
+	v := strings.TrimSpace(parts[1])
+
+	h[k] = v
+	return nil
+}
+
+type multiFlags []string
+
+func (m *multiFlags) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlags) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
 func main() {
 
 	/*
@@ -20,39 +63,471 @@ func main() {
 	var source = flag.String("source", "https://s3.amazonaws.com/whosonfirst.mapzen.com/data/", "Where to look for files")
 	var dest = flag.String("dest", "", "Where to write files")
 	var procs = flag.Int("procs", (runtime.NumCPU() * 2), "The number of concurrent processes to clone data with")
+	var check_workers = flag.Int("check-workers", 200, "The number of files to check for changes concurrently")
+	var fetch_workers = flag.Int("fetch-workers", 100, "The number of files to fetch concurrently")
+	var meta_workers = flag.Int("meta-workers", 1, "The number of meta files to clone concurrently")
 	var loglevel = flag.String("loglevel", "info", "The level of detail for logging")
 	var skip_existing = flag.Bool("skip-existing", false, "Skip existing files on disk (without checking for remote changes)")
 	var force_updates = flag.Bool("force-updates", false, "Force updates to files on disk (without checking for remote changes)")
+	var path_column = flag.String("path-column", "path", "The name of the meta file column containing relative paths")
+	var hash_column = flag.String("hash-column", "file_hash", "The name of the meta file column containing file hashes (see -hash-algorithm)")
+	var hash_algorithm = flag.String("hash-algorithm", "md5", "The algorithm used to hash files: md5, sha1 or sha256")
+	var hash_source = flag.String("hash-source", "", "Where the expected hash of each file comes from: column, sidecar or etag. By default file_hash columns are compared with ETags")
+	var hash_sidecar_url = flag.String("hash-sidecar-url", "", "The URL of each file's sidecar hash file when -hash-source is 'sidecar', for example '{url}.sha256'. '{url}' and '{path}' are replaced by the file's URL and relative path")
+	var size_column = flag.String("size-column", "", "The name of the meta file column containing file sizes. Defaults to 'size' or 'filesize', whichever is present")
+	var lastmod_column = flag.String("lastmodified-column", "lastmodified", "The name of the meta file column containing last modified times")
+	var alt_column = flag.String("alt-paths-column", "", "The name of a meta file column listing alternate geometry files to clone alongside each record")
+	var since = flag.String("since", "", "Only clone rows whose lastmodified column is at or after this time, as an RFC 3339 string or a Unix timestamp")
+	var since_exclude_undated = flag.Bool("since-exclude-undated", false, "Leave out rows with no (or an invalid) lastmodified value when -since is set, rather than cloning them")
+	var exclude_file = flag.String("exclude-file", "", "The path to a file listing relative paths and IDs (one per line) that should never be cloned")
+	var use_lastmod = flag.Bool("use-lastmodified", false, "Skip existing files whose modification time is newer than the meta file's lastmodified column, without checking the source for changes")
+	var max_files = flag.Int64("max-files", 0, "Stop scheduling new files after this many have been fetched from each meta file. Zero means no limit")
+	var sample_rate = flag.Float64("sample-rate", 0.0, "Only consider this fraction (0.0 - 1.0) of the rows in each meta file. Zero means all of them")
+	var sample_seed = flag.Int64("sample-seed", 0, "The seed used to pick rows when -sample-rate is set")
+	var max_errors = flag.Int64("max-errors", 0, "Abort cloning a meta file as soon as this many errors have occurred. Zero means keep going (and retry failures at the end)")
+	var max_retries_min = flag.Int64("max-retries-min-scheduled", 1000, "Abort cloning a meta file as soon as more than 25 percent of the files scheduled so far have failed with retryable errors (not 404s and the like), once this many have been scheduled. Zero means only check once every file has been scheduled")
+	var max_failure_records = flag.Int("max-failure-records", 10000, "The most failed files to list in reports and summaries, beyond which they are only counted. Zero means no limit")
+	var max_pending = flag.Int("max-pending-retries", 100000, "Abort cloning a meta file if more than this many files are waiting to be retried. Zero means no limit")
+	var allow_failures = flag.Bool("allow-failures", false, "Don't treat files that are still failing after they have been retried as an error")
+	var fail_fast = flag.Bool("fail-fast", false, "Abort cloning a meta file on the first error. This is the same as -max-errors 1")
+	var data_prefix = flag.String("data-prefix", "", "What to do with the 'data/' prefix some meta files include in their paths: 'strip', 'add' or 'auto' (check the first path and add or remove the prefix if that's what it takes to find it). By default paths are used as is")
+	var dest_template = flag.String("dest-template", "", "Where to store each file under -dest, for example '{basename}' for a flat layout or '{placetype}/{basename}'. {path}, {dir}, {basename} and {id} are derived from the file's path and anything else is a meta file column. By default files are stored at their relative path")
+	var remote_prefix = flag.String("remote-prefix", "", "A prefix to add to each file's path when fetching it, but not when storing it, for example 'archive/2023-06-01/' for a dated snapshot")
+	var manifest = flag.String("manifest", "", "Write a CSV manifest of every file cloned (or skipped) to this path. If more than one meta file is cloned the meta file's basename is appended to the path")
+	var temp_dir = flag.String("temp-dir", "", "Download files here before moving them in to -dest. By default files are downloaded alongside their final location")
+	var timeout = flag.Duration("timeout", 0, "Give up cloning each meta file after this long (for example '2h'). Zero means no limit")
+	var post_verify = flag.Bool("post-verify", false, "Once everything has been cloned read back every file that was written and check it has the hash of what was downloaded. This roughly doubles local I/O")
+	var post_verify_refetch = flag.Bool("post-verify-refetch", false, "Fetch files that fail -post-verify one more time")
+	var head_keep_alive = flag.Bool("head-keep-alive", true, "Reuse connections for the HEAD requests that check whether files have changed")
+	var bundle = flag.String("bundle", "", "Download this bundle (a tar.bz2 file, or a path on disk) and extract it to -dest rather than fetching each file on its own. {meta} is replaced with the name of the meta file and if it ends in '/' then '{meta}-bundle.tar.bz2' is added to it")
+	var bundle_then_sync = flag.Bool("bundle-then-sync", false, "After extracting -bundle clone each meta file as usual to fetch anything that is missing or out of date")
+	var record_decisions = flag.Bool("record-decisions", false, "Record what happened to every file (fetched because it was new, had changed or -force-updates, skipped because it exists or hasn't changed, or failed) in -summary")
+	var reference_dir = flag.String("reference-dir", "", "A previous clone to hardlink (or copy) files from, rather than fetching them, when they haven't changed. Like rsync's --link-dest")
+	var reference_link = flag.String("reference-link", "hardlink", "How to take files from -reference-dir: hardlink, reflink (copy-on-write, where the filesystem supports it) or copy. Each falls back to the next")
+	var group_by = flag.String("group-by", "", "Break the outcomes of each run down by this meta file column (for example placetype or iso), or by the first component of each file's path if it is 'path' or a row doesn't have the column, in -summary and the final log lines")
+	var clobber = flag.Bool("clobber-conflicts", false, "Remove files that are where a directory needs to be, and directories that are where a file needs to be, rather than failing to write those files")
+	var verbose = flag.Bool("verbose", false, "Include how long each file took to check, fetch and process in the debug messages (-loglevel debug)")
+	var incremental_manifest = flag.String("incremental-manifest", "", "A -manifest written by a previous run (it can be the same file). Rows whose file_hash matches it are skipped without checking the source, unless it is missing or out of date")
+	var incremental_max_age = flag.Duration("incremental-max-age", 0, "Don't use an -incremental-manifest older than this (for example '48h'). Zero means any age")
+	var quarantine = flag.Bool("quarantine", false, "Move the local copy of a file out of the way (to <path>.quarantined-<time>) when it has changed but the new version fails -hash-source verification, so that the stale copy isn't mistaken for good data")
+	var quarantine_dir = flag.String("quarantine-dir", "", "Move files quarantined by -quarantine here, keeping their paths, rather than renaming them in place. Implies -quarantine")
+	var force_http1 = flag.Bool("force-http1", false, "Don't use HTTP/2, even if the source supports it. For troubleshooting proxies and other things that break HTTP/2 connections")
+	var skip_preflight = flag.Bool("skip-preflight", false, "Don't check that the first file in each meta file looks right before cloning the rest")
+	var allow_self_clone = flag.Bool("allow-self-clone", false, "Don't refuse to clone from a source (on this machine) that is, or serves files from, the destination")
+	var probe_self_clone = flag.Bool("probe-self-clone", false, "Check whether an HTTP source on this machine serves files from the destination, by writing a probe file there (it is removed again)")
+	var active_window = flag.String("active-window", "", "Only send requests between these times of day (HH:MM-HH:MM, in UTC), pausing otherwise")
+	var strict_meta = flag.Bool("strict-meta-files", false, "Stop reading a meta file at the first malformed row, rather than skipping it")
+	var fix_permissions = flag.Bool("fix-permissions", false, "Change the mode of existing files that can't be read because of their permissions to 0644, rather than failing them")
+	var allow_empty_bodies = flag.Bool("allow-empty-bodies", false, "Don't fail GeoJSON files that the source sends with an empty body")
+	var record_provenance = flag.Bool("record-provenance", false, "Record the ETag and Last-Modified header each file was fetched with (in extended attributes, where supported) and use them to skip unchanged files without reading them")
+	var write_if_different = flag.Bool("write-if-different", false, "Leave local files alone, rather than writing them again, when what is fetched (even with -force-updates) is the same")
+	var detect_false_changes = flag.Bool("detect-false-changes", false, "Compare changed files with the local copy once they have been fetched and leave it alone if they are the same")
+	var allow_empty = flag.Bool("allow-empty", false, "Don't fail meta files that have no rows (or none with a path)")
+	var max_bad_rows = flag.Int64("max-bad-rows", 0, "Fail if a meta file has more than this many malformed rows. Zero means no limit")
+	var max_bad_rows_rate = flag.Float64("max-bad-rows-rate", 0.0, "Fail if more than this fraction (0.0 - 1.0) of the rows in a meta file are malformed. Zero means no limit")
+	var unknown_changes = flag.String("unknown-changes", "fetch", "What to do with files when it isn't possible to tell whether they have changed: fetch, skip or fail")
+	var unreadable_local = flag.String("unreadable-local", "fetch", "What to do with existing files that can't be read: fetch them again or fail them, so they can be looked at")
+	var protect_newer = flag.Bool("protect-newer-local", false, "Don't update files that have changed if the local copy was modified more recently than the source's (according to its Last-Modified header). -force-updates overrides this")
+	var lastmod_tolerance = flag.Duration("lastmodified-tolerance", 5*time.Minute, "Ignore Last-Modified headers further in the future than this, as well as ones that are the Unix epoch")
+	var trace_requests = flag.Bool("trace-requests", false, "Time the DNS, connect, TLS, wait and body phases of every request, and log them at debug level if -verbose is set. Also count the connections opened and reused, and the protocol each request used")
+	var status_interval = flag.Duration("status-interval", 1*time.Second, "How often to log the progress of each run. A negative value means never, the summary at the end of each run is always logged")
+	var status_stderr = flag.Bool("status-stderr", false, "Write the progress of each run to STDERR instead of logging it")
+	var run_label = flag.String("run-label", "", "Prefix every log and status line with this label, to tell apart several clones logging to the same place")
+	var label_logs = flag.Bool("label-logs", false, "Prefix every log and status line with the name of the meta file being cloned, unless -run-label is set")
+	var log_timings = flag.Bool("log-timings", false, "Log a histogram of download times, and the slowest and largest files, at the end of each run")
+	var updated_meta = flag.String("updated-meta", "", "Write a copy of each meta file, with its file_hash, size and lastmodified columns updated to match the files on disk, to this path. If more than one meta file is cloned the meta file's basename is appended to the path")
+	var updated_meta_status = flag.Bool("updated-meta-status", false, "Keep rows for files that could not be cloned in the updated meta file and add a clone_status column, rather than leaving them out")
+	var summary = flag.String("summary", "", "Write a JSON summary of each run to this path, whether or not it succeeded. If more than one meta file is cloned the meta file's basename is appended to the path")
+	var verify = flag.Bool("verify", false, "Verify the files in -dest against each meta file instead of cloning anything")
+	var verify_etags = flag.Bool("verify-etags", false, "When verifying, compare files against the source's ETag header for meta files without a file_hash column")
+	var validate_ids = flag.Bool("validate-ids", false, "Warn about meta file rows whose id and path columns disagree")
+	var reject_ids = flag.Bool("reject-id-mismatches", false, "Don't clone meta file rows whose id and path columns disagree, and count them as errors. Implies -validate-ids")
+	var min_size = flag.Int64("min-existing-size", 0, "Fetch existing files that are smaller than this many bytes again, even with -skip-existing. Empty files are always fetched again")
+	var validate_json = flag.Bool("validate-json", false, "Fetch existing .geojson and .json files that don't parse as JSON again, even with -skip-existing, and refuse to write downloads of them that don't parse as JSON")
+	var prescan_dest = flag.Bool("prescan-dest", false, "Find out which files are already in -dest by walking it once at the start, rather than checking each file separately. Quicker on network filesystems")
+	var adaptive = flag.Bool("adaptive-throttle", false, "Reduce the number of concurrent requests, and add a delay between them, when the source starts returning errors")
+	var throttle_rate = flag.Float64("throttle-error-rate", 0.2, "The error rate, over the last -throttle-window requests, above which -adaptive-throttle kicks in")
+	var throttle_window = flag.Int("throttle-window", 100, "The number of recent requests that -adaptive-throttle considers")
+	var throttle_min = flag.Int("throttle-min-concurrency", 1, "The fewest concurrent requests -adaptive-throttle will reduce to")
+	var throttle_delay = flag.Duration("throttle-max-delay", 5*time.Second, "The longest delay -adaptive-throttle will add before each request")
+	var max_host_conns = flag.Int("max-conns-per-host", 0, "The maximum number of concurrent requests to any one host. Zero means no limit")
+	var max_size = flag.Int64("max-file-size", 0, "Skip files larger than this many bytes. Zero means no limit")
+	var skip_unknown = flag.Bool("skip-unknown-size", false, "When -max-file-size is set, also skip files whose size can not be determined")
+	var order = flag.String("order", "", "Schedule rows by the size in the meta file, either 'largest-first' or 'smallest-first', instead of in the order they are read")
+	var resume = flag.Bool("resume", false, "Keep partial downloads and resume them using HTTP Range requests when they are retried")
+	var compress = flag.Bool("compress", false, "Store files gzip-compressed, as <path>.gz")
 	var strict = flag.Bool("strict", false, "Exit (1) if any meta file fails cloning")
 
+	headers := make(headerFlags)
+	flag.Var(headers, "header", "An additional 'Name: value' HTTP header to send with every request. May be passed multiple times")
+
+	var mirrors multiFlags
+	flag.Var(&mirrors, "mirror", "A fallback source to try when a file can not be retrieved from -source. May be passed multiple times")
+
+	var status_actions multiFlags
+	flag.Var(&status_actions, "status-action", "Treat responses with a given status code differently, as 'CODE=ACTION' where ACTION is one of accept, accept-with-warning, not-modified, retryable-error or permanent-error. May be passed multiple times")
+
+	var allowed_extensions multiFlags
+	flag.Var(&allowed_extensions, "allowed-extension", "Only clone files with this extension (for example .geojson), failing rows for any others. May be passed multiple times")
+
+	var force_paths multiFlags
+	flag.Var(&force_paths, "force-path", "Force updates to files whose path starts with, or matches as a glob pattern, this value (without checking for remote changes). May be passed multiple times")
+
+	var github_repo = flag.String("github-repo", "", "Clone files from a GitHub repository, as 'owner/repo', instead of -source. Use -bearer-token for private repositories")
+	var github_branch = flag.String("github-branch", "master", "The branch to clone from when -github-repo is set")
+	var github_prefix = flag.String("github-prefix", "data/", "The directory, within -github-repo, that paths in meta files are relative to")
+
+	var s3_bucket = flag.String("s3-bucket", "", "Clone files from an S3 bucket, instead of -source. Credentials are read from the usual AWS environment variables or shared credentials file")
+	var s3_prefix = flag.String("s3-prefix", "data/", "The key prefix, within -s3-bucket, that paths in meta files are relative to")
+	var s3_region = flag.String("s3-region", "", "The region of -s3-bucket. Defaults to AWS_REGION or us-east-1")
+	var s3_endpoint = flag.String("s3-endpoint", "", "The endpoint of an S3-compatible service, like MinIO, to use instead of AWS")
+	var s3_metadata_key = flag.String("s3-metadata-key", "md5", "The object metadata key containing each file's MD5 hash")
+
+	var basic_auth = flag.String("basic-auth", "", "A 'username:password' string to use for HTTP basic authentication")
+	var bearer_token = flag.String("bearer-token", "", "A token to send as an HTTP 'Authorization: Bearer' header")
+	var user_agent = flag.String("user-agent", "", "An additional string to append to the default User-Agent header (for example, to identify a particular pipeline)")
+	var ca_bundle = flag.String("ca-bundle", "", "The path to a PEM-encoded bundle of additional certificate authorities to trust")
+	var insecure = flag.Bool("insecure-skip-verify", false, "Do not verify TLS certificates. This is dangerous and you should not use it unless you really know what you are doing")
+	var proxy = flag.String("proxy", "", "The URL of an http, https or socks5 proxy to use for all requests. If empty the HTTP_PROXY and HTTPS_PROXY environment variables are honoured")
+	var unix_socket = flag.String("unix-socket", "", "The path to a Unix domain socket to send every request through, for example a local proxy sidecar")
+	var max_redirects = flag.Int("max-redirects", 0, "The maximum number of redirects to follow for a single request. Zero means the default (10) and a negative number means never follow redirects")
+	var refuse_cross_host = flag.Bool("refuse-cross-host-redirects", false, "Do not follow redirects to a different host")
+	var version = flag.Bool("version", false, "Print the version of go-whosonfirst-clone and exit")
+
 	flag.Parse()
 	args := flag.Args()
 
+	if *version {
+		fmt.Println(clone.Version())
+		os.Exit(0)
+	}
+
 	writer := io.MultiWriter(os.Stdout)
 
 	logger := log.NewWOFLogger("[wof-clone-metafiles] ")
 	logger.AddLogger(writer, *loglevel)
 
-	cl, err := clone.NewWOFClone(*source, *dest, *procs, logger)
+	// Verifying doesn't write anything so -dest doesn't need to be writable, or exist
+
+	new_clone := clone.NewValidatedWOFClone
+
+	if *verify {
+		new_clone = clone.NewWOFClone
+	}
+
+	// NewWOFClone leaves this to us since it affects the whole process
+
+	runtime.GOMAXPROCS(*procs)
+
+	cl, err := new_clone(*source, *dest, *procs, logger)
 
 	if err != nil {
 		logger.Error("failed to create new Clone instance, because %v", err)
 		os.Exit(1)
 	}
 
-	for _, file := range args {
+	cl.Headers = headers
+	cl.CheckWorkers = *check_workers
+	cl.MaxRedirects = *max_redirects
+	cl.RefuseCrossHostRedirects = *refuse_cross_host
+	cl.FetchWorkers = *fetch_workers
+	cl.MetaFileWorkers = *meta_workers
+	cl.UseLastModified = *use_lastmod
+	cl.SinceExcludeUndated = *since_exclude_undated
+	cl.ExcludeFile = *exclude_file
+	cl.ForcePaths = force_paths
+	cl.PathColumn = *path_column
+	cl.HashColumn = *hash_column
+	cl.DestTemplate = *dest_template
+	cl.RemotePrefix = *remote_prefix
+	cl.DataPrefix = *data_prefix
+	cl.HashAlgorithm = *hash_algorithm
+	cl.HashSource = *hash_source
+	cl.HashSidecarURL = *hash_sidecar_url
+	cl.SizeColumn = *size_column
+	cl.LastModifiedColumn = *lastmod_column
+	cl.AltPathsColumn = *alt_column
+	cl.MaxFiles = *max_files
+	cl.SampleRate = *sample_rate
+	cl.SampleSeed = *sample_seed
+	cl.MaxErrors = *max_errors
+	cl.MaxPendingRetries = *max_pending
+	cl.MaxRetriesMinScheduled = *max_retries_min
+	cl.MaxFailureRecords = *max_failure_records
+	cl.AllowFailures = *allow_failures
+	cl.CompressLocal = *compress
+	cl.ResumeDownloads = *resume
+	cl.MaxFileSize = *max_size
+	cl.RowOrder = *order
+	cl.MaxConnsPerHost = *max_host_conns
+	cl.AdaptiveThrottle = *adaptive
+	cl.ThrottleErrorRate = *throttle_rate
+	cl.ThrottleWindow = *throttle_window
+	cl.ThrottleMinConcurrency = *throttle_min
+	cl.ThrottleMaxDelay = *throttle_delay
+	cl.MinExistingSize = *min_size
+	cl.TempDir = *temp_dir
+	cl.Timeout = *timeout
+	cl.LogTimings = *log_timings
+	cl.StatusInterval = *status_interval
+	cl.TraceRequests = *trace_requests
+	cl.ProtectNewerLocal = *protect_newer
+	cl.LastModifiedTolerance = *lastmod_tolerance
+	cl.UnknownChanges = *unknown_changes
+	cl.UnreadableLocal = *unreadable_local
+	cl.FixPermissions = *fix_permissions
+	cl.StrictMetaFiles = *strict_meta
+	cl.AllowEmpty = *allow_empty
+	cl.AllowEmptyBodies = *allow_empty_bodies
+	cl.DetectFalseChanges = *detect_false_changes
+	cl.WriteIfDifferent = *write_if_different
+	cl.RecordProvenance = *record_provenance
+	cl.SkipPreflight = *skip_preflight
+	cl.AllowSelfClone = *allow_self_clone
+	cl.ProbeSelfClone = *probe_self_clone
+	cl.ActiveWindow = *active_window
+	cl.QuarantineFailures = *quarantine || *quarantine_dir != ""
+	cl.QuarantineDir = *quarantine_dir
+	cl.IncrementalManifest = *incremental_manifest
+	cl.IncrementalMaxAge = *incremental_max_age
+	cl.Verbose = *verbose
+	cl.RunLabel = *run_label
+	cl.LabelLogs = *label_logs
+	cl.ClobberConflicts = *clobber
+	cl.GroupBy = *group_by
+	cl.LogGroups = *group_by != ""
+	cl.ReferenceDir = *reference_dir
+	cl.ReferenceLink = *reference_link
+	cl.RecordDecisions = *record_decisions
+	cl.Bundle = *bundle
+	cl.BundleThenSync = *bundle_then_sync
+	cl.HeadKeepAlive = *head_keep_alive
+	cl.MaxBadRows = *max_bad_rows
+	cl.MaxBadRowsRate = *max_bad_rows_rate
+	cl.PostVerify = *post_verify || *post_verify_refetch
+	cl.PostVerifyRefetch = *post_verify_refetch
+	cl.UpdatedMetaStatus = *updated_meta_status
+	cl.ValidateJSON = *validate_json
+	cl.AllowedExtensions = allowed_extensions
+	cl.PrescanDest = *prescan_dest
+	cl.ValidateIds = *validate_ids || *reject_ids
+	cl.RejectIdMismatches = *reject_ids
+	cl.SkipUnknownSize = *skip_unknown
+
+	if *fail_fast {
+		cl.MaxErrors = 1
+	}
+
+	if *status_stderr {
+		cl.StatusWriter = os.Stderr
+	}
+
+	for _, m := range mirrors {
+
+		err := cl.AddMirror(m)
+
+		if err != nil {
+			logger.Error("invalid mirror %s, because %v", m, err)
+			os.Exit(1)
+		}
+	}
+
+	for _, a := range status_actions {
+
+		code, action, err := clone.ParseStatusAction(a)
+
+		if err != nil {
+			logger.Error("invalid status action %s, because %v", a, err)
+			os.Exit(1)
+		}
+
+		if cl.StatusActions == nil {
+			cl.StatusActions = make(map[int]clone.StatusAction)
+		}
+
+		cl.StatusActions[code] = action
+	}
+
+	if *ca_bundle != "" {
+
+		err := cl.SetCABundle(*ca_bundle)
+
+		if err != nil {
+			logger.Error("failed to load CA bundle %s, because %v", *ca_bundle, err)
+			os.Exit(1)
+		}
+	}
+
+	if *insecure {
+		cl.SetInsecureSkipVerify(true)
+	}
+
+	if *force_http1 {
+		cl.SetForceHTTP1(true)
+	}
+
+	if *proxy != "" {
+
+		err := cl.SetProxy(*proxy)
+
+		if err != nil {
+			logger.Error("invalid proxy, because %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *since != "" {
 
-		err := cl.CloneMetaFile(file, *skip_existing, *force_updates)
+		t, err := time.Parse(time.RFC3339, *since)
 
 		if err != nil {
-			logger.Error("failed to clone %s, because %v", file, err)
 
-			if *strict {
+			ts, ts_err := strconv.ParseInt(*since, 10, 64)
+
+			if ts_err != nil {
+				logger.Error("invalid -since time '%s', expected an RFC 3339 string or a Unix timestamp", *since)
 				os.Exit(1)
 			}
+
+			t = time.Unix(ts, 0)
+		}
+
+		cl.Since = t
+	}
+
+	if *unix_socket != "" {
+
+		err := cl.SetUnixSocket(*unix_socket)
+
+		if err != nil {
+			logger.Error("invalid Unix socket, because %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *user_agent != "" {
+		cl.UserAgent = fmt.Sprintf("%s %s", cl.UserAgent, *user_agent)
+	}
+
+	if *basic_auth != "" {
+
+		parts := strings.SplitN(*basic_auth, ":", 2)
+
+		if len(parts) != 2 {
+			logger.Error("invalid -basic-auth string, expected 'username:password'")
+			os.Exit(1)
+		}
+
+		cl.SetBasicAuth(parts[0], parts[1])
+	}
+
+	if *bearer_token != "" {
+		cl.SetBearerToken(*bearer_token)
+	}
+
+	if *s3_bucket != "" {
+
+		s3_source := clone.S3Source{
+			Bucket:      *s3_bucket,
+			Prefix:      *s3_prefix,
+			Region:      *s3_region,
+			Endpoint:    *s3_endpoint,
+			MetadataKey: *s3_metadata_key,
+		}
+
+		err := cl.SetS3Source(s3_source)
+
+		if err != nil {
+			logger.Error("failed to set S3 source, because %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *github_repo != "" {
+
+		parts := strings.SplitN(*github_repo, "/", 2)
+
+		if len(parts) != 2 {
+			logger.Error("invalid -github-repo string, expected 'owner/repo'")
+			os.Exit(1)
+		}
+
+		err := cl.SetGitHubSource(parts[0], parts[1], *github_branch, *github_prefix)
+
+		if err != nil {
+			logger.Error("failed to set GitHub source, because %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *verify {
+
+		ok := true
+
+		files := make([]string, 0)
+
+		for _, path := range args {
+
+			matches, err := clone.MetaFiles(path)
+
+			if err != nil {
+				logger.Error("failed to find meta files in %s, because %v", path, err)
+				ok = false
+				continue
+			}
+
+			files = append(files, matches...)
+		}
+
+		for _, file := range files {
+
+			rpt, err := cl.Verify(file, *verify_etags)
+
+			if err != nil {
+				logger.Error("failed to verify %s, because %v", file, err)
+				ok = false
+			}
+
+			if rpt == nil {
+				continue
+			}
+
+			for _, p := range rpt.Missing {
+				logger.Warning("missing %s", p)
+			}
+
+			for _, p := range rpt.Mismatched {
+				logger.Warning("mismatched %s", p)
+			}
+
+			for _, p := range rpt.Unknown {
+				logger.Warning("unable to verify %s", p)
+			}
+		}
+
+		if !ok {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// When there is more than one meta file (including the meta files in a directory)
+	// these are suffixed with the name of each one, see CloneMetaFiles
+
+	cl.ManifestPath = *manifest
+	cl.UpdatedMetaPath = *updated_meta
+	cl.SummaryPath = *summary
+
+	err = cl.CloneMetaFiles(args, *skip_existing, *force_updates)
+
+	if err != nil {
+		logger.Error("failed to clone meta files, because %v", err)
+
+		if *strict {
+			os.Exit(1)
 		}
 	}
 
-	cl.Status()
 	os.Exit(0)
 }
@@ -0,0 +1,136 @@
+package clone
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const compressed_suffix = ".gz"
+
+// LocalPath returns the path that rel_path is (or will be) stored at on disk. See also
+// DestPath and DestTemplate.
+
+func (c *WOFClone) LocalPath(rel_path string) string {
+
+	return c.localPath(c.localRelPath(rel_path))
+}
+
+// localPath returns the path on disk for dest_rel, a path relative to Dest.
+
+func (c *WOFClone) localPath(dest_rel string) string {
+
+	local := path.Join(c.Dest, dest_rel)
+
+	if c.CompressLocal {
+		local = local + compressed_suffix
+	}
+
+	return local
+}
+
+// hashLocal returns the hash (see HashAlgorithm) of the (uncompressed) contents of local,
+// so that compressed files can still be compared against file_hash columns and ETags.
+
+func (c *WOFClone) hashLocal(local string) (string, error) {
+
+	return c.hashLocalAs(local, c.hashAlgorithm())
+}
+
+func (c *WOFClone) hashLocalAs(local string, algorithm string) (string, error) {
+
+	return c.hashLocalRetrying(local, func() (string, error) {
+
+		if !c.CompressLocal {
+			return hashFile(local, algorithm)
+		}
+
+		body, err := c.readLocal(local)
+
+		if err != nil {
+			return "", err
+		}
+
+		return hashBytes(body, algorithm), nil
+	})
+}
+
+// changeHash returns the hash of local used to decide whether it has changed,
+// which is the same as hashLocal unless c.LocalHash is set.
+
+func (c *WOFClone) changeHash(local string) (string, error) {
+
+	if c.LocalHash == nil {
+		return c.hashLocal(local)
+	}
+
+	return c.hashLocalRetrying(local, func() (string, error) {
+
+		body, err := c.readLocal(local)
+
+		if err != nil {
+			return "", err
+		}
+
+		return c.LocalHash(body), nil
+	})
+}
+
+// readLocal returns the (uncompressed) contents of local.
+
+func (c *WOFClone) readLocal(local string) ([]byte, error) {
+
+	if !c.CompressLocal {
+		return ioutil.ReadFile(local)
+	}
+
+	fh, err := os.Open(local)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fh.Close()
+
+	gz, err := gzip.NewReader(fh)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+// removeAlternate removes any copy of local stored in the other format (compressed
+// or not). Since CompressLocal may be toggled between runs this ensures that a tree
+// never contains both.
+
+func (c *WOFClone) removeAlternate(local string) {
+
+	other := local + compressed_suffix
+
+	if c.CompressLocal {
+		other = strings.TrimSuffix(local, compressed_suffix)
+	}
+
+	_, err := c.statLocal(other)
+
+	if err != nil {
+		return
+	}
+
+	c.Logger.Debug("remove %s since it has been replaced by %s", other, local)
+
+	err = os.Remove(other)
+
+	if err != nil {
+		c.Logger.Warning("Failed to remove %s, because %v", other, err)
+		return
+	}
+
+	c.indexRemoved(other)
+}
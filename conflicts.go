@@ -0,0 +1,96 @@
+package clone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prepareLocal makes sure that local can be written: that the directory it goes in
+// exists and that there isn't a directory at local itself. Anything in the way, left
+// behind by an earlier run or a different layout, is a *PathConflictError unless
+// c.ClobberConflicts is true, in which case it is removed.
+
+func (c *WOFClone) prepareLocal(local string) error {
+
+	root := filepath.Dir(local)
+
+	err := os.MkdirAll(root, 0755)
+
+	if err != nil {
+
+		conflict := c.fileInTheWay(root)
+
+		if conflict == "" {
+			return &WriteError{Path: local, Err: err}
+		}
+
+		if !c.ClobberConflicts {
+			return &PathConflictError{Path: local, Conflict: conflict}
+		}
+
+		c.Logger.Warning("Removing %s to make room for %s, see ClobberConflicts", conflict, local)
+
+		err = os.Remove(conflict)
+
+		if err == nil {
+			c.indexRemoved(conflict)
+			err = os.MkdirAll(root, 0755)
+		}
+
+		if err != nil {
+			return &WriteError{Path: local, Err: err}
+		}
+	}
+
+	info, err := os.Lstat(local)
+
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	if !c.ClobberConflicts {
+		return &PathConflictError{Path: local, Conflict: local, IsDir: true}
+	}
+
+	c.Logger.Warning("Removing the directory %s to make room for a file, see ClobberConflicts", local)
+
+	err = os.RemoveAll(local)
+
+	if err != nil {
+		return &WriteError{Path: local, Err: err}
+	}
+
+	return nil
+}
+
+// fileInTheWay returns the first of root's ancestors, below c.Dest, that exists but
+// isn't a directory, or "" if there isn't one.
+
+func (c *WOFClone) fileInTheWay(root string) string {
+
+	rel_path, err := filepath.Rel(c.Dest, root)
+
+	if err != nil || strings.HasPrefix(rel_path, "..") {
+		return ""
+	}
+
+	current := c.Dest
+
+	for _, part := range strings.Split(rel_path, string(filepath.Separator)) {
+
+		current = filepath.Join(current, part)
+
+		info, err := os.Stat(current)
+
+		if os.IsNotExist(err) {
+			return ""
+		}
+
+		if err == nil && !info.IsDir() {
+			return current
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,88 @@
+package clone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathConflicts(t *testing.T) {
+
+	// Each of these leaves something in the way of 1/1.geojson
+
+	conflicts := []struct {
+		name   string
+		setup  func(dest string) error
+		reason string
+	}{
+		{"a file where a directory should be", func(dest string) error {
+			return ioutil.WriteFile(filepath.Join(dest, "1"), []byte("in the way"), 0644)
+		}, "is a file, not a directory"},
+		{"a directory where the file should be", func(dest string) error {
+			return os.MkdirAll(filepath.Join(dest, "1", "1.geojson", "old"), 0755)
+		}, "there is a directory there"},
+	}
+
+	for _, conflict := range conflicts {
+
+		for _, clobber := range []bool{false, true} {
+
+			source := newTestSource(t)
+			source.set("2/2.geojson", `{"id":2}`)
+			source.set("1/1.geojson", `{"id":1}`)
+
+			c := newTestClone(t, source.URL)
+			c.AllowFailures = true
+			c.ClobberConflicts = clobber
+
+			err := conflict.setup(c.Dest)
+
+			if err != nil {
+				t.Fatalf("%s: failed to set up, %v", conflict.name, err)
+			}
+
+			err = c.CloneMetaFile(writeMetaFile(t, "2/2.geojson", "1/1.geojson"), false, false)
+
+			if err != nil {
+				t.Fatalf("%s: failed to clone, %v", conflict.name, err)
+			}
+
+			info, stat_err := os.Stat(c.LocalPath("1/1.geojson"))
+
+			if clobber {
+
+				if c.Success != 2 || c.Error != 0 {
+					t.Errorf("%s, clobbering: expected 2 files to be cloned, got %d and %d errors", conflict.name, c.Success, c.Error)
+				}
+
+				if stat_err != nil || info.IsDir() {
+					t.Errorf("%s, clobbering: expected 1/1.geojson to be a file, %v", conflict.name, stat_err)
+				}
+
+				continue
+			}
+
+			if c.Success != 1 || c.Error != 1 {
+				t.Errorf("%s: expected 1 file to be cloned and 1 to fail, got %d and %d", conflict.name, c.Success, c.Error)
+			}
+
+			if c.PermanentErrors != 1 || c.Retried != 0 {
+				t.Errorf("%s: expected a permanent error that isn't retried, got %d permanent and %d retried", conflict.name, c.PermanentErrors, c.Retried)
+			}
+
+			rpt := c.Report()
+
+			if rpt.FirstFailure != "1/1.geojson" || !strings.Contains(rpt.FirstError, conflict.reason) {
+				t.Errorf("%s: expected 1/1.geojson to fail because %s, got %s (%s)", conflict.name, conflict.reason, rpt.FirstFailure, rpt.FirstError)
+			}
+
+			// Whatever was in the way is left alone
+
+			if stat_err == nil && !info.IsDir() {
+				t.Errorf("%s: expected 1/1.geojson not to have been written", conflict.name)
+			}
+		}
+	}
+}
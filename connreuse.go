@@ -0,0 +1,59 @@
+package clone
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// watchConnReuse returns req with a hook that records whether it was sent on a reused
+// (kept alive) connection, and a function that returns whether it was.
+
+func watchConnReuse(req *http.Request) (*http.Request, func() bool) {
+
+	reused := new(int32)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+
+			if info.Reused {
+				atomic.StoreInt32(reused, 1)
+			} else {
+				atomic.StoreInt32(reused, 0)
+			}
+		},
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	return req, func() bool {
+		return atomic.LoadInt32(reused) == 1
+	}
+}
+
+// isConnReuseError returns true if err, from sending req on a reused connection, is
+// most likely because the source closed the connection while it was idle, in which
+// case req can be sent again straight away on a new one. Only requests without a body
+// (GET and HEAD) are sent again, and never once the run has been cancelled or because
+// the request timed out.
+
+func (c *WOFClone) isConnReuseError(req *http.Request, err error) bool {
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+
+	if c.ctx.Err() != nil {
+		return false
+	}
+
+	var net_err net.Error
+
+	if errors.As(err, &net_err) && net_err.Timeout() {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// data_prefix is the directory that WOF repositories keep their records in. Some meta
+// files include it in their paths and some don't, see DataPrefix.
+
+const data_prefix = "data/"
+
+// The values that DataPrefix can have.
+
+const (
+	DataPrefixStrip = "strip"
+	DataPrefixAdd   = "add"
+	DataPrefixAuto  = "auto"
+)
+
+// dataPrefix keeps track of what (if anything) needs to be done to the paths in a meta
+// file so they work with Source. When DataPrefix is "auto" that isn't known until the
+// first row has been probed.
+
+type dataPrefix struct {
+	mode string
+	once *sync.Once
+}
+
+// checkDataPrefix returns an error if DataPrefix isn't valid.
+
+func (c *WOFClone) checkDataPrefix() error {
+
+	switch c.DataPrefix {
+	case "", DataPrefixStrip, DataPrefixAdd, DataPrefixAuto:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported data prefix option '%s'", c.DataPrefix)
+	}
+}
+
+func (c *WOFClone) newDataPrefix() *dataPrefix {
+
+	p := dataPrefix{
+		mode: c.DataPrefix,
+		once: new(sync.Once),
+	}
+
+	if p.mode == DataPrefixAuto {
+		p.mode = ""
+	}
+
+	return &p
+}
+
+// probe works out whether rel_path (from the first row of a meta file) should have the
+// data prefix added or removed by asking exists whether it (or the alternative) exists.
+// It does nothing unless DataPrefix is "auto" and only probes once.
+
+func (c *WOFClone) probeDataPrefix(p *dataPrefix, rel_path string, exists func(string) bool) {
+
+	if c.DataPrefix != DataPrefixAuto {
+		return
+	}
+
+	p.once.Do(func() {
+
+		if exists(rel_path) {
+			return
+		}
+
+		mode := DataPrefixAdd
+
+		if strings.HasPrefix(rel_path, data_prefix) {
+			mode = DataPrefixStrip
+		}
+
+		alt_path := normalizePath(rel_path, mode)
+
+		if !exists(alt_path) {
+			c.Logger.Warning("neither %s or %s exist, leaving paths as they are", rel_path, alt_path)
+			return
+		}
+
+		c.Logger.Warning("%s does not exist but %s does, so the %s prefix will be %s for every path", rel_path, alt_path, data_prefix, map[string]string{DataPrefixAdd: "added", DataPrefixStrip: "removed"}[mode])
+		p.mode = mode
+	})
+}
+
+// remoteExists returns true if a HEAD request for rel_path succeeds.
+
+func (c *WOFClone) remoteExists(rel_path string) bool {
+
+	rsp, err := c.Fetch("HEAD", c.Source+rel_path)
+
+	if err != nil {
+		return false
+	}
+
+	rsp.Body.Close()
+	return true
+}
+
+// localExists returns true if rel_path has been cloned.
+
+func (c *WOFClone) localExists(rel_path string) bool {
+
+	_, err := os.Stat(c.LocalPath(rel_path))
+	return err == nil
+}
+
+// rowPath returns the path for row (see PathColumn) with the data prefix added or removed
+// according to p.
+
+func (c *WOFClone) rowPath(row map[string]string, p *dataPrefix) string {
+
+	rel_path := row[c.PathColumn]
+
+	if p == nil {
+		return rel_path
+	}
+
+	return normalizePath(rel_path, p.mode)
+}
+
+func normalizePath(rel_path string, mode string) string {
+
+	switch mode {
+	case DataPrefixStrip:
+		return strings.TrimPrefix(strings.TrimLeft(rel_path, "/"), data_prefix)
+	case DataPrefixAdd:
+
+		rel_path = strings.TrimLeft(rel_path, "/")
+
+		if !strings.HasPrefix(rel_path, data_prefix) {
+			rel_path = data_prefix + rel_path
+		}
+
+		return rel_path
+	default:
+		return rel_path
+	}
+}
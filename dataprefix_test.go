@@ -0,0 +1,81 @@
+package clone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDataPrefixAuto(t *testing.T) {
+
+	// The source always keeps its files in data/, so a Source that ends in data/ wants
+	// paths without it and one that doesn't wants paths with it
+
+	tests := []struct {
+		name     string
+		source   string
+		path     string
+		fetched  string
+		warnings int
+	}{
+		{"data/ in both", "", "data/1/1.geojson", "data/1/1.geojson", 0},
+		{"data/ in neither", "data/", "1/1.geojson", "data/1/1.geojson", 0},
+		{"data/ only in the source", "data/", "data/1/1.geojson", "data/1/1.geojson", 1},
+		{"data/ only in the meta file", "", "1/1.geojson", "data/1/1.geojson", 1},
+	}
+
+	for _, test := range tests {
+
+		source := newTestSource(t)
+		source.set("data/1/1.geojson", `{"id":1}`)
+		source.set("data/2/2.geojson", `{"id":2}`)
+
+		logger := new(testLogger)
+
+		c, err := NewWOFClone(source.URL+test.source, t.TempDir(), 2, logger)
+
+		if err != nil {
+			t.Fatalf("Failed to create clone, %v", err)
+		}
+
+		c.StatusInterval = -1
+		c.DataPrefix = DataPrefixAuto
+
+		other := strings.Replace(test.path, "1", "2", -1)
+
+		err = c.CloneMetaFile(writeMetaFile(t, test.path, other), false, false)
+
+		if err != nil {
+			t.Fatalf("%s: failed to clone, %v", test.name, err)
+		}
+
+		if c.Success != 2 {
+			t.Errorf("%s: expected 2 files to be cloned, got %d", test.name, c.Success)
+		}
+
+		warnings := 0
+
+		for _, line := range logger.Lines() {
+
+			if strings.Contains(line, "prefix will be") {
+				warnings += 1
+			}
+		}
+
+		if warnings != test.warnings {
+			t.Errorf("%s: expected %d warnings about the prefix, got %d", test.name, test.warnings, warnings)
+		}
+
+		// A path that doesn't exist is only probed once, by preflight, and not again
+		// when the run starts
+
+		missing := test.source + test.path
+
+		if test.warnings > 0 && source.count(missing) != 1 {
+			t.Errorf("%s: expected %s to be probed once, got %d requests", test.name, missing, source.count(missing))
+		}
+
+		if source.count(test.fetched) == 0 {
+			t.Errorf("%s: expected %s to be fetched", test.name, test.fetched)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+)
+
+// DecideOptions are what Decide needs to know, besides a meta file row and its local
+// copy, to decide what should happen to a file. SkipExisting and ForceUpdates are the
+// same as the skip_existing and force_updates arguments to CloneMetaFile and the rest
+// are the same as the WOFClone fields of the same names. LocalIncomplete is true if
+// the local copy is known to be unusable for some reason Decide can't see for itself,
+// for example because it doesn't parse as JSON (see ValidateJSON).
+
+type DecideOptions struct {
+	SkipExisting       bool
+	ForceUpdates       bool
+	UseLastModified    bool
+	LastModifiedColumn string
+	MaxFileSize        int64
+	SizeColumn         string
+	MinExistingSize    int64
+	LocalIncomplete    bool
+}
+
+// ChangeProbe is how Decide finds out whether a local copy is different from the
+// source's, when it comes to that, which usually means a request to the source. It
+// returns true if the local copy should be replaced and, if it shouldn't, the decision
+// that says why (for example DecisionSkippedETag or DecisionSkippedLocalNewer).
+
+type ChangeProbe func() (bool, Decision, error)
+
+// skip_reasons are the reasons Decide gives for the decisions a ChangeProbe makes.
+
+var skip_reasons = map[Decision]string{
+	DecisionSkippedETag:       "the local copy's hash matches the source's ETag",
+	DecisionSkippedFileHash:   "the meta file's hash matches the source's",
+	DecisionSkippedUnknown:    "it can't be told whether it has changed",
+	DecisionSkippedLocalNewer: "the local copy is newer than the source's",
+}
+
+// Decide decides what should happen to the file for row (which may be nil, for files
+// that aren't listed in a meta file of their own) whose local copy is info (nil if
+// there isn't one), returning the decision and the reason for it. It is the same
+// decision CloneMetaFile makes for every file, without any of the side effects.
+// changed is only called if the decision comes down to whether the local copy has
+// changed, and if it fails so does Decide, with DecisionFailed. A decision to fetch a
+// file is one of DecisionFetchedNew, DecisionFetchedChanged or DecisionForced, anything
+// else (see Decision's Skipped) means it is left alone.
+
+func Decide(row map[string]string, info os.FileInfo, opts DecideOptions, changed ChangeProbe) (Decision, string, error) {
+
+	if opts.MaxFileSize > 0 && isTooLarge(row, opts.SizeColumn, opts.MaxFileSize) {
+		return DecisionSkippedTooLarge, fmt.Sprintf("it is larger than %d bytes", opts.MaxFileSize), nil
+	}
+
+	if info == nil {
+		return DecisionFetchedNew, "there is no local copy", nil
+	}
+
+	if opts.ForceUpdates {
+		return DecisionForced, "updates are being forced", nil
+	}
+
+	if opts.LocalIncomplete || info.Size() == 0 || info.Size() < opts.MinExistingSize {
+		return DecisionFetchedNew, "the local copy looks incomplete", nil
+	}
+
+	if opts.SkipExisting {
+		return DecisionSkippedExisting, "there is a local copy and existing files are being skipped", nil
+	}
+
+	column := opts.LastModifiedColumn
+
+	if column == "" {
+		column = "lastmodified"
+	}
+
+	if opts.UseLastModified && !isModifiedSince(row, column, info) {
+		return DecisionSkippedLastModified, fmt.Sprintf("the local copy is newer than its %s column", column), nil
+	}
+
+	has_changes, decision, err := changed()
+
+	if err != nil {
+		return DecisionFailed, fmt.Sprintf("it couldn't be told whether it has changed, %v", err), err
+	}
+
+	if has_changes {
+		return DecisionFetchedChanged, "the local copy is different from the source's", nil
+	}
+
+	reason, ok := skip_reasons[decision]
+
+	if !ok {
+		reason = "the local copy hasn't changed"
+	}
+
+	return decision, reason, nil
+}
@@ -0,0 +1,277 @@
+package clone
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testFileInfo is an os.FileInfo for a local copy that doesn't need to exist.
+
+type testFileInfo struct {
+	size    int64
+	modtime time.Time
+}
+
+func (i testFileInfo) Name() string       { return "1234.geojson" }
+func (i testFileInfo) Size() int64        { return i.size }
+func (i testFileInfo) Mode() os.FileMode  { return 0644 }
+func (i testFileInfo) ModTime() time.Time { return i.modtime }
+func (i testFileInfo) IsDir() bool        { return false }
+func (i testFileInfo) Sys() interface{}   { return nil }
+
+func TestDecide(t *testing.T) {
+
+	local_time := time.Unix(1500000000, 0)
+	older := strconv.FormatInt(local_time.Unix()-60, 10)
+	newer := strconv.FormatInt(local_time.Unix()+60, 10)
+
+	local := testFileInfo{size: 100, modtime: local_time}
+	empty := testFileInfo{size: 0, modtime: local_time}
+
+	probe_err := errors.New("the source went away")
+
+	// A probe of nil means Decide shouldn't get as far as calling it
+
+	type probe struct {
+		changed  bool
+		decision Decision
+		err      error
+	}
+
+	tests := []struct {
+		name     string
+		row      map[string]string
+		info     os.FileInfo
+		opts     DecideOptions
+		probe    *probe
+		decision Decision
+		reason   string
+	}{
+		{
+			name:     "no local copy",
+			info:     nil,
+			decision: DecisionFetchedNew,
+			reason:   "there is no local copy",
+		},
+		{
+			name:     "no local copy, skipping existing",
+			info:     nil,
+			opts:     DecideOptions{SkipExisting: true},
+			decision: DecisionFetchedNew,
+		},
+		{
+			name:     "no local copy, forcing updates",
+			info:     nil,
+			opts:     DecideOptions{ForceUpdates: true},
+			decision: DecisionFetchedNew,
+		},
+		{
+			name:     "too large, forcing updates",
+			row:      map[string]string{"size": "2000"},
+			info:     local,
+			opts:     DecideOptions{ForceUpdates: true, MaxFileSize: 1000},
+			decision: DecisionSkippedTooLarge,
+			reason:   "it is larger than 1000 bytes",
+		},
+		{
+			name:     "too large by a size column",
+			row:      map[string]string{"bytes": "2000", "size": "10"},
+			info:     nil,
+			opts:     DecideOptions{MaxFileSize: 1000, SizeColumn: "bytes"},
+			decision: DecisionSkippedTooLarge,
+		},
+		{
+			name:     "forcing updates",
+			info:     local,
+			opts:     DecideOptions{ForceUpdates: true},
+			decision: DecisionForced,
+		},
+		{
+			name:     "forcing updates beats skipping existing",
+			info:     local,
+			opts:     DecideOptions{ForceUpdates: true, SkipExisting: true},
+			decision: DecisionForced,
+		},
+		{
+			name:     "forcing updates beats an unchanged mtime",
+			row:      map[string]string{"lastmodified": older},
+			info:     local,
+			opts:     DecideOptions{ForceUpdates: true, UseLastModified: true},
+			decision: DecisionForced,
+		},
+		{
+			name:     "skipping existing",
+			info:     local,
+			opts:     DecideOptions{SkipExisting: true},
+			decision: DecisionSkippedExisting,
+		},
+		{
+			name:     "skipping existing, but the local copy is empty",
+			info:     empty,
+			opts:     DecideOptions{SkipExisting: true},
+			decision: DecisionFetchedNew,
+			reason:   "the local copy looks incomplete",
+		},
+		{
+			name:     "skipping existing, but the local copy is too small",
+			info:     local,
+			opts:     DecideOptions{SkipExisting: true, MinExistingSize: 101},
+			decision: DecisionFetchedNew,
+		},
+		{
+			name:     "skipping existing, but the local copy is incomplete",
+			info:     local,
+			opts:     DecideOptions{SkipExisting: true, LocalIncomplete: true},
+			decision: DecisionFetchedNew,
+		},
+		{
+			name:     "skipping existing beats a changed mtime",
+			row:      map[string]string{"lastmodified": newer},
+			info:     local,
+			opts:     DecideOptions{SkipExisting: true, UseLastModified: true},
+			decision: DecisionSkippedExisting,
+		},
+		{
+			name:     "mtime is older than the local copy",
+			row:      map[string]string{"lastmodified": older},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true},
+			decision: DecisionSkippedLastModified,
+			reason:   "the local copy is newer than its lastmodified column",
+		},
+		{
+			name:     "mtime is older than the local copy, in another column",
+			row:      map[string]string{"lastmodified": newer, "mtime": older},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true, LastModifiedColumn: "mtime"},
+			decision: DecisionSkippedLastModified,
+			reason:   "the local copy is newer than its mtime column",
+		},
+		{
+			name:     "mtime is older, but isn't being used",
+			row:      map[string]string{"lastmodified": older},
+			info:     local,
+			probe:    &probe{changed: true},
+			decision: DecisionFetchedChanged,
+		},
+		{
+			name:     "mtime is newer than the local copy and the hash has changed",
+			row:      map[string]string{"lastmodified": newer},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true},
+			probe:    &probe{changed: true},
+			decision: DecisionFetchedChanged,
+			reason:   "the local copy is different from the source's",
+		},
+		{
+			name:     "mtime is newer than the local copy but the ETag matches",
+			row:      map[string]string{"lastmodified": newer},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true},
+			probe:    &probe{decision: DecisionSkippedETag},
+			decision: DecisionSkippedETag,
+			reason:   skip_reasons[DecisionSkippedETag],
+		},
+		{
+			name:     "no mtime in the row",
+			row:      map[string]string{},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true},
+			probe:    &probe{decision: DecisionSkippedETag},
+			decision: DecisionSkippedETag,
+		},
+		{
+			name:     "an mtime that can't be parsed",
+			row:      map[string]string{"lastmodified": "yesterday"},
+			info:     local,
+			opts:     DecideOptions{UseLastModified: true},
+			probe:    &probe{changed: true},
+			decision: DecisionFetchedChanged,
+		},
+		{
+			name:     "the ETag matches",
+			info:     local,
+			probe:    &probe{decision: DecisionSkippedETag},
+			decision: DecisionSkippedETag,
+			reason:   skip_reasons[DecisionSkippedETag],
+		},
+		{
+			name:     "the meta file's hash matches",
+			row:      map[string]string{"file_hash": "abc"},
+			info:     local,
+			probe:    &probe{decision: DecisionSkippedFileHash},
+			decision: DecisionSkippedFileHash,
+			reason:   skip_reasons[DecisionSkippedFileHash],
+		},
+		{
+			name:     "the hash has changed",
+			info:     local,
+			probe:    &probe{changed: true},
+			decision: DecisionFetchedChanged,
+		},
+		{
+			name:     "the local copy is newer than the source's",
+			info:     local,
+			probe:    &probe{decision: DecisionSkippedLocalNewer},
+			decision: DecisionSkippedLocalNewer,
+			reason:   skip_reasons[DecisionSkippedLocalNewer],
+		},
+		{
+			name:     "a skip without a reason of its own",
+			info:     local,
+			probe:    &probe{decision: DecisionSkippedFalseChange},
+			decision: DecisionSkippedFalseChange,
+			reason:   "the local copy hasn't changed",
+		},
+		{
+			name:     "the probe fails",
+			info:     local,
+			probe:    &probe{err: probe_err},
+			decision: DecisionFailed,
+			reason:   "it couldn't be told whether it has changed, the source went away",
+		},
+	}
+
+	for _, test := range tests {
+
+		probed := false
+
+		changed := func() (bool, Decision, error) {
+
+			probed = true
+
+			if test.probe == nil {
+				return false, DecisionSkippedUnknown, nil
+			}
+
+			return test.probe.changed, test.probe.decision, test.probe.err
+		}
+
+		decision, reason, err := Decide(test.row, test.info, test.opts, changed)
+
+		if decision != test.decision {
+			t.Errorf("%s: expected %s, got %s (%s)", test.name, test.decision, decision, reason)
+		}
+
+		if test.reason != "" && reason != test.reason {
+			t.Errorf("%s: expected the reason %q, got %q", test.name, test.reason, reason)
+		}
+
+		if probed != (test.probe != nil) {
+			t.Errorf("%s: expected the probe to be called: %v, got %v", test.name, test.probe != nil, probed)
+		}
+
+		if test.probe != nil && test.probe.err != nil {
+
+			if !errors.Is(err, test.probe.err) {
+				t.Errorf("%s: expected the probe's error, got %v", test.name, err)
+			}
+
+		} else if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package clone
+
+import (
+	"strings"
+)
+
+// Decision is what happened to a path during a run, and why. See RecordDecisions.
+
+type Decision string
+
+const (
+	DecisionFetchedNew          Decision = "fetched-new"     // there was no local copy
+	DecisionFetchedChanged      Decision = "fetched-changed" // the local copy was different from the source's, or that couldn't be told
+	DecisionForced              Decision = "forced"          // the local copy was replaced because of force_updates
+	DecisionSkippedExisting     Decision = "skipped-existing"
+	DecisionSkippedETag         Decision = "skipped-unchanged-by-etag"         // the local copy's hash matched the source's ETag
+	DecisionSkippedFileHash     Decision = "skipped-unchanged-by-file-hash"    // the meta file's hash matched the source's ETag or the local copy
+	DecisionSkippedLastModified Decision = "skipped-unchanged-by-lastmodified" // see UseLastModified
+	DecisionSkippedUnknown      Decision = "skipped-unknown-change"            // see UnknownChanges
+	DecisionSkippedLocalNewer   Decision = "skipped-local-newer"               // see ProtectNewerLocal
+	DecisionSkippedTooLarge     Decision = "skipped-too-large"                 // see MaxFileSize
+	DecisionSkippedManifest     Decision = "skipped-unchanged-by-manifest"     // see IncrementalManifest
+	DecisionSkippedFalseChange  Decision = "skipped-unchanged-by-content"      // see DetectFalseChanges
+	DecisionSkippedIdentical    Decision = "skipped-identical"                 // see WriteIfDifferent
+	DecisionSkippedNotModified  Decision = "skipped-not-modified"              // the source said the file was not modified, see StatusActions
+	DecisionLinked              Decision = "linked-from-reference"             // see ReferenceDir
+	DecisionExtracted           Decision = "extracted-from-bundle"             // see Bundle
+	DecisionIgnored             Decision = "ignored"                           // see MaxFiles
+	DecisionExcluded            Decision = "excluded"                          // see Exclude
+	DecisionFailed              Decision = "failed"
+)
+
+// Skipped returns true if d means the local copy was left alone.
+
+func (d Decision) Skipped() bool {
+
+	return strings.HasPrefix(string(d), "skipped-")
+}
+
+// redecide is decide for when rel_path has already been counted as previous, for
+// example a file that fails PostVerify after being fetched.
+
+func (c *WOFClone) redecide(rel_path string, previous Decision, d Decision) {
+
+	if c.debugging() {
+		c.Logger.Debug("%s: %s (was %s)", rel_path, d, previous)
+	}
+
+	c.countGroup(rel_path, d, previous)
+
+	if c.RecordDecisions {
+		c.report.AddDecision(rel_path, d)
+	}
+}
+
+// decide records that d is what happened to rel_path, logging it (at debug level)
+// and, if c.RecordDecisions is true, adding it to the report. A path that is retried
+// ends up with the decision made the last time it was tried.
+
+func (c *WOFClone) decide(rel_path string, d Decision) {
+
+	if c.debugging() {
+		c.Logger.Debug("%s: %s", rel_path, d)
+	}
+
+	c.countGroup(rel_path, d, "")
+
+	// Failed paths may yet be retried, see destpath.go
+
+	if d != DecisionFailed {
+		c.forgetPath(rel_path)
+	}
+
+	if c.RecordDecisions {
+		c.report.AddDecision(rel_path, d)
+	}
+}
@@ -0,0 +1,136 @@
+package clone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// destIndex is what is in Dest, found by walking it once at the start of a run, so that
+// deciding what to do with each row doesn't need a stat call (which on a network
+// filesystem is a round trip) for every file. It is kept up to date as files are
+// written, moved and removed during the run. See PrescanDest.
+
+type destIndex struct {
+	mu    sync.RWMutex
+	files map[string]os.FileInfo // local path -> its details
+}
+
+// scanDest walks c.Dest and returns what it found, or nil if it couldn't be walked.
+// Hidden directories (like .git) and c.TempDir and c.QuarantineDir, if they are inside
+// Dest, aren't looked in since nothing that is cloned is stored in them.
+
+func (c *WOFClone) scanDest() *destIndex {
+
+	t1 := time.Now()
+
+	skip := make(map[string]bool)
+
+	for _, d := range []string{c.TempDir, c.QuarantineDir} {
+
+		if d != "" {
+			skip[filepath.Clean(d)] = true
+		}
+	}
+
+	idx := destIndex{
+		files: make(map[string]os.FileInfo),
+	}
+
+	err := filepath.Walk(c.Dest, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+
+			if path != c.Dest && (strings.HasPrefix(info.Name(), ".") || skip[path]) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		idx.files[path] = info
+		return nil
+	})
+
+	if err != nil {
+		c.Logger.Warning("Failed to scan %s, because %v, checking each file instead", c.Dest, err)
+		return nil
+	}
+
+	c.Logger.Info("Found %d files in %s in %v", len(idx.files), c.Dest, time.Since(t1))
+	return &idx
+}
+
+// statLocal is os.Stat for local, but answered from c.dest_index when there is one.
+
+func (c *WOFClone) statLocal(local string) (os.FileInfo, error) {
+
+	idx := c.dest_index
+
+	if idx == nil {
+		return os.Stat(local)
+	}
+
+	idx.mu.RLock()
+	info, ok := idx.files[filepath.Clean(local)]
+	idx.mu.RUnlock()
+
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: local, Err: os.ErrNotExist}
+	}
+
+	// The walk doesn't follow symlinks, so ask about what they point to
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return os.Stat(local)
+	}
+
+	return info, nil
+}
+
+// indexWritten records that local has been written (or moved in to place), if there
+// is a c.dest_index.
+
+func (c *WOFClone) indexWritten(local string) {
+
+	idx := c.dest_index
+
+	if idx == nil {
+		return
+	}
+
+	info, err := os.Lstat(local)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err != nil {
+		delete(idx.files, filepath.Clean(local))
+		return
+	}
+
+	idx.files[filepath.Clean(local)] = info
+}
+
+// indexRemoved records that local has been removed (or moved out of the way), if
+// there is a c.dest_index.
+
+func (c *WOFClone) indexRemoved(local string) {
+
+	idx := c.dest_index
+
+	if idx == nil {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.files, filepath.Clean(local))
+}
@@ -0,0 +1,127 @@
+package clone
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+)
+
+var re_placeholder = regexp.MustCompile(`\{([^}]+)\}`)
+
+// hasDestMapping returns true if files are stored somewhere other than their relative
+// path under Dest, see DestPath and DestTemplate.
+
+func (c *WOFClone) hasDestMapping() bool {
+	return c.DestPath != nil || c.DestTemplate != ""
+}
+
+// destRelPath returns where (relative to Dest) rel_path should be stored. row is the meta
+// file row rel_path was read from and may be nil. Mapped paths can't escape Dest and if
+// a mapping produces an empty path then rel_path is used as is.
+
+func (c *WOFClone) destRelPath(rel_path string, row map[string]string) string {
+
+	var mapped string
+
+	switch {
+	case c.DestPath != nil:
+		mapped = c.DestPath(rel_path, row)
+	case c.DestTemplate != "":
+		mapped = expandDestTemplate(c.DestTemplate, rel_path, row)
+	default:
+		return rel_path
+	}
+
+	mapped = path.Clean("/" + mapped)[1:]
+
+	if mapped == "" {
+		c.Logger.Warning("destination for %s is empty, storing it at %s", rel_path, rel_path)
+		return rel_path
+	}
+
+	return mapped
+}
+
+// expandDestTemplate replaces the placeholders in template. {path}, {dir} and {basename}
+// are the relative path and its directory and filename and {id} is the ID the path is
+// for. Anything else is the value of that column in row, or "unknown" if there isn't one.
+
+func expandDestTemplate(template string, rel_path string, row map[string]string) string {
+
+	return re_placeholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+
+		name := placeholder[1 : len(placeholder)-1]
+
+		switch name {
+		case "path":
+			return rel_path
+		case "dir":
+			return path.Dir(rel_path)
+		case "basename":
+			return path.Base(rel_path)
+		case "id":
+
+			id, err := IdForPath(rel_path)
+
+			if err == nil {
+				return strconv.FormatInt(id, 10)
+			}
+		}
+
+		value := row[name]
+
+		if value == "" {
+			return "unknown"
+		}
+
+		return value
+	})
+}
+
+// mapPath works out (and remembers, until forgetPath) where rel_path, which was listed
+// in row, should be stored.
+
+func (c *WOFClone) mapPath(rel_path string, row map[string]string) {
+
+	if !c.hasDestMapping() {
+		return
+	}
+
+	mapped := c.destRelPath(rel_path, row)
+
+	c.dest_paths.Store(rel_path, mapped)
+
+	if mapped != rel_path {
+		c.report.AddLocalPath(rel_path, mapped)
+	}
+}
+
+// forgetPath forgets the mapping remembered for rel_path by mapPath, once what happened
+// to it has been decided (see decide) so that a run doesn't hold on to a mapping for
+// every row. Anything that needs to know where rel_path is stored after that keeps
+// its own copy, see writtenLog.
+
+func (c *WOFClone) forgetPath(rel_path string) {
+
+	if c.hasDestMapping() {
+		c.dest_paths.Delete(rel_path)
+	}
+}
+
+// localRelPath returns where (relative to Dest) rel_path is stored, using the mapping
+// remembered by mapPath if there is one.
+
+func (c *WOFClone) localRelPath(rel_path string) string {
+
+	if !c.hasDestMapping() {
+		return rel_path
+	}
+
+	v, ok := c.dest_paths.Load(rel_path)
+
+	if ok {
+		return v.(string)
+	}
+
+	return c.destRelPath(rel_path, nil)
+}
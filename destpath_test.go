@@ -0,0 +1,84 @@
+package clone
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDestTemplate(t *testing.T) {
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+
+	err := ioutil.WriteFile(meta, []byte("path,country\n1/1.geojson,ca\n2/2.geojson,us\n"), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", meta, err)
+	}
+
+	c := newTestClone(t, source.URL)
+	c.DestTemplate = "{country}/{basename}"
+	c.PostVerify = true
+	c.UpdatedMetaPath = filepath.Join(t.TempDir(), "updated.csv")
+	c.UpdatedMetaStatus = true
+
+	err = c.CloneMetaFile(meta, false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	for _, dest_rel := range []string{"ca/1.geojson", "us/2.geojson"} {
+
+		_, err := ioutil.ReadFile(filepath.Join(c.Dest, dest_rel))
+
+		if err != nil {
+			t.Errorf("Expected a file at %s, %v", dest_rel, err)
+		}
+	}
+
+	// Where the files were stored is only remembered while they are being cloned but
+	// verifying them and updating the meta file still find them
+
+	if c.PostVerified != 2 || c.PostVerifyMismatches != 0 {
+		t.Errorf("Expected 2 files to verify, got %d and %d mismatches", c.PostVerified, c.PostVerifyMismatches)
+	}
+
+	body, err := ioutil.ReadFile(c.UpdatedMetaPath)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %v", c.UpdatedMetaPath, err)
+	}
+
+	if strings.Count(string(body), ",ok") != 2 {
+		t.Errorf("Expected both files to be in the updated meta file, got %s", body)
+	}
+}
+
+func TestForgetPath(t *testing.T) {
+
+	c := newTestClone(t, "http://wof.invalid/")
+	c.DestTemplate = "{country}/{basename}"
+
+	row := map[string]string{"path": "1/1.geojson", "country": "ca"}
+
+	c.mapPath("1/1.geojson", row)
+	c.decide("1/1.geojson", DecisionFailed)
+
+	if c.localRelPath("1/1.geojson") != "ca/1.geojson" {
+		t.Errorf("Expected a failed path to still be mapped, got %s", c.localRelPath("1/1.geojson"))
+	}
+
+	c.decide("1/1.geojson", DecisionFetchedNew)
+
+	_, ok := c.dest_paths.Load("1/1.geojson")
+
+	if ok {
+		t.Errorf("Expected the mapping to be forgotten once the path was cloned")
+	}
+}
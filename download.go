@@ -0,0 +1,494 @@
+package clone
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const partial_suffix = ".partial"
+
+var re_md5 = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// partialDownload records enough about a download that failed part way through
+// to resume it with a Range request. They are keyed by local path in c.partials.
+
+type partialDownload struct {
+	source string
+	url    string
+	etag   string
+	size   int64
+}
+
+// download streams remote to a temporary file alongside local, which is renamed in to
+// place once the whole body has been read successfully. It returns the hash (see
+// HashAlgorithm), computed as the body was written, and the size of the (uncompressed)
+// contents. If expected isn't "" the contents must have
+// that hash, otherwise the hash (if any) that c.HashSource says they should have.
+
+func (c *WOFClone) download(remote string, local string, expected string) (writtenFile, error) {
+
+	rel_path := strings.TrimPrefix(remote, c.Source)
+	tmp := c.tempPath(local)
+
+	hasher := c.newHash()
+
+	rsp, source, offset, err := c.openDownload(remote, local, tmp, hasher)
+
+	if err != nil {
+		return writtenFile{}, err
+	}
+
+	defer rsp.Body.Close()
+
+	if c.MaxFileSize > 0 {
+
+		if offset+rsp.ContentLength > c.MaxFileSize || (rsp.ContentLength < 0 && c.SkipUnknownSize) {
+			c.partials.Delete(local)
+			os.Remove(tmp)
+			return writtenFile{}, ErrTooLarge
+		}
+	}
+
+	c.report.AddSource(rel_path, source, source != c.Source)
+
+	fetched := c.remoteURL(source, rel_path)
+
+	if c.rewritesRemote() {
+		c.report.AddFetchedFrom(rel_path, fetched)
+	}
+
+	if rsp.Request != nil && rsp.Request.URL != nil && !strings.HasPrefix(remote, "file:") {
+
+		final := rsp.Request.URL.String()
+
+		if final != fetched {
+			c.report.AddRedirect(rel_path, final)
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+
+	// OPEN FH
+
+	atomic.AddInt64(&c.Filehandles, 1)
+	defer atomic.AddInt64(&c.Filehandles, -1)
+
+	fh, err := os.OpenFile(tmp, flags, local_file_mode)
+
+	if err != nil {
+		c.Logger.Error("Failed to open %s, because %v", tmp, err)
+		c.SetMaxFilehandles()
+		return writtenFile{}, &WriteError{Path: local, Err: err}
+	}
+
+	var wr io.Writer = fh
+	var gz *gzip.Writer
+
+	if c.CompressLocal {
+		gz = gzip.NewWriter(fh)
+		wr = gz
+	}
+
+	// If there's a ContentFilter then hasher sees what it produces (which is what's
+	// written to disk) and source_hasher sees the response itself. See filter.go
+
+	src := &sourceReader{Reader: rsp.Body}
+	source_hasher := hasher
+
+	var body io.Reader = src
+	var tee io.Reader
+
+	if c.ContentFilter != nil {
+
+		source_hasher = c.newHash()
+		tee = io.TeeReader(src, source_hasher)
+
+		body, err = c.ContentFilter(rel_path, tee)
+
+		if err != nil {
+			fh.Close()
+			os.Remove(tmp)
+			c.Logger.Error("Failed to filter %s, because %v", remote, err)
+			return writtenFile{}, &FilterError{Path: rel_path, Err: err, Retryable: c.RetryFilterErrors}
+		}
+	}
+
+	// A resumed download only sees the end of the file, so it might miss it
+
+	var scan *lastModifiedScanner
+
+	if offset == 0 {
+		scan = c.scanLastModified(rel_path)
+	}
+
+	if scan != nil {
+		wr = io.MultiWriter(wr, scan)
+	}
+
+	size, read_err, write_err := copyBody(wr, hasher, body)
+
+	if tee != nil && read_err == nil && write_err == nil {
+
+		// The filter may not have needed to read the whole response but the
+		// source hash (and the check for truncated responses) needs all of it
+
+		_, read_err = io.Copy(ioutil.Discard, tee)
+	}
+
+	if read_err != nil && src.err == nil {
+		fh.Close()
+		os.Remove(tmp)
+		c.Logger.Error("Failed to filter %s, because %v", remote, read_err)
+		return writtenFile{}, &FilterError{Path: rel_path, Err: read_err, Retryable: c.RetryFilterErrors}
+	}
+
+	// n is the number of bytes read from the response, which isn't the same as the
+	// number written if there's a ContentFilter
+
+	n := src.n
+
+	if gz != nil && write_err == nil {
+		write_err = gz.Close()
+	}
+
+	close_err := fh.Close()
+
+	if write_err == nil {
+		write_err = close_err
+	}
+
+	if write_err != nil {
+		c.Logger.Error("Failed to write %s, because %v", tmp, write_err)
+		c.SetMaxFilehandles()
+		os.Remove(tmp)
+		return writtenFile{}, &WriteError{Path: local, Err: write_err}
+	}
+
+	// Make sure we got everything the source said it was going to send before
+	// anything gets moved in to place. ContentLength is -1 when it's not known.
+
+	if read_err == nil && rsp.ContentLength >= 0 && n != rsp.ContentLength {
+		read_err = io.ErrUnexpectedEOF
+	}
+
+	if read_err != nil {
+
+		c.keepOrRemovePartial(rsp, source, local, tmp, offset+n)
+
+		if read_err == io.ErrUnexpectedEOF {
+
+			atomic.AddInt64(&c.Truncated, 1)
+
+			c.Logger.Error("failed to read body for %s, because we expected %d bytes and got %d", remote, rsp.ContentLength, n)
+			return writtenFile{}, &TruncatedError{URL: remote, Expected: offset + rsp.ContentLength, Actual: offset + n}
+		}
+
+		c.Logger.Error("failed to read body for %s, because %v", remote, read_err)
+		return writtenFile{}, &FetchError{Method: "GET", URL: remote, Attempt: 1, Err: read_err}
+	}
+
+	if offset == 0 && n == 0 && !c.AllowEmptyBodies && strings.HasSuffix(rel_path, ".geojson") {
+		atomic.AddInt64(&c.EmptyBody, 1)
+		os.Remove(tmp)
+		c.Logger.Error("failed to read body for %s, because it is empty", remote)
+		return writtenFile{}, &EmptyBodyError{URL: remote}
+	}
+
+	local_hash := hex.EncodeToString(hasher.Sum(nil))
+	source_hash := local_hash
+
+	if c.ContentFilter != nil {
+		source_hash = hex.EncodeToString(source_hasher.Sum(nil))
+	}
+
+	// See hash.go for details
+
+	if expected == "" && c.hasExplicitHash() {
+
+		expected, err = c.expectedHash(rel_path, nil)
+
+		if err != nil {
+			c.Logger.Error("Failed to determine the expected hash for %s, because %v", remote, err)
+			os.Remove(tmp)
+			return writtenFile{}, err
+		}
+	}
+
+	if expected != "" && expected != source_hash {
+		c.Logger.Error("download of %s has hash %s but expected %s", remote, source_hash, expected)
+		os.Remove(tmp)
+		return writtenFile{}, &HashMismatchError{Path: rel_path, Expected: expected, Actual: source_hash}
+	}
+
+	if offset > 0 {
+
+		// Since a resumed file has been assembled from more than one response
+		// double-check it against the ETag, when the ETag looks like a hash made
+		// with the same algorithm
+
+		etag := strings.ToLower(strings.Replace(rsp.Header.Get("Etag"), "\"", "", -1))
+
+		if looksLikeHash(c.hashAlgorithm(), etag) && etag != local_hash {
+			c.Logger.Error("resumed download of %s has hash %s but expected %s", remote, local_hash, etag)
+			os.Remove(tmp)
+			return writtenFile{}, &HashMismatchError{Path: rel_path, Expected: etag, Actual: local_hash}
+		}
+
+		c.Logger.Info("resumed download of %s at byte %d", remote, offset)
+	}
+
+	if c.validatesJSON(rel_path) {
+
+		err = c.validateLocal(tmp)
+
+		if err != nil {
+			c.Logger.Error("download of %s is not valid, because %v", remote, err)
+			os.Remove(tmp)
+			return writtenFile{}, &InvalidFileError{Path: rel_path}
+		}
+	}
+
+	// See falsechange.go
+
+	if (c.DetectFalseChanges || c.WriteIfDifferent) && offset == 0 && c.isIdentical(local, local_hash) {
+
+		os.Remove(tmp)
+
+		if c.RecordProvenance {
+			c.writeProvenance(local, rsp)
+		}
+
+		host := ""
+
+		if rsp.Request != nil {
+			host = rsp.Request.URL.Host
+		}
+
+		return writtenFile{}, &identicalError{Host: host}
+	}
+
+	err = c.moveFile(tmp, local)
+
+	if err != nil {
+		c.Logger.Error("Failed to move %s to %s, because %v", tmp, local, err)
+		os.Remove(tmp)
+		return writtenFile{}, &WriteError{Path: local, Err: err}
+	}
+
+	c.removeAlternate(local)
+	c.expected.Delete(rel_path)
+
+	if c.RecordProvenance {
+		c.writeProvenance(local, rsp)
+	}
+
+	if c.ContentFilter != nil {
+		c.writeSourceRecord(local, source_hash, strings.Replace(rsp.Header.Get("Etag"), "\"", "", -1))
+		return writtenFile{hash: local_hash, size: size, lastmod: scan.lastModified()}, nil
+	}
+
+	removeSourceRecord(local)
+
+	return writtenFile{hash: local_hash, size: offset + n, lastmod: scan.lastModified()}, nil
+}
+
+// openDownload returns the response to read local's contents from, the source it
+// came from and the offset at which the response body starts. If there is a partial
+// download of local that can be resumed then hasher will have already been fed its
+// contents.
+
+func (c *WOFClone) openDownload(remote string, local string, tmp string, hasher hash.Hash) (*http.Response, string, int64, error) {
+
+	v, ok := c.partials.Load(local)
+
+	if ok {
+
+		c.partials.Delete(local)
+
+		p := v.(*partialDownload)
+
+		rsp, err := c.resumeDownload(p, tmp, hasher)
+
+		if err == nil && rsp.StatusCode == 206 && !resumesAt(rsp, p.size) {
+			rsp.Body.Close()
+			err = fmt.Errorf("asked for bytes %d onwards but got Content-Range '%s'", p.size, rsp.Header.Get("Content-Range"))
+		}
+
+		if err == nil && rsp.StatusCode == 206 {
+			return rsp, p.source, p.size, nil
+		}
+
+		if err == nil {
+
+			// The source sent us the whole file (because it has changed or doesn't
+			// understand Range requests after all) so we'll just start over with that
+
+			c.Logger.Debug("unable to resume %s, got %s instead", p.url, rsp.Status)
+
+			hasher.Reset()
+			return rsp, p.source, 0, nil
+		}
+
+		c.Logger.Debug("unable to resume %s, because %v", p.url, err)
+
+		hasher.Reset()
+		os.Remove(tmp)
+	}
+
+	rsp, source, err := c.fetchWithMirrors("GET", remote)
+
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return rsp, source, 0, nil
+}
+
+func (c *WOFClone) resumeDownload(p *partialDownload, tmp string, hasher hash.Hash) (*http.Response, error) {
+
+	info, err := os.Stat(tmp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() != p.size {
+		return nil, fmt.Errorf("%s is %d bytes but expected %d", tmp, info.Size(), p.size)
+	}
+
+	fh, err := os.Open(tmp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(hasher, fh)
+	fh.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	header.Set("Range", fmt.Sprintf("bytes=%d-", p.size))
+	header.Set("If-Range", fmt.Sprintf("\"%s\"", p.etag))
+
+	return c.fetchWithHeader("GET", p.url, header)
+}
+
+// resumesAt returns true if rsp, a 206 response to a request for everything from offset
+// onwards, starts at offset. Anything else can't be appended to what has already been
+// downloaded.
+
+func resumesAt(rsp *http.Response, offset int64) bool {
+
+	// bytes 100-199/200 (or bytes 100-199/* if the source doesn't know the size)
+
+	var first, last int64
+
+	_, err := fmt.Sscanf(rsp.Header.Get("Content-Range"), "bytes %d-%d/", &first, &last)
+
+	return err == nil && first == offset && last >= first
+}
+
+// keepOrRemovePartial keeps tmp around to be resumed later if that's possible and
+// removes it otherwise.
+
+func (c *WOFClone) keepOrRemovePartial(rsp *http.Response, source string, local string, tmp string, size int64) {
+
+	etag := strings.Replace(rsp.Header.Get("Etag"), "\"", "", -1)
+	ranges := rsp.Header.Get("Accept-Ranges")
+
+	if !c.ResumeDownloads || c.CompressLocal || c.ContentFilter != nil || etag == "" || ranges != "bytes" || size == 0 || rsp.Request == nil {
+		os.Remove(tmp)
+		return
+	}
+
+	p := partialDownload{
+		source: source,
+		url:    rsp.Request.URL.String(),
+		etag:   etag,
+		size:   size,
+	}
+
+	c.partials.Store(local, &p)
+	c.Logger.Debug("keeping %d bytes of %s to resume later", size, p.url)
+}
+
+// copyBody copies body to both wr and hasher, distinguishing between errors
+// reading from the source and errors writing to disk.
+
+func copyBody(wr io.Writer, hasher hash.Hash, body io.Reader) (int64, error, error) {
+
+	buf := make([]byte, 32*1024)
+	total := int64(0)
+
+	for {
+
+		n, err := body.Read(buf)
+
+		if n > 0 {
+
+			hasher.Write(buf[:n])
+
+			_, write_err := wr.Write(buf[:n])
+
+			if write_err != nil {
+				return total, nil, write_err
+			}
+
+			total += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return total, nil, nil
+		}
+
+		if err != nil {
+			return total, err, nil
+		}
+	}
+}
+
+// writtenFile is the hash and size of a file as it was written, see wroteFile, and its
+// wof:lastmodified property if that was looked for (see scanLastModified). lastmod is 0
+// if the file doesn't have one and -1 if it wasn't looked for.
+
+type writtenFile struct {
+	hash    string
+	size    int64
+	lastmod int64
+}
+
+// wroteFile records that rel_path has just been written with contents whose hash and
+// size were worked out as they were written, so that what needs them (PostVerify, updated
+// meta files and c.WriteHook) doesn't have to read the file back to find them out.
+
+func (c *WOFClone) wroteFile(rel_path string, written writtenFile) {
+
+	if c.written != nil {
+		c.written.Add(rel_path, c.localRelPath(rel_path), written.hash)
+	}
+
+	if c.hashes != nil {
+		c.hashes.Store(rel_path, written)
+	}
+
+	if c.WriteHook != nil {
+		c.WriteHook(rel_path, written.hash, written.size)
+	}
+}
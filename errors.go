@@ -0,0 +1,572 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrServerError       = errors.New("server error")
+	ErrExcessiveErrors   = errors.New("excessive errors")
+	ErrAborted           = errors.New("aborted")
+	ErrTooLarge          = errors.New("file is larger than MaxFileSize")
+	ErrRunning           = errors.New("rows are already being scheduled, call Wait first")
+	ErrFailures          = errors.New("some files could not be cloned")
+	ErrDeadlineExceeded  = errors.New("deadline exceeded")
+	ErrTooManyBadRows    = errors.New("too many malformed rows")
+	ErrUnsafeBundleEntry = errors.New("path is outside the destination")
+	ErrEmptyMeta         = errors.New("meta file has no usable rows")
+	ErrNotModified       = errors.New("not modified")
+)
+
+// FetchError is returned when a request to a source fails, either because we never
+// got a response (in which case StatusCode is 0 and Err is the underlying error) or
+// because the response had an unexpected status code. FetchErrors with a 404 status
+// match ErrNotFound and those with a 5XX status match ErrServerError, using errors.Is.
+// Those whose status was treated as StatusNotModified match ErrNotModified.
+
+type FetchError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Attempt    int // 1 for the primary source, 2 for the first mirror and so on
+	Err        error
+	Action     StatusAction // what StatusActions said to do with StatusCode, if anything
+}
+
+func (e *FetchError) Error() string {
+
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("Failed to %s %s (attempt %d), %v", e.Method, e.URL, e.Attempt, e.Err)
+	}
+
+	return fmt.Sprintf("Failed to %s %s (attempt %d), %s", e.Method, e.URL, e.Attempt, e.Status)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FetchError) Is(target error) bool {
+
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == 404
+	case ErrServerError:
+		return e.StatusCode >= 500
+	case ErrNotModified:
+		return e.Action == StatusNotModified
+	default:
+		return false
+	}
+}
+
+// Retryable returns true for network errors and response codes that suggest the
+// same request might work if we try again later, unless StatusActions said otherwise.
+
+func (e *FetchError) Retryable() bool {
+
+	if e.Action != "" {
+		return e.Action == StatusRetryable
+	}
+
+	switch {
+	case e.StatusCode == 0:
+		return true
+	case e.StatusCode == 408 || e.StatusCode == 429:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+// TruncatedError is returned when a response body is shorter than its Content-Length.
+
+type TruncatedError struct {
+	URL      string
+	Expected int64
+	Actual   int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("Truncated response for %s, expected %d bytes but got %d", e.URL, e.Expected, e.Actual)
+}
+
+// EmptyBodyError is returned when a successful response for a GeoJSON file has an
+// empty body, see AllowEmptyBodies.
+
+type EmptyBodyError struct {
+	URL string
+}
+
+func (e *EmptyBodyError) Error() string {
+	return fmt.Sprintf("Empty response for %s", e.URL)
+}
+
+// HashMismatchError is returned when the contents of a file don't have the hash we
+// expected them to.
+
+type HashMismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("Hash mismatch for %s, expected %s but got %s", e.Path, e.Expected, e.Actual)
+}
+
+// FilterError is returned when a ContentFilter fails. Whether or not it is retried
+// depends on RetryFilterErrors.
+
+type FilterError struct {
+	Path      string
+	Err       error
+	Retryable bool
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("Failed to filter %s, because %v", e.Path, e.Err)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// IdMismatchError is returned when a meta file row's path doesn't match its id.
+
+type IdMismatchError struct {
+	Path string
+	Id   string
+}
+
+func (e *IdMismatchError) Error() string {
+	return fmt.Sprintf("Path %s does not match ID %s", e.Path, e.Id)
+}
+
+// RejectedPathError is returned for a meta file row whose path can't, or may not, be
+// cloned, see AllowedExtensions.
+
+type RejectedPathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *RejectedPathError) Error() string {
+	return fmt.Sprintf("Refusing to clone %s, because %s", e.Path, e.Reason)
+}
+
+// MetaFileError is returned when a (compressed) meta file can not be read.
+
+type MetaFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *MetaFileError) Error() string {
+	return fmt.Sprintf("Failed to read meta file %s, %v", e.Path, e.Err)
+}
+
+func (e *MetaFileError) Unwrap() error {
+	return e.Err
+}
+
+// PartialReadError is returned by CloneMetaFile when a meta file (Meta) couldn't be
+// read to the end. Rows is the number of rows (not counting the header) read before it
+// failed and Line the line it failed on, if that is known. The rows that were read are
+// still cloned and Summary and Report say what happened to them, so that it can be
+// decided whether to clone the whole meta file again or fix it and carry on.
+
+type PartialReadError struct {
+	Meta    string
+	Rows    int64
+	Line    int
+	Err     error
+	Summary *WOFCloneSummary
+	Report  *WOFCloneReport
+}
+
+func (e *PartialReadError) Error() string {
+
+	if e.Line > 0 {
+		return fmt.Sprintf("Failed to read meta file %s at line %d, after %d rows, %v", e.Meta, e.Line, e.Rows, e.Err)
+	}
+
+	return fmt.Sprintf("Failed to read meta file %s after %d rows, %v", e.Meta, e.Rows, e.Err)
+}
+
+func (e *PartialReadError) Unwrap() error {
+	return e.Err
+}
+
+// EmptyMetaError is returned, wrapped in a *MetaFileError, when a meta file (Path) has
+// nothing in it to clone, see AllowEmpty. Rows is the number of rows it has, not
+// counting the header. If it has rows then either none of them has a path or, if
+// MissingColumn is true, there isn't a Column column at all. It matches ErrEmptyMeta.
+
+type EmptyMetaError struct {
+	Path          string
+	Column        string
+	Rows          int64
+	MissingColumn bool
+}
+
+func (e *EmptyMetaError) Error() string {
+
+	switch {
+	case e.MissingColumn:
+		return fmt.Sprintf("there is no %s column", e.Column)
+	case e.Rows == 0:
+		return "there are no rows"
+	default:
+		return fmt.Sprintf("there are %d rows but none of them has a %s", e.Rows, e.Column)
+	}
+}
+
+func (e *EmptyMetaError) Is(target error) bool {
+	return target == ErrEmptyMeta
+}
+
+// InvalidFileError is returned when a file that should contain JSON (GeoJSON) doesn't.
+
+type InvalidFileError struct {
+	Path string
+}
+
+func (e *InvalidFileError) Error() string {
+	return fmt.Sprintf("%s is not valid JSON", e.Path)
+}
+
+// WriteError is returned when a file could not be written to disk.
+
+type WriteError struct {
+	Path string
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Failed to write %s, %v", e.Path, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// LocalReadError is returned when an existing file could not be read to decide
+// whether it has changed, see UnreadableLocal.
+
+type LocalReadError struct {
+	Path string
+	Err  error
+}
+
+func (e *LocalReadError) Error() string {
+	return fmt.Sprintf("Failed to read %s, %v", e.Path, e.Err)
+}
+
+func (e *LocalReadError) Unwrap() error {
+	return e.Err
+}
+
+// CloneError is returned by CloneMetaFile when a run did not complete successfully.
+// It matches Reason (for example ErrAborted or ErrExcessiveErrors) and the first error
+// that occurred during the run using errors.Is and errors.As.
+
+type CloneError struct {
+	Meta          string
+	Reason        error
+	Errors        int64
+	FirstPath     string
+	FirstErr      error
+	Failed        []string         // the files that were still failing when the run ended
+	FailedOmitted int64            // the number of failing files left out of Failed, see MaxFailureRecords
+	Summary       *WOFCloneSummary // how far the run got
+}
+
+func (e *CloneError) Error() string {
+
+	what := e.Meta
+
+	if what == "" {
+		what = "scheduled rows"
+	}
+
+	msg := fmt.Sprintf("Failed to clone %s, %v (%d errors)", what, e.Reason, e.Errors)
+
+	if e.FirstErr != nil {
+		msg = fmt.Sprintf("%s, the first of which was %s: %v", msg, e.FirstPath, e.FirstErr)
+	}
+
+	return msg
+}
+
+func (e *CloneError) Unwrap() []error {
+
+	errs := []error{e.Reason}
+
+	if e.FirstErr != nil {
+		errs = append(errs, e.FirstErr)
+	}
+
+	return errs
+}
+
+// PreflightError is returned by CloneMetaFile, before anything is fetched, when the
+// first file in a meta file doesn't look like it came from the right place. See
+// SkipPreflight.
+
+type PreflightError struct {
+	URL    string
+	Reason string
+	Err    error
+}
+
+func (e *PreflightError) Error() string {
+
+	msg := fmt.Sprintf("Refusing to clone from %s because %s", e.URL, e.Reason)
+
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s, %v", msg, e.Err)
+	}
+
+	return msg + ". Check Source (or set SkipPreflight)"
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// SelfCloneError is returned by CloneMetaFile when Source and Dest are the same place
+// (or one is inside the other), because of Reason. See AllowSelfClone.
+
+type SelfCloneError struct {
+	Source string
+	Dest   string
+	Reason string
+}
+
+func (e *SelfCloneError) Error() string {
+
+	return fmt.Sprintf("Refusing to clone %s in to %s because %s. Check Dest (or set AllowSelfClone)", e.Source, e.Dest, e.Reason)
+}
+
+// ConfigError is returned by NewValidatedWOFClone when Option (Source or Dest) can't
+// be used, because of Reason.
+
+type ConfigError struct {
+	Option string
+	Value  string
+	Reason string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+
+	msg := fmt.Sprintf("Invalid %s (%q) because %s", e.Option, e.Value, e.Reason)
+
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s, %v", msg, e.Err)
+	}
+
+	return msg
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ManifestError is returned when a previous run's manifest at Path can't be trusted to
+// describe what is in Dest, because of Reason. See IncrementalManifest.
+
+type ManifestError struct {
+	Path   string
+	Reason string
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("%s is out of date, because %s", e.Path, e.Reason)
+}
+
+// PathConflictError is returned when Path can't be written because there is a file at
+// Conflict where a directory is needed or, if IsDir is true, a directory at Path itself.
+// They aren't retried since they won't go away on their own, see ClobberConflicts.
+
+type PathConflictError struct {
+	Path     string
+	Conflict string
+	IsDir    bool
+}
+
+func (e *PathConflictError) Error() string {
+
+	if e.IsDir {
+		return fmt.Sprintf("Can't write %s because there is a directory there", e.Path)
+	}
+
+	return fmt.Sprintf("Can't write %s because %s is a file, not a directory", e.Path, e.Conflict)
+}
+
+// BundleError is returned when a bundle (see Bundle) can't be read, or when one of the
+// entries in it, Entry, can't be extracted. Entries whose paths would end up outside
+// Dest match ErrUnsafeBundleEntry.
+
+type BundleError struct {
+	URL   string
+	Entry string
+	Err   error
+}
+
+func (e *BundleError) Error() string {
+
+	if e.Entry == "" {
+		return fmt.Sprintf("Failed to read bundle %s, %v", e.URL, e.Err)
+	}
+
+	return fmt.Sprintf("Failed to extract %s from bundle %s, %v", e.Entry, e.URL, e.Err)
+}
+
+func (e *BundleError) Unwrap() error {
+	return e.Err
+}
+
+// MetaFilesError is returned by CloneMetaFiles when any of the meta files failed. Errors
+// maps each of them (or the directory or glob pattern that couldn't be read) to the
+// reason it failed.
+
+type MetaFilesError struct {
+	Errors map[string]error
+}
+
+func (e *MetaFilesError) Error() string {
+
+	paths := make([]string, 0, len(e.Errors))
+
+	for p := range e.Errors {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	return fmt.Sprintf("%d meta files failed, the first of which was %s: %v", len(paths), paths[0], e.Errors[paths[0]])
+}
+
+// IsRetryable returns true if err is the kind of error that might go away if the
+// same path is tried again.
+
+func IsRetryable(err error) bool {
+
+	var fetch_err *FetchError
+	var filter_err *FilterError
+	var conflict_err *PathConflictError
+	var read_err *LocalReadError
+
+	if errors.As(err, &filter_err) {
+		return filter_err.Retryable
+	}
+
+	if errors.As(err, &conflict_err) {
+		return false
+	}
+
+	if errors.As(err, &read_err) {
+		return false
+	}
+
+	if errors.As(err, &fetch_err) {
+		return fetch_err.Retryable()
+	}
+
+	return true
+}
+
+// ErrorCategory returns a short, human-readable description of the kind of error
+// err is, suitable for tallying in reports.
+
+func ErrorCategory(err error) string {
+
+	var fetch_err *FetchError
+	var truncated_err *TruncatedError
+	var empty_err *EmptyBodyError
+	var hash_err *HashMismatchError
+	var write_err *WriteError
+	var id_err *IdMismatchError
+	var rejected_err *RejectedPathError
+	var invalid_err *InvalidFileError
+	var filter_err *FilterError
+	var unknown_err *UnknownChangeError
+	var bundle_err *BundleError
+	var conflict_err *PathConflictError
+	var read_err *LocalReadError
+
+	switch {
+	case errors.As(err, &filter_err):
+		return "filter"
+	case errors.As(err, &unknown_err):
+		return "unknown change"
+	case errors.As(err, &bundle_err):
+		return "bundle"
+	case errors.As(err, &conflict_err):
+		return "path conflict"
+	case errors.As(err, &read_err) && errors.Is(err, os.ErrPermission):
+		return "permission denied"
+	case errors.As(err, &read_err):
+		return "local read error"
+	case errors.As(err, &fetch_err):
+
+		switch {
+		case fetch_err.StatusCode == 0:
+			return "network error"
+		case fetch_err.StatusCode == 404:
+			return "not found"
+		case fetch_err.StatusCode >= 500:
+			return "server error"
+		default:
+			return strings.ToLower(fmt.Sprintf("http %d", fetch_err.StatusCode))
+		}
+
+	case errors.As(err, &truncated_err):
+		return "truncated"
+	case errors.As(err, &empty_err):
+		return "empty body"
+	case errors.As(err, &hash_err):
+		return "hash mismatch"
+	case errors.As(err, &write_err):
+		return "write error"
+	case errors.As(err, &id_err):
+		return "id mismatch"
+	case errors.As(err, &rejected_err):
+		return "rejected path"
+	case errors.As(err, &invalid_err):
+		return "invalid"
+	default:
+		return "other"
+	}
+}
+
+// UnknownChangeError is returned when it isn't possible to tell whether a file has
+// changed and UnknownChanges is "fail". Err is the reason, if there was one.
+
+type UnknownChangeError struct {
+	Path string
+	Err  error
+}
+
+func (e *UnknownChangeError) Error() string {
+
+	if e.Err == nil {
+		return fmt.Sprintf("Unable to determine whether %s has changed", e.Path)
+	}
+
+	return fmt.Sprintf("Unable to determine whether %s has changed, because %v", e.Path, e.Err)
+}
+
+func (e *UnknownChangeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,112 @@
+package clone
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// excludeList is the set of rel_paths and IDs that are never cloned, see Exclude.
+
+type excludeList struct {
+	paths map[string]bool
+	ids   map[int64]bool
+}
+
+// loadExcludes returns the rel_paths and IDs in c.Exclude and c.ExcludeFile, or nil if
+// there aren't any. Each one is an ID if it is a number and a rel_path otherwise.
+// Blank lines, and lines starting with "#", in c.ExcludeFile are skipped.
+
+func (c *WOFClone) loadExcludes() (*excludeList, error) {
+
+	entries := make([]string, 0)
+	entries = append(entries, c.Exclude...)
+
+	if c.ExcludeFile != "" {
+
+		fh, err := os.Open(c.ExcludeFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open exclude file %s, %v", c.ExcludeFile, err)
+		}
+
+		defer fh.Close()
+
+		scanner := bufio.NewScanner(fh)
+
+		for scanner.Scan() {
+
+			line := strings.TrimSpace(scanner.Text())
+
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			entries = append(entries, line)
+		}
+
+		err = scanner.Err()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read exclude file %s, %v", c.ExcludeFile, err)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	excludes := excludeList{
+		paths: make(map[string]bool),
+		ids:   make(map[int64]bool),
+	}
+
+	for _, e := range entries {
+
+		e = strings.TrimSpace(e)
+
+		id, err := strconv.ParseInt(e, 10, 64)
+
+		if err == nil {
+			excludes.ids[id] = true
+			continue
+		}
+
+		excludes.paths[strings.TrimPrefix(e, "/")] = true
+	}
+
+	c.Logger.Info("Excluding %d paths and %d IDs", len(excludes.paths), len(excludes.ids))
+	return &excludes, nil
+}
+
+// isExcluded returns true if rel_path (as it is listed in a meta file) is in excludes,
+// or is a record (or an alternate geometry for a record) whose ID is, in which case it
+// is counted in c.Excluded and added to the report.
+
+func (c *WOFClone) isExcluded(excludes *excludeList, rel_path string) bool {
+
+	if excludes == nil {
+		return false
+	}
+
+	excluded := excludes.paths[strings.TrimPrefix(rel_path, "/")]
+
+	if !excluded && len(excludes.ids) > 0 {
+
+		id, err := IdForPath(rel_path)
+		excluded = err == nil && excludes.ids[id]
+	}
+
+	if !excluded {
+		return false
+	}
+
+	atomic.AddInt64(&c.Excluded, 1)
+	c.report.AddExcluded(rel_path)
+	c.decide(rel_path, DecisionExcluded)
+
+	return true
+}
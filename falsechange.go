@@ -0,0 +1,89 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// identicalError is returned by download when DetectFalseChanges or WriteIfDifferent
+// is true and what was fetched from Host is the same as the local copy, which is left
+// alone.
+
+type identicalError struct {
+	Host string
+}
+
+func (e *identicalError) Error() string {
+	return fmt.Sprintf("fetched file from %s is the same as the local copy", e.Host)
+}
+
+// isIdentical returns true if there is a copy of local already and its contents hash
+// to local_hash, which is the hash of what was just fetched.
+
+func (c *WOFClone) isIdentical(local string, local_hash string) bool {
+
+	_, err := os.Stat(local)
+
+	if err != nil {
+		return false
+	}
+
+	existing_hash, err := c.hashLocal(local)
+
+	if err != nil {
+		return false
+	}
+
+	return existing_hash == local_hash
+}
+
+// skipIdentical records that rel_path wasn't written because what was fetched from
+// host was the same as the local copy, and returns why. If it was only fetched because
+// of force_updates (forced) it is counted in SkippedIdentical, see WriteIfDifferent,
+// otherwise the source said it had changed and, if DetectFalseChanges is true, it is
+// counted as a false change.
+
+func (c *WOFClone) skipIdentical(rel_path string, host string, forced bool) Decision {
+
+	if forced || !c.DetectFalseChanges {
+
+		if c.debugging() {
+			c.Logger.Debug("%s is the same as the local copy, leaving it alone", rel_path)
+		}
+
+		atomic.AddInt64(&c.SkippedIdentical, 1)
+		return DecisionSkippedIdentical
+	}
+
+	if c.debugging() {
+		c.Logger.Debug("%s is the same as the local copy, even though %s said it had changed", rel_path, host)
+	}
+
+	atomic.AddInt64(&c.FalseChanges, 1)
+	c.report.AddFalseChange(host)
+
+	return DecisionSkippedFalseChange
+}
+
+// logFalseChanges logs how many files each host said had changed when they hadn't,
+// which usually means something in between (a CDN, say) is rewriting them and
+// changing their ETags.
+
+func (c *WOFClone) logFalseChanges() {
+
+	counts := c.report.FalseChanges()
+
+	hosts := make([]string, 0, len(counts))
+
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		c.Logger.Warning("%s reported %d files as changed that were the same as the local copy, check that nothing is rewriting them (try sending \"Accept-Encoding: identity\")", host, counts[host])
+	}
+}
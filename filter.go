@@ -0,0 +1,130 @@
+package clone
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// source_record_suffix is appended to the (hidden) file that records where a filtered
+// file came from, see ContentFilter.
+
+const source_record_suffix = ".source"
+
+// sourceReader wraps a response body to count the bytes read from it and to remember
+// any error reading it, so that errors from a ContentFilter can be told apart from
+// errors reading the response.
+
+type sourceReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+
+	n, err := r.Reader.Read(p)
+
+	r.n += int64(n)
+
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// sourceRecordPath returns the path of the file recording the hash and ETag of the
+// response that local was filtered from. It is a dot file alongside local, which
+// Verify (and most other things) will ignore.
+
+func sourceRecordPath(local string) string {
+
+	return filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+source_record_suffix)
+}
+
+// writeSourceRecord records the hash and ETag of the response that local was written
+// from, since local itself won't match either of them once it has been filtered.
+
+func (c *WOFClone) writeSourceRecord(local string, hash string, etag string) {
+
+	body := hash + " " + etag + "\n"
+
+	err := ioutil.WriteFile(sourceRecordPath(local), []byte(body), 0644)
+
+	if err != nil {
+		c.Logger.Warning("Failed to record the source of %s, because %v", local, err)
+	}
+}
+
+// readSourceRecord returns the hash and ETag recorded by writeSourceRecord for local.
+
+func readSourceRecord(local string) (string, string, error) {
+
+	body, err := ioutil.ReadFile(sourceRecordPath(local))
+
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(string(body))
+
+	switch len(fields) {
+	case 0:
+		return "", "", nil
+	case 1:
+		return fields[0], "", nil
+	default:
+		return fields[0], fields[1], nil
+	}
+}
+
+// removeSourceRecord removes the source record for local, if there is one.
+
+func removeSourceRecord(local string) {
+
+	os.Remove(sourceRecordPath(local))
+}
+
+// filteredHasChanged is HasChanged for when there is a ContentFilter. Since local has
+// been filtered its hash is meaningless so the ETag of the response it was filtered
+// from is compared with the source's current ETag instead. Whether files with no record
+// of where they came from have changed is Unknown.
+
+func (c *WOFClone) filteredHasChanged(local string, remote string) (ChangeState, error) {
+
+	_, etag, err := readSourceRecord(local)
+
+	if err != nil || etag == "" {
+		c.Logger.Debug("no record of the source for %s", local)
+		return Unknown, nil
+	}
+
+	remote_etag, err := c.remoteHash(remote)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	return changeState(remote_etag != etag), nil
+}
+
+// sourceHash returns the hash of the contents of local before any ContentFilter was
+// applied, which is what expected hashes (see HashSource) need to be compared with.
+
+func (c *WOFClone) sourceHash(local string) (string, error) {
+
+	if c.ContentFilter == nil {
+		return c.hashLocal(local)
+	}
+
+	hash, _, err := readSourceRecord(local)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
@@ -0,0 +1,36 @@
+package clone
+
+import (
+	"path"
+	"strings"
+)
+
+// isForcedPath returns true if rel_path (as it is listed in a meta file) matches one of
+// c.ForcePaths, either because it starts with it or because it matches it as a
+// path.Match pattern.
+
+func (c *WOFClone) isForcedPath(rel_path string) bool {
+
+	rel_path = strings.TrimPrefix(rel_path, "/")
+
+	for _, p := range c.ForcePaths {
+
+		p = strings.TrimPrefix(p, "/")
+
+		if p == "" {
+			continue
+		}
+
+		if strings.HasPrefix(rel_path, p) {
+			return true
+		}
+
+		ok, err := path.Match(p, rel_path)
+
+		if err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package clone
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// github_raw_root and github_api_root are variables rather than constants so they
+// can be pointed somewhere else, for example at a GitHub Enterprise install.
+
+var github_raw_root = "https://raw.githubusercontent.com/"
+var github_api_root = "https://api.github.com/"
+
+// SetGitHubSource sets c.Source to the files in the branch of a GitHub repository,
+// optionally below prefix (for example "data/" for the whosonfirst-data repos), by way
+// of raw.githubusercontent.com. Since GitHub doesn't report MD5 hashes as ETags change
+// detection compares git blob SHAs instead, asking the contents API for the SHA of each
+// remote file. For private repositories (or to get a more generous rate limit) use
+// SetBearerToken with a GitHub access token.
+
+func (c *WOFClone) SetGitHubSource(owner string, repo string, branch string, prefix string) error {
+
+	if owner == "" || repo == "" {
+		return errors.New("Missing GitHub owner or repository")
+	}
+
+	if branch == "" {
+		branch = "master"
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	c.Source = fmt.Sprintf("%s%s/%s/%s/%s", github_raw_root, owner, repo, branch, prefix)
+
+	c.LocalHash = gitBlobHash
+
+	c.RemoteHash = func(remote string) (string, error) {
+
+		rel_path := prefix + strings.TrimPrefix(remote, c.Source)
+		return c.gitHubBlobHash(owner, repo, branch, rel_path)
+	}
+
+	return nil
+}
+
+// gitBlobHash returns the SHA that git (and so GitHub) uses to identify body.
+
+func gitBlobHash(body []byte) string {
+
+	h := sha1.New()
+
+	fmt.Fprintf(h, "blob %d\x00", len(body))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// gitHubBlobHash asks the GitHub contents API for the blob SHA of rel_path.
+
+func (c *WOFClone) gitHubBlobHash(owner string, repo string, branch string, rel_path string) (string, error) {
+
+	api_url := fmt.Sprintf("%srepos/%s/%s/contents/%s?ref=%s", github_api_root, owner, repo, rel_path, url.QueryEscape(branch))
+
+	header := make(http.Header)
+	header.Set("Accept", "application/vnd.github.v3+json")
+
+	rsp, err := c.fetchWithHeader("GET", api_url, header)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	var contents struct {
+		SHA string `json:"sha"`
+	}
+
+	err = json.Unmarshal(body, &contents)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse GitHub contents for %s, %v", rel_path, err)
+	}
+
+	if contents.SHA == "" {
+		return "", fmt.Errorf("GitHub contents for %s did not include a SHA", rel_path)
+	}
+
+	return contents.SHA, nil
+}
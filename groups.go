@@ -0,0 +1,178 @@
+package clone
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GroupByPath groups files by the first component of their path, see GroupBy.
+
+const GroupByPath = "path"
+
+// GroupStats are the outcomes of the files in a group, see GroupBy. Scheduled is always
+// the sum of the other three.
+
+type GroupStats struct {
+	Scheduled int64 `json:"scheduled"`
+	Success   int64 `json:"success"`
+	Error     int64 `json:"error"`
+	Skipped   int64 `json:"skipped"`
+}
+
+// pendingGroup is the group of a file that has been read from the meta file but hasn't
+// finished yet, or that failed and may yet be retried.
+
+type pendingGroup struct {
+	group  string
+	failed bool
+}
+
+// groupTracker remembers the group of each file from the time its row is read until it
+// is finished, so that the group stats only need as much memory as there are groups
+// (and files in progress or failing) rather than rows.
+
+type groupTracker struct {
+	mu      *sync.Mutex
+	pending map[string]*pendingGroup
+}
+
+func newGroupTracker() *groupTracker {
+
+	t := groupTracker{
+		mu:      new(sync.Mutex),
+		pending: make(map[string]*pendingGroup),
+	}
+
+	return &t
+}
+
+// groupKey returns the group that rel_path, read from row (which may be nil), belongs
+// to: the value of the c.GroupBy column or, if there isn't one, the first component of
+// its path.
+
+func (c *WOFClone) groupKey(rel_path string, row map[string]string) string {
+
+	if c.GroupBy != GroupByPath && row[c.GroupBy] != "" {
+		return row[c.GroupBy]
+	}
+
+	return pathGroup(rel_path)
+}
+
+func pathGroup(rel_path string) string {
+
+	rel_path = strings.TrimPrefix(rel_path, data_prefix)
+
+	i := strings.Index(rel_path, "/")
+
+	if i == -1 {
+		return ""
+	}
+
+	return rel_path[:i]
+}
+
+// setGroup records that rel_path belongs to group until it is finished.
+
+func (c *WOFClone) setGroup(rel_path string, group string) {
+
+	t := c.groups
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[rel_path] = &pendingGroup{group: group}
+}
+
+// forgetGroup forgets the group of rel_path, which won't be cloned after all.
+
+func (c *WOFClone) forgetGroup(rel_path string) {
+
+	t := c.groups
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, rel_path)
+}
+
+// countGroup counts d, the outcome of rel_path, in the stats for its group replacing
+// previous (if it isn't "") or the failure it is being retried after. Files that aren't
+// part of a run from a meta file are grouped by their path.
+
+func (c *WOFClone) countGroup(rel_path string, d Decision, previous Decision) {
+
+	t := c.groups
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+
+	p, ok := t.pending[rel_path]
+
+	if !ok {
+		p = &pendingGroup{group: pathGroup(rel_path)}
+	}
+
+	if p.failed {
+		previous = DecisionFailed
+	}
+
+	if d == DecisionFailed {
+		p.failed = true
+		t.pending[rel_path] = p
+	} else {
+		delete(t.pending, rel_path)
+	}
+
+	t.mu.Unlock()
+
+	if previous != "" {
+		c.report.AddGroup(p.group, previous, -1)
+	}
+
+	if d != DecisionIgnored {
+		c.report.AddGroup(p.group, d, 1)
+	}
+}
+
+// logGroups logs the stats for each group, those with the most errors first.
+
+func (c *WOFClone) logGroups() {
+
+	groups := c.report.Groups()
+
+	names := make([]string, 0, len(groups))
+
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i int, j int) bool {
+
+		a := groups[names[i]]
+		b := groups[names[j]]
+
+		if a.Error != b.Error {
+			return a.Error > b.Error
+		}
+
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		g := groups[name]
+		c.Logger.Info("group %s: scheduled: %d success: %d error: %d skipped: %d", name, g.Scheduled, g.Success, g.Error, g.Skipped)
+	}
+}
@@ -0,0 +1,377 @@
+package clone
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The hash algorithms that can be used for HashAlgorithm.
+
+const (
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+)
+
+// The places that the expected hash of each file can come from, see HashSource.
+
+const (
+	HashSourceColumn  = "column"
+	HashSourceSidecar = "sidecar"
+	HashSourceETag    = "etag"
+)
+
+// hash_lengths are the lengths of the hex-encoded hashes for each algorithm, which is
+// how ETags are recognized as hashes (or not).
+
+var hash_lengths = map[string]int{
+	HashMD5:    32,
+	HashSHA1:   40,
+	HashSHA256: 64,
+}
+
+// max_sidecar_size is the most we'll read of a sidecar file, which is only expected to
+// contain a hash and (maybe) a filename.
+
+const max_sidecar_size = 4096
+
+func newHasher(algorithm string) (hash.Hash, error) {
+
+	switch algorithm {
+	case HashMD5, "":
+		return md5.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported hash algorithm '%s'", algorithm)
+	}
+}
+
+// checkHashOptions returns an error if HashAlgorithm or HashSource aren't valid.
+
+func (c *WOFClone) checkHashOptions() error {
+
+	_, err := newHasher(c.HashAlgorithm)
+
+	if err != nil {
+		return err
+	}
+
+	switch c.HashSource {
+	case "", HashSourceColumn, HashSourceETag:
+		return nil
+	case HashSourceSidecar:
+
+		if c.HashSidecarURL == "" {
+			return fmt.Errorf("HashSidecarURL must be set when HashSource is '%s'", HashSourceSidecar)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("Unsupported hash source '%s'", c.HashSource)
+	}
+}
+
+func (c *WOFClone) hashAlgorithm() string {
+
+	if c.HashAlgorithm == "" {
+		return HashMD5
+	}
+
+	return c.HashAlgorithm
+}
+
+// newHash returns a new hash.Hash for c.HashAlgorithm, which is checked when a run starts.
+
+func (c *WOFClone) newHash() hash.Hash {
+
+	h, err := newHasher(c.HashAlgorithm)
+
+	if err != nil {
+		return md5.New()
+	}
+
+	return h
+}
+
+// looksLikeHash returns true if s could be a hex-encoded hash made with algorithm.
+
+func looksLikeHash(algorithm string, s string) bool {
+
+	if len(s) != hash_lengths[algorithm] {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// hashFile returns the hash of local, reading it a bit at a time since it may be as
+// large as a meta file.
+
+func hashFile(local string, algorithm string) (string, error) {
+
+	fh, err := os.Open(local)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer fh.Close()
+
+	h, err := newHasher(algorithm)
+
+	if err != nil {
+		h = md5.New()
+	}
+
+	_, err = io.Copy(h, fh)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashBytes(body []byte, algorithm string) string {
+
+	h, err := newHasher(algorithm)
+
+	if err != nil {
+		h = md5.New()
+	}
+
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hasExplicitHash returns true if files are verified against a hash published
+// alongside them (see HashSource), rather than an ETag.
+
+func (c *WOFClone) hasExplicitHash() bool {
+	return c.HashSource == HashSourceColumn || c.HashSource == HashSourceSidecar
+}
+
+// expectedHash returns the hash that rel_path is expected to have according to
+// c.HashSource, or "" if there isn't one. row is the meta file row for rel_path and
+// may be nil, in which case any hash remembered by rememberHash is used.
+
+func (c *WOFClone) expectedHash(rel_path string, row map[string]string) (string, error) {
+
+	switch c.HashSource {
+	case HashSourceColumn:
+
+		if row != nil {
+
+			hash, ok := c.rowHash(row)
+
+			if !ok {
+				return "", nil
+			}
+
+			return hash, nil
+		}
+
+		return c.rememberedHash(rel_path), nil
+
+	case HashSourceSidecar:
+		return c.sidecarHash(rel_path)
+	default:
+		return "", nil
+	}
+}
+
+// rowHash returns the (lower case) hash in row's HashColumn and true, or false if
+// there isn't one or it doesn't look like a hash, see InvalidHash. row may be nil.
+
+func (c *WOFClone) rowHash(row map[string]string) (string, bool) {
+
+	hash, ok := row[c.HashColumn]
+
+	if !ok {
+		return "", false
+	}
+
+	hash = strings.ToLower(strings.TrimSpace(hash))
+
+	// Unless HashSource says otherwise HashColumn has MD5 hashes in it, whatever
+	// HashAlgorithm is
+
+	algorithm := HashMD5
+
+	if c.HashSource == HashSourceColumn {
+		algorithm = c.hashAlgorithm()
+	}
+
+	return hash, looksLikeHash(algorithm, hash)
+}
+
+// checkRowHash logs and counts (in InvalidHash) row, for rel_path, if there is
+// something in its HashColumn that doesn't look like a hash.
+
+func (c *WOFClone) checkRowHash(rel_path string, row map[string]string) {
+
+	value, ok := row[c.HashColumn]
+
+	if !ok {
+		return
+	}
+
+	_, valid := c.rowHash(row)
+
+	if valid {
+		return
+	}
+
+	atomic.AddInt64(&c.InvalidHash, 1)
+	c.Logger.Warning("%s has an invalid %s (%q), comparing the local copy with the source instead: %v", rel_path, c.HashColumn, value, row)
+}
+
+// rememberHash keeps the expected hash from row for when rel_path is downloaded, since
+// the meta file row isn't available by then.
+
+func (c *WOFClone) rememberHash(rel_path string, row map[string]string) {
+
+	if c.HashSource != HashSourceColumn {
+		return
+	}
+
+	hash, ok := c.rowHash(row)
+
+	if !ok {
+		return
+	}
+
+	c.expected.Store(rel_path, hash)
+}
+
+// rememberedHash returns the hash kept for rel_path by rememberHash, or "" if there
+// isn't one.
+
+func (c *WOFClone) rememberedHash(rel_path string) string {
+
+	v, ok := c.expected.Load(rel_path)
+
+	if !ok {
+		return ""
+	}
+
+	return v.(string)
+}
+
+// sidecarHash fetches the sidecar file for rel_path (see HashSidecarURL) and returns
+// the hash it contains. Sidecar files are expected to look like the output of sha256sum
+// (and friends): the hash, optionally followed by whitespace and a filename.
+
+func (c *WOFClone) sidecarHash(rel_path string) (string, error) {
+
+	remote := strings.Replace(c.HashSidecarURL, "{url}", c.Source+rel_path, -1)
+	remote = strings.Replace(remote, "{path}", rel_path, -1)
+
+	rsp, err := c.Fetch("GET", remote)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, max_sidecar_size))
+
+	if err != nil {
+		return "", &FetchError{Method: "GET", URL: remote, Attempt: 1, Err: err}
+	}
+
+	fields := strings.Fields(string(body))
+
+	if len(fields) == 0 || !looksLikeHash(c.hashAlgorithm(), strings.ToLower(fields[0])) {
+		return "", fmt.Errorf("%s does not contain a %s hash", remote, c.hashAlgorithm())
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// hasExpectedHashChanged compares local with the hash that rel_path is expected to have
+// (see expectedHash) falling back to CheckChanged if there isn't one.
+
+func (c *WOFClone) hasExpectedHashChanged(rel_path string, row map[string]string, local string, remote string) (ChangeState, error) {
+
+	expected, err := c.expectedHash(rel_path, row)
+
+	if err != nil {
+		c.Logger.Warning("Failed to determine the expected hash for %s, because %v", rel_path, err)
+		return Unknown, err
+	}
+
+	if expected == "" {
+		return c.CheckChanged(local, remote)
+	}
+
+	local_hash, err := c.sourceHash(local)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	if c.debugging() {
+		c.Logger.Debug("comparing expected %s hash (%s) for %s", c.hashAlgorithm(), expected, local)
+	}
+
+	return changeState(local_hash != expected), nil
+}
+
+// etagHasChanged is CheckChanged for when c.HashAlgorithm isn't MD5. An ETag that looks
+// like a hash in c.HashAlgorithm is compared with the local hash as usual. An ETag that
+// looks like an MD5 hash is compared with the MD5 hash of local but since it is only
+// used to decide whether to fetch a file, not to verify one, that's good enough.
+// Anything else is Unknown.
+
+func (c *WOFClone) etagHasChanged(local string, remote string) (ChangeState, error) {
+
+	etag, err := c.remoteHash(remote)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	return c.etagChanged(local, remote, etag)
+}
+
+// etagChanged is etagHasChanged once the source's ETag (etag) is known.
+
+func (c *WOFClone) etagChanged(local string, remote string, etag string) (ChangeState, error) {
+
+	etag = strings.ToLower(etag)
+
+	algorithm := c.hashAlgorithm()
+
+	if !looksLikeHash(algorithm, etag) {
+
+		if !looksLikeHash(HashMD5, etag) {
+			c.Logger.Debug("ETag for %s (%s) is not a hash", remote, etag)
+			return Unknown, nil
+		}
+
+		algorithm = HashMD5
+	}
+
+	local_hash, err := c.hashLocalAs(local, algorithm)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	return changeState(local_hash != etag), nil
+}
@@ -0,0 +1,64 @@
+package clone
+
+import (
+	"net/http"
+)
+
+// newHeadClient returns the client that HEAD requests are sent with during a run when
+// HeadKeepAlive is true. Every other request is sent with Connection: close (to keep
+// the number of open files down) but a run that is mostly checking whether files have
+// changed spends most of its time setting up connections for HEAD requests that each
+// take a few milliseconds, so these keep up to one idle connection per check worker
+// open and reuse them. It is built from c's own client and transport when the run
+// starts so that it has the same TLS, proxy and redirect settings.
+
+func (c *WOFClone) newHeadClient() *http.Client {
+
+	t := c.transport.Clone()
+
+	idle := c.CheckWorkers
+
+	if idle < 1 {
+		idle = 1
+	}
+
+	t.DisableKeepAlives = false
+	t.MaxIdleConnsPerHost = idle
+
+	if t.MaxIdleConns > 0 && t.MaxIdleConns < idle {
+		t.MaxIdleConns = idle
+	}
+
+	cl := *c.client
+	cl.Transport = t
+
+	return &cl
+}
+
+// clientFor returns the client that req should be sent with, and whether or not the
+// connection should be closed once it is done.
+
+func (c *WOFClone) clientFor(req *http.Request) (*http.Client, bool) {
+
+	head_client := c.head_client
+
+	if req.Method == "HEAD" && head_client != nil {
+		return head_client, false
+	}
+
+	// See http2.go
+
+	return c.client, !c.isMultiplexed(req.URL.Host)
+}
+
+// closeHeadClient closes any idle connections kept open by the run's HEAD client.
+
+func (c *WOFClone) closeHeadClient() {
+
+	if c.head_client == nil {
+		return
+	}
+
+	c.head_client.CloseIdleConnections()
+	c.head_client = nil
+}
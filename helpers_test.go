@@ -0,0 +1,196 @@
+package clone
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClone returns a WOFClone that clones from source into a temporary directory,
+// without any status lines.
+
+func newTestClone(t *testing.T, source string) *WOFClone {
+
+	t.Helper()
+
+	c, err := NewWOFClone(source, t.TempDir(), 2, nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create clone, %v", err)
+	}
+
+	c.StatusInterval = -1
+	return c
+}
+
+// writeMetaFile writes a meta file with a path column and one row for each of paths.
+
+func writeMetaFile(t *testing.T, paths ...string) string {
+
+	t.Helper()
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+	body := "path\n" + strings.Join(paths, "\n") + "\n"
+
+	err := ioutil.WriteFile(meta, []byte(body), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", meta, err)
+	}
+
+	return meta
+}
+
+// testSource is an httptest server that serves files from memory, with their MD5 hash as
+// their ETag (as the WOF data servers do), and counts the requests for each of them.
+
+type testSource struct {
+	URL      string
+	mu       sync.Mutex
+	files    map[string]string
+	status   map[string]int
+	failures map[string]int // the number of requests left to fail, or -1 for all of them
+	requests map[string]int
+	delay    time.Duration
+}
+
+// newTestSource starts a testSource, which is closed when the test finishes.
+
+func newTestSource(t *testing.T) *testSource {
+
+	t.Helper()
+
+	s := testSource{
+		files:    make(map[string]string),
+		status:   make(map[string]int),
+		failures: make(map[string]int),
+		requests: make(map[string]int),
+	}
+
+	server := httptest.NewServer(&s)
+	t.Cleanup(server.Close)
+
+	s.URL = server.URL + "/"
+	return &s
+}
+
+// set sets the body served for rel_path.
+
+func (s *testSource) set(rel_path string, body string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[rel_path] = body
+}
+
+// fail makes every request for rel_path fail with status.
+
+func (s *testSource) fail(rel_path string, status int) {
+
+	s.failFirst(rel_path, status, -1)
+}
+
+// failFirst makes the next count requests for rel_path fail with status.
+
+func (s *testSource) failFirst(rel_path string, status int, count int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status[rel_path] = status
+	s.failures[rel_path] = count
+}
+
+// slow makes every request take at least delay.
+
+func (s *testSource) slow(delay time.Duration) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delay = delay
+}
+
+// count returns the number of requests (of any method) for rel_path so far.
+
+func (s *testSource) count(rel_path string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[rel_path]
+}
+
+func (s *testSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	rel_path := strings.TrimPrefix(r.URL.Path, "/")
+
+	s.mu.Lock()
+	s.requests[rel_path] += 1
+	status := s.status[rel_path]
+	failures := s.failures[rel_path]
+	body, ok := s.files[rel_path]
+	delay := s.delay
+
+	if failures > 0 {
+		s.failures[rel_path] = failures - 1
+	}
+
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+
+	if failures != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	hash := md5.Sum([]byte(body))
+
+	w.Header().Set("ETag", "\""+hex.EncodeToString(hash[:])+"\"")
+	w.Write([]byte(body))
+}
+
+// testLogger is a Logger that keeps every message, prefixed with its level.
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) log(level string, format string, v ...interface{}) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, level+": "+fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Debug(format string, v ...interface{})   { l.log("debug", format, v...) }
+func (l *testLogger) Info(format string, v ...interface{})    { l.log("info", format, v...) }
+func (l *testLogger) Warning(format string, v ...interface{}) { l.log("warning", format, v...) }
+func (l *testLogger) Error(format string, v ...interface{})   { l.log("error", format, v...) }
+
+// Lines returns the messages logged so far.
+
+func (l *testLogger) Lines() []string {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
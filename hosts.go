@@ -0,0 +1,75 @@
+package clone
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// hostLimiter caps the number of requests in flight to any one host. A request holds
+// its slot until the response body is closed (or the request fails) so it is
+// important that every response returned by Fetch gets closed.
+
+type hostLimiter struct {
+	mu    *sync.Mutex
+	slots map[string]chan bool
+}
+
+func newHostLimiter() *hostLimiter {
+
+	l := hostLimiter{
+		mu:    new(sync.Mutex),
+		slots: make(map[string]chan bool),
+	}
+
+	return &l
+}
+
+// acquire blocks until there are fewer than max requests in flight to host, or ctx
+// is cancelled, and returns a function to call once the request is finished.
+
+func (l *hostLimiter) acquire(ctx context.Context, host string, max int) (func(), error) {
+
+	l.mu.Lock()
+
+	slots, ok := l.slots[host]
+
+	if !ok || cap(slots) != max {
+		slots = make(chan bool, max)
+		l.slots[host] = slots
+	}
+
+	l.mu.Unlock()
+
+	select {
+	case slots <- true:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	once := new(sync.Once)
+
+	release := func() {
+		once.Do(func() {
+			<-slots
+		})
+	}
+
+	return release, nil
+}
+
+// releaseOnClose wraps a response body so that its host slot is released when the
+// body is closed.
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
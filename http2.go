@@ -0,0 +1,68 @@
+package clone
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Requests are usually sent with Connection: close, to keep the number of open files
+// down, but that also stops HTTP/2 from multiplexing them over a single connection
+// (which is the whole point) so once a host has been seen to speak HTTP/2 requests to
+// it leave the connection open instead. See clientFor.
+
+// SetForceHTTP1 stops requests being made using HTTP/2, even when the source supports
+// it, which can help when something between here and the source mangles HTTP/2
+// connections. It must be called before anything has been fetched.
+
+func (c *WOFClone) SetForceHTTP1(force bool) {
+
+	if force {
+
+		c.transport.ForceAttemptHTTP2 = false
+		c.transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+
+		// The TLS config copied from http.DefaultTransport already offers HTTP/2
+		// to servers, which would happily agree to it
+
+		cfg := c.transport.TLSClientConfig
+
+		if cfg != nil {
+
+			protos := make([]string, 0)
+
+			for _, p := range cfg.NextProtos {
+
+				if p != "h2" {
+					protos = append(protos, p)
+				}
+			}
+
+			cfg.NextProtos = protos
+		}
+
+		return
+	}
+
+	c.transport.ForceAttemptHTTP2 = true
+	c.transport.TLSNextProto = nil
+}
+
+// observeProtocol remembers that the host req was sent to speaks HTTP/2, if rsp says
+// so.
+
+func (c *WOFClone) observeProtocol(req *http.Request, rsp *http.Response) {
+
+	if rsp.ProtoMajor != 2 {
+		return
+	}
+
+	c.h2_hosts.Store(req.URL.Host, true)
+}
+
+// isMultiplexed returns true if host has been seen to speak HTTP/2.
+
+func (c *WOFClone) isMultiplexed(host string) bool {
+
+	_, ok := c.h2_hosts.Load(host)
+	return ok
+}
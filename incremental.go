@@ -0,0 +1,258 @@
+package clone
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// incremental_spot_checks is the number of files listed in a previous manifest that
+// are checked to still be in Dest before it is trusted, see loadPreviousManifest.
+
+const incremental_spot_checks = 20
+
+// manifestEntry is a single row of a previous run's manifest.
+
+type manifestEntry struct {
+	hash    string
+	size    int64
+	lastmod int64
+	local   string // relative to Dest
+}
+
+// previousManifest is the manifest written by a previous run, see IncrementalManifest.
+
+type previousManifest struct {
+	entries map[string]manifestEntry
+}
+
+// cachedManifest is a previousManifest, or nil if it couldn't be used, and the
+// modification time of the file it was read from.
+
+type cachedManifest struct {
+	manifest *previousManifest
+	modtime  time.Time
+}
+
+// manifestCache holds previous manifests once they have been read. It is shared by
+// every session (see newSession) so that runs that start at the same time, or one
+// after the other, only read a manifest again once it has been replaced.
+
+type manifestCache struct {
+	mu     sync.Mutex
+	loaded map[string]cachedManifest
+}
+
+func newManifestCache() *manifestCache {
+
+	m := manifestCache{
+		loaded: make(map[string]cachedManifest),
+	}
+
+	return &m
+}
+
+// previousManifest returns c.IncrementalManifest, reading it the first time it is
+// asked for, or nil if there isn't one or it can't be used.
+
+func (c *WOFClone) previousManifest() *previousManifest {
+
+	if c.IncrementalManifest == "" {
+		return nil
+	}
+
+	if !c.canCompareManifestHashes() {
+		c.Logger.Warning("The hashes in %s can't be compared with the meta file's (because of ContentFilter or HashSource), checking every file instead", c.IncrementalManifest)
+		return nil
+	}
+
+	path := c.IncrementalManifest
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		c.Logger.Warning("Not using %s, because %v, checking every file instead", path, err)
+		return nil
+	}
+
+	cache := c.manifests
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cached, ok := cache.loaded[path]
+
+	if ok && cached.modtime.Equal(info.ModTime()) {
+		return cached.manifest
+	}
+
+	m, err := c.loadPreviousManifest(path, info)
+
+	if err != nil {
+		c.Logger.Warning("Not using %s, because %v, checking every file instead", path, err)
+		m = nil
+	}
+
+	cache.loaded[path] = cachedManifest{manifest: m, modtime: info.ModTime()}
+	return m
+}
+
+// canCompareManifestHashes returns true if the hashes in a manifest, which are of the
+// local copies of files, are made the same way as the meta file's.
+
+func (c *WOFClone) canCompareManifestHashes() bool {
+
+	if c.ContentFilter != nil {
+		return false
+	}
+
+	switch c.HashSource {
+	case HashSourceColumn:
+		return true
+	case "":
+		return c.hashAlgorithm() == HashMD5
+	default:
+		return false
+	}
+}
+
+// loadPreviousManifest reads the manifest at path, whose details are info, returning
+// an error if it is older than c.IncrementalMaxAge or any of the first few files it
+// lists are missing from (or, unless c.CompressLocal is true, a different size in)
+// c.Dest, since then it can't be trusted to describe what is there.
+
+func (c *WOFClone) loadPreviousManifest(path string, info os.FileInfo) (*previousManifest, error) {
+
+	age := time.Since(info.ModTime())
+
+	if c.IncrementalMaxAge > 0 && age > c.IncrementalMaxAge {
+		return nil, &ManifestError{Path: path, Reason: "it is " + age.Round(time.Second).String() + " old"}
+	}
+
+	reader, err := openMetaFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	entries := make(map[string]manifestEntry)
+
+	for {
+
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		rel_path := row["path"]
+
+		if rel_path == "" || row["file_hash"] == "" {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(row["size"], 10, 64)
+		lastmod, _ := strconv.ParseInt(row["lastmodified"], 10, 64)
+
+		local := row[manifest_local_path]
+
+		if local == "" {
+			local = rel_path
+		}
+
+		entries[rel_path] = manifestEntry{
+			hash:    strings.ToLower(row["file_hash"]),
+			size:    size,
+			lastmod: lastmod,
+			local:   local,
+		}
+	}
+
+	checked := 0
+
+	for _, e := range entries {
+
+		if checked == incremental_spot_checks {
+			break
+		}
+
+		checked += 1
+
+		local := filepath.Join(c.Dest, e.local)
+		local_info, err := os.Stat(local)
+
+		if err != nil {
+			return nil, &ManifestError{Path: path, Reason: local + " is missing"}
+		}
+
+		if !c.CompressLocal && local_info.Size() != e.size {
+			return nil, &ManifestError{Path: path, Reason: local + " is not the size it lists"}
+		}
+	}
+
+	c.Logger.Info("Read %d files from %s, only rows that don't match will be checked", len(entries), path)
+
+	m := previousManifest{
+		entries: entries,
+	}
+
+	return &m, nil
+}
+
+// isUnchangedSinceManifest returns true if the meta file says that rel_path has the
+// same hash as when the previous manifest was written, and is still stored in the same
+// place, without looking at the source or the local copy.
+
+func (c *WOFClone) isUnchangedSinceManifest(rel_path string, row map[string]string) bool {
+
+	m := c.previous
+
+	if m == nil || row == nil {
+		return false
+	}
+
+	hash := strings.ToLower(row[c.HashColumn])
+
+	if hash == "" {
+		return false
+	}
+
+	e, ok := m.entries[rel_path]
+
+	if !ok || e.hash != hash {
+		return false
+	}
+
+	return e.local == c.localRelPath(rel_path)
+}
+
+// skipUnchangedSinceManifest records that rel_path was skipped because it hasn't
+// changed since the previous manifest, copying its entry to the new one.
+
+func (c *WOFClone) skipUnchangedSinceManifest(rel_path string) {
+
+	atomic.AddInt64(&c.Scheduled, 1)
+	atomic.AddInt64(&c.Completed, 1)
+	atomic.AddInt64(&c.Skipped, 1)
+	atomic.AddInt64(&c.SkippedManifest, 1)
+	c.addMetric(MetricFilesScheduled, 1)
+	c.addMetric(MetricFilesSkipped, 1)
+
+	if c.manifest != nil {
+		e := c.previous.entries[rel_path]
+		c.manifest.Add(rel_path, e.local, e.hash, e.size, time.Unix(e.lastmod, 0))
+	}
+
+	c.decide(rel_path, DecisionSkippedManifest)
+}
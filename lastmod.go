@@ -0,0 +1,77 @@
+package clone
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// default_lastmod_tolerance is the default value for WOFClone.LastModifiedTolerance
+
+const default_lastmod_tolerance = 5 * time.Minute
+
+// lastModified returns the time in rsp's Last-Modified header and true, or false if
+// there isn't one or it can't be believed, because it is the Unix epoch (or earlier)
+// or further in the future than c.LastModifiedTolerance allows for clocks being out.
+// Ones that can't be believed are counted, by host, see BogusLastModified.
+
+func (c *WOFClone) lastModified(rsp *http.Response) (time.Time, bool) {
+
+	header := rsp.Header.Get("Last-Modified")
+
+	if header == "" {
+		return time.Time{}, false
+	}
+
+	lastmod, err := http.ParseTime(header)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	tolerance := c.LastModifiedTolerance
+
+	if tolerance <= 0 {
+		tolerance = default_lastmod_tolerance
+	}
+
+	if lastmod.Unix() > 0 && lastmod.Before(time.Now().Add(tolerance)) {
+		return lastmod, true
+	}
+
+	host := ""
+
+	if rsp.Request != nil {
+		host = rsp.Request.URL.Host
+	}
+
+	if c.debugging() {
+		c.Logger.Debug("Ignoring implausible Last-Modified header (%s) from %s", header, host)
+	}
+
+	atomic.AddInt64(&c.BogusLastModified, 1)
+	c.report.AddBogusLastModified(host)
+
+	return time.Time{}, false
+}
+
+// logBogusLastModified logs how many implausible Last-Modified headers each host sent,
+// so that it can be taken up with whoever runs it.
+
+func (c *WOFClone) logBogusLastModified() {
+
+	counts := c.report.BogusLastModified()
+
+	hosts := make([]string, 0, len(counts))
+
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		c.Logger.Warning("%s sent %d implausible Last-Modified headers, which were ignored", host, counts[host])
+	}
+}
@@ -0,0 +1,147 @@
+package clone
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-log"
+)
+
+// Logger is what a WOFClone logs with. *log.WOFLogger satisfies it, and so will a thin
+// wrapper around most other logging packages. Messages are printf-style.
+
+type Logger interface {
+	Debug(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Warning(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// DebugLogger is implemented by a Logger that can say whether it will actually emit
+// debug messages. Debug messages are only put together when it will, or when a Logger
+// doesn't implement it (and isn't a *log.WOFLogger, which is checked directly) since
+// formatting thousands of lines per second that nobody will see is a measurable part
+// of a large clone.
+
+type DebugLogger interface {
+	DebugEnabled() bool
+}
+
+// discardLogger is the Logger used when NewWOFClone is given a nil logger.
+
+type discardLogger struct{}
+
+func (l discardLogger) Debug(format string, v ...interface{})   {}
+func (l discardLogger) Info(format string, v ...interface{})    {}
+func (l discardLogger) Warning(format string, v ...interface{}) {}
+func (l discardLogger) Error(format string, v ...interface{})   {}
+func (l discardLogger) DebugEnabled() bool                      { return false }
+
+// ensureLogger returns logger or, if it is nil (including a nil *log.WOFLogger), a
+// Logger that discards everything.
+
+func ensureLogger(logger Logger) Logger {
+
+	if logger == nil {
+		return discardLogger{}
+	}
+
+	wof_logger, ok := logger.(*log.WOFLogger)
+
+	if ok && wof_logger == nil {
+		return discardLogger{}
+	}
+
+	return logger
+}
+
+// NewWOFCloneWithWOFLogger is NewWOFClone for code that already has a *log.WOFLogger,
+// which (as before there was a Logger interface) may be nil.
+
+func NewWOFCloneWithWOFLogger(source string, dest string, procs int, logger *log.WOFLogger) (*WOFClone, error) {
+
+	return NewWOFClone(source, dest, procs, logger)
+}
+
+// debugEnabled returns false if logger is known to throw debug messages away.
+
+func debugEnabled(logger Logger) bool {
+
+	switch l := logger.(type) {
+	case DebugLogger:
+		return l.DebugEnabled()
+	case *log.WOFLogger:
+		_, ok := l.Loggers["debug"]
+		return ok
+	default:
+		return true
+	}
+}
+
+// debugging returns true if c.Logger will emit debug messages. It is checked each time,
+// rather than once, because loggers can be added to a *log.WOFLogger at any point.
+
+func (c *WOFClone) debugging() bool {
+
+	return debugEnabled(c.Logger)
+}
+
+// labelLogger is a Logger that prefixes every message with "[label] ", see RunLabel.
+
+type labelLogger struct {
+	logger Logger
+	label  string
+}
+
+func (l *labelLogger) Debug(format string, v ...interface{}) {
+	l.logger.Debug("[%s] "+format, append([]interface{}{l.label}, v...)...)
+}
+
+func (l *labelLogger) Info(format string, v ...interface{}) {
+	l.logger.Info("[%s] "+format, append([]interface{}{l.label}, v...)...)
+}
+
+func (l *labelLogger) Warning(format string, v ...interface{}) {
+	l.logger.Warning("[%s] "+format, append([]interface{}{l.label}, v...)...)
+}
+
+func (l *labelLogger) Error(format string, v ...interface{}) {
+	l.logger.Error("[%s] "+format, append([]interface{}{l.label}, v...)...)
+}
+
+func (l *labelLogger) DebugEnabled() bool {
+	return debugEnabled(l.logger)
+}
+
+// runLabel returns the label for a run of meta (which may be ""), see RunLabel.
+
+func (c *WOFClone) runLabel(meta string) string {
+
+	switch {
+	case c.meta_options.Label != "":
+		return c.meta_options.Label
+	case c.RunLabel != "":
+		return c.RunLabel
+	case c.LabelLogs:
+		return metaLabel(meta)
+	default:
+		return ""
+	}
+}
+
+// labelRun sets the label for a run of meta and has c.Logger prefix it to everything
+// logged. It is called by sessions as soon as they are created, so that everything
+// from checking the source onwards is labeled, and again by startRun which, since a
+// labelLogger is never wrapped in another one, is harmless.
+
+func (c *WOFClone) labelRun(meta string) {
+
+	c.run_label = c.runLabel(meta)
+
+	logger, ok := c.Logger.(*labelLogger)
+
+	if ok {
+		c.Logger = logger.logger
+	}
+
+	if c.run_label != "" {
+		c.Logger = &labelLogger{logger: c.Logger, label: c.run_label}
+	}
+}
@@ -0,0 +1,120 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunLabelsShareALogger(t *testing.T) {
+
+	source := newTestSource(t)
+
+	for i := 1; i <= 10; i++ {
+		source.set(fmt.Sprintf("%d/%d.geojson", i, i), fmt.Sprintf(`{"id":%d}`, i))
+	}
+
+	source.fail("11/11.geojson", 404)
+
+	logger := new(testLogger)
+	labels := []string{"alpha", "beta"}
+
+	clones := make([]*WOFClone, len(labels))
+
+	for i, label := range labels {
+
+		c, err := NewWOFClone(source.URL, t.TempDir(), 2, logger)
+
+		if err != nil {
+			t.Fatalf("Failed to create clone, %v", err)
+		}
+
+		c.StatusInterval = -1
+		c.AllowFailures = true
+		c.RunLabel = label
+
+		clones[i] = c
+	}
+
+	meta := writeMetaFile(t, "1/1.geojson", "2/2.geojson", "3/3.geojson", "11/11.geojson")
+
+	wg := new(sync.WaitGroup)
+	errs := make([]error, len(clones))
+
+	for i, c := range clones {
+
+		wg.Add(1)
+
+		go func(i int, c *WOFClone) {
+			defer wg.Done()
+			errs[i] = c.CloneMetaFile(meta, false, false)
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+
+		if err != nil {
+			t.Fatalf("Clone %s failed, %v", labels[i], err)
+		}
+	}
+
+	counts := make(map[string]int)
+
+	for _, line := range logger.Lines() {
+
+		// Lines are "level: message", see testLogger
+
+		message := line[strings.Index(line, ": ")+2:]
+		labelled := false
+
+		for i, label := range labels {
+
+			if !strings.HasPrefix(message, "["+label+"] ") {
+				continue
+			}
+
+			labelled = true
+			counts[label] += 1
+
+			// A message about one clone's destination is never labelled as the other's
+
+			other := clones[1-i].Dest
+
+			if strings.Contains(message, other) {
+				t.Errorf("Expected a message about %s not to be labelled %s, %s", other, label, line)
+			}
+		}
+
+		if !labelled {
+			t.Errorf("Expected every line to be labelled, %s", line)
+		}
+	}
+
+	for _, label := range labels {
+
+		if counts[label] == 0 {
+			t.Errorf("Expected some lines to be labelled %s", label)
+		}
+	}
+
+	// Warnings about the failed file are labelled too
+
+	for _, label := range labels {
+
+		found := false
+
+		for _, line := range logger.Lines() {
+
+			if strings.HasPrefix(line, "warning: ["+label+"] ") && strings.Contains(line, "11/11.geojson") {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("Expected a warning about 11/11.geojson labelled %s", label)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package clone
+
+import (
+	"github.com/whosonfirst/go-whosonfirst-csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The manifest is written using the same columns (and dialect) as the WOF meta
+// files so that it can be diffed against the meta file that produced it or fed
+// back in to anything that already knows how to read meta files.
+
+var manifest_fieldnames = []string{"path", "file_hash", "size", "lastmodified"}
+
+// When files are stored somewhere other than their relative path (see DestPath) the
+// manifest has an extra column with where they were actually stored.
+
+const manifest_local_path = "local_path"
+
+// manifest rows are written to a temporary file as they are produced (so we don't
+// need to hold them all in memory) which is renamed in to place when it is closed.
+
+type manifest struct {
+	mu     *sync.Mutex
+	path   string
+	tmp    string
+	fh     *os.File
+	writer *csv.DictWriter
+	mapped bool
+}
+
+func newManifest(path string, mapped bool) (*manifest, error) {
+
+	abs_path, err := filepath.Abs(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := abs_path + ".tmp"
+
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fieldnames := manifest_fieldnames
+
+	if mapped {
+		fieldnames = append(fieldnames[:len(fieldnames):len(fieldnames)], manifest_local_path)
+	}
+
+	writer, err := csv.NewDictWriter(fh, fieldnames)
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	writer.WriteHeader()
+
+	m := manifest{
+		mu:     new(sync.Mutex),
+		path:   abs_path,
+		tmp:    tmp,
+		fh:     fh,
+		writer: writer,
+		mapped: mapped,
+	}
+
+	return &m, nil
+}
+
+// Add records rel_path, which is stored at dest_rel (relative to Dest).
+
+func (m *manifest) Add(rel_path string, dest_rel string, hash string, size int64, lastmod time.Time) {
+
+	row := map[string]string{
+		"path":         rel_path,
+		"file_hash":    hash,
+		"size":         strconv.FormatInt(size, 10),
+		"lastmodified": strconv.FormatInt(lastmod.Unix(), 10),
+	}
+
+	if m.mapped {
+		row[manifest_local_path] = dest_rel
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writer.WriteRow(row)
+}
+
+func (m *manifest) Close() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writer.Writer.Flush()
+
+	err := m.writer.Writer.Error()
+
+	if err != nil {
+		m.fh.Close()
+		return err
+	}
+
+	err = m.fh.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(m.tmp, m.path)
+}
+
+// addSkippedToManifest records a file that was not fetched, using its current
+// local hash, so that the manifest describes the whole clone and not just the
+// files that changed.
+
+func (c *WOFClone) addSkippedToManifest(rel_path string, local string) {
+
+	m := c.manifest
+
+	if m == nil {
+		return
+	}
+
+	info, err := os.Stat(local)
+
+	if err != nil {
+		c.Logger.Warning("Failed to stat %s for manifest, because %v", local, err)
+		return
+	}
+
+	hash, err := c.hashLocal(local)
+
+	if err != nil {
+		c.Logger.Warning("Failed to hash %s for manifest, because %v", local, err)
+		return
+	}
+
+	m.Add(rel_path, c.localRelPath(rel_path), hash, info.Size(), info.ModTime())
+}
@@ -0,0 +1,131 @@
+package clone
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	gocsv "encoding/csv"
+	"errors"
+	"github.com/whosonfirst/go-whosonfirst-csv"
+	"io"
+	"os"
+)
+
+var (
+	gzip_magic  = []byte{0x1f, 0x8b}
+	bzip2_magic = []byte("BZh")
+)
+
+// metaFile is an open meta file and the (possibly decompressing) CSV reader for it.
+
+type metaFile struct {
+	*csv.DictReader
+	fh *os.File
+}
+
+func (m *metaFile) Close() error {
+	return m.fh.Close()
+}
+
+// openMetaFile opens the meta file at path for reading. Meta files compressed with
+// gzip or bzip2 (for example wof-locality-latest.csv.bz2) are detected by sniffing
+// their first few bytes and decompressed transparently. Errors reading a compressed
+// stream are returned as a *MetaFileError naming path.
+
+func openMetaFile(path string) (*metaFile, error) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := decompressMetaFile(path, fh)
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	reader, err := csv.NewDictReader(r)
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	m := metaFile{
+		DictReader: reader,
+		fh:         fh,
+	}
+
+	return &m, nil
+}
+
+// decompressMetaFile wraps fh in a gzip or bzip2 reader if its contents look like
+// they have been compressed, and returns it as-is otherwise.
+
+func decompressMetaFile(path string, fh io.Reader) (io.Reader, error) {
+
+	buf := bufio.NewReader(fh)
+
+	magic, err := buf.Peek(3)
+
+	if err != nil && err != io.EOF {
+		return nil, &MetaFileError{Path: path, Err: err}
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzip_magic):
+
+		gz, err := gzip.NewReader(buf)
+
+		if err != nil {
+			return nil, &MetaFileError{Path: path, Err: err}
+		}
+
+		return &metaFileReader{path: path, reader: gz}, nil
+
+	case bytes.HasPrefix(magic, bzip2_magic):
+
+		return &metaFileReader{path: path, reader: bzip2.NewReader(buf)}, nil
+
+	default:
+		return buf, nil
+	}
+}
+
+// metaFileReader wraps a decompressing reader so that a corrupt stream is reported as
+// a problem with the meta file rather than surfacing as a confusing CSV parse error.
+
+type metaFileReader struct {
+	path   string
+	reader io.Reader
+}
+
+func (r *metaFileReader) Read(p []byte) (int, error) {
+
+	n, err := r.reader.Read(p)
+
+	if err != nil && err != io.EOF {
+		err = &MetaFileError{Path: r.path, Err: err}
+	}
+
+	return n, err
+}
+
+// badRowLine returns the line that a malformed row (a stray quote or the wrong number
+// of fields) starts on, and true, if err was returned because of one. Reading can
+// carry on with the next row after these, unlike other errors. See StrictMetaFiles
+
+func badRowLine(err error) (int, bool) {
+
+	var parse_err *gocsv.ParseError
+
+	if !errors.As(err, &parse_err) {
+		return 0, false
+	}
+
+	return parse_err.StartLine, true
+}
@@ -0,0 +1,263 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// meta_file_suffixes are the names of the files in a directory that MetaFiles treats
+// as meta files.
+
+var meta_file_suffixes = []string{".csv", ".csv.gz", ".csv.bz2"}
+
+// isMetaFileSet returns true if path is a directory or a glob pattern, rather than a
+// single meta file.
+
+func isMetaFileSet(path string) bool {
+
+	info, err := os.Stat(path)
+
+	if err == nil {
+		return info.IsDir()
+	}
+
+	return strings.ContainsAny(path, "*?[")
+}
+
+// MetaFiles returns the meta files at path, which may be a single meta file, a
+// directory (in which case every .csv, .csv.gz or .csv.bz2 file in it is returned) or
+// a glob pattern, sorted by name.
+
+func MetaFiles(path string) ([]string, error) {
+
+	if !isMetaFileSet(path) {
+		return []string{path}, nil
+	}
+
+	files := make([]string, 0)
+
+	info, err := os.Stat(path)
+
+	if err == nil && info.IsDir() {
+
+		entries, err := ioutil.ReadDir(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+
+			if e.IsDir() || !isMetaFileName(e.Name()) {
+				continue
+			}
+
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+
+	} else {
+
+		matches, err := filepath.Glob(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+
+			info, err := os.Stat(m)
+
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			files = append(files, m)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("There are no meta files in %s", path)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func isMetaFileName(name string) bool {
+
+	for _, suffix := range meta_file_suffixes {
+
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MetaFileOptions are the options for one of the meta files cloned by
+// CloneMetaFilesWithOptions. SkipExisting and ForceUpdates are the same as the
+// skip_existing and force_updates arguments to CloneMetaFile. If Filter isn't nil only
+// the rows it returns true for are cloned, the rest are counted in Ignored.
+
+type MetaFileOptions struct {
+	File         string // a meta file, a directory or a glob pattern, see MetaFiles
+	SkipExisting bool
+	ForceUpdates bool
+	Filter       func(row map[string]string) bool
+	Label        string // overrides RunLabel for this meta file
+}
+
+// CloneMetaFiles clones every meta file in paths, each of which may be a meta file, a
+// directory or a glob pattern (see MetaFiles). They are cloned one after the other, in
+// order, unless MetaFileWorkers is greater than one. A meta file that fails doesn't
+// stop the others being cloned, instead the failures are returned together as a
+// *MetaFilesError once they have all finished. When there is more than one meta file
+// ManifestPath, IncrementalManifest, SummaryPath and UpdatedMetaPath are suffixed with
+// the name of each one. Report has a summary of each meta file and Stats the totals for all of them.
+
+func (c *WOFClone) CloneMetaFiles(paths []string, skip_existing bool, force_updates bool) error {
+
+	files := make([]MetaFileOptions, len(paths))
+
+	for i, path := range paths {
+		files[i] = MetaFileOptions{File: path, SkipExisting: skip_existing, ForceUpdates: force_updates}
+	}
+
+	return c.CloneMetaFilesWithOptions(files)
+}
+
+// CloneMetaFilesWithOptions is CloneMetaFiles but with options for each meta file, so
+// that (for example) some can be cloned with ForceUpdates and others with SkipExisting
+// in the same call. Every meta file matched by a directory or a glob pattern is cloned
+// with its options.
+
+func (c *WOFClone) CloneMetaFilesWithOptions(options []MetaFileOptions) error {
+
+	failed := make(map[string]error)
+	failed_mu := new(sync.Mutex)
+
+	files := make([]MetaFileOptions, 0)
+
+	for _, opts := range options {
+
+		matches, err := MetaFiles(opts.File)
+
+		if err != nil {
+			c.Logger.Error("Failed to find meta files in %s, because %v", opts.File, err)
+			failed[opts.File] = err
+			c.report.AddMetaFile(&WOFCloneSummary{Meta: opts.File, Started: time.Now(), Finished: time.Now(), Error: err.Error()})
+			continue
+		}
+
+		for _, m := range matches {
+			file_opts := opts
+			file_opts.File = m
+			files = append(files, file_opts)
+		}
+	}
+
+	multi := len(files) > 1
+
+	pool := newWorkerPool(context.Background(), c.MetaFileWorkers)
+
+	for _, opts := range files {
+
+		opts := opts
+
+		pool.Submit(func() {
+
+			_, err := c.cloneMetaFileSession(opts, multi)
+
+			if err != nil {
+				failed_mu.Lock()
+				failed[opts.File] = err
+				failed_mu.Unlock()
+			}
+		})
+	}
+
+	pool.Close()
+
+	if len(failed) > 0 {
+		return &MetaFilesError{Errors: failed}
+	}
+
+	return nil
+}
+
+// cloneMetaFileSession clones opts.File in a session of its own, see newSession. If
+// multi is true it is one of several meta files being cloned and the paths of
+// everything written about it are suffixed with its name.
+
+func (c *WOFClone) cloneMetaFileSession(opts MetaFileOptions, multi bool) (*WOFCloneSummary, error) {
+
+	file := opts.File
+
+	s, err := c.newSession()
+
+	if err != nil {
+		c.Logger.Error("Failed to clone %s, because %v", file, err)
+		return nil, err
+	}
+
+	if multi {
+		s.ManifestPath = metaFileOutputPath(c.ManifestPath, file)
+		s.IncrementalManifest = metaFileOutputPath(c.IncrementalManifest, file)
+		s.SummaryPath = metaFileOutputPath(c.SummaryPath, file)
+		s.UpdatedMetaPath = metaFileOutputPath(c.UpdatedMetaPath, file)
+	}
+
+	s.meta_options = opts
+	s.labelRun(file)
+
+	t1 := time.Now()
+
+	err = s.cloneMetaFile(file, opts.SkipExisting, opts.ForceUpdates)
+
+	c.endSession(s)
+
+	var partial_err *PartialReadError
+
+	if errors.As(err, &partial_err) {
+		partial_err.Summary = s.last_summary
+		partial_err.Report = s.Report()
+	}
+
+	summary := s.last_summary
+
+	if summary == nil {
+
+		// The meta file couldn't be read at all
+
+		abs_path, _ := filepath.Abs(file)
+		summary = &WOFCloneSummary{Meta: abs_path, Label: s.run_label, Started: t1, Finished: time.Now(), SkipExisting: opts.SkipExisting, ForceUpdates: opts.ForceUpdates}
+
+		if err != nil {
+			summary.Error = err.Error()
+		}
+	}
+
+	c.report.AddMetaFile(summary)
+
+	return s.last_summary, err
+}
+
+// metaFileOutputPath returns path suffixed with the name of meta, or "" if path is "".
+
+func metaFileOutputPath(path string, meta string) string {
+
+	if path == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s-%s", path, filepath.Base(meta))
+}
@@ -0,0 +1,92 @@
+package clone
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metrics is implemented by anything that wants to observe what a WOFClone is doing,
+// for example an adapter that registers Prometheus collectors. Every metric is labeled
+// with the "meta" file being cloned, runs with a RunLabel also have a "run" label and
+// request durations have a "method" label.
+// Implementations must be safe for concurrent use.
+
+type Metrics interface {
+	AddCounter(name string, delta float64, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+	Observe(name string, value float64, labels map[string]string)
+}
+
+const (
+	MetricFilesScheduled  = "wof_clone_files_scheduled_total"
+	MetricFilesSucceeded  = "wof_clone_files_succeeded_total"
+	MetricFilesFailed     = "wof_clone_files_failed_total"
+	MetricFilesSkipped    = "wof_clone_files_skipped_total"
+	MetricBytesDownloaded = "wof_clone_bytes_downloaded_total"
+	MetricRetries         = "wof_clone_retries_total"
+	MetricRequestDuration = "wof_clone_request_duration_seconds"
+	MetricLastSuccess     = "wof_clone_last_success_timestamp_seconds"
+)
+
+func (c *WOFClone) metricLabels() map[string]string {
+
+	labels := make(map[string]string, len(c.MetricLabels)+2)
+
+	for k, v := range c.MetricLabels {
+		labels[k] = v
+	}
+
+	labels["meta"] = c.meta_label
+
+	if c.run_label != "" {
+		labels["run"] = c.run_label
+	}
+
+	return labels
+}
+
+func (c *WOFClone) addMetric(name string, delta float64) {
+
+	if c.Metrics == nil {
+		return
+	}
+
+	c.Metrics.AddCounter(name, delta, c.metricLabels())
+}
+
+func (c *WOFClone) observeRequest(method string, d time.Duration) {
+
+	if c.Metrics == nil {
+		return
+	}
+
+	labels := c.metricLabels()
+	labels["method"] = method
+
+	c.Metrics.Observe(MetricRequestDuration, d.Seconds(), labels)
+}
+
+func (c *WOFClone) setLastSuccess(t time.Time) {
+
+	if c.Metrics == nil {
+		return
+	}
+
+	c.Metrics.SetGauge(MetricLastSuccess, float64(t.Unix()), c.metricLabels())
+}
+
+func metaLabel(path string) string {
+
+	if path == "" {
+		return ""
+	}
+
+	label := filepath.Base(path)
+
+	for _, ext := range []string{".gz", ".bz2"} {
+		label = strings.TrimSuffix(label, ext)
+	}
+
+	return label
+}
@@ -0,0 +1,56 @@
+package clone
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// isLocalNewer returns true if local (whose info is info) was modified more recently
+// than remote, according to remote's Last-Modified header. If that can't be determined
+// it returns false, so that the file is updated as usual.
+
+func (c *WOFClone) isLocalNewer(local string, info os.FileInfo, remote string) bool {
+
+	rsp, err := c.Fetch("HEAD", remote)
+
+	if err != nil {
+		return false
+	}
+
+	rsp.Body.Close()
+
+	lastmod, ok := c.lastModified(rsp)
+
+	if !ok {
+		c.Logger.Debug("%s has no usable Last-Modified header, so can't tell whether %s is newer", remote, local)
+		return false
+	}
+
+	return info.ModTime().After(lastmod)
+}
+
+// protectLocal records that rel_path was not updated because the local copy is newer
+// than the source's, see ProtectNewerLocal.
+
+func (c *WOFClone) protectLocal(rel_path string, local string) {
+
+	c.Logger.Warning("%s has changed but the local copy is newer, so it will not be updated", local)
+
+	atomic.AddInt64(&c.LocalNewer, 1)
+	c.report.AddLocalNewer(rel_path)
+}
+
+// logLocalNewer logs every file that has been left alone because the local copy is
+// newer, so they aren't forgotten about.
+
+func (c *WOFClone) logLocalNewer() {
+
+	paths := c.report.LocalNewer()
+
+	if len(paths) == 0 {
+		return
+	}
+
+	c.Logger.Warning("%d files were not updated because the local copies are newer: %s", len(paths), strings.Join(paths, ", "))
+}
@@ -0,0 +1,268 @@
+package clone
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// The orders rows can be scheduled in, see RowOrder.
+
+const (
+	OrderLargestFirst  = "largest-first"
+	OrderSmallestFirst = "smallest-first"
+)
+
+// rowKey is what is kept of a row while the rows are being sorted: where it is (its
+// index in a slice of rows or, for orderedRows, its offset and length in the copy of the
+// meta file) and its size, or -1 if that isn't known.
+
+type rowKey struct {
+	index  int64
+	length int
+	size   int64
+}
+
+// checkRowOrder returns an error if c.RowOrder isn't one of the orders above.
+
+func (c *WOFClone) checkRowOrder() error {
+
+	switch c.RowOrder {
+	case "", OrderLargestFirst, OrderSmallestFirst:
+		return nil
+	default:
+		return fmt.Errorf("Invalid RowOrder value '%s'", c.RowOrder)
+	}
+}
+
+// sortRowKeys sorts keys by size according to order. Rows whose size isn't known come
+// last and rows of the same size stay in the order they were read.
+
+func sortRowKeys(keys []rowKey, order string) {
+
+	sort.SliceStable(keys, func(i int, j int) bool {
+
+		a := keys[i]
+		b := keys[j]
+
+		if (a.size < 0) != (b.size < 0) {
+			return b.size < 0
+		}
+
+		if order == OrderLargestFirst {
+			return a.size > b.size
+		}
+
+		return a.size < b.size
+	})
+}
+
+// orderRows returns the rows in reader, the meta file at path (which may be "" if there
+// isn't one, as for CloneRows), in c.RowOrder.
+
+func (c *WOFClone) orderRows(path string, reader rowReader) rowReader {
+
+	if c.RowOrder == "" {
+		return reader
+	}
+
+	// They're already all in memory, so only the order needs sorting
+
+	slice, ok := reader.(*sliceRows)
+
+	if ok {
+
+		keys := make([]rowKey, len(slice.rows))
+
+		for i, row := range slice.rows {
+			keys[i] = rowKey{index: int64(i), size: c.rowSize(row)}
+		}
+
+		sortRowKeys(keys, c.RowOrder)
+
+		rows := make([]map[string]string, len(keys))
+
+		for i, k := range keys {
+			rows[i] = slice.rows[k.index]
+		}
+
+		return &sliceRows{rows: rows}
+	}
+
+	// Rows from a channel can't be sorted until the channel has been closed, by which
+	// point they might as well have been cloned
+
+	if path == "" {
+		c.Logger.Warning("RowOrder is ignored for rows that are sent on a channel")
+		return reader
+	}
+
+	r := orderedRows{
+		c:     c,
+		path:  path,
+		first: reader,
+	}
+
+	return &r
+}
+
+// rowSize returns the size in row's size column, or -1 if it doesn't have one.
+
+func (c *WOFClone) rowSize(row map[string]string) int64 {
+
+	size, ok := rowSize(row, c.SizeColumn)
+
+	if !ok {
+		return -1
+	}
+
+	return size
+}
+
+// orderedRows is a rowReader for a meta file's rows in c.RowOrder. The meta file is read
+// once, copying each row to a temporary file and keeping only its rowKey, and then each
+// row is read back from the copy in turn, so that however large the meta file is only
+// the keys are ever in memory. The copy isn't compressed, even if the meta file is, so
+// that rows can be read from it in any order.
+
+type orderedRows struct {
+	c      *WOFClone
+	path   string
+	first  rowReader // the meta file, as it was opened by cloneMetaFile
+	keys   []rowKey
+	sorted bool
+	next   int      // the next of keys to return
+	spill  *os.File // the copy of the meta file
+	writer *bufio.Writer
+	offset int64 // the length of spill so far
+}
+
+// Read returns the next row. Malformed rows are returned (as errors) while the meta file
+// is first read, so they are counted once, and left out of the copy.
+
+func (r *orderedRows) Read() (map[string]string, error) {
+
+	if !r.sorted {
+
+		for {
+
+			row, err := r.first.Read()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			err = r.keep(row)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if r.writer != nil {
+
+			err := r.writer.Flush()
+
+			if err != nil {
+				return nil, &WriteError{Path: r.spill.Name(), Err: err}
+			}
+		}
+
+		r.sort()
+	}
+
+	if r.next >= len(r.keys) {
+		return nil, io.EOF
+	}
+
+	k := r.keys[r.next]
+	r.next += 1
+
+	body := make([]byte, k.length)
+
+	_, err := r.spill.ReadAt(body, k.index)
+
+	if err != nil {
+		return nil, &MetaFileError{Path: r.path, Err: err}
+	}
+
+	var row map[string]string
+
+	err = json.Unmarshal(body, &row)
+
+	if err != nil {
+		return nil, &MetaFileError{Path: r.path, Err: err}
+	}
+
+	return row, nil
+}
+
+// keep adds row to the copy of the meta file, and its key to r.keys.
+
+func (r *orderedRows) keep(row map[string]string) error {
+
+	if r.spill == nil {
+
+		fh, err := ioutil.TempFile(r.c.tempRoot(), ".wof-clone-rows-")
+
+		if err != nil {
+			return &WriteError{Path: r.c.tempRoot(), Err: err}
+		}
+
+		r.spill = fh
+		r.writer = bufio.NewWriter(fh)
+	}
+
+	body, err := json.Marshal(row)
+
+	if err != nil {
+		return &MetaFileError{Path: r.path, Err: err}
+	}
+
+	_, err = r.writer.Write(body)
+
+	if err != nil {
+		return &WriteError{Path: r.spill.Name(), Err: err}
+	}
+
+	r.keys = append(r.keys, rowKey{index: r.offset, length: len(body), size: r.c.rowSize(row)})
+	r.offset += int64(len(body))
+
+	return nil
+}
+
+func (r *orderedRows) sort() {
+
+	r.sorted = true
+
+	for _, k := range r.keys {
+
+		if k.size >= 0 {
+			sortRowKeys(r.keys, r.c.RowOrder)
+			r.c.Logger.Info("scheduling the %d rows in %s %s", len(r.keys), r.path, r.c.RowOrder)
+			return
+		}
+	}
+
+	r.c.Logger.Warning("%s doesn't have sizes to order its rows by, so they will be scheduled in the order they were read", r.path)
+}
+
+// Close removes the copy of the meta file. first is closed by cloneMetaFile.
+
+func (r *orderedRows) Close() error {
+
+	if r.spill == nil {
+		return nil
+	}
+
+	r.spill.Close()
+	return os.Remove(r.spill.Name())
+}
@@ -0,0 +1,101 @@
+package clone
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOrderedRows(t *testing.T) {
+
+	c := newTestClone(t, "http://wof.invalid/")
+	c.RowOrder = OrderLargestFirst
+
+	first := sliceRows{rows: []map[string]string{
+		{"path": "1/1.geojson", "size": "10"},
+		{"path": "2/2.geojson", "size": ""},
+		{"path": "3/3.geojson", "size": "30"},
+		{"path": "4/4.geojson", "size": "20"},
+		{"path": "5/5.geojson", "size": "20"},
+	}}
+
+	r := orderedRows{c: c, path: "meta.csv", first: &first}
+
+	paths := make([]string, 0)
+
+	for {
+
+		row, err := r.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to read rows, %v", err)
+		}
+
+		paths = append(paths, row["path"])
+	}
+
+	// Rows of the same size stay in the order they were read and rows without a size
+	// come last
+
+	expected := "3/3.geojson 4/4.geojson 5/5.geojson 1/1.geojson 2/2.geojson"
+
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(paths, " "))
+	}
+
+	spill := r.spill.Name()
+
+	r.Close()
+
+	_, err := os.Stat(spill)
+
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the copy of the meta file to be removed, %v", err)
+	}
+}
+
+func TestRowOrderMetaFile(t *testing.T) {
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+	source.set("3/3.geojson", `{"id":3}`)
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+
+	err := ioutil.WriteFile(meta, []byte("path,size\n1/1.geojson,8\n2/2.geojson,\n3/3.geojson,9\n"), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", meta, err)
+	}
+
+	c := newTestClone(t, source.URL)
+	c.RowOrder = OrderSmallestFirst
+	c.TempDir = t.TempDir()
+
+	err = c.CloneMetaFile(meta, false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	if c.Success != 3 {
+		t.Errorf("Expected 3 files to be cloned, got %d", c.Success)
+	}
+
+	filepath.Walk(c.TempDir, func(path string, info os.FileInfo, err error) error {
+
+		if err == nil && strings.HasPrefix(info.Name(), ".wof-clone-rows-") {
+			t.Errorf("Expected the copy of the meta file to be removed, found %s", path)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package clone
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// isJSONPath returns true if rel_path is a GeoJSON (or JSON) file rather than one of the
+// other files, like READMEs and licenses, that meta files sometimes list. Only JSON files
+// are checked by ValidateJSON.
+
+func isJSONPath(rel_path string) bool {
+
+	ext := strings.ToLower(path.Ext(rel_path))
+	return ext == ".geojson" || ext == ".json"
+}
+
+// validatesJSON returns true if the contents of rel_path should parse as JSON, see
+// ValidateJSON.
+
+func (c *WOFClone) validatesJSON(rel_path string) bool {
+
+	return c.ValidateJSON && isJSONPath(rel_path)
+}
+
+// isDirectoryPath returns true if rel_path is shaped like a directory ("data/123/",
+// say) rather than a file, which would make its local path the directory it should be
+// written in to.
+
+func isDirectoryPath(rel_path string) bool {
+
+	if strings.HasSuffix(rel_path, "/") {
+		return true
+	}
+
+	base := path.Base(rel_path)
+	return base == "." || base == ".."
+}
+
+// hasAllowedExtension returns true if rel_path ends with one of c.AllowedExtensions, or
+// if there aren't any.
+
+func (c *WOFClone) hasAllowedExtension(rel_path string) bool {
+
+	if len(c.AllowedExtensions) == 0 {
+		return true
+	}
+
+	rel_path = strings.ToLower(rel_path)
+
+	for _, ext := range c.AllowedExtensions {
+
+		ext = strings.ToLower(strings.TrimSpace(ext))
+
+		if ext == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		if strings.HasSuffix(rel_path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRowPath returns a *RejectedPathError if rel_path, from a meta file row, is shaped
+// like a directory or doesn't have one of c.AllowedExtensions.
+
+func (c *WOFClone) checkRowPath(rel_path string) error {
+
+	if isDirectoryPath(rel_path) {
+		return &RejectedPathError{Path: rel_path, Reason: "it is a directory rather than a file"}
+	}
+
+	if !c.hasAllowedExtension(rel_path) {
+		return &RejectedPathError{Path: rel_path, Reason: "it doesn't have one of the allowed extensions"}
+	}
+
+	return nil
+}
+
+// rejectPath counts rel_path as a file that failed, permanently, before anything was
+// fetched for it, because of err.
+
+func (c *WOFClone) rejectPath(rel_path string, err error) {
+
+	atomic.AddInt64(&c.Scheduled, 1)
+	atomic.AddInt64(&c.Completed, 1)
+	c.addMetric(MetricFilesScheduled, 1)
+	atomic.AddInt64(&c.PermanentErrors, 1)
+	c.recordError(rel_path, err)
+	c.decide(rel_path, DecisionFailed)
+}
@@ -0,0 +1,180 @@
+package clone
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// writtenLog is a record of every file written during a run, where it was stored
+// (relative to Dest, see DestPath) and the hash of what was written, for PostVerify. It is kept in a temporary file rather than in memory
+// since a run may write hundreds of thousands of files.
+
+type writtenLog struct {
+	mu     *sync.Mutex
+	fh     *os.File
+	writer *bufio.Writer
+	err    error
+	closed bool // set once the log is being read, after which Add does nothing
+}
+
+func newWrittenLog(dir string) (*writtenLog, error) {
+
+	fh, err := ioutil.TempFile(dir, ".wof-clone-written-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := writtenLog{
+		mu:     new(sync.Mutex),
+		fh:     fh,
+		writer: bufio.NewWriter(fh),
+	}
+
+	return &l, nil
+}
+
+func (l *writtenLog) Add(rel_path string, dest_rel string, hash string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil || l.closed {
+		return
+	}
+
+	_, l.err = l.writer.WriteString(rel_path + "\t" + dest_rel + "\t" + hash + "\n")
+}
+
+// Each calls cb for every file in the log, in the order they were written. Files
+// written after Each has been called (for example, by cb) are not added to the log.
+
+func (l *writtenLog) Each(cb func(rel_path string, dest_rel string, hash string)) error {
+
+	l.mu.Lock()
+
+	l.closed = true
+
+	err := l.err
+
+	if err == nil {
+		err = l.writer.Flush()
+	}
+
+	if err == nil {
+		_, err = l.fh.Seek(0, 0)
+	}
+
+	l.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(l.fh)
+
+	for scanner.Scan() {
+
+		parts := strings.SplitN(scanner.Text(), "\t", 3)
+
+		if len(parts) == 3 {
+			cb(parts[0], parts[1], parts[2])
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Remove closes and removes the log.
+
+func (l *writtenLog) Remove() {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fh.Close()
+	os.Remove(l.fh.Name())
+}
+
+// postVerify re-reads every file written during run and checks that it still has the
+// hash that was computed from the response body as it was written. Mismatches are
+// recorded as errors and, if PostVerifyRefetch is true, fetched one more time.
+
+func (c *WOFClone) postVerify(run *cloneRun) {
+
+	verify_pool := newWorkerPool(run.ctx, c.CheckWorkers)
+
+	err := run.written.Each(func(rel_path string, dest_rel string, hash string) {
+
+		verify_pool.Submit(func() {
+			c.postVerifyPath(rel_path, dest_rel, hash)
+		})
+	})
+
+	verify_pool.Close()
+
+	if err != nil {
+		c.Logger.Error("Failed to read the list of files written, so they could not all be verified, because %v", err)
+	}
+
+	c.Logger.Info("verified %d files after cloning them, %d did not match", atomic.LoadInt64(&c.PostVerified), atomic.LoadInt64(&c.PostVerifyMismatches))
+}
+
+func (c *WOFClone) postVerifyPath(rel_path string, dest_rel string, hash string) {
+
+	local := c.localPath(dest_rel)
+
+	atomic.AddInt64(&c.PostVerified, 1)
+
+	local_hash, err := c.hashLocal(local)
+
+	if err == nil && local_hash == hash {
+		return
+	}
+
+	atomic.AddInt64(&c.PostVerifyMismatches, 1)
+
+	if err != nil {
+		c.Logger.Error("Failed to read %s back after writing it, because %v", local, err)
+		err = &WriteError{Path: local, Err: err}
+	} else {
+		c.Logger.Error("%s has hash %s but %s was written", local, local_hash, hash)
+		err = &HashMismatchError{Path: rel_path, Expected: hash, Actual: local_hash}
+	}
+
+	// Note that this doesn't use recordError since there's no point aborting
+	// at this stage. rel_path was counted as a success when it was written
+
+	atomic.AddInt64(&c.Success, -1)
+	atomic.AddInt64(&c.Error, 1)
+	c.addMetric(MetricFilesFailed, 1)
+	c.report.AddFailure(rel_path, err)
+	c.redecide(rel_path, DecisionFetchedChanged, DecisionFailed)
+
+	if !c.PostVerifyRefetch {
+		return
+	}
+
+	// Where rel_path is stored was forgotten once it was written, see forgetPath
+
+	if c.hasDestMapping() {
+		c.dest_paths.Store(rel_path, dest_rel)
+	}
+
+	err = c.Process(c.Source+rel_path, local)
+
+	if err != nil {
+		c.Logger.Error("Failed to fetch %s again after it did not verify, because %v", rel_path, err)
+		c.report.UpdateFailure(rel_path, err)
+		return
+	}
+
+	atomic.AddInt64(&c.Error, -1)
+	atomic.AddInt64(&c.Success, 1)
+	c.report.Resolve(rel_path)
+	c.decide(rel_path, DecisionFetchedChanged)
+}
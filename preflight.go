@@ -0,0 +1,163 @@
+package clone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// preflight fetches the first file listed in the meta file at meta and checks that it
+// looks like it came from the right place before CloneMetaFile starts fetching the
+// rest of them. A Source that points at an HTML directory listing, or that redirects
+// somewhere else entirely, would otherwise "succeed" in writing a copy of the same
+// page for every row. It returns a *PreflightError if anything looks wrong, see
+// SkipPreflight. The file is fetched with the mirrors as a fallback and an error that is
+// worth retrying (a 503, say) only means that nothing could be checked, not that Source
+// is wrong, so it is logged and the run goes ahead. If DataPrefix is "auto" the first
+// file's path is probed here and p is what was found out, which the run goes on to use
+// rather than probing (and warning about it) again.
+
+func (c *WOFClone) preflight(meta string, p *dataPrefix) error {
+
+	row, err := c.firstRow(meta)
+
+	if err != nil || row == nil {
+
+		// Problems reading the meta file itself are reported by CloneMetaFile
+
+		return nil
+	}
+
+	return c.preflightRow(row, p)
+}
+
+// preflightRow is preflight for the file in row, see also CloneRows.
+
+func (c *WOFClone) preflightRow(row map[string]string, p *dataPrefix) error {
+
+	c.probeDataPrefix(p, row[c.PathColumn], c.remoteExists)
+
+	rel_path := c.rowPath(row, p)
+	remote := c.remoteURL(c.Source, rel_path)
+
+	c.Logger.Debug("preflight check for %s", remote)
+
+	// The first file is fetched the same way as all the others, so a primary Source
+	// that is having a bad moment falls through to the mirrors (see AddMirror)
+
+	rsp, served_by, err := c.fetchWithMirrors("GET", c.Source+rel_path)
+
+	if err != nil && c.isRetryable(err, 1) {
+
+		// That says nothing about whether Source is the right place, only that
+		// it can't be told right now, and the run itself will retry
+
+		c.Logger.Warning("Unable to check %s before cloning, because %v", remote, err)
+		return nil
+	}
+
+	if err != nil {
+		return &PreflightError{URL: remote, Reason: "it could not be fetched", Err: err}
+	}
+
+	defer rsp.Body.Close()
+
+	source, _ := url.Parse(served_by)
+
+	if rsp.Request != nil && rsp.Request.URL != nil && source != nil && source.Scheme != "file" {
+
+		final := rsp.Request.URL
+
+		if final.Host != source.Host {
+			reason := fmt.Sprintf("it redirected to a different host (%s)", final)
+			return &PreflightError{URL: remote, Reason: reason}
+		}
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+
+	if err != nil && err != io.EOF {
+		return &PreflightError{URL: remote, Reason: "it could not be read", Err: err}
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) || strings.Contains(rsp.Header.Get("Content-Type"), "html") {
+		return &PreflightError{URL: remote, Reason: "it looks like an HTML page (a directory listing?) rather than data"}
+	}
+
+	if !json.Valid(body) {
+		return &PreflightError{URL: remote, Reason: "it is not valid JSON"}
+	}
+
+	expected := strings.ToLower(row[c.HashColumn])
+
+	algorithm := HashMD5
+
+	if c.HashSource == HashSourceColumn {
+		algorithm = c.hashAlgorithm()
+	}
+
+	if looksLikeHash(algorithm, expected) {
+
+		actual := hashBytes(body, algorithm)
+
+		if actual != expected {
+			reason := fmt.Sprintf("its %s hash (%s) doesn't match the meta file (%s)", algorithm, actual, expected)
+			return &PreflightError{URL: remote, Reason: reason}
+		}
+	}
+
+	return nil
+}
+
+// firstRow returns the first row in the meta file at meta that can be checked (see
+// canPreflight), or nil if there isn't one.
+
+func (c *WOFClone) firstRow(meta string) (map[string]string, error) {
+
+	reader, err := openMetaFile(meta)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	for {
+
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		if err != nil {
+
+			_, ok := badRowLine(err)
+
+			if ok && !c.StrictMetaFiles {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if c.canPreflight(row) {
+			return row, nil
+		}
+	}
+}
+
+// canPreflight returns true if row is for a JSON file that would be cloned, rather than
+// (say) a README, which couldn't be expected to parse as JSON, or a path that will be
+// rejected. See pathkind.go
+
+func (c *WOFClone) canPreflight(row map[string]string) bool {
+
+	rel_path := row[c.PathColumn]
+
+	return rel_path != "" && isJSONPath(rel_path) && c.checkRowPath(rel_path) == nil
+}
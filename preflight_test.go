@@ -0,0 +1,104 @@
+package clone
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPreflightFallsThroughToMirror(t *testing.T) {
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+
+	defer primary.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"type":"Feature"}`))
+	}))
+
+	defer mirror.Close()
+
+	c := newTestClone(t, primary.URL+"/")
+
+	err := c.AddMirror(mirror.URL + "/")
+
+	if err != nil {
+		t.Fatalf("Failed to add mirror, %v", err)
+	}
+
+	err = c.CloneMetaFile(writeMetaFile(t, "101/736/545/101736545.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Expected the clone to succeed using the mirror, %v", err)
+	}
+
+	_, err = os.Stat(c.LocalPath("101/736/545/101736545.geojson"))
+
+	if err != nil {
+		t.Fatalf("Expected the file to have been cloned, %v", err)
+	}
+}
+
+func TestPreflightTransientErrorIsNotARefusal(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+
+	defer ts.Close()
+
+	c := newTestClone(t, ts.URL+"/")
+
+	err := c.CloneMetaFile(writeMetaFile(t, "1/1.geojson"), false, false)
+
+	var preflight_err *PreflightError
+
+	if errors.As(err, &preflight_err) {
+		t.Fatalf("Expected a 503 not to be a preflight refusal, %v", err)
+	}
+
+	if err == nil {
+		t.Fatalf("Expected the clone to fail")
+	}
+}
+
+func TestPreflightRefusals(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"html", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html><body>Index of /</body></html>"))
+		}},
+		{"invalid json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not json"))
+		}},
+		{"not found", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(404)
+		}},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+
+			c := newTestClone(t, ts.URL+"/")
+
+			err := c.CloneMetaFile(writeMetaFile(t, "1/1.geojson"), false, false)
+
+			var preflight_err *PreflightError
+
+			if !errors.As(err, &preflight_err) {
+				t.Fatalf("Expected a *PreflightError, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package clone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progress_smoothing is how much weight the most recent rate gets when progress works
+// out how quickly files are being completed.
+
+const progress_smoothing = 0.3
+
+// default_status_interval is the default value for WOFClone.StatusInterval
+
+const default_status_interval = 1 * time.Second
+
+// recent_errors is the number of errors each run remembers, for Progress.
+
+const recent_errors = 10
+
+// Phase is what a run is doing, see Progress.
+
+type Phase string
+
+const (
+	PhaseReading   Phase = "reading"   // reading the meta file, and fetching files as it goes
+	PhaseBundle    Phase = "bundle"    // fetching and extracting a bundle, see Bundle
+	PhaseFetching  Phase = "fetching"  // fetching files that have already been scheduled
+	PhaseRetrying  Phase = "retrying"  // retrying files that failed, see processRetries
+	PhaseVerifying Phase = "verifying" // see PostVerify
+	PhaseDone      Phase = "done"
+)
+
+// RecentError is one of the most recent errors in a run, see Progress.
+
+type RecentError struct {
+	Path  string
+	Error string
+	Time  time.Time
+}
+
+// WOFCloneProgress is a snapshot of how a run is getting on, see Progress.
+
+type WOFCloneProgress struct {
+	Meta         string // the meta file being cloned, if there is one
+	Phase        Phase
+	Started      time.Time
+	Elapsed      time.Duration
+	Done         int64         // the number of rows dealt with so far
+	Total        int64         // the (approximate) number of rows in the meta file, or -1 if it isn't known yet
+	Fraction     float64       // how much of the run is done, from 0 to 1, or -1 if Total isn't known
+	Rate         float64       // files fetched per second, not counting skipped files
+	Stats        WOFCloneStats // the run's counters, and InFlight and Queued for every run
+	RecentErrors []RecentError // the last few errors, oldest first
+	PausedUntil  time.Time     // when requests will be sent again if the run is paused outside ActiveWindow, otherwise zero
+}
+
+// progress keeps track of how far through a run is, for Status and Progress. The
+// total number of rows is counted in the background (see countRows) so it is unknown,
+// and only the rate at which files are completed is reported, until that's done or
+// for runs that aren't reading a meta file (see Schedule).
+
+type progress struct {
+	mu        sync.Mutex
+	total     int64 // the number of rows in the meta file, or -1 if it isn't known
+	last      time.Time
+	last_done int64
+	rate      float64 // files per second, not counting skipped files
+	meta      string
+	started   time.Time
+	finished  time.Time
+	phase     Phase
+	errors    [recent_errors]RecentError // a ring, errors_at is where the next one goes
+	errors_n  int
+	errors_at int
+}
+
+func newProgress(meta string, phase Phase) *progress {
+
+	p := progress{
+		total:   -1,
+		last:    time.Now(),
+		meta:    meta,
+		started: time.Now(),
+		phase:   phase,
+	}
+
+	return &p
+}
+
+// countRows counts the rows in the meta file at path. It reads lines rather than CSV
+// records, so a quoted field with a newline in it throws the count off slightly, which
+// is why the total is only ever shown as an estimate.
+
+func (p *progress) countRows(path string) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return
+	}
+
+	defer fh.Close()
+
+	r, err := decompressMetaFile(path, fh)
+
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	lines := int64(0)
+	last := byte('\n')
+
+	for {
+
+		b, err := reader.ReadSlice('\n')
+
+		if len(b) > 0 {
+			last = b[len(b)-1]
+		}
+
+		if err == nil {
+			lines += 1
+			continue
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != io.EOF {
+			return
+		}
+
+		break
+	}
+
+	if last != '\n' {
+		lines += 1
+	}
+
+	// The header isn't a row
+
+	if lines > 0 {
+		lines -= 1
+	}
+
+	atomic.StoreInt64(&p.total, lines)
+}
+
+// update records that fetched files (ones that weren't skipped) have been completed
+// so far and returns the smoothed rate at which they are being completed. Skipped
+// files are left out because they are so much quicker than the rest that, early in a
+// run when there are a lot of them, they would make the run look like it was going to
+// finish far sooner than it will.
+
+func (p *progress) update(fetched int64) float64 {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(p.last).Seconds()
+
+	if elapsed <= 0 {
+		return p.rate
+	}
+
+	rate := float64(fetched-p.last_done) / elapsed
+
+	if p.last_done == 0 || p.rate == 0 {
+		p.rate = rate
+	} else {
+		p.rate = (progress_smoothing * rate) + ((1 - progress_smoothing) * p.rate)
+	}
+
+	p.last = now
+	p.last_done = fetched
+
+	return p.rate
+}
+
+// status returns a description of how far through the run is, given the number of
+// rows (or files) dealt with so far and the number of those that weren't skipped.
+
+func (p *progress) status(done int64, fetched int64) string {
+
+	rate := p.update(fetched)
+	total := atomic.LoadInt64(&p.total)
+
+	if total < 0 {
+		return fmt.Sprintf("rate: %.1f files/s", rate)
+	}
+
+	pct := 100.0
+
+	if total > 0 && done < total {
+		pct = (float64(done) / float64(total)) * 100.0
+	}
+
+	eta := "unknown"
+
+	switch {
+	case done >= total:
+		eta = formatETA(0)
+	case rate > 0:
+		eta = formatETA(time.Duration(float64(total-done) / rate * float64(time.Second)))
+	}
+
+	return fmt.Sprintf("completed %d of ~%d (%.1f%%), ETA %s, rate: %.1f files/s", done, total, pct, eta, rate)
+}
+
+// formatETA returns d as hh:mm:ss.
+
+func formatETA(d time.Duration) string {
+
+	secs := int64(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
+
+// setPhase records that the run has moved on to phase.
+
+func (p *progress) setPhase(phase Phase) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.phase = phase
+
+	if phase == PhaseDone {
+		p.finished = time.Now()
+	}
+}
+
+// addError remembers that rel_path failed because of err, forgetting the oldest error
+// if there are already recent_errors of them.
+
+func (p *progress) addError(rel_path string, err error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.errors[p.errors_at] = RecentError{Path: rel_path, Error: err.Error(), Time: time.Now()}
+	p.errors_at = (p.errors_at + 1) % recent_errors
+
+	if p.errors_n < recent_errors {
+		p.errors_n += 1
+	}
+}
+
+// snapshot returns p as a WOFCloneProgress, given the number of rows (or files) dealt
+// with so far and the number of those that weren't skipped. Unlike status it only
+// works out the rate again if Status hasn't done so in the last second, so that it can
+// be called as often as anyone likes without making the rate jump around.
+
+func (p *progress) snapshot(done int64, fetched int64) *WOFCloneProgress {
+
+	p.mu.Lock()
+	stale := time.Since(p.last) >= default_status_interval
+	p.mu.Unlock()
+
+	rate := 0.0
+
+	if stale {
+		rate = p.update(fetched)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !stale {
+		rate = p.rate
+	}
+
+	total := atomic.LoadInt64(&p.total)
+
+	pr := WOFCloneProgress{
+		Meta:     p.meta,
+		Phase:    p.phase,
+		Started:  p.started,
+		Elapsed:  time.Since(p.started),
+		Done:     done,
+		Total:    total,
+		Fraction: -1,
+		Rate:     rate,
+	}
+
+	if !p.finished.IsZero() {
+		pr.Elapsed = p.finished.Sub(p.started)
+	}
+
+	switch {
+	case p.phase == PhaseDone, total == 0, total > 0 && done >= total:
+		pr.Fraction = 1
+	case total > 0:
+		pr.Fraction = float64(done) / float64(total)
+	}
+
+	pr.RecentErrors = make([]RecentError, 0, p.errors_n)
+
+	for i := 0; i < p.errors_n; i++ {
+		idx := (p.errors_at - p.errors_n + i + recent_errors) % recent_errors
+		pr.RecentErrors = append(pr.RecentErrors, p.errors[idx])
+	}
+
+	return &pr
+}
+
+// liveRuns keeps track of the runs, of a WOFClone and all of its sessions (see
+// newSession), that are going and of the last one to finish, for Progress.
+
+type liveRuns struct {
+	mu   sync.Mutex
+	runs []*liveRun
+	last *liveRun
+}
+
+// liveRun is the WOFClone (usually a session) a run belongs to and its progress.
+
+type liveRun struct {
+	c *WOFClone
+	p *progress
+}
+
+func (l *liveRuns) add(r *liveRun) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.runs = append(l.runs, r)
+}
+
+func (l *liveRuns) remove(r *liveRun) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	runs := make([]*liveRun, 0, len(l.runs))
+
+	for _, other := range l.runs {
+
+		if other != r {
+			runs = append(runs, other)
+		}
+	}
+
+	l.runs = runs
+	l.last = r
+}
+
+// current returns the run that started most recently and is still going or, if there
+// isn't one, the last one to finish.
+
+func (l *liveRuns) current() *liveRun {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.runs) > 0 {
+		return l.runs[len(l.runs)-1]
+	}
+
+	return l.last
+}
+
+// Progress returns a snapshot of how the current run (the most recent call to
+// CloneMetaFile, or Schedule and Wait, that is still going, or if there isn't one the
+// last to finish) is getting on: what it is doing, how far through the meta file it
+// is, how quickly files are being fetched, its counters and its last few errors. When
+// several meta files are being cloned at once (see MetaFileWorkers) it is the one that
+// started last. It returns nil if nothing has been cloned yet. It only reads counters
+// so it is safe, and cheap, to call as often as needed from any goroutine.
+
+func (c *WOFClone) Progress() *WOFCloneProgress {
+
+	r := c.live.current()
+
+	if r == nil {
+		return nil
+	}
+
+	done := r.c.rowsDone()
+	fetched := atomic.LoadInt64(&r.c.Completed) - atomic.LoadInt64(&r.c.Skipped)
+
+	pr := r.p.snapshot(done, fetched)
+
+	for _, pair := range r.c.countersWith(&pr.Stats) {
+		*pair[1] = atomic.LoadInt64(pair[0])
+	}
+
+	pr.Stats.Running = atomic.LoadInt64(&c.totals.Running)
+	pr.Stats.InFlight = atomic.LoadInt64(&c.totals.InFlight)
+	pr.Stats.Queued = atomic.LoadInt64(&c.totals.Queued)
+	pr.PausedUntil = r.c.pausedUntil()
+
+	return pr
+}
+
+// rowsDone returns the number of rows (or files) in the current run that have been
+// dealt with, one way or another.
+
+func (c *WOFClone) rowsDone() int64 {
+
+	return atomic.LoadInt64(&c.Completed) + atomic.LoadInt64(&c.Ignored) + atomic.LoadInt64(&c.TooOld) +
+		atomic.LoadInt64(&c.Excluded) + atomic.LoadInt64(&c.MissingPath) + atomic.LoadInt64(&c.BadRows)
+}
+
+// setPhase records that the current run has moved on to phase, see Progress.
+
+func (c *WOFClone) setPhase(phase Phase) {
+
+	if p := c.progress; p != nil {
+		p.setPhase(phase)
+	}
+}
+
+// recentError remembers that rel_path failed because of err, see Progress.
+
+func (c *WOFClone) recentError(rel_path string, err error) {
+
+	if p := c.progress; p != nil {
+		p.addError(rel_path, err)
+	}
+}
@@ -0,0 +1,205 @@
+package clone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The extended attributes that the provenance of a cloned file is recorded in, see
+// RecordProvenance.
+
+const (
+	provenance_xattr_etag    = "user.wof.etag"
+	provenance_xattr_lastmod = "user.wof.lastmodified"
+	provenance_xattr_stat    = "user.wof.stat"
+)
+
+// provenance_record_suffix is appended to the (hidden) file that records the provenance
+// of a cloned file when its filesystem doesn't support extended attributes.
+
+const provenance_record_suffix = ".provenance"
+
+// provenance is the ETag and Last-Modified header of the response a file was written
+// from, along with the file's size and modification time once it had been, so that
+// a file that has been changed since then can be told apart.
+
+type provenance struct {
+	ETag         string
+	LastModified string
+	Size         int64
+	ModTime      int64
+}
+
+// matches returns true if info is the file that p was recorded for.
+
+func (p provenance) matches(info os.FileInfo) bool {
+
+	return p.Size == info.Size() && p.ModTime == info.ModTime().UnixNano()
+}
+
+func (p provenance) stat() string {
+
+	return fmt.Sprintf("%d %d", p.Size, p.ModTime)
+}
+
+func (p *provenance) parseStat(stat string) bool {
+
+	fields := strings.Fields(stat)
+
+	if len(fields) != 2 {
+		return false
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+
+	if err != nil {
+		return false
+	}
+
+	mtime, err := strconv.ParseInt(fields[1], 10, 64)
+
+	if err != nil {
+		return false
+	}
+
+	p.Size = size
+	p.ModTime = mtime
+
+	return true
+}
+
+// provenanceRecordPath returns the path of the file recording the provenance of local
+// when it can't be stored in extended attributes.
+
+func provenanceRecordPath(local string) string {
+
+	return filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+provenance_record_suffix)
+}
+
+// writeProvenance records the ETag and Last-Modified header of rsp, the response that
+// local was written from, in local's extended attributes or, if its filesystem doesn't
+// support them, in a hidden file next to it.
+
+func (c *WOFClone) writeProvenance(local string, rsp *http.Response) {
+
+	info, err := os.Stat(local)
+
+	if err != nil {
+		return
+	}
+
+	p := provenance{
+		ETag:         strings.Replace(rsp.Header.Get("Etag"), "\"", "", -1),
+		LastModified: rsp.Header.Get("Last-Modified"),
+		Size:         info.Size(),
+		ModTime:      info.ModTime().UnixNano(),
+	}
+
+	err = setXattr(local, provenance_xattr_etag, p.ETag)
+
+	if err == nil {
+
+		setXattr(local, provenance_xattr_lastmod, p.LastModified)
+		setXattr(local, provenance_xattr_stat, p.stat())
+
+		os.Remove(provenanceRecordPath(local))
+		return
+	}
+
+	if !isXattrUnsupported(err) {
+		c.Logger.Warning("Failed to record the provenance of %s, because %v", local, err)
+		return
+	}
+
+	if c.debugging() {
+		c.Logger.Debug("Extended attributes aren't supported for %s, recording its provenance in %s", local, provenanceRecordPath(local))
+	}
+
+	body := p.ETag + "\n" + p.LastModified + "\n" + p.stat() + "\n"
+
+	err = ioutil.WriteFile(provenanceRecordPath(local), []byte(body), local_file_mode)
+
+	if err != nil {
+		c.Logger.Warning("Failed to record the provenance of %s, because %v", local, err)
+	}
+}
+
+// readProvenance returns the provenance recorded for local by writeProvenance and
+// true, or false if there isn't any or local has been changed since it was recorded.
+
+func (c *WOFClone) readProvenance(local string) (provenance, bool) {
+
+	var p provenance
+
+	info, err := os.Stat(local)
+
+	if err != nil {
+		return p, false
+	}
+
+	etag, err := getXattr(local, provenance_xattr_etag)
+
+	if err == nil {
+
+		p.ETag = etag
+		p.LastModified, _ = getXattr(local, provenance_xattr_lastmod)
+
+		stat, _ := getXattr(local, provenance_xattr_stat)
+
+		if !p.parseStat(stat) {
+			return p, false
+		}
+
+	} else {
+
+		body, err := ioutil.ReadFile(provenanceRecordPath(local))
+
+		if err != nil {
+			return p, false
+		}
+
+		lines := strings.Split(string(body), "\n")
+
+		if len(lines) < 3 || !p.parseStat(lines[2]) {
+			return p, false
+		}
+
+		p.ETag = lines[0]
+		p.LastModified = lines[1]
+	}
+
+	if p.ETag == "" || !p.matches(info) {
+		return p, false
+	}
+
+	return p, true
+}
+
+// provenanceHasChanged is CheckChanged for a local copy whose provenance was recorded.
+// If the source's ETag is the one local was written from then it hasn't changed and
+// local doesn't need to be read at all, otherwise it is hashed as usual.
+
+func (c *WOFClone) provenanceHasChanged(local string, remote string, p provenance) (ChangeState, error) {
+
+	etag, err := c.remoteHash(remote)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	if etag == p.ETag {
+
+		if c.debugging() {
+			c.Logger.Debug("%s was written from the source's current version (%s)", local, etag)
+		}
+
+		return Unchanged, nil
+	}
+
+	return c.compareETag(local, remote, etag)
+}
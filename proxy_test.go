@@ -0,0 +1,141 @@
+package clone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestProxy starts a stub HTTP proxy that serves every request from source, whatever
+// host it was for, and returns it along with the number of requests it has proxied.
+
+func newTestProxy(t *testing.T, source *testSource) (*httptest.Server, *int64) {
+
+	t.Helper()
+
+	proxied := new(int64)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Requests to a proxy have the absolute URL they are for
+
+		if r.URL.Host != "wof.invalid" {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+
+		atomic.AddInt64(proxied, 1)
+		source.ServeHTTP(w, r)
+	}))
+
+	t.Cleanup(proxy.Close)
+
+	return proxy, proxied
+}
+
+// cloneThroughProxy clones two files from a host that doesn't resolve, which only works
+// if the requests go through a proxy.
+
+func cloneThroughProxy(t *testing.T, set func(c *WOFClone) error) {
+
+	t.Helper()
+
+	c := newTestClone(t, "http://wof.invalid/")
+
+	err := set(c)
+
+	if err != nil {
+		t.Fatalf("Failed to set proxy, %v", err)
+	}
+
+	err = c.CloneMetaFile(writeMetaFile(t, "1/1.geojson", "2/2.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	if c.Success != 2 {
+		t.Errorf("Expected 2 files to be cloned, got %d", c.Success)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+
+	proxy, proxied := newTestProxy(t, source)
+
+	cloneThroughProxy(t, func(c *WOFClone) error {
+		return c.SetProxy(proxy.URL)
+	})
+
+	if atomic.LoadInt64(proxied) == 0 {
+		t.Errorf("Expected the proxy to see the requests")
+	}
+
+	if source.count("1/1.geojson") == 0 || source.count("2/2.geojson") == 0 {
+		t.Errorf("Expected both files to be requested through the proxy")
+	}
+}
+
+func TestSetProxyRefusals(t *testing.T) {
+
+	c := newTestClone(t, "http://wof.invalid/")
+
+	for _, uri := range []string{"ftp://proxy.example/", "http://", "::"} {
+
+		err := c.SetProxy(uri)
+
+		if err == nil {
+			t.Errorf("Expected %s to be refused", uri)
+		}
+	}
+}
+
+// TestProxyFromEnvironment runs itself again with HTTP_PROXY set, because the standard
+// library only reads it once per process.
+
+func TestProxyFromEnvironment(t *testing.T) {
+
+	if os.Getenv("WOF_CLONE_TEST_PROXY") != "" {
+
+		// Setting a proxy and then unsetting it goes back to the environment
+
+		cloneThroughProxy(t, func(c *WOFClone) error {
+
+			err := c.SetProxy("http://127.0.0.1:1/")
+
+			if err != nil {
+				return err
+			}
+
+			return c.SetProxy("")
+		})
+
+		return
+	}
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+
+	proxy, proxied := newTestProxy(t, source)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestProxyFromEnvironment$")
+	cmd.Env = append(os.Environ(), "WOF_CLONE_TEST_PROXY=1", "HTTP_PROXY="+proxy.URL, "NO_PROXY=")
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Failed to clone with HTTP_PROXY set, %v\n%s", err, out)
+	}
+
+	if atomic.LoadInt64(proxied) == 0 {
+		t.Errorf("Expected the proxy from the environment to see the requests")
+	}
+}
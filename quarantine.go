@@ -0,0 +1,86 @@
+package clone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// quarantine_suffix is added, along with the time, to the name of files quarantined
+// alongside themselves, see QuarantineFailures.
+
+const quarantine_suffix = ".quarantined-"
+
+// quarantine moves the local copy of rel_path out of the way if c.QuarantineFailures
+// is true and a replacement for it, which it was decided to fetch because the source
+// has changed (decision), failed verification with cl_err.
+
+func (c *WOFClone) quarantine(rel_path string, decision Decision, cl_err error) {
+
+	if !c.QuarantineFailures {
+		return
+	}
+
+	if decision != DecisionFetchedChanged && decision != DecisionForced {
+		return
+	}
+
+	var hash_err *HashMismatchError
+
+	if !errors.As(cl_err, &hash_err) {
+		return
+	}
+
+	local := c.LocalPath(rel_path)
+
+	_, err := os.Stat(local)
+
+	if err != nil {
+		return
+	}
+
+	quarantined := local + quarantine_suffix + time.Now().Format("20060102T150405")
+
+	if c.QuarantineDir != "" {
+		quarantined = filepath.Join(c.QuarantineDir, c.localRelPath(rel_path))
+	}
+
+	err = os.MkdirAll(filepath.Dir(quarantined), 0755)
+
+	if err == nil {
+		err = c.moveFile(local, quarantined)
+	}
+
+	if err != nil {
+		c.Logger.Error("Failed to quarantine %s, because %v", local, err)
+		return
+	}
+
+	c.Logger.Warning("Moved %s to %s since it is out of date and a verified replacement couldn't be fetched", local, quarantined)
+
+	atomic.AddInt64(&c.Quarantined, 1)
+	c.report.AddQuarantined(rel_path, quarantined)
+}
+
+// releaseQuarantine removes the quarantined copy of rel_path, if there is one, now
+// that a verified replacement has been fetched. It returns true if there was one.
+
+func (c *WOFClone) releaseQuarantine(rel_path string) bool {
+
+	quarantined, ok := c.report.RemoveQuarantined(rel_path)
+
+	if !ok {
+		return false
+	}
+
+	err := os.Remove(quarantined)
+
+	if err != nil && !os.IsNotExist(err) {
+		c.Logger.Warning("Failed to remove %s, because %v", quarantined, err)
+	}
+
+	atomic.AddInt64(&c.Quarantined, -1)
+	return true
+}
@@ -0,0 +1,174 @@
+package clone
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// do sends req, waiting for a slot if c.AdaptiveThrottle or c.MaxConnsPerHost is set
+// (see throttle.go and hosts.go) and honouring the
+// X-RateLimit-Remaining and X-RateLimit-Reset headers that GitHub (and others) send.
+// Once a source says there are no requests remaining every request waits until the
+// limit resets, rather than hammering in to 403 errors, and requests that were refused
+// because of the limit are retried up to c.MaxRateLimitWaits times. Requests that fail
+// because a kept alive connection had been closed by the source are sent again, once,
+// straight away (see ReusedConnRetries). Outside c.ActiveWindow requests wait for it
+// to open (see window.go). The returned function must be called once the response
+// body has been closed (or the request failed).
+
+func (c *WOFClone) do(req *http.Request) (*http.Response, func(), error) {
+
+	waits := 0
+	resent := false
+
+	for {
+
+		err := c.waitForRateLimit()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = c.waitForActiveWindow()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		release := func() {}
+
+		th := c.throttle
+
+		if th != nil {
+
+			r, err := th.acquire(c.ctx)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			release = r
+		}
+
+		if c.MaxConnsPerHost > 0 {
+
+			r, err := c.hosts.acquire(c.ctx, req.URL.Host, c.MaxConnsPerHost)
+
+			if err != nil {
+				release()
+				return nil, nil, err
+			}
+
+			throttle_release := release
+
+			release = func() {
+				r()
+				throttle_release()
+			}
+		}
+
+		traced, finish := c.traceRequest(req)
+		traced, reused := watchConnReuse(traced)
+
+		traced_release := release
+
+		release = func() {
+			traced_release()
+			finish()
+		}
+
+		t1 := time.Now()
+
+		client, _ := c.clientFor(req)
+
+		rsp, err := client.Do(traced)
+
+		c.observeRequest(req.Method, time.Since(t1))
+
+		if th != nil && c.ctx.Err() == nil {
+			th.record(err != nil || rsp.StatusCode == 429 || rsp.StatusCode >= 500)
+		}
+
+		if err != nil && !resent && reused() && c.isConnReuseError(req, err) {
+
+			release()
+
+			if c.debugging() {
+				c.Logger.Debug("%s %s failed on a reused connection, because %v, trying again on a new one", req.Method, req.URL, err)
+			}
+
+			// If the source closed one idle connection it has probably closed the rest
+
+			client.CloseIdleConnections()
+
+			atomic.AddInt64(&c.ReusedConnRetries, 1)
+			resent = true
+			continue
+		}
+
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+
+		c.observeProtocol(req, rsp)
+
+		if !c.checkRateLimit(rsp) || waits >= c.MaxRateLimitWaits {
+			return rsp, release, nil
+		}
+
+		waits += 1
+
+		c.Logger.Warning("%s %s was rate limited, waiting to try again", req.Method, req.URL)
+
+		rsp.Body.Close()
+		release()
+	}
+}
+
+// checkRateLimit records when the rate limit for rsp's source resets if there are no
+// requests remaining, and returns true if rsp itself was refused because of it.
+
+func (c *WOFClone) checkRateLimit(rsp *http.Response) bool {
+
+	if rsp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return false
+	}
+
+	reset, err := strconv.ParseInt(rsp.Header.Get("X-RateLimit-Reset"), 10, 64)
+
+	if err != nil {
+
+		// Better to wait a little while than not at all
+
+		reset = time.Now().Add(time.Minute).Unix()
+	}
+
+	atomic.StoreInt64(c.rate_reset, reset)
+
+	return rsp.StatusCode == 403 || rsp.StatusCode == 429
+}
+
+// waitForRateLimit blocks until the most recent rate limit has reset (or c.ctx is
+// cancelled).
+
+func (c *WOFClone) waitForRateLimit() error {
+
+	reset := time.Unix(atomic.LoadInt64(c.rate_reset), 0)
+	wait := time.Until(reset)
+
+	if wait <= 0 {
+		return nil
+	}
+
+	c.Logger.Info("rate limit exhausted, waiting %v until it resets", wait)
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
@@ -0,0 +1,68 @@
+package clone
+
+import (
+	"net/http"
+	"strings"
+)
+
+const default_max_redirects = 10
+
+// checkRedirect is installed as the http.Client's CheckRedirect function. Returning
+// http.ErrUseLastResponse means the redirect response itself is handed back to fetch
+// which then fails with a (non-retryable) *FetchError carrying the 3XX status code.
+
+func (c *WOFClone) checkRedirect(req *http.Request, via []*http.Request) error {
+
+	max := c.MaxRedirects
+
+	if max == 0 {
+		max = default_max_redirects
+	}
+
+	chain := make([]string, 0)
+
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+
+	chain = append(chain, req.URL.String())
+
+	c.Logger.Debug("redirect %s", strings.Join(chain, " -> "))
+
+	if max < 0 {
+		c.Logger.Warning("Refusing to follow redirect from %s to %s because redirects are disabled", via[0].URL, req.URL)
+		return http.ErrUseLastResponse
+	}
+
+	if len(via) > max {
+		c.Logger.Warning("Refusing to follow redirect from %s to %s after %d redirects", via[0].URL, req.URL, len(via))
+		return http.ErrUseLastResponse
+	}
+
+	cross_host := req.URL.Host != via[0].URL.Host
+
+	if cross_host && c.RefuseCrossHostRedirects {
+		c.Logger.Warning("Refusing to follow redirect from %s to a different host (%s)", via[0].URL, req.URL.Host)
+		return http.ErrUseLastResponse
+	}
+
+	if c.ForwardAuthOnRedirect {
+
+		// net/http drops the Authorization header when it is redirected to a different
+		// domain so put it (and everything else) back
+
+		c.PrepareRequest(req)
+		return nil
+	}
+
+	if cross_host {
+
+		req.Header.Del("Authorization")
+
+		for k := range c.Headers {
+			req.Header.Del(k)
+		}
+	}
+
+	return nil
+}
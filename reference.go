@@ -0,0 +1,183 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// The ways that files can be taken from ReferenceDir, see ReferenceLink. Each one falls
+// back to the next if it doesn't work, for example because ReferenceDir is on another
+// filesystem.
+
+const (
+	ReferenceHardlink = "hardlink"
+	ReferenceReflink  = "reflink"
+	ReferenceCopy     = "copy"
+)
+
+var reference_methods = []string{ReferenceHardlink, ReferenceReflink, ReferenceCopy}
+
+func (c *WOFClone) checkReferenceLink() error {
+
+	switch c.ReferenceLink {
+	case "", ReferenceHardlink, ReferenceReflink, ReferenceCopy:
+		return nil
+	default:
+		return fmt.Errorf("Invalid ReferenceLink value '%s'", c.ReferenceLink)
+	}
+}
+
+// referencePath returns where the file that would be stored at local can be found in
+// c.ReferenceDir.
+
+func (c *WOFClone) referencePath(local string) (string, bool) {
+
+	dest_rel, err := filepath.Rel(c.Dest, local)
+
+	if err != nil || strings.HasPrefix(dest_rel, "..") {
+		return "", false
+	}
+
+	return filepath.Join(c.ReferenceDir, dest_rel), true
+}
+
+// linkReference stores rel_path at local by linking (or copying) the copy in
+// c.ReferenceDir, if there is one and it is the same as the source's. It returns true
+// if it did, in which case rel_path doesn't need to be fetched. row is the meta file
+// row for rel_path and may be nil.
+
+func (c *WOFClone) linkReference(rel_path string, row map[string]string, local string) bool {
+
+	ref, ok := c.referencePath(local)
+
+	if !ok {
+		return false
+	}
+
+	_, err := os.Stat(ref)
+
+	if err != nil {
+		return false
+	}
+
+	same, err := c.isSameAsReference(rel_path, row, ref)
+
+	if err != nil {
+		c.Logger.Debug("Unable to compare %s with the source, so fetching it, because %v", ref, err)
+		return false
+	}
+
+	if !same {
+		c.Logger.Debug("%s is different from the source, so fetching it", ref)
+		return false
+	}
+
+	method, err := c.linkFile(ref, local)
+
+	if err != nil {
+		c.Logger.Warning("Failed to link %s to %s, so fetching it, because %v", ref, local, err)
+		return false
+	}
+
+	c.Logger.Debug("%s %s from %s", method, local, ref)
+
+	atomic.AddInt64(&c.Linked, 1)
+	c.removeAlternate(local)
+	c.addSkippedToManifest(rel_path, local)
+
+	return true
+}
+
+// isSameAsReference returns true if ref, the copy of rel_path in c.ReferenceDir, is the
+// same as the source's. Like checkPath this uses the expected hash (see HashSource), or
+// the meta file's MD5 hash, if there is one, without making any requests and compares
+// ref with the source otherwise.
+
+func (c *WOFClone) isSameAsReference(rel_path string, row map[string]string, ref string) (bool, error) {
+
+	remote := c.Source + rel_path
+
+	var state ChangeState
+	var err error
+
+	file_hash := strings.ToLower(row[c.HashColumn])
+
+	if c.hasExplicitHash() {
+		state, err = c.hasExpectedHashChanged(rel_path, row, ref, remote)
+	} else if looksLikeHash(HashMD5, file_hash) && c.LocalHash == nil && c.ContentFilter == nil && c.s3 == nil && c.HashSource == "" && c.hashAlgorithm() == HashMD5 {
+
+		ref_hash, hash_err := c.hashLocal(ref)
+
+		if hash_err != nil {
+			return false, hash_err
+		}
+
+		state, err = changeState(ref_hash != file_hash), nil
+
+	} else {
+		state, err = c.CheckChanged(ref, remote)
+	}
+
+	return state == Unchanged, err
+}
+
+// linkFile puts a copy of ref at local using c.ReferenceLink, or the methods after it if
+// that doesn't work, and returns the method that did.
+
+func (c *WOFClone) linkFile(ref string, local string) (string, error) {
+
+	err := c.prepareLocal(local)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Links are made alongside local, rather than in TempDir, so the rename is atomic and
+	// a hardlink doesn't have to cross filesystems twice
+
+	staged := local + partial_suffix
+
+	methods := reference_methods
+
+	for i, m := range reference_methods {
+
+		if m == c.ReferenceLink {
+			methods = reference_methods[i:]
+		}
+	}
+
+	for _, m := range methods {
+
+		os.Remove(staged)
+
+		switch m {
+		case ReferenceHardlink:
+			err = os.Link(ref, staged)
+		case ReferenceReflink:
+			err = reflink(ref, staged)
+		default:
+			err = copyFile(ref, staged)
+		}
+
+		if err != nil {
+			c.Logger.Debug("Failed to %s %s, because %v", m, ref, err)
+			continue
+		}
+
+		err = os.Rename(staged, local)
+
+		if err != nil {
+			os.Remove(staged)
+			return "", err
+		}
+
+		c.indexWritten(local)
+		return m, nil
+	}
+
+	os.Remove(staged)
+	return "", err
+}
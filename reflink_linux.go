@@ -0,0 +1,43 @@
+//go:build linux
+
+package clone
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, see ioctl_ficlone(2)
+
+const ficlone = 0x40049409
+
+// reflink makes dest a copy-on-write clone of src. It fails if the filesystem doesn't
+// support that, or if they are on different filesystems.
+
+func reflink(src string, dest string) error {
+
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+
+	err = out.Close()
+
+	if errno != 0 {
+		os.Remove(dest)
+		return errno
+	}
+
+	return err
+}
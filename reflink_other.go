@@ -0,0 +1,14 @@
+//go:build !linux
+
+package clone
+
+import (
+	"errors"
+)
+
+// reflink is only supported on Linux, everywhere else ReferenceLink falls back to copying.
+
+func reflink(src string, dest string) error {
+
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,33 @@
+package clone
+
+import (
+	"strings"
+)
+
+// rewritesRemote returns true if files are fetched from somewhere other than their
+// relative path under Source, see RemotePrefix and RemotePath.
+
+func (c *WOFClone) rewritesRemote() bool {
+	return c.RemotePath != nil || c.RemotePrefix != ""
+}
+
+// remoteURL returns the URL that rel_path is actually fetched from when source (which
+// is c.Source or one of c.Mirrors) serves it, which is source + rel_path unless
+// RemotePrefix or RemotePath say otherwise.
+
+func (c *WOFClone) remoteURL(source string, rel_path string) string {
+
+	switch {
+	case c.RemotePath != nil:
+		rel_path = strings.TrimPrefix(c.RemotePath(rel_path), "/")
+	case c.RemotePrefix != "":
+
+		prefix := strings.Trim(c.RemotePrefix, "/")
+
+		if prefix != "" {
+			rel_path = prefix + "/" + rel_path
+		}
+	}
+
+	return source + rel_path
+}
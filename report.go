@@ -0,0 +1,738 @@
+package clone
+
+import (
+	"sort"
+	"sync"
+)
+
+// default_max_failure_records is the default value for WOFClone.MaxFailureRecords
+
+const default_max_failure_records = 10000
+
+type WOFCloneReport struct {
+	Sources           map[string]int64      // the number of files fetched from each source
+	Mirrored          map[string]string     // rel_path -> source, for files not fetched from the primary source
+	FirstFailure      string                // the first path that failed to be cloned, if any
+	FirstError        string                // the reason FirstFailure failed
+	Errors            map[string]int64      // the number of errors of each kind, see ErrorCategory
+	RedirectedTo      map[string]string     // rel_path -> URL, for files that were served following a redirect
+	FetchedFrom       map[string]string     // rel_path -> URL, when RemotePrefix or RemotePath is set
+	TooLarge          []string              // files that were skipped because they are larger than MaxFileSize
+	PendingRetries    []string              // files that are waiting to be retried
+	IdMismatches      map[string]string     // rel_path -> id, for meta file rows whose id and path disagree
+	Failed            []string              // files that have failed and not (yet) succeeded on a retry
+	FailedOmitted     int64                 // the number of failed files left out of Failed, see MaxFailureRecords
+	Durations         []HistogramBucket     // how long downloads took, see timings.go
+	Slowest           []FileTiming          // the slowest downloads, slowest first
+	Largest           []FileTiming          // the largest downloads, largest first
+	LocalPaths        map[string]string     // rel_path -> path relative to Dest, for files stored somewhere else (see DestPath)
+	RequestPhases     map[string]PhaseStats // how long each phase of a request took, when TraceRequests is true
+	Connections       ConnectionStats       // the connections used by requests, when TraceRequests is true
+	LocalNewer        []string              // files that were not updated because the local copy is newer, see ProtectNewerLocal
+	MetaFiles         []*WOFCloneSummary    // a summary of each meta file cloned, sorted by Meta
+	Decisions         map[string]Decision   // rel_path -> what happened to it, when RecordDecisions is true
+	Groups            map[string]GroupStats // group -> the outcomes of the files in it, when GroupBy is set
+	Quarantined       map[string]string     // rel_path -> where its out of date local copy was moved, see QuarantineFailures
+	BogusLastModified map[string]int64      // host -> the number of implausible Last-Modified headers it sent, see LastModifiedTolerance
+	FalseChanges      map[string]int64      // host -> the number of files it said had changed that hadn't, see DetectFalseChanges
+	Unreadable        map[string]string     // rel_path -> why its local copy couldn't be read, see UnreadableLocal
+	Excluded          []string              // rows that weren't cloned because they are listed in Exclude
+}
+
+// report is the internal (and concurrency-safe) bookkeeping behind WOFCloneReport.
+
+type report struct {
+	mu            *sync.Mutex
+	sources       map[string]int64
+	mirrored      map[string]string
+	first_failure string
+	first_error   error
+	errors        map[string]int64
+	redirects     map[string]string
+	fetched_from  map[string]string
+	too_large     []string
+	id_mismatches map[string]string
+	failed        map[string]string
+	max_failed    int   // see MaxFailureRecords
+	omitted       int64 // failures not recorded in failed because of max_failed
+	local_paths   map[string]string
+	local_newer   map[string]bool
+	meta_files    map[string]*WOFCloneSummary
+	decisions     map[string]Decision
+	groups        map[string]*GroupStats
+	quarantined   map[string]string
+	bogus_lastmod map[string]int64
+	false_changes map[string]int64
+	unreadable    map[string]string
+	excluded      map[string]bool
+}
+
+func newReport() *report {
+
+	r := report{
+		mu:            new(sync.Mutex),
+		sources:       make(map[string]int64),
+		mirrored:      make(map[string]string),
+		errors:        make(map[string]int64),
+		redirects:     make(map[string]string),
+		fetched_from:  make(map[string]string),
+		too_large:     make([]string, 0),
+		id_mismatches: make(map[string]string),
+		failed:        make(map[string]string),
+		local_paths:   make(map[string]string),
+		local_newer:   make(map[string]bool),
+		meta_files:    make(map[string]*WOFCloneSummary),
+		decisions:     make(map[string]Decision),
+		groups:        make(map[string]*GroupStats),
+		quarantined:   make(map[string]string),
+		bogus_lastmod: make(map[string]int64),
+		false_changes: make(map[string]int64),
+		unreadable:    make(map[string]string),
+		excluded:      make(map[string]bool),
+	}
+
+	return &r
+}
+
+func (r *report) AddSource(rel_path string, source string, mirrored bool) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sources[source] += 1
+
+	if mirrored {
+		r.mirrored[rel_path] = source
+	}
+}
+
+func (r *report) AddRedirect(rel_path string, final string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.redirects[rel_path] = final
+}
+
+func (r *report) AddFetchedFrom(rel_path string, remote string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fetched_from[rel_path] = remote
+}
+
+func (r *report) AddTooLarge(rel_path string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.too_large = append(r.too_large, rel_path)
+}
+
+func (r *report) AddLocalPath(rel_path string, dest_rel string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.local_paths[rel_path] = dest_rel
+}
+
+func (r *report) AddLocalNewer(rel_path string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.local_newer[rel_path] = true
+}
+
+// AddMetaFile records the summary of a meta file that has been cloned, replacing any
+// earlier summary of the same meta file.
+
+func (r *report) AddMetaFile(summary *WOFCloneSummary) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.meta_files[summary.Meta] = summary
+}
+
+func (r *report) metaFileSummaries() []*WOFCloneSummary {
+
+	summaries := make([]*WOFCloneSummary, 0, len(r.meta_files))
+
+	for _, s := range r.meta_files {
+		summaries = append(summaries, s)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Meta < summaries[j].Meta
+	})
+
+	return summaries
+}
+
+// LocalNewer returns the sorted list of files that were not updated because the
+// local copy is newer.
+
+func (r *report) LocalNewer() []string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.localNewerPaths()
+}
+
+func (r *report) localNewerPaths() []string {
+
+	paths := make([]string, 0)
+
+	for rel_path := range r.local_newer {
+		paths = append(paths, rel_path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func (r *report) AddUnreadable(rel_path string, err error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unreadable[rel_path] = err.Error()
+}
+
+func (r *report) AddExcluded(rel_path string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.excluded[rel_path] = true
+}
+
+func (r *report) excludedPaths() []string {
+
+	paths := make([]string, 0, len(r.excluded))
+
+	for rel_path := range r.excluded {
+		paths = append(paths, rel_path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func (r *report) AddBogusLastModified(host string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.bogus_lastmod[host] += 1
+}
+
+// BogusLastModified returns the number of implausible Last-Modified headers sent by each
+// host.
+
+func (r *report) BogusLastModified() map[string]int64 {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.copyBogusLastModified()
+}
+
+func (r *report) copyBogusLastModified() map[string]int64 {
+
+	counts := make(map[string]int64)
+
+	for k, v := range r.bogus_lastmod {
+		counts[k] = v
+	}
+
+	return counts
+}
+
+func (r *report) AddFalseChange(host string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.false_changes[host] += 1
+}
+
+// FalseChanges returns the number of files each host said had changed that were the
+// same as the local copy.
+
+func (r *report) FalseChanges() map[string]int64 {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.copyFalseChanges()
+}
+
+func (r *report) copyFalseChanges() map[string]int64 {
+
+	counts := make(map[string]int64)
+
+	for k, v := range r.false_changes {
+		counts[k] = v
+	}
+
+	return counts
+}
+
+func (r *report) AddQuarantined(rel_path string, quarantined string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.quarantined[rel_path] = quarantined
+}
+
+// RemoveQuarantined forgets that rel_path was quarantined, returning where it was
+// quarantined and whether it was.
+
+func (r *report) RemoveQuarantined(rel_path string) (string, bool) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	quarantined, ok := r.quarantined[rel_path]
+
+	if ok {
+		delete(r.quarantined, rel_path)
+	}
+
+	return quarantined, ok
+}
+
+func (r *report) AddIdMismatch(rel_path string, id string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.id_mismatches[rel_path] = id
+}
+
+func (r *report) AddDecision(rel_path string, d Decision) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.decisions[rel_path] = d
+}
+
+// Decisions returns what happened to each path, see RecordDecisions.
+
+func (r *report) Decisions() map[string]Decision {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.copyDecisions()
+}
+
+func (r *report) copyDecisions() map[string]Decision {
+
+	decisions := make(map[string]Decision)
+
+	for k, v := range r.decisions {
+		decisions[k] = v
+	}
+
+	return decisions
+}
+
+// AddGroup adds n (which may be negative) files with the outcome d to the stats for
+// group, see GroupBy.
+
+func (r *report) AddGroup(group string, d Decision, n int64) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.groups[group]
+
+	if !ok {
+		g = new(GroupStats)
+		r.groups[group] = g
+	}
+
+	g.Scheduled += n
+
+	switch {
+	case d == DecisionFailed:
+		g.Error += n
+	case d.Skipped():
+		g.Skipped += n
+	default:
+		g.Success += n
+	}
+}
+
+// Groups returns the stats for each group, see GroupBy.
+
+func (r *report) Groups() map[string]GroupStats {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.copyGroups()
+}
+
+func (r *report) copyGroups() map[string]GroupStats {
+
+	groups := make(map[string]GroupStats)
+
+	for k, v := range r.groups {
+		groups[k] = *v
+	}
+
+	return groups
+}
+
+// ErrorCategories returns the number of errors of each kind, see ErrorCategory.
+
+func (r *report) ErrorCategories() map[string]int64 {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	errors := make(map[string]int64)
+
+	for k, v := range r.errors {
+		errors[k] = v
+	}
+
+	return errors
+}
+
+func (r *report) AddFailure(rel_path string, err error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.first_error == nil {
+		r.first_failure = rel_path
+		r.first_error = err
+	}
+
+	r.errors[ErrorCategory(err)] += 1
+	r.addFailed(rel_path, err.Error())
+}
+
+// addFailed records that rel_path failed with msg or, if there are already max_failed
+// failures recorded, just counts it.
+
+func (r *report) addFailed(rel_path string, msg string) {
+
+	_, ok := r.failed[rel_path]
+
+	if !ok && r.max_failed > 0 && len(r.failed) >= r.max_failed {
+		r.omitted += 1
+		return
+	}
+
+	r.failed[rel_path] = msg
+}
+
+// UpdateFailure records that rel_path, which previously failed, has failed again.
+
+func (r *report) UpdateFailure(rel_path string, err error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Failures that weren't recorded in the first place are still only counted
+
+	_, ok := r.failed[rel_path]
+
+	if ok {
+		r.failed[rel_path] = err.Error()
+	}
+}
+
+// Resolve records that rel_path, which previously failed, has since been cloned
+// (or skipped) successfully.
+
+func (r *report) Resolve(rel_path string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.failed[rel_path]
+
+	if ok {
+		delete(r.failed, rel_path)
+	} else if r.omitted > 0 {
+		r.omitted -= 1
+	}
+}
+
+// FailedCount returns the number of files that have failed and not been resolved that
+// are listed by Failed, and the number that were left out because of MaxFailureRecords.
+
+func (r *report) FailedCount() (int, int64) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.failed), r.omitted
+}
+
+// Failed returns the sorted list of files that have failed and not been resolved.
+
+func (r *report) Failed() []string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.failedPaths()
+}
+
+// FailedErrors returns the files that have failed and not been resolved, and why.
+
+func (r *report) FailedErrors() map[string]string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := make(map[string]string)
+
+	for k, v := range r.failed {
+		failed[k] = v
+	}
+
+	return failed
+}
+
+func (r *report) failedPaths() []string {
+
+	failed := make([]string, 0)
+
+	for rel_path := range r.failed {
+		failed = append(failed, rel_path)
+	}
+
+	sort.Strings(failed)
+	return failed
+}
+
+// ResetFailed forgets about any failures (and decisions) from previous runs and
+// records no more than max failures from now on, or all of them if max is zero.
+
+func (r *report) ResetFailed(max int) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failed = make(map[string]string)
+	r.max_failed = max
+	r.omitted = 0
+	r.decisions = make(map[string]Decision)
+	r.groups = make(map[string]*GroupStats)
+}
+
+// Merge adds everything recorded in other to r. Failures in other replace any earlier
+// failures of the same files.
+
+func (r *report) Merge(other *report) {
+
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, v := range other.sources {
+		r.sources[k] += v
+	}
+
+	for k, v := range other.mirrored {
+		r.mirrored[k] = v
+	}
+
+	if r.first_error == nil && other.first_error != nil {
+		r.first_failure = other.first_failure
+		r.first_error = other.first_error
+	}
+
+	for k, v := range other.errors {
+		r.errors[k] += v
+	}
+
+	for k, v := range other.redirects {
+		r.redirects[k] = v
+	}
+
+	for k, v := range other.fetched_from {
+		r.fetched_from[k] = v
+	}
+
+	r.too_large = append(r.too_large, other.too_large...)
+
+	for k, v := range other.id_mismatches {
+		r.id_mismatches[k] = v
+	}
+
+	r.max_failed = other.max_failed
+
+	for k, v := range other.failed {
+		r.addFailed(k, v)
+	}
+
+	r.omitted += other.omitted
+
+	for k, v := range other.local_paths {
+		r.local_paths[k] = v
+	}
+
+	for k := range other.local_newer {
+		r.local_newer[k] = true
+	}
+
+	for k, v := range other.meta_files {
+		r.meta_files[k] = v
+	}
+
+	for k, v := range other.quarantined {
+		r.quarantined[k] = v
+	}
+
+	for k, v := range other.bogus_lastmod {
+		r.bogus_lastmod[k] += v
+	}
+
+	for k, v := range other.false_changes {
+		r.false_changes[k] += v
+	}
+
+	for k, v := range other.unreadable {
+		r.unreadable[k] = v
+	}
+
+	for k, v := range other.excluded {
+		r.excluded[k] = v
+	}
+
+	for k, v := range other.decisions {
+		r.decisions[k] = v
+	}
+
+	for k, v := range other.groups {
+
+		g, ok := r.groups[k]
+
+		if !ok {
+			g = new(GroupStats)
+			r.groups[k] = g
+		}
+
+		g.Scheduled += v.Scheduled
+		g.Success += v.Success
+		g.Error += v.Error
+		g.Skipped += v.Skipped
+	}
+}
+
+func (r *report) FirstFailure() (string, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.first_failure, r.first_error
+}
+
+func (r *report) Snapshot() *WOFCloneReport {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sources := make(map[string]int64)
+
+	for k, v := range r.sources {
+		sources[k] = v
+	}
+
+	mirrored := make(map[string]string)
+
+	for k, v := range r.mirrored {
+		mirrored[k] = v
+	}
+
+	errors := make(map[string]int64)
+
+	for k, v := range r.errors {
+		errors[k] = v
+	}
+
+	redirects := make(map[string]string)
+
+	for k, v := range r.redirects {
+		redirects[k] = v
+	}
+
+	fetched_from := make(map[string]string)
+
+	for k, v := range r.fetched_from {
+		fetched_from[k] = v
+	}
+
+	too_large := make([]string, len(r.too_large))
+	copy(too_large, r.too_large)
+
+	id_mismatches := make(map[string]string)
+
+	for k, v := range r.id_mismatches {
+		id_mismatches[k] = v
+	}
+
+	local_paths := make(map[string]string)
+
+	for k, v := range r.local_paths {
+		local_paths[k] = v
+	}
+
+	quarantined := make(map[string]string)
+
+	for k, v := range r.quarantined {
+		quarantined[k] = v
+	}
+
+	unreadable := make(map[string]string)
+
+	for k, v := range r.unreadable {
+		unreadable[k] = v
+	}
+
+	rpt := WOFCloneReport{
+		Unreadable:        unreadable,
+		Excluded:          r.excludedPaths(),
+		BogusLastModified: r.copyBogusLastModified(),
+		FalseChanges:      r.copyFalseChanges(),
+		LocalPaths:        local_paths,
+		LocalNewer:        r.localNewerPaths(),
+		MetaFiles:         r.metaFileSummaries(),
+		Failed:            r.failedPaths(),
+		FailedOmitted:     r.omitted,
+		IdMismatches:      id_mismatches,
+		TooLarge:          too_large,
+		Errors:            errors,
+		RedirectedTo:      redirects,
+		FetchedFrom:       fetched_from,
+		Sources:           sources,
+		Mirrored:          mirrored,
+		FirstFailure:      r.first_failure,
+		Decisions:         r.copyDecisions(),
+		Groups:            r.copyGroups(),
+		Quarantined:       quarantined,
+	}
+
+	if r.first_error != nil {
+		rpt.FirstError = r.first_error.Error()
+	}
+
+	return &rpt
+}
@@ -0,0 +1,105 @@
+package clone
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestResumeWrongRange checks that a partial download isn't resumed with a range that
+// doesn't start where it left off, which a source that ignores part of a Range header
+// might send.
+
+func TestResumeWrongRange(t *testing.T) {
+
+	body := fmt.Sprintf(`{"id":1,"name":"%s"}`, strings.Repeat("x", 1000))
+
+	sum := md5.Sum([]byte(body))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	mu := new(sync.Mutex)
+	requests := make([]string, 0)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/1/1.geojson" {
+			w.Write([]byte(`{"id":2}`))
+			return
+		}
+
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Header.Get("Range"))
+		first := len(requests) == 1
+		mu.Unlock()
+
+		w.Header().Set("Etag", etag)
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if r.Method != "GET" {
+			return
+		}
+
+		// The first response is cut off half way through
+
+		if first {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+			w.Write([]byte(body[:len(body)/2]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		// And then the whole file is sent as if it were the range that was asked for
+
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(body)-1, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+
+		w.Write([]byte(body))
+	}))
+
+	defer source.Close()
+
+	c := newTestClone(t, source.URL+"/")
+	c.ResumeDownloads = true
+	c.AllowFailures = true
+	c.MaxRetries = 100
+
+	err := c.CloneMetaFile(writeMetaFile(t, "2/2.geojson", "1/1.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	if c.Success != 2 {
+		t.Errorf("Expected 2 files to be cloned, got %d (%v)", c.Success, c.Report().FirstError)
+	}
+
+	got, err := ioutil.ReadFile(c.LocalPath("1/1.geojson"))
+
+	if err != nil || string(got) != body {
+		t.Errorf("Expected 1/1.geojson to be the whole file, got %d bytes (%v)", len(got), err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	ranged := false
+
+	for _, req := range requests {
+
+		if strings.HasPrefix(req, "GET bytes=") {
+			ranged = true
+		}
+	}
+
+	if !ranged {
+		t.Errorf("Expected the download to be resumed, got %v", requests)
+	}
+}
@@ -0,0 +1,166 @@
+package clone
+
+import (
+	"sync"
+)
+
+// default_max_pending_retries is the default value for WOFClone.MaxPendingRetries
+
+const default_max_pending_retries = 100000
+
+// default_max_retries_min_scheduled is the default value for WOFClone.MaxRetriesMinScheduled
+
+const default_max_retries_min_scheduled = 1000
+
+// DefaultRetryPredicate is the RetryPredicate used when WOFClone.RetryPredicate isn't
+// set. It retries errors that might go away if the same request is tried again (see
+// IsRetryable), whatever the attempt.
+
+func DefaultRetryPredicate(err error, attempt int) bool {
+
+	return IsRetryable(err)
+}
+
+// isRetryable returns true if err, from the attempt'th try at something, should be
+// retried, according to c.RetryPredicate.
+
+func (c *WOFClone) isRetryable(err error, attempt int) bool {
+
+	if c.RetryPredicate == nil {
+		return DefaultRetryPredicate(err, attempt)
+	}
+
+	return c.RetryPredicate(err, attempt)
+}
+
+// retryEntry is what is known about a path waiting to be retried from the time it
+// failed: what had been decided about it (DecisionFailed if it failed before that
+// was known) and the hash it was expected to have, if the meta file said.
+
+type retryEntry struct {
+	decision Decision
+	hash     string
+}
+
+// fetching returns true if it had already been decided that the path needed to be
+// fetched, so that retrying it can go straight to fetching it.
+
+func (e retryEntry) fetching() bool {
+
+	switch e.decision {
+	case DecisionFetchedNew, DecisionFetchedChanged, DecisionForced:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryQueue is the collection of (relative) paths waiting to be retried. Paths are
+// popped in LIFO order and pushing a path that is already queued is a no-op so that
+// a file that fails more than once is still only retried once.
+
+type retryQueue struct {
+	mu         sync.Mutex
+	paths      []string
+	queued     map[string]retryEntry
+	max        int
+	overflowed bool
+}
+
+func newRetryQueue(max int) *retryQueue {
+
+	q := retryQueue{
+		paths:  make([]string, 0),
+		queued: make(map[string]retryEntry),
+		max:    max,
+	}
+
+	return &q
+}
+
+// Push adds rel_path, and what is known about it, to the queue. It returns false if rel_path could not be added
+// because the queue is full, in which case the queue is flagged as having overflowed.
+
+func (q *retryQueue) Push(rel_path string, entry retryEntry) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, queued := q.queued[rel_path]
+
+	if queued {
+		return true
+	}
+
+	if q.max > 0 && len(q.paths) >= q.max {
+		q.overflowed = true
+		return false
+	}
+
+	q.paths = append(q.paths, rel_path)
+	q.queued[rel_path] = entry
+
+	return true
+}
+
+func (q *retryQueue) Pop() (string, retryEntry, bool) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := len(q.paths)
+
+	if count == 0 {
+		return "", retryEntry{}, false
+	}
+
+	rel_path := q.paths[count-1]
+	q.paths = q.paths[:count-1]
+
+	entry := q.queued[rel_path]
+	delete(q.queued, rel_path)
+
+	return rel_path, entry, true
+}
+
+func (q *retryQueue) Length() int64 {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return int64(len(q.paths))
+}
+
+func (q *retryQueue) Overflowed() bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.overflowed
+}
+
+// Paths returns a copy of the paths currently waiting to be retried.
+
+func (q *retryQueue) Paths() []string {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths := make([]string, len(q.paths))
+	copy(paths, q.paths)
+
+	return paths
+}
+
+// Reset empties the queue, sets its maximum size to max and clears the overflowed flag.
+
+func (q *retryQueue) Reset(max int) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paths = make([]string, 0)
+	q.queued = make(map[string]retryEntry)
+	q.max = max
+	q.overflowed = false
+}
@@ -0,0 +1,138 @@
+package clone
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPermanentlyFailingPath(t *testing.T) {
+
+	source := newTestSource(t)
+
+	paths := make([]string, 0)
+
+	for i := 1; i <= 5; i++ {
+		rel_path := fmt.Sprintf("%d/%d.geojson", i, i)
+		source.set(rel_path, fmt.Sprintf(`{"id":%d}`, i))
+		paths = append(paths, rel_path)
+	}
+
+	broken := "6/6.geojson"
+	source.fail(broken, 503)
+
+	paths = append(paths, broken)
+
+	c := newTestClone(t, source.URL)
+
+	err := c.CloneMetaFile(writeMetaFile(t, paths...), false, false)
+
+	if err == nil {
+		t.Fatalf("Expected the clone to fail")
+	}
+
+	if c.Error != 1 || c.Success != 5 {
+		t.Errorf("Expected 1 error and 5 successes, got %d and %d", c.Error, c.Success)
+	}
+
+	if c.Retried != 1 {
+		t.Errorf("Expected %s to be retried once, got %d", broken, c.Retried)
+	}
+
+	// Once when it is first fetched and once when it is retried
+
+	if source.count(broken) != 2 {
+		t.Errorf("Expected 2 requests for %s, got %d", broken, source.count(broken))
+	}
+
+	rpt := c.Report()
+
+	if len(rpt.Failed) != 1 || rpt.Failed[0] != broken {
+		t.Errorf("Expected %s to be the only failure in the report, got %v", broken, rpt.Failed)
+	}
+
+	if rpt.FirstFailure != broken {
+		t.Errorf("Expected %s to be the first failure, got %s", broken, rpt.FirstFailure)
+	}
+
+	errors := int64(0)
+
+	for _, count := range rpt.Errors {
+		errors += count
+	}
+
+	if errors != 1 {
+		t.Errorf("Expected the report to count 1 error, got %v", rpt.Errors)
+	}
+
+	if len(rpt.PendingRetries) != 0 {
+		t.Errorf("Expected nothing to be left to retry, got %v", rpt.PendingRetries)
+	}
+}
+
+func TestNotFoundIsNotRetried(t *testing.T) {
+
+	source := newTestSource(t)
+
+	paths := make([]string, 0)
+
+	for i := 1; i <= 12; i++ {
+		rel_path := fmt.Sprintf("%d/%d.geojson", i, i)
+		source.set(rel_path, fmt.Sprintf(`{"id":%d}`, i))
+		paths = append(paths, rel_path)
+	}
+
+	// Enough deleted files that they would be more than MaxRetries percent of the run, if
+	// they counted, and two that fail once and then work
+
+	deleted := paths[4:8]
+	unavailable := paths[10:12]
+
+	for _, rel_path := range deleted {
+		source.fail(rel_path, 404)
+	}
+
+	for _, rel_path := range unavailable {
+		source.failFirst(rel_path, 503, 1)
+	}
+
+	c := newTestClone(t, source.URL)
+	c.AllowFailures = true
+
+	err := c.CloneMetaFile(writeMetaFile(t, paths...), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	for _, rel_path := range deleted {
+
+		if source.count(rel_path) != 1 {
+			t.Errorf("Expected 1 request for %s, got %d", rel_path, source.count(rel_path))
+		}
+	}
+
+	for _, rel_path := range unavailable {
+
+		if source.count(rel_path) != 2 {
+			t.Errorf("Expected %s to be retried, got %d requests", rel_path, source.count(rel_path))
+		}
+	}
+
+	if c.Retried != 2 {
+		t.Errorf("Expected 2 retries, got %d", c.Retried)
+	}
+
+	if c.PermanentErrors != 4 || c.Error != 4 {
+		t.Errorf("Expected 4 errors, all permanent, got %d and %d", c.Error, c.PermanentErrors)
+	}
+
+	if c.Success != 8 {
+		t.Errorf("Expected 8 files to be cloned, got %d", c.Success)
+	}
+
+	rpt := c.Report()
+
+	if len(rpt.Failed) != len(deleted) {
+		t.Errorf("Expected only the deleted files to have failed, got %v", rpt.Failed)
+	}
+}
@@ -0,0 +1,309 @@
+package clone
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// rows_label is what the rows given to CloneRows (or CloneRowsChan) are called in log
+// messages, where a meta file would be named.
+
+const rows_label = "rows"
+
+// rowReader is where the rows in a run come from: a meta file (see CloneMetaFile) or
+// rows that the caller already has (see CloneRows). Read returns io.EOF once there are
+// no more.
+
+type rowReader interface {
+	Read() (map[string]string, error)
+	Close() error
+}
+
+// sliceRows is a rowReader for a slice of rows.
+
+type sliceRows struct {
+	rows []map[string]string
+	next int
+}
+
+func (r *sliceRows) Read() (map[string]string, error) {
+
+	if r.next >= len(r.rows) {
+		return nil, io.EOF
+	}
+
+	row := r.rows[r.next]
+	r.next += 1
+
+	return row, nil
+}
+
+func (r *sliceRows) Close() error {
+	return nil
+}
+
+// chanRows is a rowReader for rows sent on a channel, which is finished with once it
+// has been closed.
+
+type chanRows struct {
+	rows <-chan map[string]string
+}
+
+func (r *chanRows) Read() (map[string]string, error) {
+
+	row, ok := <-r.rows
+
+	if !ok {
+		return nil, io.EOF
+	}
+
+	return row, nil
+}
+
+// Close reads (and discards) anything left in the channel in the background, so that
+// whatever is sending rows isn't left blocked forever if the run stops early.
+
+func (r *chanRows) Close() error {
+
+	go func() {
+		for range r.rows {
+		}
+	}()
+
+	return nil
+}
+
+// peekedRows is a rowReader that returns rows that have already been read from another
+// one before going back to it, see cloneRows.
+
+type peekedRows struct {
+	peeked []map[string]string
+	rest   rowReader
+}
+
+func (r *peekedRows) Read() (map[string]string, error) {
+
+	if len(r.peeked) > 0 {
+		row := r.peeked[0]
+		r.peeked = r.peeked[1:]
+		return row, nil
+	}
+
+	return r.rest.Read()
+}
+
+func (r *peekedRows) Close() error {
+	return r.rest.Close()
+}
+
+// CloneRows clones the files in rows, which are the same as the rows in a meta file
+// (see CloneMetaFile), for callers that already have them in memory. They go through
+// exactly the same checks as a meta file's rows, with the same counters and retries,
+// in a session of their own (see newSession). There is no meta file to fetch a Bundle
+// for or to write an updated copy of (see UpdatedMetaPath).
+
+func (c *WOFClone) CloneRows(rows []map[string]string, skip_existing bool, force_updates bool) error {
+
+	return c.cloneRowsSession(&sliceRows{rows: rows}, int64(len(rows)), skip_existing, force_updates)
+}
+
+// CloneRowsChan is CloneRows for rows sent on a channel, which the caller must close
+// once there are no more. It returns once they have all been cloned. If the run stops
+// early (see MaxErrors, for example) anything still being sent is read and discarded,
+// so that the sender isn't left blocked.
+
+func (c *WOFClone) CloneRowsChan(rows <-chan map[string]string, skip_existing bool, force_updates bool) error {
+
+	return c.cloneRowsSession(&chanRows{rows: rows}, -1, skip_existing, force_updates)
+}
+
+// cloneRowsSession clones the rows from reader, of which there are total (or -1 if that
+// isn't known), in a session of its own.
+
+func (c *WOFClone) cloneRowsSession(reader rowReader, total int64, skip_existing bool, force_updates bool) error {
+
+	defer reader.Close()
+
+	s, err := c.newSession()
+
+	if err != nil {
+		c.Logger.Error("Failed to clone %s, because %v", rows_label, err)
+		return err
+	}
+
+	s.meta_options = MetaFileOptions{
+		SkipExisting: skip_existing,
+		ForceUpdates: force_updates,
+	}
+
+	s.labelRun("")
+
+	err = s.cloneRows(reader, total, skip_existing, force_updates)
+
+	c.endSession(s)
+
+	return err
+}
+
+// cloneRows is cloneMetaFile for the rows from reader.
+
+func (c *WOFClone) cloneRows(reader rowReader, total int64, skip_existing bool, force_updates bool) error {
+
+	if c.isRunning() {
+		return ErrRunning
+	}
+
+	// See window.go
+
+	err := c.checkActiveWindow()
+
+	if err == nil {
+		err = c.waitForActiveWindow()
+	}
+
+	if err != nil {
+		c.Logger.Error("Failed to clone %s, because %v", rows_label, err)
+		return err
+	}
+
+	if !c.AllowSelfClone {
+
+		err := c.checkSelfClone()
+
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return err
+		}
+	}
+
+	// See order.go
+
+	reader = c.orderRows("", reader)
+
+	// The first row with a path is checked before anything else is fetched, the same
+	// as for a meta file, and then cloned along with everything else. Rows aren't read
+	// any further ahead than that, so if it isn't a JSON file there is no check
+
+	peeked := make([]map[string]string, 0)
+	var first map[string]string
+
+	for first == nil {
+
+		row, err := reader.Read()
+
+		if err != nil {
+			break
+		}
+
+		peeked = append(peeked, row)
+
+		if row[c.PathColumn] != "" {
+			first = row
+		}
+	}
+
+	reader = &peekedRows{peeked: peeked, rest: reader}
+
+	prefix := c.newDataPrefix()
+
+	if !c.SkipPreflight && first != nil && c.canPreflight(first) {
+
+		err := c.preflightRow(first, prefix)
+
+		if err != nil {
+			c.Logger.Error("%v", err)
+			return err
+		}
+	}
+
+	run, err := c.startRun("", prefix)
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&c.progress.total, total)
+	c.setPhase(PhaseReading)
+
+	opts := ScheduleOptions{
+		SkipExisting: skip_existing,
+		ForceUpdates: force_updates,
+	}
+
+	rows, _, read_err := c.scheduleRows(rows_label, reader, opts)
+
+	atomic.StoreInt64(&run.rows, rows)
+
+	if read_err != nil {
+		run.read_err = read_err
+		c.Wait()
+		c.Logger.Error("Failed to read %s, because %v", rows_label, read_err)
+		return read_err
+	}
+
+	return c.Wait()
+}
+
+// scheduleRows schedules every row from reader (see Schedule), stopping early if the
+// run is aborted, and returns the number of rows read and the number of those that had
+// a path. label is what the rows are called in log messages. Malformed rows are skipped
+// unless they are fatal (see StrictMetaFiles and MaxBadRows), in which case the error
+// is returned as well.
+
+func (c *WOFClone) scheduleRows(label string, reader rowReader, opts ScheduleOptions) (int64, int, error) {
+
+	rows := int64(0)
+	with_path := 0 // see AllowEmpty
+
+	for {
+
+		if c.isAborted() {
+			break
+		}
+
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		rows += 1
+
+		if err != nil {
+
+			line, ok := badRowLine(err)
+
+			if !ok || c.StrictMetaFiles {
+				rows -= 1 // it wasn't read
+				return rows, with_path, &PartialReadError{Meta: label, Rows: rows, Line: line, Err: err}
+			}
+
+			bad_rows := atomic.AddInt64(&c.BadRows, 1)
+			c.Logger.Warning("row %d (line %d) of %s is malformed, skipping, %v", rows, line, label, err)
+
+			if c.MaxBadRows > 0 && bad_rows > c.MaxBadRows {
+				return rows, with_path, &MetaFileError{Path: label, Err: ErrTooManyBadRows}
+			}
+
+			continue
+		}
+
+		if row[c.PathColumn] == "" {
+			atomic.AddInt64(&c.MissingPath, 1)
+			c.Logger.Warning("row %d of %s has an empty %s column, skipping", rows, label, c.PathColumn)
+			continue
+		}
+
+		with_path += 1
+
+		if c.meta_options.Filter != nil && !c.meta_options.Filter(row) {
+			atomic.AddInt64(&c.Ignored, 1)
+			c.decide(row[c.PathColumn], DecisionIgnored)
+			continue
+		}
+
+		c.Schedule(row, opts)
+	}
+
+	return rows, with_path, nil
+}
@@ -0,0 +1,422 @@
+package clone
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Source describes an S3 bucket (or something that speaks the S3 protocol, like
+// MinIO) to clone files from. See SetS3Source.
+
+type S3Source struct {
+	Bucket      string
+	Prefix      string // the key prefix that paths in meta files are relative to, for example "data/"
+	Region      string // defaults to the AWS_REGION or AWS_DEFAULT_REGION environment variables, or "us-east-1"
+	Endpoint    string // for S3-compatible services, for example "http://localhost:9000". Implies path-style URLs
+	MetadataKey string // the user metadata key holding each object's MD5 hash, default "md5"
+	Profile     string // the shared credentials profile to use, defaults to AWS_PROFILE or "default"
+}
+
+// s3Signer signs requests to an S3 host using AWS Signature Version 4. Requests are
+// sent unsigned if no credentials could be found, which works for public buckets.
+
+type s3Signer struct {
+	host          string
+	region        string
+	metadata_key  string
+	access_key    string
+	secret_key    string
+	session_token string
+}
+
+// SetS3Source sets c.Source to the objects in an S3 bucket. Objects are fetched with
+// signed GET requests (the same as GetObject) and change detection reads the MD5 hash
+// from the object's user metadata (x-amz-meta-<MetadataKey>) with a HEAD request, since
+// the ETags of multipart uploads aren't MD5 hashes. If there is no such metadata the
+// ETag is used if it looks like an MD5 hash and otherwise the object is considered
+// unchanged if it is the same size as, and no newer than, the local copy.
+//
+// Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables or, failing that, the shared credentials
+// file (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials). Everything else about
+// fetching files (workers, retries, counters) is the same as for any other source.
+
+func (c *WOFClone) SetS3Source(src S3Source) error {
+
+	if src.Bucket == "" {
+		return errors.New("Missing S3 bucket")
+	}
+
+	region := src.Region
+
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	metadata_key := src.MetadataKey
+
+	if metadata_key == "" {
+		metadata_key = "md5"
+	}
+
+	prefix := strings.TrimPrefix(src.Prefix, "/")
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	var source string
+
+	if src.Endpoint != "" {
+
+		endpoint := strings.TrimSuffix(src.Endpoint, "/")
+		source = fmt.Sprintf("%s/%s/%s", endpoint, src.Bucket, prefix)
+
+	} else {
+		source = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", src.Bucket, region, prefix)
+	}
+
+	u, err := url.Parse(source)
+
+	if err != nil {
+		return err
+	}
+
+	signer := s3Signer{
+		host:         u.Host,
+		region:       region,
+		metadata_key: metadata_key,
+	}
+
+	err = signer.loadCredentials(src.Profile)
+
+	if err != nil {
+		return err
+	}
+
+	if signer.access_key == "" {
+		c.Logger.Warning("No AWS credentials found, requests to %s will not be signed", u.Host)
+	}
+
+	c.Source = source
+	c.s3 = &signer
+
+	return nil
+}
+
+// loadCredentials looks for credentials in the environment and then in the shared
+// credentials file.
+
+func (s *s3Signer) loadCredentials(profile string) error {
+
+	s.access_key = os.Getenv("AWS_ACCESS_KEY_ID")
+	s.secret_key = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	s.session_token = os.Getenv("AWS_SESSION_TOKEN")
+
+	if s.access_key != "" && s.secret_key != "" {
+		return nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	if path == "" {
+
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return nil
+		}
+
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+
+	if profile == "" {
+		profile = "default"
+	}
+
+	fh, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	section := ""
+
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if section != profile {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		k := strings.TrimSpace(parts[0])
+		v := strings.TrimSpace(parts[1])
+
+		switch k {
+		case "aws_access_key_id":
+			s.access_key = v
+		case "aws_secret_access_key":
+			s.secret_key = v
+		case "aws_session_token":
+			s.session_token = v
+		}
+	}
+
+	return scanner.Err()
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, if req is for
+// the S3 host and there are credentials to sign it with.
+
+func (s *s3Signer) sign(req *http.Request, now time.Time) {
+
+	if req.URL.Host != s.host || s.access_key == "" {
+		return
+	}
+
+	now = now.UTC()
+
+	amz_date := now.Format("20060102T150405Z")
+	short_date := now.Format("20060102")
+	payload_hash := "UNSIGNED-PAYLOAD"
+
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	if s.session_token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.session_token)
+	}
+
+	// S3 wants every path segment escaped exactly once, which isn't quite what
+	// net/url does, so set RawPath to make sure what we sign is what gets sent
+
+	escaped_path := s3EscapePath(req.URL.Path)
+	req.URL.RawPath = escaped_path
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payload_hash,
+		"x-amz-date":           amz_date,
+	}
+
+	if s.session_token != "" {
+		headers["x-amz-security-token"] = s.session_token
+	}
+
+	names := make([]string, 0)
+
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	canonical_headers := ""
+
+	for _, k := range names {
+		canonical_headers += k + ":" + headers[k] + "\n"
+	}
+
+	signed_headers := strings.Join(names, ";")
+
+	canonical_request := strings.Join([]string{
+		req.Method,
+		escaped_path,
+		s3CanonicalQuery(req.URL.Query()),
+		canonical_headers,
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", short_date, s.region)
+
+	request_hash := sha256.Sum256([]byte(canonical_request))
+
+	string_to_sign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amz_date,
+		scope,
+		hex.EncodeToString(request_hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secret_key), short_date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.access_key, scope, signed_headers, signature)
+	req.Header.Set("Authorization", auth)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3Escape escapes str the way AWS Signature Version 4 expects, which is everything
+// except unreserved characters.
+
+func s3Escape(str string) string {
+
+	var b strings.Builder
+
+	for i := 0; i < len(str); i++ {
+
+		ch := str[i]
+
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+
+	return b.String()
+}
+
+func s3EscapePath(path string) string {
+
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+
+	pairs := make([]string, 0)
+
+	for k, values := range query {
+
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3HasChanged is CheckChanged for S3 sources, see SetS3Source.
+
+func (c *WOFClone) s3HasChanged(local string, remote string) (ChangeState, error) {
+
+	rsp, err := c.Fetch("HEAD", remote)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	rsp.Body.Close()
+
+	remote_hash := rsp.Header.Get("X-Amz-Meta-" + c.s3.metadata_key)
+
+	if remote_hash == "" {
+
+		etag := strings.Replace(rsp.Header.Get("Etag"), "\"", "", -1)
+
+		if re_md5.MatchString(etag) {
+			remote_hash = etag
+		}
+	}
+
+	remote_hash = strings.ToLower(remote_hash)
+
+	if remote_hash != "" {
+
+		// The metadata key may well hold a hash made with HashAlgorithm but ETags are
+		// always MD5 hashes, which are good enough to tell whether something has changed
+
+		algorithm := c.hashAlgorithm()
+
+		if !looksLikeHash(algorithm, remote_hash) {
+			algorithm = HashMD5
+		}
+
+		local_hash, err := c.hashLocalAs(local, algorithm)
+
+		if err != nil {
+			return Unknown, err
+		}
+
+		return changeState(local_hash != remote_hash), nil
+	}
+
+	// No hash to go on so compare sizes and modification times instead
+
+	info, err := os.Stat(local)
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	if !c.CompressLocal && info.Size() != rsp.ContentLength {
+		return Changed, nil
+	}
+
+	lastmod, ok := c.lastModified(rsp)
+
+	if !ok {
+		return Unknown, nil
+	}
+
+	return changeState(lastmod.After(info.ModTime())), nil
+}
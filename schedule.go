@@ -0,0 +1,565 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduleOptions control how Schedule decides whether the files for a row need to be
+// fetched. They are the same as the skip_existing and force_updates arguments to
+// CloneMetaFile.
+
+type ScheduleOptions struct {
+	SkipExisting bool
+	ForceUpdates bool
+}
+
+// cloneRun is the state shared by every row scheduled between the first call to
+// Schedule (or CloneMetaFile) and the matching call to Wait.
+
+type cloneRun struct {
+	meta       string
+	started    time.Time
+	ctx        context.Context
+	read_err   error // set if CloneMetaFile failed to read the whole meta file
+	done       chan bool
+	stopped    chan bool
+	cancel     context.CancelFunc
+	check_pool *workerPool
+	fetch_pool *workerPool
+	manifest   *manifest
+	count      int64 // the number of rows submitted so far, see MaxFiles
+	rows       int64 // the number of rows CloneMetaFile read from meta
+	excludes   *excludeList
+	sampler    *rand.Rand
+	sampler_mu *sync.Mutex
+	prefix     *dataPrefix // see DataPrefix
+	written    *writtenLog // see PostVerify
+	hashes     *sync.Map   // rel_path -> writtenFile, see UpdatedMetaPath
+	live       *liveRun    // see Progress
+}
+
+// startRun sets up the context, manifest and worker pools for a new run. meta is
+// the (absolute) path of the meta file being cloned, if there is one, and prefix is
+// what preflight found out about DataPrefix, if anything (see dataPrefix).
+
+func (c *WOFClone) startRun(meta string, prefix *dataPrefix) (*cloneRun, error) {
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	if c.run != nil {
+		return c.run, nil
+	}
+
+	// Counters describe a single run, see also Stats
+
+	c.resetCounters()
+
+	run := cloneRun{
+		meta:       meta,
+		started:    time.Now(),
+		sampler_mu: new(sync.Mutex),
+		prefix:     prefix,
+	}
+
+	if run.prefix == nil {
+		run.prefix = c.newDataPrefix()
+	}
+
+	err := c.checkHashOptions()
+
+	if err == nil {
+		err = c.checkDataPrefix()
+	}
+
+	if err == nil {
+		err = c.checkUnknownChanges()
+	}
+
+	if err == nil {
+		err = c.checkUnreadableLocal()
+	}
+
+	if err == nil {
+		err = c.checkReferenceLink()
+	}
+
+	if err == nil {
+		err = c.checkActiveWindow()
+	}
+
+	if err == nil {
+		err = c.checkStatusActions()
+	}
+
+	if err == nil {
+		err = c.checkRowOrder()
+	}
+
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return nil, err
+	}
+
+	excludes, err := c.loadExcludes()
+
+	if err != nil {
+		c.Logger.Error("%v", err)
+		return nil, err
+	}
+
+	run.excludes = excludes
+
+	if c.TempDir != "" {
+
+		err := os.MkdirAll(c.tempRoot(), 0755)
+
+		if err != nil {
+			c.Logger.Error("Failed to create %s, because %v", c.tempRoot(), err)
+			return nil, err
+		}
+	}
+
+	if c.ManifestPath != "" {
+
+		m, err := newManifest(c.ManifestPath, c.hasDestMapping())
+
+		if err != nil {
+			c.Logger.Error("Failed to create manifest %s, because %v", c.ManifestPath, err)
+			return nil, err
+		}
+
+		run.manifest = m
+	}
+
+	// The hash of each file written is kept so that updated meta files don't have to
+	// hash them all again, see wroteFile
+
+	if c.UpdatedMetaPath != "" && meta != "" {
+		run.hashes = new(sync.Map)
+	}
+
+	if c.PostVerify {
+
+		l, err := newWrittenLog(c.tempRoot())
+
+		if err != nil {
+
+			c.Logger.Error("Failed to create a list of files to verify, because %v", err)
+
+			if run.manifest != nil {
+				run.manifest.Close()
+			}
+
+			return nil, err
+		}
+
+		run.written = l
+	}
+
+	// Temporary files can only be cleaned up if no other run (another call to
+	// CloneMetaFile, see newSession) is in the middle of downloading them
+
+	running := atomic.AddInt64(&c.totals.Running, 1)
+
+	if !c.SkipTempCleanup && running == 1 {
+		c.removeTempFiles()
+	}
+
+	c.timer = time.Now()
+	c.meta_label = metaLabel(meta)
+	c.labelRun(meta)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	deadline, ok := c.runDeadline(run.started)
+
+	if ok {
+		cancel()
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+
+	run.ctx = ctx
+
+	c.ctx = ctx
+	c.cancel = cancel
+	c.manifest = run.manifest
+	c.written = run.written
+	c.hashes = run.hashes
+
+	run.cancel = cancel
+
+	c.throttle = nil
+	c.head_client = nil
+	c.groups = nil
+	c.previous = c.previousManifest()
+	phase := PhaseFetching
+
+	if meta != "" {
+		phase = PhaseReading
+	}
+
+	c.progress = newProgress(meta, phase)
+	c.dest_index = nil
+
+	if c.PrescanDest {
+		c.dest_index = c.scanDest()
+	}
+
+	if c.GroupBy != "" {
+		c.groups = newGroupTracker()
+	}
+
+	if c.HeadKeepAlive {
+		c.head_client = c.newHeadClient()
+	}
+
+	if c.TopFilesCount > 0 && c.TopFilesCount != c.timings.max {
+		c.timings = newTimings(c.TopFilesCount)
+	}
+
+	if c.AdaptiveThrottle {
+		c.throttle = newThrottle(c.ThrottleWindow, c.ThrottleErrorRate, c.CheckWorkers+c.FetchWorkers, c.ThrottleMinConcurrency, c.ThrottleMaxDelay)
+	}
+
+	atomic.StoreInt32(&c.aborted, 0)
+	atomic.StoreInt32(&c.excessive, 0)
+	c.dest_paths = new(sync.Map)
+	c.retries.Reset(c.MaxPendingRetries)
+	c.report.ResetFailed(c.MaxFailureRecords)
+	c.Failed = nil
+
+	// See notes about MaxFiles and SampleRate in the WOFClone struct
+
+	if c.SampleRate > 0.0 && c.SampleRate < 1.0 {
+		run.sampler = rand.New(rand.NewSource(c.SampleSeed))
+	}
+
+	/*
+		Rows are checked for changes (which usually means a HEAD request) by a pool of
+		c.CheckWorkers goroutines and anything that actually needs to be fetched is handed
+		off to a separate, usually smaller, pool of c.FetchWorkers goroutines. Both pools
+		have bounded queues so Schedule simply blocks when the workers are busy rather
+		than spawning a goroutine for every row. See workers.go
+	*/
+
+	run.check_pool = newWorkerPool(ctx, c.CheckWorkers)
+	run.fetch_pool = newTrackedWorkerPool(ctx, c.FetchWorkers, &c.totals.Queued, &c.totals.InFlight)
+
+	run.done = make(chan bool)
+	run.stopped = make(chan bool)
+
+	go func() {
+
+		defer close(run.stopped)
+
+		interval := c.StatusInterval
+
+		if interval < 0 {
+			<-run.done
+			return
+		}
+
+		if interval == 0 {
+			interval = default_status_interval
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-run.done:
+				return
+			case <-ticker.C:
+				c.Status()
+			}
+		}
+	}()
+
+	run.live = &liveRun{c: c, p: c.progress}
+	c.live.add(run.live)
+
+	c.run = &run
+
+	// Only now that the run is set up can Stats and Status on the WOFClone a session
+	// was started from look at it, see newSession
+
+	if c.parent != nil {
+		c.parent.run_mu.Lock()
+		c.parent.sessions[c] = true
+		c.parent.run_mu.Unlock()
+	}
+
+	return c.run, nil
+}
+
+// Schedule decides whether the files for row (a record from a meta file) need to be
+// fetched and, if they do, queues them to be fetched in the background. It blocks
+// while the workers are busy. Call Wait once every row has been scheduled to wait for
+// the fetches to finish and for any failures to be retried. This is the unit of work
+// that CloneMetaFile performs for each row in a meta file, so the rules about skipping,
+// sampling and MaxFiles (and all the counters) are the same.
+
+func (c *WOFClone) Schedule(row map[string]string, opts ScheduleOptions) error {
+
+	run, err := c.startRun("", nil)
+
+	if err != nil {
+		return err
+	}
+
+	if row[c.PathColumn] == "" {
+		atomic.AddInt64(&c.MissingPath, 1)
+		return fmt.Errorf("Row has no %s column", c.PathColumn)
+	}
+
+	if c.deadlineExceeded(run) {
+		return ErrDeadlineExceeded
+	}
+
+	if c.isAborted() {
+		return ErrAborted
+	}
+
+	if c.isExcluded(run.excludes, row[c.PathColumn]) {
+		return nil
+	}
+
+	if c.isBeforeSince(row) {
+		atomic.AddInt64(&c.TooOld, 1)
+		return nil
+	}
+
+	if run.sampler != nil {
+
+		run.sampler_mu.Lock()
+		ignore := run.sampler.Float64() >= c.SampleRate
+		run.sampler_mu.Unlock()
+
+		if ignore {
+			atomic.AddInt64(&c.Ignored, 1)
+			return nil
+		}
+	}
+
+	if c.MaxFiles > 0 && atomic.LoadInt64(&run.count) >= c.MaxFiles {
+		atomic.AddInt64(&c.Ignored, 1)
+		return nil
+	}
+
+	c.probeDataPrefix(run.prefix, row[c.PathColumn], c.remoteExists)
+
+	rel_path := c.rowPath(row, run.prefix)
+
+	force_updates := opts.ForceUpdates || c.isForcedPath(row[c.PathColumn])
+
+	run.check_pool.Submit(func() {
+		c.checkRow(rel_path, row, run.fetch_pool, opts.SkipExisting, force_updates, &run.count)
+	})
+
+	return nil
+}
+
+// Wait blocks until everything queued by Schedule has been fetched and then retries
+// any failures. It returns a *CloneError if the run was aborted (see MaxErrors), ran
+// past its deadline (see Deadline and Timeout), too
+// many files failed to be retried or, unless AllowFailures is true, any file was still
+// failing once the retries were done. The failing files are listed in c.Failed.
+
+func (c *WOFClone) Wait() (err error) {
+
+	c.run_mu.Lock()
+	run := c.run
+	c.run_mu.Unlock()
+
+	if run == nil {
+		return nil
+	}
+
+	defer c.endRun(run)
+
+	c.setPhase(PhaseFetching)
+
+	defer func() {
+
+		var clone_err *CloneError
+
+		summary := c.summary(run, err)
+
+		if errors.As(err, &clone_err) {
+			clone_err.Summary = summary
+		}
+
+		if c.keep_summary {
+			c.last_summary = summary
+		}
+
+		c.Logger.Info("%s", summary)
+		c.writeSummary(summary)
+
+		c.writeUpdatedMeta(run)
+	}()
+
+	run.check_pool.Close()
+	run.fetch_pool.Close()
+
+	// Note that c.Failed is updated again once the retries have been processed
+
+	c.Failed = c.report.Failed()
+
+	if c.MaxFiles > 0 && atomic.LoadInt64(&run.count) >= c.MaxFiles {
+		c.Logger.Info("stopped scheduling after %d files, %d rows were ignored", c.MaxFiles, atomic.LoadInt64(&c.Ignored))
+	}
+
+	if c.hasExcessiveErrors() {
+		c.Logger.Warning("aborted because too many files failed")
+		return c.cloneError(run.meta, ErrExcessiveErrors)
+	}
+
+	if c.deadlineExceeded(run) {
+		c.Logger.Warning("the deadline for this run passed before it finished")
+		return c.cloneError(run.meta, ErrDeadlineExceeded)
+	}
+
+	if c.isAborted() {
+		c.Logger.Warning("aborted after %d errors", atomic.LoadInt64(&c.Error))
+		return c.cloneError(run.meta, ErrAborted)
+	}
+
+	attempted, failed := c.processRetries()
+
+	if c.deadlineExceeded(run) {
+		c.Logger.Warning("the deadline for this run passed while failures were being retried")
+		return c.cloneError(run.meta, ErrDeadlineExceeded)
+	}
+
+	if !attempted {
+		c.Logger.Warning("failed to process retries")
+		return c.cloneError(run.meta, ErrExcessiveErrors)
+	}
+
+	if failed > 0 {
+		c.Logger.Warning("%d files failed again when they were retried", failed)
+	}
+
+	if run.written != nil {
+
+		c.setPhase(PhaseVerifying)
+		c.postVerify(run)
+
+		if c.deadlineExceeded(run) {
+			c.Logger.Warning("the deadline for this run passed while files were being verified")
+			return c.cloneError(run.meta, ErrDeadlineExceeded)
+		}
+	}
+
+	c.Failed = c.report.Failed()
+
+	_, omitted := c.report.FailedCount()
+
+	if (len(c.Failed) > 0 || omitted > 0) && !c.AllowFailures {
+		c.Logger.Warning("%d files could not be cloned", int64(len(c.Failed))+omitted)
+		return c.cloneError(run.meta, ErrFailures)
+	}
+
+	c.setLastSuccess(time.Now())
+	return nil
+}
+
+// runDeadline returns the time by which a run that started at started must finish,
+// and false if there isn't one. See Deadline and Timeout.
+
+func (c *WOFClone) runDeadline(started time.Time) (time.Time, bool) {
+
+	var deadline time.Time
+
+	if c.Timeout > 0 {
+		deadline = started.Add(c.Timeout)
+	}
+
+	if !c.Deadline.IsZero() && (deadline.IsZero() || c.Deadline.Before(deadline)) {
+		deadline = c.Deadline
+	}
+
+	return deadline, !deadline.IsZero()
+}
+
+func (c *WOFClone) deadlineExceeded(run *cloneRun) bool {
+	return errors.Is(run.ctx.Err(), context.DeadlineExceeded)
+}
+
+// endRun releases everything set up by startRun and logs the final status of the run.
+
+func (c *WOFClone) endRun(run *cloneRun) {
+
+	run.cancel()
+
+	close(run.done)
+	<-run.stopped
+
+	c.setPhase(PhaseDone)
+	c.live.remove(run.live)
+
+	c.logLocalNewer()
+	c.logBogusLastModified()
+	c.logPermissionDenied()
+	c.logFalseChanges()
+
+	if c.LogGroups && c.groups != nil {
+		c.logGroups()
+	}
+	c.addTotals()
+
+	atomic.AddInt64(&c.totals.Running, -1)
+
+	if c.LogTimings && !c.DisableTimings {
+		c.logTimings()
+	}
+
+	if c.TraceRequests {
+		c.logConnections()
+	}
+
+	if run.manifest != nil {
+
+		err := run.manifest.Close()
+
+		if err != nil {
+			c.Logger.Error("Failed to write manifest %s, because %v", c.ManifestPath, err)
+		}
+	}
+
+	if run.written != nil {
+		run.written.Remove()
+	}
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	c.closeHeadClient()
+
+	c.ctx = context.Background()
+	c.cancel = func() {}
+	c.manifest = nil
+	c.written = nil
+	c.run = nil
+}
+
+// isRunning returns true if there is a run (started by Schedule or CloneMetaFile)
+// that hasn't been waited on yet.
+
+func (c *WOFClone) isRunning() bool {
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	return c.run != nil
+}
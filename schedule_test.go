@@ -0,0 +1,148 @@
+package clone
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLargeMetaFileIsBounded clones a meta file with many more rows than there are
+// workers and checks that neither the number of goroutines nor the heap grows with the
+// number of rows, which it would if rows were read any faster than they are cloned.
+
+func TestLargeMetaFileIsBounded(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("Skipping a large meta file in short mode")
+	}
+
+	const rows = 2000
+	const padding = 16 * 1024
+
+	// Every row is served successfully, so that they all go all the way through the
+	// workers and are written to disk
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1}`))
+	}))
+
+	defer source.Close()
+
+	// Each row is padded out so that the meta file (about 32MB) is much larger than the
+	// heap is allowed to grow. It is written straight to disk so that it isn't on the
+	// heap to begin with
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+
+	fh, err := os.Create(meta)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %v", meta, err)
+	}
+
+	wr := bufio.NewWriter(fh)
+	wr.WriteString("path,name\n")
+
+	name := strings.Repeat("x", padding)
+
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(wr, "%d/%d.geojson,%s\n", i, i, name)
+	}
+
+	err = wr.Flush()
+
+	if err == nil {
+		err = fh.Close()
+	}
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", meta, err)
+	}
+
+	limit := uint64(rows*padding) / 4
+
+	c := newTestClone(t, source.URL+"/")
+	c.CheckWorkers = 8
+	c.FetchWorkers = 8
+
+	runtime.GC()
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	baseline := runtime.NumGoroutine()
+
+	peak_goroutines := 0
+	peak_heap := uint64(0)
+
+	done := make(chan bool)
+	wg := new(sync.WaitGroup)
+
+	wg.Add(1)
+
+	go func() {
+
+		defer wg.Done()
+
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+
+				n := runtime.NumGoroutine()
+
+				if n > peak_goroutines {
+					peak_goroutines = n
+				}
+
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+
+				if stats.HeapInuse > peak_heap {
+					peak_heap = stats.HeapInuse
+				}
+			}
+		}
+	}()
+
+	err = c.CloneMetaFile(meta, false, false)
+
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	checkCounters(t, c, rows)
+
+	// The workers, their connections and the server's handlers, but nothing like one
+	// for each row
+
+	if peak_goroutines-baseline > 200 {
+		t.Errorf("Expected a bounded number of goroutines, got %d more than the %d there were to begin with", peak_goroutines-baseline, baseline)
+	}
+
+	// Holding on to all of the rows, or even a quarter of them, would go over this
+
+	if peak_heap > before.HeapInuse+limit {
+		t.Errorf("Expected the heap to grow by less than %d bytes, got %d", limit, peak_heap-before.HeapInuse)
+	}
+
+	if c.Success != rows {
+		t.Errorf("Expected %d files to be cloned, got %d", rows, c.Success)
+	}
+}
@@ -0,0 +1,218 @@
+package clone
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfclone_probe_max is the most bytes read from each response when looking for the
+// probe written by isServedFromDest.
+
+const selfclone_probe_max = 1024
+
+// checkSelfClone returns a *SelfCloneError if c.Source is (or is inside, or contains)
+// c.Dest, which would mean cloning files on to themselves. This is only checked for
+// file URLs and, if c.ProbeSelfClone is true, for HTTP sources on this machine, see
+// AllowSelfClone.
+
+func (c *WOFClone) checkSelfClone() error {
+
+	u, err := url.Parse(c.Source)
+
+	if err != nil {
+		return nil
+	}
+
+	switch u.Scheme {
+	case "file", "":
+
+		root := u.Path
+
+		if u.Scheme == "" {
+			root = c.Source
+		}
+
+		source := resolvePath(root)
+		dest := resolvePath(c.Dest)
+
+		if isWithin(source, dest) {
+			return &SelfCloneError{Source: c.Source, Dest: c.Dest, Reason: "Dest is inside the source directory"}
+		}
+
+		if isWithin(dest, source) {
+			return &SelfCloneError{Source: c.Source, Dest: c.Dest, Reason: "the source directory is inside Dest"}
+		}
+
+	case "http", "https":
+
+		if !c.ProbeSelfClone || !isLocalHost(u.Hostname()) {
+			return nil
+		}
+
+		if c.isServedFromDest() {
+			return &SelfCloneError{Source: c.Source, Dest: c.Dest, Reason: "the source is serving files from Dest"}
+		}
+	}
+
+	return nil
+}
+
+// isServedFromDest writes a probe file with random contents in to c.Dest and returns
+// true if c.Source serves it back, which it would if its root directory were Dest. The
+// probe file is removed again before it returns.
+
+func (c *WOFClone) isServedFromDest() bool {
+
+	secret := make([]byte, 16)
+
+	_, err := rand.Read(secret)
+
+	if err != nil {
+		return false
+	}
+
+	body := []byte(hex.EncodeToString(secret))
+
+	dest := resolvePath(c.Dest)
+
+	fh, err := ioutil.TempFile(dest, ".wof-clone-selfcheck-")
+
+	if err != nil {
+		return false
+	}
+
+	probe := fh.Name()
+
+	defer os.Remove(probe)
+
+	_, err = fh.Write(body)
+	fh.Close()
+
+	if err != nil {
+		return false
+	}
+
+	return c.servesProbe(c.Source+filepath.Base(probe), body)
+}
+
+// servesProbe returns true if remote's body is body. The request is sent like any other,
+// see do.
+
+func (c *WOFClone) servesProbe(remote string, body []byte) bool {
+
+	req, err := http.NewRequest("GET", remote, nil)
+
+	if err != nil {
+		return false
+	}
+
+	req = req.WithContext(c.ctx)
+
+	c.PrepareRequest(req)
+
+	rsp, release, err := c.do(req)
+
+	if err != nil {
+		return false
+	}
+
+	defer release()
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		return false
+	}
+
+	served, err := ioutil.ReadAll(io.LimitReader(rsp.Body, selfclone_probe_max))
+
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(served, body)
+}
+
+// isLocalHost returns true if host is this machine: "localhost", a loopback address or
+// one of the addresses of its network interfaces (or a name that resolves to one).
+
+func isLocalHost(host string) bool {
+
+	if strings.ToLower(host) == "localhost" {
+		return true
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+
+	if ips[0] == nil {
+
+		addrs, err := net.LookupIP(host)
+
+		if err != nil {
+			return false
+		}
+
+		ips = addrs
+	}
+
+	local, _ := net.InterfaceAddrs()
+
+	for _, ip := range ips {
+
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+
+		for _, addr := range local {
+
+			ipnet, ok := addr.(*net.IPNet)
+
+			if ok && ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// resolvePath returns the absolute path of path with any symlinks resolved, as far as
+// that's possible.
+
+func resolvePath(path string) string {
+
+	abs_path, err := filepath.Abs(path)
+
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs_path)
+
+	if err != nil {
+		return abs_path
+	}
+
+	return resolved
+}
+
+// isWithin returns true if path is dir or inside it.
+
+func isWithin(dir string, path string) bool {
+
+	rel, err := filepath.Rel(dir, path)
+
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,228 @@
+package clone
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsWithin(t *testing.T) {
+
+	tests := []struct {
+		dir    string
+		path   string
+		within bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/a/b/c", true},
+		{"/a", "/ab", false},
+		{"/a/b", "/a", false},
+		{"/a", "/b", false},
+		{"/a", "/a/../b", false},
+	}
+
+	for _, test := range tests {
+
+		within := isWithin(test.dir, test.path)
+
+		if within != test.within {
+			t.Errorf("isWithin(%q, %q) is %v, expected %v", test.dir, test.path, within, test.within)
+		}
+	}
+}
+
+// symlinkTree makes a tree with a data directory, a dest directory inside it and a
+// sibling directory whose name starts with data, along with symlinks to each of them.
+
+func symlinkTree(t *testing.T) string {
+
+	t.Helper()
+
+	root := t.TempDir()
+
+	for _, dir := range []string{"real/data/dest/sub", "real/data2"} {
+
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %v", dir, err)
+		}
+	}
+
+	links := map[string]string{
+		"link-data":     "real/data",
+		"link-dest":     "real/data/dest",
+		"link-dest-sub": "real/data/dest/sub",
+		"link-data2":    "real/data2",
+	}
+
+	for link, target := range links {
+
+		err := os.Symlink(filepath.Join(root, target), filepath.Join(root, link))
+
+		if err != nil {
+			t.Skipf("Unable to create symlinks, %v", err)
+		}
+	}
+
+	return root
+}
+
+func TestResolvePath(t *testing.T) {
+
+	root := symlinkTree(t)
+
+	real_root, err := filepath.EvalSymlinks(root)
+
+	if err != nil {
+		t.Fatalf("Failed to resolve %s, %v", root, err)
+	}
+
+	// A path that doesn't exist can't be resolved, so it is only made absolute
+
+	tests := []struct {
+		path     string
+		resolved string
+		exists   bool
+	}{
+		{"real/data", "real/data", true},
+		{"link-data", "real/data", true},
+		{"link-data/dest", "real/data/dest", true},
+		{"link-dest", "real/data/dest", true},
+		{"link-dest-sub", "real/data/dest/sub", true},
+		{"link-data/missing", "link-data/missing", false},
+	}
+
+	for _, test := range tests {
+
+		resolved := resolvePath(filepath.Join(root, test.path))
+		expected := filepath.Join(real_root, test.resolved)
+
+		if !test.exists {
+			expected = filepath.Join(root, test.resolved)
+		}
+
+		if resolved != expected {
+			t.Errorf("resolvePath(%q) is %q, expected %q", test.path, resolved, expected)
+		}
+	}
+}
+
+func TestCheckSelfCloneSymlinks(t *testing.T) {
+
+	root := symlinkTree(t)
+
+	tests := []struct {
+		name   string
+		source string
+		dest   string
+		reason string
+	}{
+		{"same directory", "real/data", "link-data", "Dest is inside the source directory"},
+		{"symlinked source, dest inside it", "link-data", "real/data/dest", "Dest is inside the source directory"},
+		{"symlinked dest, inside source", "real/data", "link-dest", "Dest is inside the source directory"},
+		{"both symlinked, dest inside source", "link-data", "link-dest", "Dest is inside the source directory"},
+		{"symlinked source, inside dest", "link-dest-sub", "real/data/dest", "the source directory is inside Dest"},
+		{"symlinked dest, source inside it", "real/data/dest/sub", "link-data", "the source directory is inside Dest"},
+		{"both symlinked, source inside dest", "link-dest-sub", "link-dest", "the source directory is inside Dest"},
+		{"sibling with a shared prefix", "link-data2", "link-data", ""},
+		{"symlinked sibling dest", "real/data2", "link-dest", ""},
+	}
+
+	for _, test := range tests {
+
+		source := "file://" + filepath.ToSlash(filepath.Join(root, test.source)) + "/"
+
+		c, err := NewWOFClone(source, filepath.Join(root, test.dest), 2, nil)
+
+		if err != nil {
+			t.Fatalf("%s: failed to create clone, %v", test.name, err)
+		}
+
+		err = c.checkSelfClone()
+
+		if test.reason == "" {
+
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.name, err)
+			}
+
+			continue
+		}
+
+		var self_err *SelfCloneError
+
+		if !errors.As(err, &self_err) {
+			t.Errorf("%s: expected a SelfCloneError, got %v", test.name, err)
+			continue
+		}
+
+		if self_err.Reason != test.reason {
+			t.Errorf("%s: expected %q, got %q", test.name, test.reason, self_err.Reason)
+		}
+	}
+}
+
+func TestSelfCloneProbe(t *testing.T) {
+
+	for _, probe := range []bool{false, true} {
+
+		dest := t.TempDir()
+
+		var requests int32
+
+		files := http.FileServer(http.Dir(dest))
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			files.ServeHTTP(w, r)
+		}))
+
+		c, err := NewWOFClone(server.URL+"/", dest, 2, nil)
+
+		if err != nil {
+			t.Fatalf("Failed to create clone, %v", err)
+		}
+
+		c.StatusInterval = -1
+		c.ProbeSelfClone = probe
+
+		meta := writeMetaFile(t)
+
+		err = c.CloneMetaFile(meta, false, false)
+		server.Close()
+
+		var self_err *SelfCloneError
+		refused := errors.As(err, &self_err)
+
+		if refused != probe {
+			t.Errorf("ProbeSelfClone %v: expected refused to be %v, got %v", probe, probe, err)
+		}
+
+		expected := int32(0)
+
+		if probe {
+			expected = 1
+		}
+
+		if requests != expected {
+			t.Errorf("ProbeSelfClone %v: expected %d requests, got %d", probe, expected, requests)
+		}
+
+		left, err := ioutil.ReadDir(dest)
+
+		if err != nil {
+			t.Fatalf("Failed to read %s, %v", dest, err)
+		}
+
+		if len(left) != 0 {
+			t.Errorf("ProbeSelfClone %v: expected Dest to be empty, found %s", probe, left[0].Name())
+		}
+	}
+}
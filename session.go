@@ -0,0 +1,273 @@
+package clone
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// WOFCloneStats are the totals for every run (every call to CloneMetaFile, or every
+// Schedule and Wait) that a WOFClone has finished or is in the middle of, see Stats,
+// except for Running, the number of runs still going, and InFlight and Queued which are
+// the number of fetches happening, and waiting to happen, right now across all of them.
+
+type WOFCloneStats struct {
+	Running           int64
+	InFlight          int64
+	Queued            int64
+	Runs              int64
+	Scheduled         int64
+	Completed         int64
+	Success           int64
+	Error             int64
+	Skipped           int64
+	SkippedTooLarge   int64
+	Ignored           int64
+	Truncated         int64
+	MissingPath       int64
+	LocalNewer        int64
+	UnknownChange     int64
+	BadRows           int64
+	BundleFiles       int64
+	BundleErrors      int64
+	Linked            int64
+	PermanentErrors   int64
+	SkippedManifest   int64
+	Quarantined       int64
+	BogusLastModified int64
+	Unreadable        int64
+	InvalidHash       int64
+	ReusedConnRetries int64
+	TooOld            int64
+	Excluded          int64
+	FetchedBytes      int64
+	Retried           int64
+	EmptyBody         int64
+	Forced            int64
+	PermissionDenied  int64
+	FalseChanges      int64
+	SkippedIdentical  int64
+}
+
+// Stats returns the totals for every run that has finished so far, along with the
+// counters of any calls to CloneMetaFile (or CloneRows) that are still going, so it can
+// be called from another goroutine to see how they are getting on. The Success, Error
+// (and so on) fields of a WOFClone only describe a single run, see CloneMetaFile.
+
+func (c *WOFClone) Stats() *WOFCloneStats {
+
+	// Sessions add their counters to the totals and stop being live under run_mu, see
+	// addTotals, so nothing is counted twice or not at all
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	t := c.totals
+
+	stats := WOFCloneStats{
+		Running:           atomic.LoadInt64(&t.Running),
+		InFlight:          atomic.LoadInt64(&t.InFlight),
+		Queued:            atomic.LoadInt64(&t.Queued),
+		Runs:              atomic.LoadInt64(&t.Runs),
+		Scheduled:         atomic.LoadInt64(&t.Scheduled),
+		Completed:         atomic.LoadInt64(&t.Completed),
+		Success:           atomic.LoadInt64(&t.Success),
+		Error:             atomic.LoadInt64(&t.Error),
+		Skipped:           atomic.LoadInt64(&t.Skipped),
+		SkippedTooLarge:   atomic.LoadInt64(&t.SkippedTooLarge),
+		Ignored:           atomic.LoadInt64(&t.Ignored),
+		Truncated:         atomic.LoadInt64(&t.Truncated),
+		MissingPath:       atomic.LoadInt64(&t.MissingPath),
+		LocalNewer:        atomic.LoadInt64(&t.LocalNewer),
+		UnknownChange:     atomic.LoadInt64(&t.UnknownChange),
+		BadRows:           atomic.LoadInt64(&t.BadRows),
+		BundleFiles:       atomic.LoadInt64(&t.BundleFiles),
+		BundleErrors:      atomic.LoadInt64(&t.BundleErrors),
+		Linked:            atomic.LoadInt64(&t.Linked),
+		PermanentErrors:   atomic.LoadInt64(&t.PermanentErrors),
+		SkippedManifest:   atomic.LoadInt64(&t.SkippedManifest),
+		Quarantined:       atomic.LoadInt64(&t.Quarantined),
+		BogusLastModified: atomic.LoadInt64(&t.BogusLastModified),
+		Unreadable:        atomic.LoadInt64(&t.Unreadable),
+		InvalidHash:       atomic.LoadInt64(&t.InvalidHash),
+		ReusedConnRetries: atomic.LoadInt64(&t.ReusedConnRetries),
+		TooOld:            atomic.LoadInt64(&t.TooOld),
+		Excluded:          atomic.LoadInt64(&t.Excluded),
+		FetchedBytes:      atomic.LoadInt64(&t.FetchedBytes),
+		Retried:           atomic.LoadInt64(&t.Retried),
+		EmptyBody:         atomic.LoadInt64(&t.EmptyBody),
+		Forced:            atomic.LoadInt64(&t.Forced),
+		PermissionDenied:  atomic.LoadInt64(&t.PermissionDenied),
+		FalseChanges:      atomic.LoadInt64(&t.FalseChanges),
+		SkippedIdentical:  atomic.LoadInt64(&t.SkippedIdentical),
+	}
+
+	for s := range c.sessions {
+
+		for _, pair := range s.countersWith(&stats) {
+			*pair[1] += atomic.LoadInt64(pair[0])
+		}
+	}
+
+	return &stats
+}
+
+// counters returns pointers to the per-run counters alongside the matching totals.
+
+func (c *WOFClone) counters() [][2]*int64 {
+	return c.countersWith(c.totals)
+}
+
+// countersWith is counters but paired with the fields of t instead of c's totals.
+
+func (c *WOFClone) countersWith(t *WOFCloneStats) [][2]*int64 {
+
+	return [][2]*int64{
+		{&c.Scheduled, &t.Scheduled},
+		{&c.Completed, &t.Completed},
+		{&c.Success, &t.Success},
+		{&c.Error, &t.Error},
+		{&c.Skipped, &t.Skipped},
+		{&c.SkippedTooLarge, &t.SkippedTooLarge},
+		{&c.Ignored, &t.Ignored},
+		{&c.Truncated, &t.Truncated},
+		{&c.MissingPath, &t.MissingPath},
+		{&c.LocalNewer, &t.LocalNewer},
+		{&c.UnknownChange, &t.UnknownChange},
+		{&c.BadRows, &t.BadRows},
+		{&c.BundleFiles, &t.BundleFiles},
+		{&c.BundleErrors, &t.BundleErrors},
+		{&c.Linked, &t.Linked},
+		{&c.PermanentErrors, &t.PermanentErrors},
+		{&c.SkippedManifest, &t.SkippedManifest},
+		{&c.Quarantined, &t.Quarantined},
+		{&c.BogusLastModified, &t.BogusLastModified},
+		{&c.Unreadable, &t.Unreadable},
+		{&c.InvalidHash, &t.InvalidHash},
+		{&c.ReusedConnRetries, &t.ReusedConnRetries},
+		{&c.TooOld, &t.TooOld},
+		{&c.Excluded, &t.Excluded},
+		{&c.FetchedBytes, &t.FetchedBytes},
+		{&c.Retried, &t.Retried},
+		{&c.EmptyBody, &t.EmptyBody},
+		{&c.Forced, &t.Forced},
+		{&c.PermissionDenied, &t.PermissionDenied},
+		{&c.FalseChanges, &t.FalseChanges},
+		{&c.SkippedIdentical, &t.SkippedIdentical},
+	}
+}
+
+// resetCounters zeroes the per-run counters at the start of a run.
+
+func (c *WOFClone) resetCounters() {
+
+	for _, pair := range c.counters() {
+		atomic.StoreInt64(pair[0], 0)
+	}
+
+	atomic.StoreInt64(&c.PostVerified, 0)
+	atomic.StoreInt64(&c.PostVerifyMismatches, 0)
+	atomic.StoreInt64(&c.TempFilesRemoved, 0)
+}
+
+// addTotals adds the per-run counters to the totals at the end of a run. For a session
+// that is also when its counters stop being added in by Stats.
+
+func (c *WOFClone) addTotals() {
+
+	if c.parent != nil {
+
+		c.parent.run_mu.Lock()
+		defer c.parent.run_mu.Unlock()
+
+		delete(c.parent.sessions, c)
+	}
+
+	atomic.AddInt64(&c.totals.Runs, 1)
+
+	for _, pair := range c.counters() {
+		atomic.AddInt64(pair[1], atomic.LoadInt64(pair[0]))
+	}
+}
+
+// newSession returns a copy of c for a single call to CloneMetaFile. It has the same
+// options and shares the HTTP client, rate limits and so on with c but has its own
+// counters, retry queue, report and run so that any number of calls can be made, one
+// after the other or at the same time, without getting in each other's way. c keeps
+// track of its sessions from when their run starts until it ends (see startRun and
+// addTotals), so that Stats and Status can see how they are getting on. Sessions can't be started while c itself is in the middle of a run
+// started by Schedule.
+
+func (c *WOFClone) newSession() (*WOFClone, error) {
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	if c.run != nil {
+		return nil, ErrRunning
+	}
+
+	s := *c
+
+	s.run = nil
+	s.run_mu = new(sync.Mutex)
+	s.sessions = make(map[*WOFClone]bool)
+	s.parent = c
+	s.retries = newRetryQueue(c.MaxPendingRetries)
+	s.report = newReport()
+	s.ctx = context.Background()
+	s.cancel = func() {}
+	s.aborted = 0
+	s.excessive = 0
+	s.manifest = nil
+	s.written = nil
+	s.hashes = nil
+	s.throttle = nil
+	s.head_client = nil
+	s.groups = nil
+	s.previous = nil
+	s.progress = nil
+	s.dest_index = nil
+	s.meta_options = MetaFileOptions{}
+	s.Failed = nil
+	s.Filehandles = 0
+	s.expected = new(sync.Map)
+	s.dest_paths = new(sync.Map)
+	s.keep_summary = true
+	s.last_summary = nil
+
+	for _, pair := range s.counters() {
+		*pair[0] = 0
+	}
+
+	s.PostVerified = 0
+	s.PostVerifyMismatches = 0
+	s.TempFilesRemoved = 0
+
+	return &s, nil
+}
+
+// endSession copies the results of session s back to c, so that (as has always been
+// the case) c's counters and Failed describe the most recent call to CloneMetaFile and
+// Report describes every call.
+
+func (c *WOFClone) endSession(s *WOFClone) {
+
+	c.run_mu.Lock()
+	defer c.run_mu.Unlock()
+
+	// In case its run never ended, see addTotals
+
+	delete(c.sessions, s)
+
+	for i, pair := range c.counters() {
+		atomic.StoreInt64(pair[0], atomic.LoadInt64(s.counters()[i][0]))
+	}
+
+	atomic.StoreInt64(&c.PostVerified, atomic.LoadInt64(&s.PostVerified))
+	atomic.StoreInt64(&c.PostVerifyMismatches, atomic.LoadInt64(&s.PostVerifyMismatches))
+	atomic.StoreInt64(&c.TempFilesRemoved, atomic.LoadInt64(&s.TempFilesRemoved))
+
+	c.Failed = s.Failed
+	c.report.Merge(s.report)
+}
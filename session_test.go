@@ -0,0 +1,289 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// checkCounters fails t unless every row of a run was scheduled and completed once and
+// ended up in exactly one of Success, Error or Skipped.
+
+func checkCounters(t *testing.T, c *WOFClone, rows int64) {
+
+	t.Helper()
+
+	if c.Scheduled != rows {
+		t.Errorf("Expected %d rows to be scheduled, got %d", rows, c.Scheduled)
+	}
+
+	if c.Completed != c.Scheduled {
+		t.Errorf("Expected as many rows to be completed (%d) as scheduled (%d)", c.Completed, c.Scheduled)
+	}
+
+	total := c.Success + c.Error + c.Skipped
+
+	if total != c.Scheduled {
+		t.Errorf("Expected success (%d), error (%d) and skipped (%d) to add up to %d, got %d", c.Success, c.Error, c.Skipped, c.Scheduled, total)
+	}
+}
+
+func TestCountersAddUp(t *testing.T) {
+
+	source := newTestSource(t)
+
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+	source.set("3/3.geojson", `{"id":3}`)
+
+	c := newTestClone(t, source.URL)
+
+	err := c.CloneMetaFile(writeMetaFile(t, "1/1.geojson", "2/2.geojson", "3/3.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	checkCounters(t, c, 3)
+
+	if c.Success != 3 {
+		t.Errorf("Expected 3 new files, got %d", c.Success)
+	}
+
+	// 1 is unchanged, 2 has changed, 4 is new, 5 has been deleted and 6 is broken
+
+	source.set("2/2.geojson", `{"id":2,"name":"changed"}`)
+	source.set("4/4.geojson", `{"id":4}`)
+	source.fail("6/6.geojson", 500)
+
+	paths := []string{"1/1.geojson", "2/2.geojson", "4/4.geojson", "5/5.geojson", "6/6.geojson"}
+
+	c.AllowFailures = true
+
+	err = c.CloneMetaFile(writeMetaFile(t, paths...), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	checkCounters(t, c, int64(len(paths)))
+
+	if c.Success != 2 || c.Skipped != 1 || c.Error != 2 {
+		t.Errorf("Expected 2 fetched, 1 skipped and 2 failed, got %d, %d and %d", c.Success, c.Skipped, c.Error)
+	}
+
+	if c.PermanentErrors != 1 {
+		t.Errorf("Expected the deleted file to be a permanent error, got %d", c.PermanentErrors)
+	}
+
+	stats := c.Stats()
+
+	if stats.Runs != 2 || stats.Scheduled != 8 {
+		t.Errorf("Expected 2 runs and 8 rows in all, got %d and %d", stats.Runs, stats.Scheduled)
+	}
+
+	if stats.Success+stats.Error+stats.Skipped != stats.Scheduled {
+		t.Errorf("Expected the totals to add up to %d, got %d", stats.Scheduled, stats.Success+stats.Error+stats.Skipped)
+	}
+}
+
+// TestStatusDuringClone is meant to be run with -race. It also checks that Stats sees
+// the run's counters go up while it is still going, rather than only once it is done.
+
+func TestStatusDuringClone(t *testing.T) {
+
+	source := newTestSource(t)
+	source.slow(2 * time.Millisecond)
+
+	paths := make([]string, 0)
+
+	for i := 1; i <= 50; i++ {
+		rel_path := fmt.Sprintf("%d/%d.geojson", i, i)
+		source.set(rel_path, fmt.Sprintf(`{"id":%d}`, i))
+		paths = append(paths, rel_path)
+	}
+
+	c := newTestClone(t, source.URL)
+	c.StatusInterval = time.Millisecond
+
+	done := make(chan bool)
+	wg := new(sync.WaitGroup)
+
+	var live int32
+
+	for i := 0; i < 4; i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			completed := int64(0)
+
+			for {
+
+				select {
+				case <-done:
+					return
+				default:
+
+					c.Status()
+					stats := c.Stats()
+
+					if stats.Completed < completed {
+						t.Errorf("Expected Completed never to go down, got %d after %d", stats.Completed, completed)
+					}
+
+					completed = stats.Completed
+
+					if stats.Runs == 0 && stats.Completed > 0 {
+						atomic.StoreInt32(&live, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	err := c.CloneMetaFile(writeMetaFile(t, paths...), false, false)
+
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	checkCounters(t, c, int64(len(paths)))
+
+	if atomic.LoadInt32(&live) == 0 {
+		t.Errorf("Expected Completed to go up while the run was going")
+	}
+
+	if c.Stats().Success != int64(len(paths)) {
+		t.Errorf("Expected %d files to be cloned, got %d", len(paths), c.Stats().Success)
+	}
+}
+
+func TestConcurrentClones(t *testing.T) {
+
+	source := newTestSource(t)
+	source.slow(time.Millisecond)
+
+	for i := 1; i <= 40; i++ {
+		source.set(fmt.Sprintf("%d/%d.geojson", i, i), fmt.Sprintf(`{"id":%d}`, i))
+	}
+
+	source.fail("41/41.geojson", 404)
+
+	// The two clones overlap, but each has files (and a failure) the other doesn't
+
+	type run struct {
+		paths  []string
+		clone  *WOFClone
+		logger *testLogger
+		err    error
+	}
+
+	runs := []*run{
+		{paths: []string{}},
+		{paths: []string{}},
+	}
+
+	for i := 1; i <= 20; i++ {
+		runs[0].paths = append(runs[0].paths, fmt.Sprintf("%d/%d.geojson", i, i))
+	}
+
+	for i := 11; i <= 40; i++ {
+		runs[1].paths = append(runs[1].paths, fmt.Sprintf("%d/%d.geojson", i, i))
+	}
+
+	runs[1].paths = append(runs[1].paths, "41/41.geojson")
+
+	for _, r := range runs {
+
+		r.logger = new(testLogger)
+
+		c, err := NewWOFClone(source.URL, t.TempDir(), 2, r.logger)
+
+		if err != nil {
+			t.Fatalf("Failed to create clone, %v", err)
+		}
+
+		c.StatusInterval = -1
+		c.AllowFailures = true
+
+		r.clone = c
+	}
+
+	wg := new(sync.WaitGroup)
+
+	for _, r := range runs {
+
+		wg.Add(1)
+
+		go func(r *run, meta string) {
+			defer wg.Done()
+			r.err = r.clone.CloneMetaFile(meta, false, false)
+		}(r, writeMetaFile(t, r.paths...))
+	}
+
+	wg.Wait()
+
+	for i, r := range runs {
+
+		if r.err != nil {
+			t.Fatalf("Clone %d failed, %v", i, r.err)
+		}
+
+		checkCounters(t, r.clone, int64(len(r.paths)))
+
+		failed := int64(0)
+
+		if i == 1 {
+			failed = 1
+		}
+
+		if r.clone.Success != int64(len(r.paths))-failed || r.clone.Error != failed {
+			t.Errorf("Clone %d: expected %d cloned and %d failed, got %d and %d", i, int64(len(r.paths))-failed, failed, r.clone.Success, r.clone.Error)
+		}
+
+		if r.clone.Stats().Runs != 1 {
+			t.Errorf("Clone %d: expected 1 run, got %d", i, r.clone.Stats().Runs)
+		}
+
+		for _, rel_path := range r.paths[:len(r.paths)-int(failed)] {
+
+			_, err := os.Stat(r.clone.LocalPath(rel_path))
+
+			if err != nil {
+				t.Errorf("Clone %d: expected %s to have been cloned, %v", i, rel_path, err)
+			}
+		}
+
+		// Each clone logs to its own logger, and only about its own destination
+
+		other := runs[1-i].clone.Dest
+
+		if len(r.logger.Lines()) == 0 {
+			t.Errorf("Clone %d: expected something to be logged", i)
+		}
+
+		for _, line := range r.logger.Lines() {
+
+			if strings.Contains(line, other) {
+				t.Errorf("Clone %d: logged a message about the other clone, %s", i, line)
+			}
+		}
+	}
+
+	_, err := os.Stat(runs[0].clone.LocalPath("30/30.geojson"))
+
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a file from the second clone not to be in the first's destination, %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package clone
+
+import (
+	"strconv"
+	"strings"
+)
+
+// rowLastModified returns the time (as a Unix timestamp) in row's column and true, or
+// false if it doesn't have one or it isn't a valid timestamp.
+
+func rowLastModified(row map[string]string, column string) (int64, bool) {
+
+	str_lastmod, ok := row[column]
+
+	if !ok {
+		return 0, false
+	}
+
+	lastmod, err := strconv.ParseInt(strings.TrimSpace(str_lastmod), 10, 64)
+
+	if err != nil || lastmod <= 0 {
+		return 0, false
+	}
+
+	return lastmod, true
+}
+
+// isBeforeSince returns true if row should be left out because of c.Since, because
+// its LastModifiedColumn says it was last modified before then or, if
+// c.SinceExcludeUndated is true, it doesn't say when it was.
+
+func (c *WOFClone) isBeforeSince(row map[string]string) bool {
+
+	if c.Since.IsZero() {
+		return false
+	}
+
+	lastmod, ok := rowLastModified(row, c.LastModifiedColumn)
+
+	if !ok {
+		return c.SinceExcludeUndated
+	}
+
+	return lastmod < c.Since.Unix()
+}
@@ -0,0 +1,119 @@
+package clone
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StatusAction is what is done with a response, according to its status code. See
+// StatusActions.
+
+type StatusAction string
+
+const (
+	StatusAccept      StatusAction = "accept"              // the response is used as it is
+	StatusAcceptWarn  StatusAction = "accept-with-warning" // the response is used, but a warning is logged
+	StatusNotModified StatusAction = "not-modified"        // the file hasn't changed, so it is skipped rather than failed
+	StatusRetryable   StatusAction = "retryable-error"     // a *FetchError that is worth retrying
+	StatusPermanent   StatusAction = "permanent-error"     // a *FetchError that isn't
+)
+
+// DefaultStatusAction returns what is done with a response with the status code code,
+// unless StatusActions says otherwise. 200 is accepted, other 2XX codes (a 203 from a
+// transforming proxy, say) are accepted with a warning, 304 means not modified, 408,
+// 429 and 5XX codes are errors worth retrying and everything else is a permanent
+// error.
+
+func DefaultStatusAction(code int) StatusAction {
+
+	switch {
+	case code == 200:
+		return StatusAccept
+	case code >= 200 && code < 300:
+		return StatusAcceptWarn
+	case code == 304:
+		return StatusNotModified
+	case code == 408 || code == 429:
+		return StatusRetryable
+	case code >= 500:
+		return StatusRetryable
+	default:
+		return StatusPermanent
+	}
+}
+
+// statusAction returns what is done with a response with the status code code.
+
+func (c *WOFClone) statusAction(code int) StatusAction {
+
+	action, ok := c.StatusActions[code]
+
+	if ok {
+		return action
+	}
+
+	return DefaultStatusAction(code)
+}
+
+// checkStatusActions returns an error if c.StatusActions has an action that isn't one
+// of the StatusAction constants.
+
+func (c *WOFClone) checkStatusActions() error {
+
+	for code, action := range c.StatusActions {
+
+		switch action {
+		case StatusAccept, StatusAcceptWarn, StatusNotModified, StatusRetryable, StatusPermanent:
+		default:
+			return fmt.Errorf("Invalid StatusActions value '%s' for %d", action, code)
+		}
+	}
+
+	return nil
+}
+
+// isWholeContentRange returns true if rsp, a 206 response to a request that didn't ask
+// for a range, has the whole file anyway.
+
+func isWholeContentRange(rsp *http.Response) bool {
+
+	// bytes 0-99/100
+
+	var first, last, size int64
+
+	_, err := fmt.Sscanf(rsp.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size)
+
+	return err == nil && first == 0 && last == size-1
+}
+
+// ParseStatusAction parses "CODE=ACTION" (for example "203=accept"), as used by the
+// -status-action flag.
+
+func ParseStatusAction(value string) (int, StatusAction, error) {
+
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("Invalid status action '%s', expected CODE=ACTION", value)
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+
+	if err != nil || code < 100 || code > 599 {
+		return 0, "", fmt.Errorf("Invalid status code '%s'", parts[0])
+	}
+
+	action := StatusAction(strings.TrimSpace(parts[1]))
+
+	c := WOFClone{StatusActions: map[int]StatusAction{code: action}}
+
+	err = c.checkStatusActions()
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return code, action, nil
+}
@@ -0,0 +1,310 @@
+package clone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WOFCloneSummary is written, as JSON, to c.SummaryPath at the end of every run
+// whether or not it succeeded so that there is always a record of how far it got.
+
+type WOFCloneSummary struct {
+	Source            string                `json:"source"`
+	Dest              string                `json:"dest"`
+	Meta              string                `json:"meta,omitempty"`
+	MetaHash          string                `json:"meta_hash,omitempty"` // the MD5 hash of Meta
+	Label             string                `json:"label,omitempty"`     // see RunLabel
+	SkipExisting      bool                  `json:"skip_existing"`       // see MetaFileOptions
+	ForceUpdates      bool                  `json:"force_updates"`
+	Started           time.Time             `json:"started"`
+	Finished          time.Time             `json:"finished"`
+	Ok                bool                  `json:"ok"`
+	Error             string                `json:"error,omitempty"`
+	Aborted           bool                  `json:"aborted"`           // see MaxErrors
+	DeadlineExceeded  bool                  `json:"deadline_exceeded"` // see Deadline and Timeout
+	ExcessiveErrors   bool                  `json:"excessive_errors"`  // see MaxRetries and MaxPendingRetries
+	Rows              int64                 `json:"rows"`              // the number of rows read from Meta
+	Scheduled         int64                 `json:"scheduled"`
+	Completed         int64                 `json:"completed"`
+	Success           int64                 `json:"success"`
+	Forced            int64                 `json:"forced"` // fetched because of force_updates or ForcePaths
+	Linked            int64                 `json:"linked"` // see ReferenceDir
+	Errors            int64                 `json:"errors"`
+	PermanentErrors   int64                 `json:"permanent_errors"` // errors that weren't retried, see MaxRetries
+	Skipped           int64                 `json:"skipped"`
+	SkippedManifest   int64                 `json:"skipped_manifest"` // see IncrementalManifest
+	Ignored           int64                 `json:"ignored"`
+	Truncated         int64                 `json:"truncated"`
+	UnknownChanges    int64                 `json:"unknown_changes"` // see UnknownChanges
+	BadRows           int64                 `json:"bad_rows"`        // see StrictMetaFiles
+	BundleFiles       int64                 `json:"bundle_files"`    // see Bundle
+	BundleErrors      int64                 `json:"bundle_errors"`
+	Quarantined       int64                 `json:"quarantined"`         // see QuarantineFailures
+	BogusLastModified int64                 `json:"bogus_lastmodified"`  // see LastModifiedTolerance
+	Unreadable        int64                 `json:"unreadable"`          // see UnreadableLocal
+	PermissionDenied  int64                 `json:"permission_denied"`   // see FixPermissions
+	InvalidHash       int64                 `json:"invalid_hash"`        // rows whose hash doesn't look like one, see InvalidHash
+	ReusedConnRetries int64                 `json:"reused_conn_retries"` // see ReusedConnRetries
+	TooOld            int64                 `json:"too_old"`             // rows left out because of Since
+	Excluded          int64                 `json:"excluded"`            // rows left out because of Exclude
+	FetchedBytes      int64                 `json:"fetched_bytes"`
+	Retried           int64                 `json:"retried"`                    // files tried again at the end of the run
+	EmptyBody         int64                 `json:"empty_body"`                 // see AllowEmptyBodies
+	FalseChanges      int64                 `json:"false_changes"`              // see DetectFalseChanges
+	SkippedIdentical  int64                 `json:"skipped_identical"`          // see WriteIfDifferent
+	ErrorCategories   map[string]int64      `json:"error_categories,omitempty"` // the number of errors of each kind, see ErrorCategory
+	Failed            map[string]string     `json:"failed"`                     // rel_path -> error, for files still failing at the end of the run
+	FailedOmitted     int64                 `json:"failed_omitted"`             // files still failing but left out of Failed, see MaxFailureRecords
+	Decisions         map[string]Decision   `json:"decisions,omitempty"`        // rel_path -> what happened to it, see RecordDecisions
+	Groups            map[string]GroupStats `json:"groups,omitempty"`           // group -> the outcomes of the files in it, see GroupBy
+}
+
+// summary returns a summary of run, which ended with err (which may be nil).
+
+func (c *WOFClone) summary(run *cloneRun, err error) *WOFCloneSummary {
+
+	if err == nil {
+		err = run.read_err
+	}
+
+	summary := WOFCloneSummary{
+		Source:            c.Source,
+		Dest:              c.Dest,
+		Meta:              run.meta,
+		Label:             c.run_label,
+		SkipExisting:      c.meta_options.SkipExisting,
+		ForceUpdates:      c.meta_options.ForceUpdates,
+		Started:           run.started,
+		Finished:          time.Now(),
+		Ok:                err == nil,
+		Aborted:           errors.Is(err, ErrAborted),
+		DeadlineExceeded:  errors.Is(err, ErrDeadlineExceeded),
+		ExcessiveErrors:   errors.Is(err, ErrExcessiveErrors),
+		Rows:              atomic.LoadInt64(&run.rows),
+		Scheduled:         atomic.LoadInt64(&c.Scheduled),
+		Completed:         atomic.LoadInt64(&c.Completed),
+		Success:           atomic.LoadInt64(&c.Success),
+		Forced:            atomic.LoadInt64(&c.Forced),
+		Linked:            atomic.LoadInt64(&c.Linked),
+		Errors:            atomic.LoadInt64(&c.Error),
+		PermanentErrors:   atomic.LoadInt64(&c.PermanentErrors),
+		Skipped:           atomic.LoadInt64(&c.Skipped),
+		SkippedManifest:   atomic.LoadInt64(&c.SkippedManifest),
+		Ignored:           atomic.LoadInt64(&c.Ignored),
+		Truncated:         atomic.LoadInt64(&c.Truncated),
+		UnknownChanges:    atomic.LoadInt64(&c.UnknownChange),
+		BadRows:           atomic.LoadInt64(&c.BadRows),
+		BundleFiles:       atomic.LoadInt64(&c.BundleFiles),
+		BundleErrors:      atomic.LoadInt64(&c.BundleErrors),
+		Quarantined:       atomic.LoadInt64(&c.Quarantined),
+		BogusLastModified: atomic.LoadInt64(&c.BogusLastModified),
+		Unreadable:        atomic.LoadInt64(&c.Unreadable),
+		PermissionDenied:  atomic.LoadInt64(&c.PermissionDenied),
+		InvalidHash:       atomic.LoadInt64(&c.InvalidHash),
+		ReusedConnRetries: atomic.LoadInt64(&c.ReusedConnRetries),
+		TooOld:            atomic.LoadInt64(&c.TooOld),
+		Excluded:          atomic.LoadInt64(&c.Excluded),
+		FetchedBytes:      atomic.LoadInt64(&c.FetchedBytes),
+		Retried:           atomic.LoadInt64(&c.Retried),
+		EmptyBody:         atomic.LoadInt64(&c.EmptyBody),
+		FalseChanges:      atomic.LoadInt64(&c.FalseChanges),
+		SkippedIdentical:  atomic.LoadInt64(&c.SkippedIdentical),
+		ErrorCategories:   c.report.ErrorCategories(),
+		Failed:            c.report.FailedErrors(),
+	}
+
+	_, summary.FailedOmitted = c.report.FailedCount()
+
+	if c.RecordDecisions {
+		summary.Decisions = c.report.Decisions()
+	}
+
+	if c.GroupBy != "" {
+		summary.Groups = c.report.Groups()
+	}
+
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	if run.meta != "" {
+
+		hash, err := hashFile(run.meta, c.hashAlgorithm())
+
+		if err != nil {
+			c.Logger.Warning("Failed to hash %s for summary, because %v", run.meta, err)
+		} else {
+			summary.MetaHash = hash
+		}
+	}
+
+	return &summary
+}
+
+// String returns a one line, human readable, account of the run s describes: how long
+// it took, what happened to its files, how much was fetched and how quickly, and the
+// most common kinds of error.
+
+func (s *WOFCloneSummary) String() string {
+
+	what := s.Meta
+
+	if what == "" {
+		what = "scheduled rows"
+	}
+
+	outcome := "finished"
+
+	if !s.Ok {
+		outcome = "failed"
+	}
+
+	duration := s.Finished.Sub(s.Started)
+	rate := 0.0
+
+	if duration > 0 {
+		rate = float64(s.FetchedBytes) / duration.Seconds()
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Cloning %s %s in %v: %d scheduled, %d succeeded (%s fetched, %s/s), %d skipped, %d errors (%d permanent), %d retried, %d ignored",
+		what, outcome, duration.Round(time.Millisecond), s.Scheduled, s.Success, formatBytes(s.FetchedBytes), formatBytes(int64(rate)),
+		s.Skipped, s.Errors, s.PermanentErrors, s.Retried, s.Ignored)
+
+	if s.Forced > 0 {
+		fmt.Fprintf(&b, ", %d forced", s.Forced)
+	}
+
+	if s.FalseChanges > 0 {
+		fmt.Fprintf(&b, ", %d false changes", s.FalseChanges)
+	}
+
+	if s.SkippedIdentical > 0 {
+		fmt.Fprintf(&b, ", %d identical", s.SkippedIdentical)
+	}
+
+	if s.TooOld > 0 {
+		fmt.Fprintf(&b, ", %d too old", s.TooOld)
+	}
+
+	if s.Excluded > 0 {
+		fmt.Fprintf(&b, ", %d excluded", s.Excluded)
+	}
+
+	if s.BadRows > 0 {
+		fmt.Fprintf(&b, ", %d malformed rows", s.BadRows)
+	}
+
+	if len(s.ErrorCategories) > 0 {
+
+		categories := make([]string, 0, len(s.ErrorCategories))
+
+		for k := range s.ErrorCategories {
+			categories = append(categories, k)
+		}
+
+		sort.Slice(categories, func(i, j int) bool {
+
+			ci := s.ErrorCategories[categories[i]]
+			cj := s.ErrorCategories[categories[j]]
+
+			if ci != cj {
+				return ci > cj
+			}
+
+			return categories[i] < categories[j]
+		})
+
+		if len(categories) > summary_error_categories {
+			categories = categories[:summary_error_categories]
+		}
+
+		top := make([]string, len(categories))
+
+		for i, k := range categories {
+			top[i] = fmt.Sprintf("%s (%d)", k, s.ErrorCategories[k])
+		}
+
+		fmt.Fprintf(&b, ", most common errors: %s", strings.Join(top, ", "))
+	}
+
+	if s.Error != "" {
+		fmt.Fprintf(&b, ", %s", s.Error)
+	}
+
+	return b.String()
+}
+
+// summary_error_categories is the number of kinds of error listed by
+// WOFCloneSummary's String.
+
+const summary_error_categories = 3
+
+// formatBytes returns n as a number of bytes, KB, MB or GB (each 1024 of the last).
+
+func formatBytes(n int64) string {
+
+	units := []string{"KB", "MB", "GB"}
+
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	f := float64(n)
+	unit := ""
+
+	for _, u := range units {
+
+		f = f / 1024.0
+		unit = u
+
+		if f < 1024.0 {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%.1f %s", f, unit)
+}
+
+// writeSummary writes summary to c.SummaryPath, if it is set. The file is written to a temporary file first and then renamed so
+// readers never see a partial summary.
+
+func (c *WOFClone) writeSummary(summary *WOFCloneSummary) {
+
+	if c.SummaryPath == "" {
+		return
+	}
+
+	body, err := json.MarshalIndent(summary, "", "  ")
+
+	if err != nil {
+		c.Logger.Error("Failed to encode summary, because %v", err)
+		return
+	}
+
+	tmp := c.SummaryPath + ".tmp"
+
+	err = os.MkdirAll(filepath.Dir(c.SummaryPath), 0755)
+
+	if err == nil {
+		err = ioutil.WriteFile(tmp, body, 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, c.SummaryPath)
+	}
+
+	if err != nil {
+		c.Logger.Error("Failed to write summary %s, because %v", c.SummaryPath, err)
+		os.Remove(tmp)
+	}
+}
@@ -0,0 +1,178 @@
+package clone
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// tempRoot returns the directory in c.TempDir that temporary files go in, or "" if
+// c.TempDir isn't set. It is named after c.Dest so that clones into different
+// destinations can share a TempDir without tripping over, or cleaning up, each other's
+// files.
+
+func (c *WOFClone) tempRoot() string {
+
+	if c.TempDir == "" {
+		return ""
+	}
+
+	dest, err := filepath.Abs(c.Dest)
+
+	if err != nil {
+		dest = c.Dest
+	}
+
+	return filepath.Join(c.TempDir, hashBytes([]byte(dest), HashMD5)[:12])
+}
+
+// tempPath returns where local is downloaded to before being moved in to place. By
+// default that is alongside local, so the final rename is atomic, but if c.TempDir is
+// set then it is a file in c.tempRoot named after the (escaped) path relative to c.Dest.
+
+func (c *WOFClone) tempPath(local string) string {
+
+	if c.TempDir == "" {
+		return local + partial_suffix
+	}
+
+	rel_path, err := filepath.Rel(c.Dest, local)
+
+	if err != nil {
+		rel_path = local
+	}
+
+	return filepath.Join(c.tempRoot(), url.PathEscape(filepath.ToSlash(rel_path))+partial_suffix)
+}
+
+// moveFile renames tmp to local, keeping track of the change if Dest was scanned at
+// the start of the run (see PrescanDest).
+
+func (c *WOFClone) moveFile(tmp string, local string) error {
+
+	err := c.renameFile(tmp, local)
+
+	if err != nil {
+		return err
+	}
+
+	c.indexRemoved(tmp)
+	c.indexWritten(local)
+
+	return nil
+}
+
+// renameFile renames tmp to local. If they are on different filesystems, which can
+// happen when c.TempDir is set, tmp is copied alongside local first and that copy is
+// renamed instead so that readers never see a partially written file.
+
+func (c *WOFClone) renameFile(tmp string, local string) error {
+
+	err := os.Rename(tmp, local)
+
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	c.Logger.Debug("%s and %s are on different filesystems, copying", tmp, local)
+
+	staged := local + partial_suffix
+
+	err = copyFile(tmp, staged)
+
+	if err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	err = os.Rename(staged, local)
+
+	if err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	return os.Remove(tmp)
+}
+
+func copyFile(src string, dest string) error {
+
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	close_err := out.Close()
+
+	if err == nil {
+		err = close_err
+	}
+
+	return err
+}
+
+// removeTempFiles removes any temporary download files left behind, in c.Dest and
+// c.tempRoot, by a previous run that was interrupted. Partial downloads that this
+// WOFClone is keeping around to resume (see ResumeDownloads) are left alone.
+
+func (c *WOFClone) removeTempFiles() {
+
+	keep := make(map[string]bool)
+
+	c.partials.Range(func(k interface{}, v interface{}) bool {
+		keep[c.tempPath(k.(string))] = true
+		return true
+	})
+
+	removed := int64(0)
+
+	for _, root := range []string{c.Dest, c.tempRoot()} {
+
+		if root == "" {
+			continue
+		}
+
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+
+			if err != nil {
+				return nil
+			}
+
+			if info.IsDir() || !strings.HasSuffix(path, partial_suffix) || keep[path] {
+				return nil
+			}
+
+			err = os.Remove(path)
+
+			if err != nil {
+				c.Logger.Warning("Failed to remove leftover temporary file %s, because %v", path, err)
+				return nil
+			}
+
+			removed += 1
+			return nil
+		})
+	}
+
+	if removed > 0 {
+		c.Logger.Info("removed %d leftover temporary files", removed)
+	}
+
+	atomic.AddInt64(&c.TempFilesRemoved, removed)
+}
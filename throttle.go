@@ -0,0 +1,247 @@
+package clone
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// throttle implements WOFClone.AdaptiveThrottle. It keeps track of whether each of the
+// last window requests failed (with a 429 or 5XX status or a network error) and when
+// the error rate goes above max_rate it halves the number of requests allowed in
+// flight at once, down to floor, and starts (or doubles) a delay before each request,
+// up to max_delay. Once the error rate drops below half of max_rate the limit is raised
+// by a quarter and the delay halved, a step at a time.
+
+type throttle struct {
+	mu        *sync.Mutex
+	outcomes  []bool // true for an error
+	next      int
+	count     int
+	errors    int
+	active    int
+	limit     int
+	max       int
+	floor     int
+	delay     time.Duration
+	max_delay time.Duration
+	max_rate  float64
+	wake      chan bool
+}
+
+const (
+	default_throttle_window   = 100
+	default_throttle_rate     = 0.2
+	default_throttle_delay    = 100 * time.Millisecond
+	default_throttle_maxdelay = 5 * time.Second
+)
+
+func newThrottle(window int, max_rate float64, max int, floor int, max_delay time.Duration) *throttle {
+
+	if window < 1 {
+		window = default_throttle_window
+	}
+
+	if max_rate <= 0.0 {
+		max_rate = default_throttle_rate
+	}
+
+	if floor < 1 {
+		floor = 1
+	}
+
+	if max < floor {
+		max = floor
+	}
+
+	if max_delay <= 0 {
+		max_delay = default_throttle_maxdelay
+	}
+
+	t := throttle{
+		mu:        new(sync.Mutex),
+		outcomes:  make([]bool, window),
+		limit:     max,
+		max:       max,
+		floor:     floor,
+		max_delay: max_delay,
+		max_rate:  max_rate,
+		wake:      make(chan bool),
+	}
+
+	return &t
+}
+
+// acquire blocks until there are fewer requests in flight than the current limit (or
+// ctx is done) and then waits out the current delay. The returned function must be
+// called when the request is finished.
+
+func (t *throttle) acquire(ctx context.Context) (func(), error) {
+
+	for {
+
+		t.mu.Lock()
+
+		if t.active < t.limit {
+
+			t.active += 1
+			delay := t.delay
+			t.mu.Unlock()
+
+			release := t.releaser()
+
+			if delay > 0 {
+
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					release()
+					return nil, ctx.Err()
+				}
+			}
+
+			return release, nil
+		}
+
+		wake := t.wake
+		t.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *throttle) releaser() func() {
+
+	once := new(sync.Once)
+
+	return func() {
+
+		once.Do(func() {
+			t.mu.Lock()
+			t.active -= 1
+			t.broadcast()
+			t.mu.Unlock()
+		})
+	}
+}
+
+// broadcast wakes up everything waiting in acquire. t.mu must be held.
+
+func (t *throttle) broadcast() {
+	close(t.wake)
+	t.wake = make(chan bool)
+}
+
+// record adds the outcome of a request to the window and adjusts the limit and
+// delay if necessary.
+
+func (t *throttle) record(failed bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	window := len(t.outcomes)
+
+	if t.count == window && t.outcomes[t.next] {
+		t.errors -= 1
+	}
+
+	t.outcomes[t.next] = failed
+	t.next = (t.next + 1) % window
+
+	if t.count < window {
+		t.count += 1
+	}
+
+	if failed {
+		t.errors += 1
+	}
+
+	// Wait for a decent sample before doing anything, which is smaller when the limit
+	// is low so that recovery doesn't take forever. The window is emptied after every
+	// adjustment so that each decision is based on how things went since the last one
+
+	sample := window / 4
+
+	if t.limit*2 < sample {
+		sample = t.limit * 2
+	}
+
+	if t.count < sample {
+		return
+	}
+
+	rate := float64(t.errors) / float64(t.count)
+
+	switch {
+	case rate > t.max_rate:
+
+		t.limit = t.limit / 2
+
+		if t.limit < t.floor {
+			t.limit = t.floor
+		}
+
+		if t.delay == 0 {
+			t.delay = default_throttle_delay
+		} else {
+			t.delay = t.delay * 2
+		}
+
+		if t.delay > t.max_delay {
+			t.delay = t.max_delay
+		}
+
+		t.reset()
+
+	case rate < t.max_rate/2 && (t.limit < t.max || t.delay > 0):
+
+		step := t.limit / 4
+
+		if step < 1 {
+			step = 1
+		}
+
+		t.limit += step
+
+		if t.limit > t.max {
+			t.limit = t.max
+		}
+
+		t.delay = t.delay / 2
+
+		if t.delay < 10*time.Millisecond {
+			t.delay = 0
+		}
+
+		t.reset()
+		t.broadcast()
+	}
+}
+
+// reset empties the window. t.mu must be held.
+
+func (t *throttle) reset() {
+
+	for i := range t.outcomes {
+		t.outcomes[i] = false
+	}
+
+	t.next = 0
+	t.count = 0
+	t.errors = 0
+}
+
+// state returns the current limit and delay.
+
+func (t *throttle) state() (int, time.Duration) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.limit, t.delay
+}
@@ -0,0 +1,192 @@
+package clone
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// duration_buckets are the upper bounds of the buckets in the download duration
+// histogram. Anything slower than the last one is counted in an extra, unbounded,
+// bucket.
+
+var duration_buckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+const default_top_files = 10
+
+// HistogramBucket is the number of downloads that took no longer than UpperBound
+// (and longer than the previous bucket's UpperBound). The last bucket in a histogram
+// has an UpperBound of zero, meaning no upper bound.
+
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+// FileTiming is how long it took to download a file, and how big it was.
+
+type FileTiming struct {
+	Path     string
+	Duration time.Duration
+	Size     int64
+}
+
+// timings keeps a histogram of download durations along with the slowest and largest
+// files downloaded so far. Memory use is fixed regardless of how many files there are.
+
+type timings struct {
+	mu      *sync.Mutex
+	counts  []int64
+	slowest *timingHeap
+	largest *timingHeap
+	max     int
+}
+
+func newTimings(max int) *timings {
+
+	if max < 1 {
+		max = default_top_files
+	}
+
+	t := timings{
+		mu:      new(sync.Mutex),
+		counts:  make([]int64, len(duration_buckets)+1),
+		slowest: &timingHeap{less: func(a FileTiming, b FileTiming) bool { return a.Duration < b.Duration }},
+		largest: &timingHeap{less: func(a FileTiming, b FileTiming) bool { return a.Size < b.Size }},
+		max:     max,
+	}
+
+	return &t
+}
+
+func (t *timings) Add(ft FileTiming) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := sort.Search(len(duration_buckets), func(i int) bool {
+		return ft.Duration <= duration_buckets[i]
+	})
+
+	t.counts[idx] += 1
+
+	t.slowest.offer(ft, t.max)
+	t.largest.offer(ft, t.max)
+}
+
+// Snapshot returns the histogram along with the slowest and largest files, in
+// descending order.
+
+func (t *timings) Snapshot() ([]HistogramBucket, []FileTiming, []FileTiming) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	histogram := make([]HistogramBucket, len(t.counts))
+
+	for i, count := range t.counts {
+
+		var upper time.Duration
+
+		if i < len(duration_buckets) {
+			upper = duration_buckets[i]
+		}
+
+		histogram[i] = HistogramBucket{UpperBound: upper, Count: count}
+	}
+
+	return histogram, t.slowest.sorted(), t.largest.sorted()
+}
+
+// timingHeap is a min-heap (according to less) used to keep the top N FileTimings.
+
+type timingHeap struct {
+	items []FileTiming
+	less  func(a FileTiming, b FileTiming) bool
+}
+
+func (h *timingHeap) Len() int           { return len(h.items) }
+func (h *timingHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *timingHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *timingHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(FileTiming))
+}
+
+func (h *timingHeap) Pop() interface{} {
+
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+
+	return item
+}
+
+// offer adds ft to the heap if there are fewer than max items in it or ft beats the
+// smallest of them.
+
+func (h *timingHeap) offer(ft FileTiming, max int) {
+
+	if len(h.items) < max {
+		heap.Push(h, ft)
+		return
+	}
+
+	if h.less(h.items[0], ft) {
+		h.items[0] = ft
+		heap.Fix(h, 0)
+	}
+}
+
+func (h *timingHeap) sorted() []FileTiming {
+
+	items := make([]FileTiming, len(h.items))
+	copy(items, h.items)
+
+	sort.Slice(items, func(i, j int) bool {
+		return h.less(items[j], items[i])
+	})
+
+	return items
+}
+
+// logTimings logs the download duration histogram and the slowest and largest files.
+
+func (c *WOFClone) logTimings() {
+
+	histogram, slowest, largest := c.timings.Snapshot()
+
+	for _, b := range histogram {
+
+		if b.Count == 0 {
+			continue
+		}
+
+		if b.UpperBound == 0 {
+			c.Logger.Info("downloads slower than %v: %d", duration_buckets[len(duration_buckets)-1], b.Count)
+		} else {
+			c.Logger.Info("downloads up to %v: %d", b.UpperBound, b.Count)
+		}
+	}
+
+	for _, ft := range slowest {
+		c.Logger.Info("slowest: %s took %v (%d bytes)", ft.Path, ft.Duration, ft.Size)
+	}
+
+	for _, ft := range largest {
+		c.Logger.Info("largest: %s is %d bytes (%v)", ft.Path, ft.Size, ft.Duration)
+	}
+}
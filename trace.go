@@ -0,0 +1,353 @@
+package clone
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The phases of a request that are timed when TraceRequests is true.
+
+const (
+	PhaseDNS     = "dns"     // resolving the host name
+	PhaseConnect = "connect" // opening the TCP connection
+	PhaseTLS     = "tls"     // the TLS handshake
+	PhaseWait    = "wait"    // from sending the request to the first byte of the response
+	PhaseBody    = "body"    // from the first byte of the response to closing the body
+)
+
+// max_trace_samples is how many timings are kept for each phase to work out percentiles
+// from. Beyond that a random sample is kept, so memory use is fixed.
+
+const max_trace_samples = 1000
+
+// PhaseStats summarizes how long one phase of every traced request took.
+
+type PhaseStats struct {
+	Count int64
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// ConnectionStats counts the connections used by every traced request: how many were
+// opened and how many were reused, and how many requests used each protocol ("h2" or
+// "http/1.1"). With HTTP/2 many requests share a connection so Reused should be far
+// larger than Opened. See SetForceHTTP1.
+
+type ConnectionStats struct {
+	Opened    int64
+	Reused    int64
+	Protocols map[string]int64
+}
+
+// requestTrace records when each phase of a single request started and finished, and
+// the connection it used. httptrace hooks may be called from more than one goroutine,
+// hence the mutex.
+
+type requestTrace struct {
+	mu         *sync.Mutex
+	started    time.Time
+	dns_start  time.Time
+	conn_start time.Time
+	tls_start  time.Time
+	wrote      time.Time
+	first_byte time.Time
+	phases     map[string]time.Duration
+	got_conn   bool
+	reused     bool
+	proto      string
+}
+
+func newRequestTrace() *requestTrace {
+
+	tr := requestTrace{
+		mu:      new(sync.Mutex),
+		started: time.Now(),
+		phases:  make(map[string]time.Duration),
+	}
+
+	return &tr
+}
+
+func (tr *requestTrace) set(t *time.Time) {
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	*t = time.Now()
+}
+
+func (tr *requestTrace) done(phase string, start *time.Time) {
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if !start.IsZero() {
+		tr.phases[phase] = time.Since(*start)
+	}
+}
+
+// gotConn records whether the connection for the request was reused and, since the
+// protocol is negotiated during the TLS handshake, which protocol it speaks.
+
+func (tr *requestTrace) gotConn(info httptrace.GotConnInfo) {
+
+	proto := "http/1.1"
+
+	tls_conn, ok := info.Conn.(*tls.Conn)
+
+	if ok {
+
+		negotiated := tls_conn.ConnectionState().NegotiatedProtocol
+
+		if negotiated != "" {
+			proto = negotiated
+		}
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.got_conn = true
+	tr.reused = info.Reused
+	tr.proto = proto
+}
+
+func (tr *requestTrace) clientTrace() *httptrace.ClientTrace {
+
+	return &httptrace.ClientTrace{
+		GotConn: tr.gotConn,
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tr.set(&tr.dns_start)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tr.done(PhaseDNS, &tr.dns_start)
+		},
+		ConnectStart: func(string, string) {
+			tr.set(&tr.conn_start)
+		},
+		ConnectDone: func(string, string, error) {
+			tr.done(PhaseConnect, &tr.conn_start)
+		},
+		TLSHandshakeStart: func() {
+			tr.set(&tr.tls_start)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tr.done(PhaseTLS, &tr.tls_start)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			tr.set(&tr.wrote)
+		},
+		GotFirstResponseByte: func() {
+			tr.done(PhaseWait, &tr.wrote)
+			tr.set(&tr.first_byte)
+		},
+	}
+}
+
+// finish records how long the body took (if there was a response) and returns the
+// timings for each phase.
+
+func (tr *requestTrace) finish() map[string]time.Duration {
+
+	tr.done(PhaseBody, &tr.first_byte)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	phases := make(map[string]time.Duration)
+
+	for k, v := range tr.phases {
+		phases[k] = v
+	}
+
+	return phases
+}
+
+// traceRequest adds a ClientTrace to req if c.TraceRequests is true. The returned
+// function must be called once the response body has been closed (or the request
+// failed) and logs and records the timings for each phase.
+
+func (c *WOFClone) traceRequest(req *http.Request) (*http.Request, func()) {
+
+	if !c.TraceRequests {
+		return req, func() {}
+	}
+
+	tr := newRequestTrace()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), tr.clientTrace()))
+
+	finish := func() {
+
+		phases := tr.finish()
+
+		if req.Method == "HEAD" {
+			delete(phases, PhaseBody)
+		}
+
+		if c.Verbose && c.debugging() {
+			c.Logger.Debug("%s %s took %v (dns %v connect %v tls %v wait %v body %v)", req.Method, req.URL, time.Since(tr.started), phases[PhaseDNS], phases[PhaseConnect], phases[PhaseTLS], phases[PhaseWait], phases[PhaseBody])
+		}
+
+		for phase, d := range phases {
+			c.traces.add(phase, d)
+		}
+
+		tr.mu.Lock()
+		got_conn, reused, proto := tr.got_conn, tr.reused, tr.proto
+		tr.mu.Unlock()
+
+		if got_conn {
+			c.traces.addConn(reused, proto)
+		}
+	}
+
+	return req, finish
+}
+
+// logConnections logs how many connections have been opened and reused by traced
+// requests, and which protocols they spoke, so that it's easy to tell whether HTTP/2 is
+// being used.
+
+func (c *WOFClone) logConnections() {
+
+	conns := c.traces.Connections()
+
+	if conns.Opened+conns.Reused == 0 {
+		return
+	}
+
+	c.Logger.Info("connections: %d opened, %d reused, requests by protocol: %v", conns.Opened, conns.Reused, conns.Protocols)
+}
+
+// traceStats aggregates the timings for each phase of every traced request.
+
+type traceStats struct {
+	mu        *sync.Mutex
+	phases    map[string]*phaseSamples
+	opened    int64
+	reused    int64
+	protocols map[string]int64
+}
+
+type phaseSamples struct {
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+	samples []time.Duration
+}
+
+func newTraceStats() *traceStats {
+
+	s := traceStats{
+		mu:        new(sync.Mutex),
+		phases:    make(map[string]*phaseSamples),
+		protocols: make(map[string]int64),
+	}
+
+	return &s
+}
+
+func (s *traceStats) add(phase string, d time.Duration) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.phases[phase]
+
+	if !ok {
+		p = &phaseSamples{samples: make([]time.Duration, 0)}
+		s.phases[phase] = p
+	}
+
+	p.count += 1
+	p.sum += d
+
+	if d > p.max {
+		p.max = d
+	}
+
+	// Reservoir sampling, so that every request has the same chance of being
+	// one of the samples however many there are
+
+	if len(p.samples) < max_trace_samples {
+		p.samples = append(p.samples, d)
+	} else if i := rand.Int63n(p.count); i < max_trace_samples {
+		p.samples[i] = d
+	}
+}
+
+// addConn records that a request used a connection speaking proto, which was reused
+// if reused is true and opened for it otherwise.
+
+func (s *traceStats) addConn(reused bool, proto string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reused {
+		s.reused += 1
+	} else {
+		s.opened += 1
+	}
+
+	s.protocols[proto] += 1
+}
+
+// Connections returns the connection stats recorded so far.
+
+func (s *traceStats) Connections() ConnectionStats {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	protocols := make(map[string]int64)
+
+	for k, v := range s.protocols {
+		protocols[k] = v
+	}
+
+	return ConnectionStats{Opened: s.opened, Reused: s.reused, Protocols: protocols}
+}
+
+// Snapshot returns the stats for each phase that has been recorded.
+
+func (s *traceStats) Snapshot() map[string]PhaseStats {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]PhaseStats)
+
+	for phase, p := range s.phases {
+
+		samples := make([]time.Duration, len(p.samples))
+		copy(samples, p.samples)
+
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i] < samples[j]
+		})
+
+		percentile := func(pc float64) time.Duration {
+			return samples[int(pc*float64(len(samples)-1))]
+		}
+
+		stats[phase] = PhaseStats{
+			Count: p.count,
+			Mean:  p.sum / time.Duration(p.count),
+			P50:   percentile(0.5),
+			P90:   percentile(0.9),
+			P99:   percentile(0.99),
+			Max:   p.max,
+		}
+	}
+
+	return stats
+}
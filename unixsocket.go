@@ -0,0 +1,45 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SetUnixSocket sends every request through the Unix domain socket at path, for
+// example to a sidecar that handles outbound HTTP, rather than connecting to the host
+// in its URL. Nothing else about requests changes: they have the same URLs and Host
+// headers (and are encrypted end to end, for https URLs), the same timeouts and the
+// same keep alive behaviour, for GET and HEAD requests alike. An empty path connects
+// to hosts directly again. It must be called before anything has been fetched.
+
+func (c *WOFClone) SetUnixSocket(path string) error {
+
+	if path == "" {
+		c.transport.DialContext = http.DefaultTransport.(*http.Transport).DialContext
+		return nil
+	}
+
+	// The socket may not have been created yet, if whatever listens on it is still
+	// starting up, in which case requests will fail until it has been
+
+	info, err := os.Stat(path)
+
+	if err == nil && info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a Unix domain socket", path)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	c.transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+
+	return nil
+}
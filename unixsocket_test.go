@@ -0,0 +1,80 @@
+package clone
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"id":1}`)
+	source.set("2/2.geojson", `{"id":2}`)
+
+	socket := filepath.Join(t.TempDir(), "wof.sock")
+
+	listener, err := net.Listen("unix", socket)
+
+	if err != nil {
+		t.Skipf("Unable to listen on a Unix socket, %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(source)
+	server.Listener = listener
+	server.Start()
+
+	defer server.Close()
+
+	// A host that doesn't resolve, so the only way the files can be cloned is through
+	// the socket
+
+	c := newTestClone(t, "http://wof.invalid/")
+
+	err = c.SetUnixSocket(socket)
+
+	if err != nil {
+		t.Fatalf("Failed to set Unix socket, %v", err)
+	}
+
+	err = c.CloneMetaFile(writeMetaFile(t, "1/1.geojson", "2/2.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	if c.Success != 2 {
+		t.Errorf("Expected 2 files to be cloned, got %d", c.Success)
+	}
+
+	body, err := ioutil.ReadFile(c.LocalPath("1/1.geojson"))
+
+	if err != nil || string(body) != `{"id":1}` {
+		t.Errorf("Expected 1/1.geojson to have been cloned, got %q (%v)", body, err)
+	}
+
+	// The same again, to check changes over the socket too
+
+	err = c.CloneMetaFile(writeMetaFile(t, "1/1.geojson", "2/2.geojson"), false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone again, %v", err)
+	}
+
+	if c.Skipped != 2 {
+		t.Errorf("Expected 2 unchanged files to be skipped, got %d", c.Skipped)
+	}
+}
+
+func TestUnixSocketNotASocket(t *testing.T) {
+
+	c := newTestClone(t, "http://wof.invalid/")
+
+	err := c.SetUnixSocket(writeMetaFile(t))
+
+	if err == nil {
+		t.Fatalf("Expected a path that isn't a socket to be refused")
+	}
+}
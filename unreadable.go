@@ -0,0 +1,149 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The ways of dealing with existing files that can't be read, see UnreadableLocal.
+
+const (
+	UnreadableFetch = "fetch"
+	UnreadableFail  = "fail"
+)
+
+// local_read_attempts is the number of times a local file is read, to hash it, before
+// giving up. Files on network filesystems can fail to be read for reasons (like NFS's
+// ESTALE) that have gone away a moment later.
+
+const local_read_attempts = 3
+
+// local_read_delay is how long to wait before reading a local file again, multiplied
+// by the number of attempts so far.
+
+const local_read_delay = 100 * time.Millisecond
+
+// local_file_mode is the mode cloned files are written with, and what FixPermissions
+// changes the mode of files that can't be read to.
+
+const local_file_mode = 0644
+
+func (c *WOFClone) checkUnreadableLocal() error {
+
+	switch c.UnreadableLocal {
+	case "", UnreadableFetch, UnreadableFail:
+		return nil
+	default:
+		return fmt.Errorf("Invalid UnreadableLocal value '%s'", c.UnreadableLocal)
+	}
+}
+
+// hashLocalRetrying returns the result of hash, which hashes local, trying again if it
+// fails. A file that doesn't exist isn't tried again, and that error is returned as it
+// is, anything else is returned as a *LocalReadError once every attempt has failed. A
+// file that can't be read because of its permissions is only tried again if
+// FixPermissions is true and they could be fixed.
+
+func (c *WOFClone) hashLocalRetrying(local string, hash func() (string, error)) (string, error) {
+
+	fixed := false
+
+	for attempt := 1; ; attempt++ {
+
+		h, err := hash()
+
+		if err == nil {
+			return h, nil
+		}
+
+		if os.IsNotExist(err) {
+			return "", err
+		}
+
+		if errors.Is(err, os.ErrPermission) {
+
+			if fixed || !c.FixPermissions || !c.fixPermissions(local) {
+				return "", &LocalReadError{Path: local, Err: err}
+			}
+
+			fixed = true
+			continue
+		}
+
+		if attempt == local_read_attempts {
+			return "", &LocalReadError{Path: local, Err: err}
+		}
+
+		if c.debugging() {
+			c.Logger.Debug("Failed to read %s (attempt %d), because %v, trying again", local, attempt, err)
+		}
+
+		time.Sleep(local_read_delay * time.Duration(attempt))
+	}
+}
+
+// fixPermissions changes the mode of local to local_file_mode, see FixPermissions, and
+// returns true if it could.
+
+func (c *WOFClone) fixPermissions(local string) bool {
+
+	err := os.Chmod(local, local_file_mode)
+
+	if err != nil {
+		c.Logger.Warning("Failed to fix the permissions of %s, because %v", local, err)
+		return false
+	}
+
+	c.Logger.Info("Changed the mode of %s to %o so that it can be read", local, local_file_mode)
+	return true
+}
+
+// isLocalReadError returns true if err is (or wraps) a *LocalReadError.
+
+func isLocalReadError(err error) bool {
+
+	var read_err *LocalReadError
+	return errors.As(err, &read_err)
+}
+
+// unreadableLocal counts rel_path as a file whose local copy can't be read (because of
+// err) and decides what to do with it according to c.UnreadableLocal, unless it is
+// because of its permissions in which case it always fails. It returns Changed if the
+// file should be fetched again, replacing the local copy, or err if it should fail.
+
+func (c *WOFClone) unreadableLocal(rel_path string, err error) (ChangeState, error) {
+
+	atomic.AddInt64(&c.Unreadable, 1)
+	c.report.AddUnreadable(rel_path, err)
+
+	if errors.Is(err, os.ErrPermission) {
+		atomic.AddInt64(&c.PermissionDenied, 1)
+		c.Logger.Error("%v, because of its permissions, it needs looking at", err)
+		return Unknown, err
+	}
+
+	if c.UnreadableLocal == UnreadableFail {
+		c.Logger.Error("%v, it needs looking at", err)
+		return Unknown, err
+	}
+
+	c.Logger.Warning("%v, fetching it again", err)
+	return Changed, nil
+}
+
+// logPermissionDenied logs how many files couldn't be read because of their
+// permissions, so that it is obvious why they failed.
+
+func (c *WOFClone) logPermissionDenied() {
+
+	count := atomic.LoadInt64(&c.PermissionDenied)
+
+	if count == 0 {
+		return
+	}
+
+	c.Logger.Warning("%d paths unreadable due to permissions, see Unreadable in the report", count)
+}
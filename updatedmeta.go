@@ -0,0 +1,376 @@
+package clone
+
+import (
+	"encoding/json"
+	"github.com/whosonfirst/go-whosonfirst-csv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// updated_meta_status is the column added to updated meta files when UpdatedMetaStatus
+// is true. Its value is "ok", "failed" (the file could not be cloned) or "missing" (the
+// file isn't on disk, for example because it was ignored or is too large).
+
+const updated_meta_status = "clone_status"
+
+// lastmodified_key is the property lastModifiedScanner looks for.
+
+const lastmodified_key = `"wof:lastmodified"`
+
+// lastModifiedScanner is an io.Writer that picks the value of the first wof:lastmodified
+// property out of the JSON written to it, so that updated meta files don't have to read
+// back every file that was written to find it. See scanLastModified.
+
+type lastModifiedScanner struct {
+	matched int   // how much of lastmodified_key has been seen
+	colon   bool  // whether the colon after the key has been seen
+	digits  int   // how many digits of the value have been seen
+	value   int64 // the value so far
+	done    bool
+}
+
+// scanLastModified returns a lastModifiedScanner for rel_path if updated meta files want
+// its lastmodified property, or nil.
+
+func (c *WOFClone) scanLastModified(rel_path string) *lastModifiedScanner {
+
+	if c.hashes == nil || c.LastModifiedColumn == "" || !isJSONPath(rel_path) {
+		return nil
+	}
+
+	return new(lastModifiedScanner)
+}
+
+func (s *lastModifiedScanner) Write(p []byte) (int, error) {
+
+	for _, b := range p {
+
+		if s.done {
+			break
+		}
+
+		s.scan(b)
+	}
+
+	return len(p), nil
+}
+
+func (s *lastModifiedScanner) scan(b byte) {
+
+	switch {
+	case s.matched < len(lastmodified_key):
+
+		// The key only has a quote at the start, so there's no need to back up
+		// any further than that on a mismatch
+
+		if b == lastmodified_key[s.matched] {
+			s.matched += 1
+		} else if b == '"' {
+			s.matched = 1
+		} else {
+			s.matched = 0
+		}
+
+	case !s.colon:
+
+		if b == ':' {
+			s.colon = true
+		} else if !isJSONSpace(b) {
+			s.reset(b)
+		}
+
+	case b >= '0' && b <= '9':
+		s.value = s.value*10 + int64(b-'0')
+		s.digits += 1
+
+	case s.digits > 0:
+		s.done = true
+
+	case !isJSONSpace(b):
+
+		// Not a number (it might be a string that happens to be the key) so
+		// keep looking
+
+		s.reset(b)
+	}
+}
+
+func (s *lastModifiedScanner) reset(b byte) {
+
+	s.matched = 0
+	s.colon = false
+
+	if b == '"' {
+		s.matched = 1
+	}
+}
+
+// lastModified returns the value that was found, 0 if there wasn't one or -1 if s is nil
+// (which is to say nothing was looked for).
+
+func (s *lastModifiedScanner) lastModified() int64 {
+
+	if s == nil {
+		return -1
+	}
+
+	if s.digits == 0 {
+		return 0
+	}
+
+	return s.value
+}
+
+func isJSONSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// wofLastModified is just enough of a WOF record to read its lastmodified property.
+
+type wofLastModified struct {
+	Properties struct {
+		LastModified *int64 `json:"wof:lastmodified"`
+	} `json:"properties"`
+}
+
+// writeUpdatedMeta writes a copy of the meta file for run to c.UpdatedMetaPath, see
+// updateMetaFile. Runs started with Schedule rather than CloneMetaFile don't have a
+// meta file to update.
+
+func (c *WOFClone) writeUpdatedMeta(run *cloneRun) {
+
+	if c.UpdatedMetaPath == "" {
+		return
+	}
+
+	if run.meta == "" {
+		c.Logger.Warning("not writing %s since there is no meta file to update", c.UpdatedMetaPath)
+		return
+	}
+
+	if run.read_err != nil {
+		c.Logger.Warning("not writing %s since %s could not be read", c.UpdatedMetaPath, run.meta)
+		return
+	}
+
+	err := c.updateMetaFile(run.meta, c.UpdatedMetaPath, run.prefix, run.hashes)
+
+	if err != nil {
+		c.Logger.Error("Failed to write updated meta file %s, because %v", c.UpdatedMetaPath, err)
+	}
+}
+
+// updateMetaFile copies the meta file at meta to path, row for row, with the hash, size
+// and lastmodified columns (if they exist) replaced by the values for the files on disk.
+// Rows for files that failed or are missing are left out unless c.UpdatedMetaStatus is
+// true, in which case every row is kept and its status is added in another column. The
+// file is written to a temporary file first and then renamed. prefix is how paths were
+// adjusted during the run, see DataPrefix, and hashes (which may be nil) has the hash
+// and size of every file written during the run, see wroteFile.
+
+func (c *WOFClone) updateMetaFile(meta string, path string, prefix *dataPrefix, hashes *sync.Map) error {
+
+	reader, err := openMetaFile(meta)
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	fieldnames := make([]string, len(reader.Fieldnames))
+	copy(fieldnames, reader.Fieldnames)
+
+	if c.UpdatedMetaStatus && !hasColumn(fieldnames, updated_meta_status) {
+		fieldnames = append(fieldnames, updated_meta_status)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	writer, err := csv.NewDictWriter(fh, fieldnames)
+
+	if err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	writer.WriteHeader()
+
+	failed := c.report.FailedErrors()
+
+	for {
+
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+
+			// Malformed rows can't be written back out so they are left out of
+			// the updated meta file, unless StrictMetaFiles is set
+
+			line, ok := badRowLine(err)
+
+			if ok && !c.StrictMetaFiles {
+				c.Logger.Warning("line %d of %s is malformed, leaving it out of %s", line, meta, path)
+				continue
+			}
+
+			fh.Close()
+			os.Remove(tmp)
+			return err
+		}
+
+		status := c.updateMetaRow(row, prefix, failed, hashes)
+
+		if status != "ok" && !c.UpdatedMetaStatus {
+			continue
+		}
+
+		if c.UpdatedMetaStatus {
+			row[updated_meta_status] = status
+		}
+
+		writer.WriteRow(row)
+	}
+
+	writer.Writer.Flush()
+
+	err = writer.Writer.Error()
+
+	if err == nil {
+		err = fh.Close()
+	} else {
+		fh.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// updateMetaRow refreshes row from the file on disk and returns its status (see
+// updated_meta_status). failed is the set of files that could not be cloned. Files in
+// hashes are only read if row has a lastmodified column, the rest are read and hashed.
+
+func (c *WOFClone) updateMetaRow(row map[string]string, prefix *dataPrefix, failed map[string]string, hashes *sync.Map) string {
+
+	if row[c.PathColumn] == "" {
+		return "missing"
+	}
+
+	rel_path := c.rowPath(row, prefix)
+
+	_, ok := failed[rel_path]
+
+	if ok {
+		return "failed"
+	}
+
+	// Where rel_path is stored was forgotten once it was cloned, see forgetPath
+
+	local := c.localPath(c.destRelPath(rel_path, row))
+
+	info, err := os.Stat(local)
+
+	if err != nil {
+		return "missing"
+	}
+
+	var written writtenFile
+	var body []byte
+
+	if hashes != nil {
+
+		v, ok := hashes.Load(rel_path)
+
+		if ok {
+			written = v.(writtenFile)
+		}
+	}
+
+	_, has_lastmod := row[c.LastModifiedColumn]
+
+	// Files written during this run had their lastmodified property picked out as
+	// they were written, so only the ones that weren't need to be read back
+
+	if written.hash == "" || (has_lastmod && written.lastmod < 0) {
+
+		body, err = c.readLocal(local)
+
+		if err != nil {
+			c.Logger.Warning("Failed to read %s for updated meta file, because %v", local, err)
+			return "missing"
+		}
+	}
+
+	if written.hash == "" {
+		written = writtenFile{hash: hashBytes(body, c.hashAlgorithm()), size: int64(len(body)), lastmod: -1}
+	}
+
+	_, ok = row[c.HashColumn]
+
+	if ok {
+		row[c.HashColumn] = written.hash
+	}
+
+	size_column := c.SizeColumn
+
+	if size_column == "" {
+		size_column = "size"
+	}
+
+	_, ok = row[size_column]
+
+	if ok {
+		row[size_column] = strconv.FormatInt(written.size, 10)
+	}
+
+	if has_lastmod {
+
+		// Prefer the record's own idea of when it was last modified to when
+		// it happened to be written to disk
+
+		lastmod := info.ModTime().Unix()
+
+		if written.lastmod > 0 {
+			lastmod = written.lastmod
+		} else if written.lastmod < 0 {
+
+			var record wofLastModified
+
+			if json.Unmarshal(body, &record) == nil && record.Properties.LastModified != nil {
+				lastmod = *record.Properties.LastModified
+			}
+		}
+
+		row[c.LastModifiedColumn] = strconv.FormatInt(lastmod, 10)
+	}
+
+	return "ok"
+}
@@ -0,0 +1,92 @@
+package clone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastModifiedScanner(t *testing.T) {
+
+	tests := []struct {
+		body     string
+		expected int64
+	}{
+		{`{"properties":{"wof:id":1,"wof:lastmodified":1500000000}}`, 1500000000},
+		{`{"properties":{"wof:lastmodified" : 1500000000 ,"wof:id":1}}`, 1500000000},
+		{`{"properties":{"wof:name":"wof:lastmodified","wof:lastmodified":42}}`, 42},
+		{`{"properties":{"wof:lastmodified":null,"x":{"wof:lastmodified":7}}}`, 7},
+		{`{"properties":{""wof:lastmodified":9}}`, 9},
+		{`{"properties":{"wof:id":1}}`, 0},
+	}
+
+	for _, test := range tests {
+
+		// Every way of splitting the body between two writes
+
+		for i := 0; i <= len(test.body); i++ {
+
+			scan := new(lastModifiedScanner)
+
+			fmt.Fprint(scan, test.body[:i])
+			fmt.Fprint(scan, test.body[i:])
+
+			if scan.lastModified() != test.expected {
+				t.Errorf("Expected %d from %s split at %d, got %d", test.expected, test.body, i, scan.lastModified())
+				break
+			}
+		}
+	}
+
+	var scan *lastModifiedScanner
+
+	if scan.lastModified() != -1 {
+		t.Errorf("Expected -1 when nothing was looked for, got %d", scan.lastModified())
+	}
+}
+
+func TestUpdatedMetaLastModified(t *testing.T) {
+
+	source := newTestSource(t)
+	source.set("1/1.geojson", `{"properties":{"wof:id":1,"wof:lastmodified":1500000000}}`)
+	source.set("2/2.geojson", `{"properties":{"wof:id":2,"wof:lastmodified":1600000000}}`)
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+
+	err := ioutil.WriteFile(meta, []byte("path,lastmodified\n1/1.geojson,0\n2/2.geojson,0\n"), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", meta, err)
+	}
+
+	c := newTestClone(t, source.URL)
+	c.UpdatedMetaPath = filepath.Join(t.TempDir(), "updated.csv")
+
+	// Replace each file once it has been written, so that reading it back would give
+	// the wrong answer
+
+	c.WriteHook = func(rel_path string, hash string, size int64) {
+		ioutil.WriteFile(c.LocalPath(rel_path), []byte(`{"properties":{"wof:lastmodified":1}}`), 0644)
+	}
+
+	err = c.CloneMetaFile(meta, false, false)
+
+	if err != nil {
+		t.Fatalf("Failed to clone, %v", err)
+	}
+
+	body, err := ioutil.ReadFile(c.UpdatedMetaPath)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %v", c.UpdatedMetaPath, err)
+	}
+
+	for _, expected := range []string{"1/1.geojson,1500000000", "2/2.geojson,1600000000"} {
+
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected the updated meta file to have %s, got %s", expected, body)
+		}
+	}
+}
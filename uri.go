@@ -0,0 +1,82 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UriForId returns the relative path for the Who's On First record with ID id, which
+// is the ID split in to groups of (up to) three digits followed by the ID itself. For
+// example 101736545 becomes "101/736/545/101736545.geojson".
+
+func UriForId(id int64) string {
+
+	str_id := strconv.FormatInt(id, 10)
+
+	parts := make([]string, 0)
+
+	for len(str_id) > 3 {
+		parts = append(parts, str_id[0:3])
+		str_id = str_id[3:]
+	}
+
+	parts = append(parts, str_id)
+
+	return strings.Join(parts, "/") + "/" + strconv.FormatInt(id, 10) + ".geojson"
+}
+
+// IdForPath returns the Who's On First ID for a path produced by UriForId. Alternate
+// geometry files (for example 101736545-alt-quattroshapes.geojson) return the ID of the
+// record they are an alternate geometry for.
+
+func IdForPath(path string) (int64, error) {
+
+	fname := filepath.Base(path)
+
+	if !strings.HasSuffix(fname, ".geojson") {
+		return -1, errors.New("Path is not a GeoJSON file")
+	}
+
+	fname = strings.TrimSuffix(fname, ".geojson")
+	fname = strings.SplitN(fname, "-", 2)[0]
+
+	id, err := strconv.ParseInt(fname, 10, 64)
+
+	if err != nil {
+		return -1, fmt.Errorf("Failed to parse ID for %s, %v", path, err)
+	}
+
+	return id, nil
+}
+
+// checkId returns false if row has an "id" column that disagrees with rel_path (either
+// because rel_path is for a different ID or because it isn't nested the way UriForId
+// would nest it). Mismatches are logged and counted in the report.
+
+func (c *WOFClone) checkId(rel_path string, row map[string]string) bool {
+
+	str_id, ok := row["id"]
+
+	if !ok {
+		return true
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(str_id), 10, 64)
+
+	if err == nil {
+
+		expected := UriForId(id)
+
+		if rel_path == expected || strings.HasSuffix(rel_path, "/"+expected) {
+			return true
+		}
+	}
+
+	c.Logger.Warning("%s does not match ID %s", rel_path, str_id)
+	c.report.AddIdMismatch(rel_path, str_id)
+
+	return false
+}
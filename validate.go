@@ -0,0 +1,57 @@
+package clone
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// isUsable returns false if local, the local copy of rel_path which exists, looks like
+// it was left behind by an interrupted run: it is empty, smaller than c.MinExistingSize
+// or, if c.ValidateJSON is true and it is a JSON file, doesn't parse as JSON. Such files
+// are fetched again rather than skipped.
+
+func (c *WOFClone) isUsable(rel_path string, local string, info os.FileInfo) bool {
+
+	if info.Size() == 0 || info.Size() < c.MinExistingSize {
+		c.Logger.Debug("%s is only %d bytes", local, info.Size())
+		return false
+	}
+
+	if !c.validatesJSON(rel_path) {
+		return true
+	}
+
+	err := c.validateLocal(local)
+
+	// It will fail when it's hashed instead, see unreadableLocal
+
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+
+	if err != nil {
+		c.Logger.Debug("%s is not valid, because %v", local, err)
+		return false
+	}
+
+	return true
+}
+
+// validateLocal returns an error if the (uncompressed) contents of local don't parse
+// as JSON. It is used both for files that already exist and for new downloads.
+
+func (c *WOFClone) validateLocal(local string) error {
+
+	body, err := c.readLocal(local)
+
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(body) {
+		return &InvalidFileError{Path: local}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package clone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewValidatedWOFClone is NewWOFClone for code that would rather find out about a bad
+// source or destination straight away than part way through a run. source may be an
+// http, https or file URL or the path to a directory, which is turned in to a file URL,
+// and is given a trailing slash if it doesn't have one. dest is created if it doesn't
+// exist and must be a directory that can be written to. Problems with either are
+// returned as a *ConfigError.
+
+func NewValidatedWOFClone(source string, dest string, procs int, logger Logger) (*WOFClone, error) {
+
+	source, err := normalizeSource(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dest, err = normalizeDest(dest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWOFClone(source, dest, procs, logger)
+}
+
+// normalizeSource returns source as a URL ending in "/", see NewValidatedWOFClone.
+
+func normalizeSource(source string) (string, error) {
+
+	if source == "" {
+		return "", &ConfigError{Option: "Source", Reason: "it is empty"}
+	}
+
+	u, err := url.Parse(source)
+
+	if err != nil {
+		return "", &ConfigError{Option: "Source", Value: source, Reason: "it is not a valid URL", Err: err}
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+
+		if u.Host == "" {
+			return "", &ConfigError{Option: "Source", Value: source, Reason: "it has no host"}
+		}
+
+	case "file", "":
+
+		root := u.Path
+
+		if u.Scheme == "" {
+			root = source
+		}
+
+		abs_root, err := filepath.Abs(root)
+
+		if err != nil {
+			return "", &ConfigError{Option: "Source", Value: source, Reason: "it is not a valid path", Err: err}
+		}
+
+		info, err := os.Stat(abs_root)
+
+		if err != nil {
+			return "", &ConfigError{Option: "Source", Value: source, Reason: "it can't be read", Err: err}
+		}
+
+		if !info.IsDir() {
+			return "", &ConfigError{Option: "Source", Value: source, Reason: "it is not a directory"}
+		}
+
+		source = "file://" + filepath.ToSlash(abs_root)
+
+	default:
+		return "", &ConfigError{Option: "Source", Value: source, Reason: fmt.Sprintf("%s URLs are not supported", u.Scheme)}
+	}
+
+	if !strings.HasSuffix(source, "/") {
+		source = source + "/"
+	}
+
+	return source, nil
+}
+
+// normalizeDest creates dest, if necessary, and checks that files can be written to it.
+
+func normalizeDest(dest string) (string, error) {
+
+	if dest == "" {
+		return "", &ConfigError{Option: "Dest", Reason: "it is empty"}
+	}
+
+	dest = filepath.Clean(dest)
+
+	err := os.MkdirAll(dest, 0755)
+
+	if err != nil {
+		return "", &ConfigError{Option: "Dest", Value: dest, Reason: "it can't be created", Err: err}
+	}
+
+	info, err := os.Stat(dest)
+
+	if err != nil {
+		return "", &ConfigError{Option: "Dest", Value: dest, Reason: "it can't be read", Err: err}
+	}
+
+	if !info.IsDir() {
+		return "", &ConfigError{Option: "Dest", Value: dest, Reason: "it is not a directory"}
+	}
+
+	fh, err := ioutil.TempFile(dest, ".wof-clone-check-")
+
+	if err != nil {
+		return "", &ConfigError{Option: "Dest", Value: dest, Reason: "it can't be written to", Err: err}
+	}
+
+	fh.Close()
+	os.Remove(fh.Name())
+
+	return dest, nil
+}
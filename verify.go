@@ -0,0 +1,309 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type WOFCloneVerifyReport struct {
+	Checked    int64
+	Missing    []string // paths listed in the meta file that don't exist locally
+	Mismatched []string // paths whose local hash doesn't match the meta file (or the source)
+	Unknown    []string // paths that couldn't be compared, for example because the source was unreachable
+	Extra      []string // files under Dest that aren't listed in the meta file
+}
+
+// Ok returns true if every file listed in the meta file exists locally and has
+// the expected hash. Extra files are not considered a failure since Dest may be
+// shared by more than one meta file.
+
+func (r *WOFCloneVerifyReport) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.Unknown) == 0
+}
+
+// Verify checks the files under c.Dest against the meta file at path without
+// fetching anything. Local hashes are compared against the file_hash column (or
+// sidecar files, see HashSource) or, if that column is absent and use_etags is true,
+// against the ETag reported by a HEAD request to the source. Rows with no file_hash are otherwise only checked
+// for existence. Verify returns an error if any file was missing or mismatched;
+// the details are always in the report.
+
+func (c *WOFClone) Verify(file string, use_etags bool) (*WOFCloneVerifyReport, error) {
+
+	abs_path, _ := filepath.Abs(file)
+
+	reader, err := openMetaFile(abs_path)
+
+	if err != nil {
+		c.Logger.Error("Failed to read %s, because %v", abs_path, err)
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	if !hasColumn(reader.Fieldnames, c.PathColumn) {
+		err := &MetaFileError{Path: abs_path, Err: fmt.Errorf("there is no %s column", c.PathColumn)}
+		c.Logger.Error("%v", err)
+		return nil, err
+	}
+
+	rpt := WOFCloneVerifyReport{
+		Missing:    make([]string, 0),
+		Mismatched: make([]string, 0),
+		Unknown:    make([]string, 0),
+		Extra:      make([]string, 0),
+	}
+
+	mu := new(sync.Mutex)
+	seen := make(map[string]bool)
+
+	err = c.checkDataPrefix()
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := c.newDataPrefix()
+
+	procs := c.procs
+
+	if procs <= 0 {
+		procs = runtime.GOMAXPROCS(0)
+	}
+
+	verify_pool := newWorkerPool(context.Background(), procs*2)
+
+	var read_err error
+
+	for {
+
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+
+			line, ok := badRowLine(err)
+
+			if ok && !c.StrictMetaFiles {
+				c.Logger.Warning("line %d of %s is malformed, skipping, %v", line, abs_path, err)
+				continue
+			}
+
+			read_err = err
+			break
+		}
+
+		if row[c.PathColumn] == "" {
+			continue
+		}
+
+		// If paths need to have the data prefix added or removed (see DataPrefix)
+		// then that's worked out by looking for the first one locally
+
+		c.probeDataPrefix(prefix, row[c.PathColumn], c.localExists)
+
+		rel_path := c.rowPath(row, prefix)
+
+		dest_rel := c.destRelPath(rel_path, row)
+
+		seen[path.Clean(dest_rel)] = true
+
+		verify_pool.Submit(func() {
+
+			status := c.verifyRow(rel_path, c.localPath(dest_rel), row, use_etags)
+
+			atomic.AddInt64(&rpt.Checked, 1)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch status {
+			case "missing":
+				rpt.Missing = append(rpt.Missing, rel_path)
+			case "mismatched":
+				rpt.Mismatched = append(rpt.Mismatched, rel_path)
+			case "unknown":
+				rpt.Unknown = append(rpt.Unknown, rel_path)
+			}
+		})
+	}
+
+	verify_pool.Close()
+
+	if read_err != nil {
+		c.Logger.Error("Failed to read %s, because %v", abs_path, read_err)
+		return &rpt, read_err
+	}
+
+	extra, err := c.findExtra(seen)
+
+	if err != nil {
+		c.Logger.Error("Failed to walk %s, because %v", c.Dest, err)
+		return &rpt, err
+	}
+
+	rpt.Extra = extra
+
+	sort.Strings(rpt.Missing)
+	sort.Strings(rpt.Mismatched)
+	sort.Strings(rpt.Unknown)
+
+	c.Logger.Info("verified %d files in %s: missing %d mismatched %d unknown %d extra %d", rpt.Checked, c.Dest, len(rpt.Missing), len(rpt.Mismatched), len(rpt.Unknown), len(rpt.Extra))
+
+	if !rpt.Ok() {
+		return &rpt, fmt.Errorf("%s does not match %s: %d missing, %d mismatched, %d unknown", c.Dest, abs_path, len(rpt.Missing), len(rpt.Mismatched), len(rpt.Unknown))
+	}
+
+	return &rpt, nil
+}
+
+// verifyRow returns one of "ok", "missing", "mismatched" or "unknown" for rel_path,
+// which is stored at local.
+
+func (c *WOFClone) verifyRow(rel_path string, local string, row map[string]string, use_etags bool) string {
+
+	_, err := os.Stat(local)
+
+	if os.IsNotExist(err) {
+		c.Logger.Debug("%s is missing", local)
+		return "missing"
+	}
+
+	file_hash, ok := row[c.HashColumn]
+
+	if ok && (c.HashSource == "" || c.HashSource == HashSourceColumn) {
+
+		hash, valid := c.rowHash(row)
+
+		if !valid {
+			c.Logger.Warning("%s has an invalid %s (%q), so it can't be verified", rel_path, c.HashColumn, file_hash)
+			return "unknown"
+		}
+
+		file_hash = hash
+	}
+
+	switch c.HashSource {
+	case HashSourceETag:
+		ok = false
+	case HashSourceSidecar:
+
+		hash, err := c.sidecarHash(rel_path)
+
+		if err != nil {
+			c.Logger.Warning("Failed to fetch the expected hash for %s, because %v", rel_path, err)
+			return "unknown"
+		}
+
+		file_hash = hash
+		ok = true
+	}
+
+	if !ok && !use_etags {
+		return "ok"
+	}
+
+	// If there is a ContentFilter this is the hash of the file before it was filtered
+
+	local_hash, err := c.sourceHash(local)
+
+	if err != nil {
+		c.Logger.Warning("Failed to hash %s, because %v", local, err)
+		return "unknown"
+	}
+
+	if ok {
+
+		if local_hash != strings.ToLower(file_hash) {
+			c.Logger.Debug("%s has hash %s but meta file says %s", local, local_hash, file_hash)
+			return "mismatched"
+		}
+
+		return "ok"
+	}
+
+	var state ChangeState
+
+	if c.LocalHash != nil || c.s3 != nil || c.ContentFilter != nil || c.hashAlgorithm() != HashMD5 {
+		state, err = c.CheckChanged(local, c.Source+rel_path)
+	} else {
+		state, err = c.CheckHashChanged(local_hash, c.Source+rel_path)
+	}
+
+	if err != nil || state == Unknown {
+		return "unknown"
+	}
+
+	if state == Changed {
+		c.Logger.Debug("%s does not match its source", local)
+		return "mismatched"
+	}
+
+	return "ok"
+}
+
+// findExtra walks c.Dest and returns the relative paths of any files not in seen, which
+// are paths relative to Dest (after DestPath or DestTemplate have been applied).
+
+func (c *WOFClone) findExtra(seen map[string]bool) ([]string, error) {
+
+	extra := make([]string, 0)
+
+	root, err := filepath.Abs(c.Dest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(root, func(abs_path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel_path, err := filepath.Rel(root, abs_path)
+
+		if err != nil {
+			return err
+		}
+
+		rel_path = filepath.ToSlash(rel_path)
+
+		if c.CompressLocal {
+			rel_path = strings.TrimSuffix(rel_path, compressed_suffix)
+		}
+
+		if strings.HasPrefix(path.Base(rel_path), ".") {
+			return nil
+		}
+
+		if !seen[rel_path] {
+			extra = append(extra, rel_path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(extra)
+	return extra, nil
+}
@@ -0,0 +1,203 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// active_window_recheck is the longest a paused request sleeps before checking the
+// time again, so that a clock that jumps (or a machine that is suspended) doesn't
+// leave it waiting for the wrong time.
+
+const active_window_recheck = time.Minute
+
+// activeWindow is the time of day during which requests may be sent, see ActiveWindow.
+// If end is before start the window spans midnight.
+
+type activeWindow struct {
+	start time.Duration
+	end   time.Duration
+	loc   *time.Location
+}
+
+// parseActiveWindow parses an ActiveWindow value ("HH:MM-HH:MM"), returning nil if it
+// is "".
+
+func parseActiveWindow(value string, loc *time.Location) (*activeWindow, error) {
+
+	if value == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(value, "-")
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid ActiveWindow value '%s', expected HH:MM-HH:MM", value)
+	}
+
+	var offsets [2]time.Duration
+
+	for i, part := range parts {
+
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ActiveWindow value '%s', expected HH:MM-HH:MM", value)
+		}
+
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	w := activeWindow{
+		start: offsets[0],
+		end:   offsets[1],
+		loc:   loc,
+	}
+
+	return &w, nil
+}
+
+// opens returns the time that w next opens after now, or the zero time if now is
+// inside it.
+
+func (w *activeWindow) opens(now time.Time) time.Time {
+
+	now = now.In(w.loc)
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.loc)
+	offset := now.Sub(midnight)
+
+	var inside bool
+
+	switch {
+	case w.start < w.end:
+		inside = offset >= w.start && offset < w.end
+	case w.start > w.end:
+		inside = offset >= w.start || offset < w.end
+	default:
+		inside = true
+	}
+
+	if inside {
+		return time.Time{}
+	}
+
+	start := midnight.Add(w.start)
+
+	if !start.After(now) {
+		start = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, w.loc).Add(w.start)
+	}
+
+	return start
+}
+
+// checkActiveWindow parses c.ActiveWindow for waitForActiveWindow, which happens once
+// per run rather than for every request, and returns an error if it can't be parsed.
+
+func (c *WOFClone) checkActiveWindow() error {
+
+	w, err := parseActiveWindow(c.ActiveWindow, c.ActiveWindowLocation)
+
+	if err != nil {
+		return err
+	}
+
+	c.active_window = w
+	return nil
+}
+
+// waitForActiveWindow blocks until the active window (see checkActiveWindow) is open,
+// or c.ctx is cancelled, or the run's deadline passes, recording when it will for
+// Status and Progress.
+
+func (c *WOFClone) waitForActiveWindow() error {
+
+	w := c.active_window
+
+	if w == nil {
+		return nil
+	}
+
+	// c.ctx only has a deadline once the run has started, but waiting before then
+	// (see cloneMetaFile) shouldn't go on past it either
+
+	var expired <-chan time.Time
+
+	deadline, ok := c.runDeadline(time.Now())
+
+	if ok {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	paused := false
+
+	// However the wait ends nothing is paused any more
+
+	defer func() {
+
+		if paused {
+			atomic.StoreInt64(c.paused_until, 0)
+		}
+	}()
+
+	for {
+
+		opens := w.opens(time.Now())
+
+		if opens.IsZero() {
+			break
+		}
+
+		if atomic.SwapInt64(c.paused_until, opens.UnixNano()) != opens.UnixNano() {
+			c.Logger.Info("outside the active window (%s), pausing until %s", c.ActiveWindow, opens.Format(time.RFC3339))
+		}
+
+		paused = true
+
+		wait := time.Until(opens)
+
+		if wait > active_window_recheck {
+			wait = active_window_recheck
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-expired:
+			timer.Stop()
+			return ErrDeadlineExceeded
+		case <-c.ctx.Done():
+			timer.Stop()
+			return c.ctx.Err()
+		}
+	}
+
+	if paused && atomic.SwapInt64(c.paused_until, 0) != 0 {
+		c.Logger.Info("inside the active window (%s), resuming", c.ActiveWindow)
+	}
+
+	return nil
+}
+
+// pausedUntil returns when requests will be sent again, if they are waiting for
+// c.ActiveWindow to open, or the zero time if they aren't.
+
+func (c *WOFClone) pausedUntil() time.Time {
+
+	until := atomic.LoadInt64(c.paused_until)
+
+	if until == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, until)
+}
@@ -0,0 +1,68 @@
+package clone
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// closedWindow returns an ActiveWindow value that opens an hour or so from now, and so
+// is closed for the rest of any test.
+
+func closedWindow() string {
+
+	now := time.Now().UTC()
+
+	opens := now.Add(90 * time.Minute)
+	closes := now.Add(150 * time.Minute)
+
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", opens.Hour(), opens.Minute(), closes.Hour(), closes.Minute())
+}
+
+func TestActiveWindowDeadlines(t *testing.T) {
+
+	tests := []struct {
+		name string
+		set  func(c *WOFClone)
+	}{
+		{"Deadline", func(c *WOFClone) { c.Deadline = time.Now().Add(50 * time.Millisecond) }},
+		{"Timeout", func(c *WOFClone) { c.Timeout = 50 * time.Millisecond }},
+	}
+
+	for _, test := range tests {
+
+		source := newTestSource(t)
+		source.set("1/1.geojson", `{"id":1}`)
+
+		c := newTestClone(t, source.URL)
+		c.ActiveWindow = closedWindow()
+
+		test.set(c)
+
+		done := make(chan error, 1)
+
+		go func() {
+			done <- c.CloneMetaFile(writeMetaFile(t, "1/1.geojson"), false, false)
+		}()
+
+		select {
+		case err := <-done:
+
+			if !errors.Is(err, ErrDeadlineExceeded) {
+				t.Errorf("%s: expected waiting for the active window to stop at the deadline, got %v", test.name, err)
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: still waiting for the active window after the deadline", test.name)
+		}
+
+		if !c.pausedUntil().IsZero() {
+			t.Errorf("%s: expected nothing to be paused once the wait was given up, got %v", test.name, c.pausedUntil())
+		}
+
+		if source.count("1/1.geojson") != 0 {
+			t.Errorf("%s: expected nothing to be requested outside the active window", test.name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package clone
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// workerPool runs functions on a fixed number of goroutines. Submit blocks while
+// all the workers are busy which is how the various stages in CloneMetaFile apply
+// back-pressure to one another. Constructing a pool can't fail.
+
+type workerPool struct {
+	ctx       context.Context
+	jobs      chan func()
+	wg        *sync.WaitGroup
+	once      *sync.Once
+	queued    *int64 // the number of jobs waiting for a worker, may be nil
+	in_flight *int64 // the number of jobs being run, may be nil
+}
+
+func newWorkerPool(ctx context.Context, size int) *workerPool {
+
+	return newTrackedWorkerPool(ctx, size, nil, nil)
+}
+
+// newTrackedWorkerPool is newWorkerPool but keeps queued and in_flight up to date with
+// the number of jobs waiting for a worker and being run. They may be shared by more
+// than one pool.
+
+func newTrackedWorkerPool(ctx context.Context, size int, queued *int64, in_flight *int64) *workerPool {
+
+	if size < 1 {
+		size = 1
+	}
+
+	p := workerPool{
+		ctx:       ctx,
+		jobs:      make(chan func(), size),
+		wg:        new(sync.WaitGroup),
+		once:      new(sync.Once),
+		queued:    queued,
+		in_flight: in_flight,
+	}
+
+	for i := 0; i < size; i++ {
+
+		p.wg.Add(1)
+
+		go func() {
+
+			defer p.wg.Done()
+
+			for job := range p.jobs {
+
+				p.add(p.queued, -1)
+
+				// Once the context has been cancelled anything left in the
+				// queue is drained without being run
+
+				if p.ctx.Err() != nil {
+					continue
+				}
+
+				p.add(p.in_flight, 1)
+				job()
+				p.add(p.in_flight, -1)
+			}
+		}()
+	}
+
+	return &p
+}
+
+// Submit queues job to be run, blocking until there is room in the queue. It returns
+// false (and job is never run) if the pool's context has been cancelled.
+
+func (p *workerPool) Submit(job func()) bool {
+
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	p.add(p.queued, 1)
+
+	select {
+	case p.jobs <- job:
+		return true
+	case <-p.ctx.Done():
+		p.add(p.queued, -1)
+		return false
+	}
+}
+
+func (p *workerPool) add(gauge *int64, delta int64) {
+
+	if gauge != nil {
+		atomic.AddInt64(gauge, delta)
+	}
+}
+
+// Close stops the pool accepting new work and waits for the jobs already queued
+// to finish. It is safe to call more than once but Submit must not be called
+// after Close.
+
+func (p *workerPool) Close() {
+
+	p.once.Do(func() {
+		close(p.jobs)
+	})
+
+	p.wg.Wait()
+}
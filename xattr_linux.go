@@ -0,0 +1,46 @@
+//go:build linux
+
+package clone
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setXattr sets the extended attribute name of path to value.
+
+func setXattr(path string, name string, value string) error {
+
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
+
+// getXattr returns the value of the extended attribute name of path.
+
+func getXattr(path string, name string) (string, error) {
+
+	buf := make([]byte, 256)
+
+	for {
+
+		n, err := syscall.Getxattr(path, name, buf)
+
+		if errors.Is(err, syscall.ERANGE) {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return string(buf[:n]), nil
+	}
+}
+
+// isXattrUnsupported returns true if err means that the filesystem doesn't support
+// extended attributes (or not user ones).
+
+func isXattrUnsupported(err error) bool {
+
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package clone
+
+import (
+	"errors"
+)
+
+// errXattrUnsupported is returned everywhere but Linux, where provenance is always
+// recorded in hidden files instead (see RecordProvenance).
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func setXattr(path string, name string, value string) error {
+
+	return errXattrUnsupported
+}
+
+func getXattr(path string, name string) (string, error) {
+
+	return "", errXattrUnsupported
+}
+
+func isXattrUnsupported(err error) bool {
+
+	return errors.Is(err, errXattrUnsupported)
+}